@@ -9,9 +9,12 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"net/http"
 	"net/url"
+	"strings"
 )
 
 // ConfigureAuthRealmRequest is a request to /configureAuthRealm
@@ -85,12 +88,176 @@ type Session struct {
 	Config    json.RawMessage
 }
 
+// The kinds of config which have their history recorded.
+const (
+	ConfigKindService = "service"
+	ConfigKindRealm   = "realm"
+	ConfigKindClient  = "client"
+	// Sessions do not have their history recorded, but they can be managed by a config file.
+	ConfigKindSession = "session"
+)
+
+// SessionConfigID returns the ID used to refer to the auth session for the given realm and user
+// when the kind of config is ConfigKindSession.
+func SessionConfigID(realmID, userID string) string {
+	return realmID + " " + userID
+}
+
+// The actions which can create a new version of a config.
+const (
+	ConfigActionConfigure = "configure"
+	ConfigActionDelete    = "delete"
+	ConfigActionRollback  = "rollback"
+	ConfigActionPatch     = "patch"
+	ConfigActionImport    = "import"
+)
+
+// A ConfigHistoryEntry is a single version of the config for a service, realm or client.
+// A new entry is recorded every time a config is changed via the /admin HTTP API.
+type ConfigHistoryEntry struct {
+	// The kind of config: "service", "realm" or "client".
+	Kind string
+	// The service ID, realm ID or client user ID.
+	ID string
+	// The version number of this entry. The first version of a config is 1.
+	Version int64
+	// The service type or realm type. Empty for clients.
+	Type string
+	// The service user ID. Empty for realms and clients.
+	UserID string
+	// What happened to the config: "configure", "patch", "import", "delete" or "rollback". For "delete",
+	// Config is the config which was deleted.
+	Action string
+	// Who made the change. This is the Name of the admin token used.
+	Actor string
+	// When the change was made, as a unix timestamp in milliseconds.
+	Timestamp int64
+	// The complete config at this version.
+	Config json.RawMessage
+	// The changes between the previous version and this one.
+	Diff []ConfigChange
+}
+
+// A ConfigChange is a single change between two versions of a config.
+type ConfigChange struct {
+	// A JSON Pointer (RFC 6901) to the value which changed, e.g. "/Rooms/!foo:bar/Repos".
+	Path string
+	// The old value, or omitted if the value was added.
+	Old interface{} `json:",omitempty"`
+	// The new value, or omitted if the value was removed.
+	New interface{} `json:",omitempty"`
+}
+
+// Admin token scopes. A token with ScopeConfigure can do everything a token with ScopeRead can.
+const (
+	// ScopeRead allows calling /admin endpoints which do not modify anything.
+	ScopeRead = "read"
+	// ScopeConfigure allows calling every /admin endpoint.
+	ScopeConfigure = "configure"
+)
+
+// An AdminToken is a bearer token which grants access to the /admin HTTP API. Tokens are
+// loaded from the file given by the ADMIN_TOKENS_FILE environment variable.
+type AdminToken struct {
+	// A human-readable name for the holder of this token. This is logged for every admin request.
+	Name string
+	// The secret bearer token which must be supplied as an "Authorization: Bearer <token>" header.
+	Token string
+	// Either "read" or "configure".
+	Scope string
+	// Optional. If set, this token can only be used for services of these types. Tokens with
+	// ServiceTypes or UserIDs cannot be used for endpoints which do not relate to a single service.
+	ServiceTypes []string
+	// Optional. If set, this token can only be used for services with these service user IDs.
+	UserIDs []string
+}
+
+// AdminTokensFile represents the file given by ADMIN_TOKENS_FILE
+type AdminTokensFile struct {
+	Tokens []AdminToken
+}
+
 // ConfigFile represents config.sample.yaml
 type ConfigFile struct {
-	Clients  []ClientConfig
-	Realms   []ConfigureAuthRealmRequest
-	Services []ConfigureServiceRequest
-	Sessions []Session
+	Clients  []ClientConfig              `json:"clients"`
+	Realms   []ConfigureAuthRealmRequest `json:"realms"`
+	Services []ConfigureServiceRequest   `json:"services"`
+	Sessions []Session                   `json:"sessions"`
+}
+
+// RedactedValue replaces secrets in a redacted ConfigFile.
+const RedactedValue = "<redacted>"
+
+// Redact replaces every secret in the config file with RedactedValue. Secrets are client access
+// tokens and any string values in realm, session or service configs whose keys look like they
+// hold secrets, e.g. "AccessToken", "ClientSecret", "api_key" or "PrivateKeyPEM".
+func (c *ConfigFile) Redact() error {
+	for i := range c.Clients {
+		c.Clients[i].AccessToken = RedactedValue
+	}
+	var err error
+	for i := range c.Realms {
+		if c.Realms[i].Config, err = redactJSON(c.Realms[i].Config); err != nil {
+			return err
+		}
+	}
+	for i := range c.Sessions {
+		if c.Sessions[i].Config, err = redactJSON(c.Sessions[i].Config); err != nil {
+			return err
+		}
+	}
+	for i := range c.Services {
+		if c.Services[i].Config, err = redactJSON(c.Services[i].Config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsRedacted returns true if any secrets in the config file have been replaced by Redact.
+func (c *ConfigFile) IsRedacted() bool {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // else the angle brackets are escaped
+	return enc.Encode(c) == nil && bytes.Contains(buf.Bytes(), []byte(`"`+RedactedValue+`"`))
+}
+
+func redactJSON(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redactValue(v))
+}
+
+func redactValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if _, isString := child.(string); isString && isSecretKey(k) {
+				val[k] = RedactedValue
+			} else {
+				val[k] = redactValue(child)
+			}
+		}
+	case []interface{}:
+		for i := range val {
+			val[i] = redactValue(val[i])
+		}
+	}
+	return v
+}
+
+func isSecretKey(key string) bool {
+	k := strings.ToLower(key)
+	if strings.Contains(k, "public") {
+		return false
+	}
+	return strings.Contains(k, "token") || strings.Contains(k, "secret") ||
+		strings.Contains(k, "password") || strings.Contains(k, "private") || strings.Contains(k, "key")
 }
 
 // Check validates the /configureService request
@@ -128,6 +295,37 @@ func (c *ClientConfig) Check() error {
 	return nil
 }
 
+// Check validates the admin token
+func (t *AdminToken) Check() error {
+	if t.Name == "" || t.Token == "" {
+		return errors.New(`Must supply a "Name" and a "Token"`)
+	}
+	if t.Scope != ScopeRead && t.Scope != ScopeConfigure {
+		return errors.New(`"Scope" must be "read" or "configure"`)
+	}
+	return nil
+}
+
+// Restricted returns true if this token is limited to certain service types or user IDs.
+func (t *AdminToken) Restricted() bool {
+	return len(t.ServiceTypes) > 0 || len(t.UserIDs) > 0
+}
+
+// AllowsService returns true if this token may be used for a service with the given type and user ID.
+func (t *AdminToken) AllowsService(serviceType, serviceUserID string) bool {
+	return (len(t.ServiceTypes) == 0 || containsString(t.ServiceTypes, serviceType)) &&
+		(len(t.UserIDs) == 0 || containsString(t.UserIDs, serviceUserID))
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
 // Check that the request is valid.
 func (r *RequestAuthSessionRequest) Check() error {
 	if r.UserID == "" || r.RealmID == "" || r.Config == nil {
@@ -135,3 +333,96 @@ func (r *RequestAuthSessionRequest) Check() error {
 	}
 	return nil
 }
+
+// A ServiceState is a single value in the state store of a service. Services keep internal
+// state, such as what they have already seen or when to poll next, here rather than in their
+// config, so that it isn't returned by /admin/getService and doesn't race with changes to the
+// config.
+type ServiceState struct {
+	// The ID of the service which owns this value.
+	ServiceID string
+	// The namespace of the key, which groups related keys, e.g. "feeds".
+	Namespace string
+	// The key, which is unique within the namespace.
+	Key string
+	// The value, which is opaque to Go-NEB.
+	Value []byte
+	// When the value expires, as a unix timestamp in milliseconds, or 0 if it never expires.
+	// Expired values are never returned.
+	ExpiresTimestamp int64
+}
+
+// A ServicePause records that a service has been paused. Paused services do not poll, do not
+// respond to commands or expansions, and drop or queue incoming webhooks.
+type ServicePause struct {
+	// The ID of the paused service.
+	ServiceID string
+	// Who paused the service: the Name of the admin token used, or the Matrix user ID of the
+	// room admin who used "!neb pause".
+	PausedBy string
+	// True to store incoming webhooks and deliver them when the service is resumed. If false,
+	// they are dropped.
+	QueueWebhooks bool
+	// When the service was paused, as a unix timestamp in milliseconds.
+	Timestamp int64
+}
+
+// A QueuedWebhook is a webhook request for a paused service, stored to be delivered when the
+// service is resumed.
+type QueuedWebhook struct {
+	ServiceID string
+	Method    string
+	URL       string
+	Header    http.Header
+	Body      []byte
+	// When the webhook was received, as a unix timestamp in milliseconds.
+	Timestamp int64
+}
+
+// A WebhookDelivery is a webhook request which was passed to a service, kept in the webhook
+// journal with the outcome of processing it so that it can be inspected and replayed.
+type WebhookDelivery struct {
+	ID            string
+	ServiceID     string
+	CorrelationID string
+	Method        string
+	URL           string
+	Header        http.Header
+	Body          string
+	// When the webhook was received, as a unix timestamp in milliseconds.
+	Timestamp int64
+	// The HTTP status code the service responded with the last time it processed the webhook,
+	// or 0 if it hasn't finished processing it.
+	StatusCode int
+	// Why processing failed the last time the service processed the webhook, if it did.
+	Error string
+	// When the service last finished processing the webhook, as a unix timestamp in
+	// milliseconds, or 0 if it hasn't.
+	ProcessedTimestamp int64
+	// How many times the webhook has been replayed.
+	Replays int
+}
+
+// A WebhookJob is a webhook request which has been acknowledged, stored to be handled in the
+// background by a service which is a types.AsyncWebhookHandler.
+type WebhookJob struct {
+	ID        string
+	ServiceID string
+	// The ID of the webhook delivery in the webhook journal, or "" if it isn't in the journal.
+	DeliveryID    string
+	CorrelationID string
+	Method        string
+	URL           string
+	Header        http.Header
+	Body          []byte
+	// When the webhook was received, as a unix timestamp in milliseconds.
+	Timestamp int64
+	// How many times handling the webhook has failed.
+	Attempts int
+	// When the webhook should next be handled, as a unix timestamp in milliseconds.
+	NextAttemptTimestamp int64
+	// Why handling the webhook last failed, if it has.
+	LastError string
+	// The rooms which the webhook has been sent into by earlier attempts at handling it.
+	SentRooms []string
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DiffJSON returns the changes required to turn the JSON object 'old' into 'new'. Objects are
+// compared key by key, everything else (including arrays) is compared as a whole. Either input
+// may be empty, in which case every value in the other is reported as added or removed.
+func DiffJSON(old, new []byte) ([]ConfigChange, error) {
+	var oldVal, newVal interface{}
+	if len(old) > 0 {
+		if err := json.Unmarshal(old, &oldVal); err != nil {
+			return nil, err
+		}
+	}
+	if len(new) > 0 {
+		if err := json.Unmarshal(new, &newVal); err != nil {
+			return nil, err
+		}
+	}
+	changes := diffValues("", oldVal, newVal, nil)
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func diffValues(path string, oldVal, newVal interface{}, changes []ConfigChange) []ConfigChange {
+	oldObj, oldIsObj := oldVal.(map[string]interface{})
+	newObj, newIsObj := newVal.(map[string]interface{})
+	if oldVal == nil && newIsObj {
+		oldObj, oldIsObj = map[string]interface{}{}, true
+	}
+	if newVal == nil && oldIsObj {
+		newObj, newIsObj = map[string]interface{}{}, true
+	}
+	if !oldIsObj || !newIsObj {
+		if !reflect.DeepEqual(oldVal, newVal) {
+			changes = append(changes, ConfigChange{Path: path, Old: oldVal, New: newVal})
+		}
+		return changes
+	}
+	for k, v := range oldObj {
+		changes = diffValues(path+"/"+escapePointer(k), v, newObj[k], changes)
+	}
+	for k, v := range newObj {
+		if _, exists := oldObj[k]; !exists {
+			changes = diffValues(path+"/"+escapePointer(k), nil, v, changes)
+		}
+	}
+	return changes
+}
+
+// escapePointer escapes a JSON Pointer reference token as per RFC 6901.
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
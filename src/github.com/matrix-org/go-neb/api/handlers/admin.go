@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/util"
+)
+
+type ctxKey int
+
+const ctxValueAdminToken ctxKey = iota
+
+// AdminAuth authenticates requests to the /admin HTTP API using bearer tokens.
+type AdminAuth struct {
+	tokens []api.AdminToken
+}
+
+// NewAdminAuth creates a new AdminAuth which accepts the given tokens. If no tokens are
+// given, authentication is disabled and every request is allowed through.
+func NewAdminAuth(tokens []api.AdminToken) *AdminAuth {
+	return &AdminAuth{tokens}
+}
+
+// Read wraps a handler for an /admin endpoint which does not modify anything. Tokens which
+// are restricted to certain services are refused.
+func (a *AdminAuth) Read(h util.JSONRequestHandler) util.JSONRequestHandler {
+	return &adminHandler{a, h, api.ScopeRead, false}
+}
+
+// Configure wraps a handler for an /admin endpoint which may modify things. Tokens which
+// are restricted to certain services are refused.
+func (a *AdminAuth) Configure(h util.JSONRequestHandler) util.JSONRequestHandler {
+	return &adminHandler{a, h, api.ScopeConfigure, false}
+}
+
+// ReadService wraps a handler for an /admin endpoint which reads services. Tokens which are
+// restricted to certain services are allowed through: the handler is responsible for calling
+// checkServiceAccess.
+func (a *AdminAuth) ReadService(h util.JSONRequestHandler) util.JSONRequestHandler {
+	return &adminHandler{a, h, api.ScopeRead, true}
+}
+
+// ConfigureService wraps a handler for an /admin endpoint which modifies services. Tokens which
+// are restricted to certain services are allowed through: the handler is responsible for calling
+// checkServiceAccess.
+func (a *AdminAuth) ConfigureService(h util.JSONRequestHandler) util.JSONRequestHandler {
+	return &adminHandler{a, h, api.ScopeConfigure, true}
+}
+
+// token returns the admin token which matches the given secret, or nil.
+func (a *AdminAuth) token(secret string) *api.AdminToken {
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(a.tokens[i].Token), []byte(secret)) == 1 {
+			return &a.tokens[i]
+		}
+	}
+	return nil
+}
+
+type adminHandler struct {
+	auth            *AdminAuth
+	handler         util.JSONRequestHandler
+	scope           string
+	allowRestricted bool
+}
+
+func (h *adminHandler) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+	if len(h.auth.tokens) == 0 {
+		logger.Info("Unauthenticated admin request")
+		return h.handler.OnIncomingRequest(req)
+	}
+
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		logger.Warn("Admin request without a bearer token")
+		return util.MessageResponse(401, "Missing bearer token")
+	}
+	token := h.auth.token(strings.TrimPrefix(authHeader, "Bearer "))
+	if token == nil {
+		logger.Warn("Admin request with an unknown bearer token")
+		return util.MessageResponse(401, "Unknown bearer token")
+	}
+	logger = logger.WithFields(log.Fields{
+		"admin":       token.Name,
+		"admin_scope": token.Scope,
+	})
+
+	if h.scope == api.ScopeConfigure && token.Scope != api.ScopeConfigure {
+		logger.Warn("Refusing admin request: token is read-only")
+		return util.MessageResponse(403, "Token is read-only")
+	}
+	if token.Restricted() && !h.allowRestricted {
+		logger.Warn("Refusing admin request: token is restricted to certain services")
+		return util.MessageResponse(403, "Token is restricted to certain services")
+	}
+	logger.Info("Authenticated admin request")
+
+	req = req.WithContext(context.WithValue(req.Context(), ctxValueAdminToken, token))
+	return h.handler.OnIncomingRequest(req)
+}
+
+// adminTokenFromContext returns the admin token used to authenticate this request,
+// or nil if admin authentication is disabled.
+func adminTokenFromContext(ctx context.Context) *api.AdminToken {
+	token, _ := ctx.Value(ctxValueAdminToken).(*api.AdminToken)
+	return token
+}
+
+// checkServiceAccess returns an HTTP 403 response if the admin token used for this request
+// is not allowed to access a service with the given type and user ID, else nil.
+func checkServiceAccess(req *http.Request, serviceType, serviceUserID string) *util.JSONResponse {
+	token := adminTokenFromContext(req.Context())
+	if token == nil || token.AllowsService(serviceType, serviceUserID) {
+		return nil
+	}
+	util.GetLogger(req.Context()).WithFields(log.Fields{
+		"admin":           token.Name,
+		"service_type":    serviceType,
+		"service_user_id": serviceUserID,
+	}).Warn("Refusing admin request: token cannot access this service")
+	res := util.MessageResponse(403, "Token cannot access this service")
+	return &res
+}
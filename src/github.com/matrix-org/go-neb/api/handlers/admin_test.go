@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/util"
+)
+
+type mockServiceHandler struct{}
+
+func (h *mockServiceHandler) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if res := checkServiceAccess(req, "github", "@bot:localhost"); res != nil {
+		return *res
+	}
+	return util.JSONResponse{Code: 200, JSON: struct{}{}}
+}
+
+var adminAuthTests = []struct {
+	token      string
+	wrap       func(a *AdminAuth, h util.JSONRequestHandler) util.JSONRequestHandler
+	expectCode int
+}{
+	{"", (*AdminAuth).Read, 401},
+	{"unknown", (*AdminAuth).Read, 401},
+	{"reader", (*AdminAuth).Read, 200},
+	{"reader", (*AdminAuth).Configure, 403},
+	{"reader", (*AdminAuth).ConfigureService, 403},
+	{"configurer", (*AdminAuth).Configure, 200},
+	{"github-only", (*AdminAuth).Configure, 403},
+	{"github-only", (*AdminAuth).ConfigureService, 200},
+	{"rss-only", (*AdminAuth).ConfigureService, 403},
+}
+
+func TestAdminAuth(t *testing.T) {
+	auth := NewAdminAuth([]api.AdminToken{
+		{Name: "Reader", Token: "reader", Scope: api.ScopeRead},
+		{Name: "Configurer", Token: "configurer", Scope: api.ScopeConfigure},
+		{Name: "Github", Token: "github-only", Scope: api.ScopeConfigure, ServiceTypes: []string{"github"}},
+		{Name: "RSS", Token: "rss-only", Scope: api.ScopeConfigure, ServiceTypes: []string{"rssbot"}},
+	})
+	for _, test := range adminAuthTests {
+		handler := util.MakeJSONAPI(test.wrap(auth, &mockServiceHandler{}))
+		req, _ := http.NewRequest("POST", "http://go.neb/admin/something", nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.expectCode {
+			t.Errorf("TestAdminAuth token '%s' wanted HTTP status %d, got %d", test.token, test.expectCode, w.Code)
+		}
+	}
+}
+
+func TestAdminAuthDisabled(t *testing.T) {
+	handler := util.MakeJSONAPI(NewAdminAuth(nil).Configure(&mockServiceHandler{}))
+	req, _ := http.NewRequest("POST", "http://go.neb/admin/something", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != 200 {
+		t.Errorf("TestAdminAuthDisabled wanted HTTP status 200, got %d", w.Code)
+	}
+}
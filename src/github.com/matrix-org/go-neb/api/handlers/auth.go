@@ -58,6 +58,9 @@ func (h *RequestAuthSession) OnIncomingRequest(req *http.Request) util.JSONRespo
 		logger.WithError(err).Info("Failed Check")
 		return util.MessageResponse(400, err.Error())
 	}
+	if httpErr := checkNotManaged(req, h.Db, api.ConfigKindSession, api.SessionConfigID(body.RealmID, body.UserID)); httpErr != nil {
+		return *httpErr
+	}
 
 	realm, err := h.Db.LoadAuthRealm(body.RealmID)
 	if err != nil {
@@ -117,6 +120,9 @@ func (h *RemoveAuthSession) OnIncomingRequest(req *http.Request) util.JSONRespon
 	if body.UserID == "" || body.RealmID == "" {
 		return util.MessageResponse(400, `Must supply a "UserID", a "RealmID"`)
 	}
+	if httpErr := checkNotManaged(req, h.Db, api.ConfigKindSession, api.SessionConfigID(body.RealmID, body.UserID)); httpErr != nil {
+		return *httpErr
+	}
 
 	_, err := h.Db.LoadAuthRealm(body.RealmID)
 	if err != nil {
@@ -199,7 +205,6 @@ type ConfigureAuthRealm struct {
 //      },
 //  }
 func (h *ConfigureAuthRealm) OnIncomingRequest(req *http.Request) util.JSONResponse {
-	logger := util.GetLogger(req.Context())
 	if req.Method != "POST" {
 		return util.MessageResponse(405, "Unsupported Method")
 	}
@@ -217,15 +222,25 @@ func (h *ConfigureAuthRealm) OnIncomingRequest(req *http.Request) util.JSONRespo
 		return util.MessageResponse(400, "Error parsing config JSON")
 	}
 
-	if err = realm.Register(); err != nil {
+	return configureRealm(req, h.Db, realm, api.ConfigActionConfigure)
+}
+
+// configureRealm registers and stores the given auth realm, replacing any existing realm with
+// the same ID, and records the change in the config history with the given action.
+func configureRealm(req *http.Request, db *database.ServiceDB, realm types.AuthRealm, action string) util.JSONResponse {
+	if httpErr := checkNotManaged(req, db, api.ConfigKindRealm, realm.ID()); httpErr != nil {
+		return *httpErr
+	}
+	if err := realm.Register(); err != nil {
 		return util.MessageResponse(400, "Error registering auth realm")
 	}
 
-	oldRealm, err := h.Db.StoreAuthRealm(realm)
+	oldRealm, err := db.StoreAuthRealm(realm)
 	if err != nil {
-		logger.WithError(err).Error("Failed to StoreAuthRealm")
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to StoreAuthRealm")
 		return util.MessageResponse(500, "Error storing realm")
 	}
+	recordHistory(req, db, api.ConfigKindRealm, realm.ID(), realm.Type(), "", action, realm)
 
 	return util.JSONResponse{
 		Code: 200,
@@ -234,7 +249,7 @@ func (h *ConfigureAuthRealm) OnIncomingRequest(req *http.Request) util.JSONRespo
 			Type      string
 			OldConfig types.AuthRealm
 			NewConfig types.AuthRealm
-		}{body.ID, body.Type, oldRealm, realm},
+		}{realm.ID(), realm.Type(), oldRealm, realm},
 	}
 }
 
@@ -247,7 +262,8 @@ type GetSession struct {
 //
 // The JSON object provided MUST have a "RealmID" and "UserID" in order to fetch the
 // correct AuthSession. If there is no session for this tuple of realm and user ID,
-// a 200 OK is still returned with "Authenticated" set to false.
+// a 200 OK is still returned with "Authenticated" set to false. The session info is fetched
+// with the user's credentials, so this needs an admin token with the "configure" scope.
 //
 // Request:
 //  POST /admin/getSession
@@ -309,3 +325,259 @@ func (h *GetSession) OnIncomingRequest(req *http.Request) util.JSONResponse {
 		}{session.ID(), session.Authenticated(), session.Info()},
 	}
 }
+
+// ListRealms represents an HTTP handler capable of processing /admin/listRealms requests.
+type ListRealms struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/listRealms.
+//
+// The JSON object MAY contain a "Type" key, in which case only realms of that type are returned.
+// Realms hold client secrets and private keys, so this needs an admin token with the "configure"
+// scope.
+//
+// Request:
+//  POST /admin/listRealms
+//  {
+//      "Type": "github"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Realms": [
+//          {
+//              "ID": "my-realm-id",
+//              "Type": "github",
+//              "Config": {
+//                  // Auth realm config information
+//              }
+//          }
+//      ]
+//  }
+func (h *ListRealms) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Type string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	var realms []types.AuthRealm
+	var err error
+	if body.Type != "" {
+		realms, err = h.Db.LoadAuthRealmsByType(body.Type)
+	} else {
+		realms, err = h.Db.LoadAuthRealms()
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to load auth realms")
+		return util.MessageResponse(500, "Failed to load realms")
+	}
+
+	type realmInfo struct {
+		ID     string
+		Type   string
+		Config types.AuthRealm
+	}
+	infos := make([]realmInfo, len(realms))
+	for i, r := range realms {
+		infos[i] = realmInfo{r.ID(), r.Type(), r}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Realms []realmInfo
+		}{infos},
+	}
+}
+
+// DeleteRealm represents an HTTP handler capable of processing /admin/deleteRealm requests.
+type DeleteRealm struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/deleteRealm.
+//
+// The JSON object MUST contain the key "ID" to identify the realm to remove.
+//
+// A realm cannot be deleted whilst any services use it: this will return HTTP 409 with
+// the IDs of those services, which must be deleted or reconfigured first. If there are
+// auth sessions on the realm then this will also return HTTP 409, unless "Cascade" is
+// true in which case the sessions are deleted along with the realm.
+//
+// Request:
+//  POST /admin/deleteRealm
+//  {
+//      "ID": "my-realm-id",
+//      "Cascade": true
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my-realm-id",
+//      "Type": "github",
+//      "OldConfig": {
+//          // Old auth realm config information
+//      },
+//      "DeletedSessions": 2
+//  }
+func (h *DeleteRealm) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID      string
+		Cascade bool
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.ID == "" {
+		return util.MessageResponse(400, `Must supply a "ID"`)
+	}
+	logger := util.GetLogger(req.Context()).WithField("realm_id", body.ID)
+
+	if httpErr := checkNotManaged(req, h.Db, api.ConfigKindRealm, body.ID); httpErr != nil {
+		return *httpErr
+	}
+
+	realm, err := h.Db.LoadAuthRealm(body.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, "Realm not found")
+		}
+		logger.WithError(err).Error("Failed to LoadAuthRealm")
+		return util.MessageResponse(500, "Failed to load realm")
+	}
+
+	srvIDs, err := servicesUsingRealm(h.Db, body.ID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to load services")
+		return util.MessageResponse(500, "Failed to load services")
+	}
+	if len(srvIDs) > 0 {
+		return util.MessageResponse(409, "Realm is still used by services: "+strings.Join(srvIDs, ", "))
+	}
+
+	sessions, err := h.Db.LoadAuthSessionsByRealm(body.ID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to LoadAuthSessionsByRealm")
+		return util.MessageResponse(500, "Failed to load sessions")
+	}
+	if len(sessions) > 0 && !body.Cascade {
+		return util.MessageResponse(409, "Realm has auth sessions: set \"Cascade\" to delete them")
+	}
+
+	if err := h.Db.DeleteAuthRealm(body.ID); err != nil {
+		logger.WithError(err).Error("Failed to DeleteAuthRealm")
+		return util.MessageResponse(500, "Error deleting realm")
+	}
+	logger.WithField("sessions", len(sessions)).Info("Deleted auth realm")
+	recordHistory(req, h.Db, api.ConfigKindRealm, realm.ID(), realm.Type(), "", api.ConfigActionDelete, realm)
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID              string
+			Type            string
+			OldConfig       types.AuthRealm
+			DeletedSessions int
+		}{realm.ID(), realm.Type(), realm, len(sessions)},
+	}
+}
+
+// servicesUsingRealm returns the IDs of every service which declares that it uses the given realm.
+func servicesUsingRealm(db *database.ServiceDB, realmID string) (srvIDs []string, err error) {
+	srvs, err := db.LoadServices("", "", "", 0)
+	if err != nil {
+		return
+	}
+	for _, srv := range srvs {
+		rd, ok := srv.(types.RealmDependent)
+		if !ok {
+			continue
+		}
+		for _, id := range rd.RealmIDs() {
+			if id == realmID {
+				srvIDs = append(srvIDs, srv.ServiceID())
+				break
+			}
+		}
+	}
+	return
+}
+
+// ListSessions represents an HTTP handler capable of processing /admin/listSessions requests.
+type ListSessions struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/listSessions.
+//
+// The JSON object MUST contain the key "RealmID". Every auth session on that realm is
+// returned, ordered by user ID. Session-specific info is not included: use /admin/getSession
+// for that. This needs an admin token with the "configure" scope, like every other endpoint for
+// auth sessions.
+//
+// Request:
+//  POST /admin/listSessions
+//  {
+//      "RealmID": "my-realm"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Sessions": [
+//          {
+//              "ID": "session_id",
+//              "UserID": "@my_user:localhost",
+//              "Authenticated": true
+//          }
+//      ]
+//  }
+func (h *ListSessions) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		RealmID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.RealmID == "" {
+		return util.MessageResponse(400, `Must supply a "RealmID"`)
+	}
+
+	if _, err := h.Db.LoadAuthRealm(body.RealmID); err != nil {
+		return util.MessageResponse(400, "Unknown RealmID")
+	}
+
+	sessions, err := h.Db.LoadAuthSessionsByRealm(body.RealmID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadAuthSessionsByRealm")
+		return util.MessageResponse(500, "Failed to load sessions")
+	}
+
+	type sessionInfo struct {
+		ID            string
+		UserID        string
+		Authenticated bool
+	}
+	infos := make([]sessionInfo, len(sessions))
+	for i, s := range sessions {
+		infos[i] = sessionInfo{s.ID(), s.UserID(), s.Authenticated()}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Sessions []sessionInfo
+		}{infos},
+	}
+}
@@ -1,17 +1,21 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/util"
 )
 
 // ConfigureClient represents an HTTP handler capable of processing /admin/configureClient requests.
 type ConfigureClient struct {
 	Clients *clients.Clients
+	Db      *database.ServiceDB
 }
 
 // OnIncomingRequest handles POST requests to /admin/configureClient. The JSON object provided
@@ -53,17 +57,145 @@ func (s *ConfigureClient) OnIncomingRequest(req *http.Request) util.JSONResponse
 		return util.MessageResponse(400, "Error parsing client config")
 	}
 
-	oldClient, err := s.Clients.Update(body)
+	return configureClient(req, s.Db, s.Clients, body, api.ConfigActionConfigure)
+}
+
+// configureClient updates the config for a matrix client and records the change in the
+// config history with the given action.
+func configureClient(req *http.Request, db *database.ServiceDB, cli *clients.Clients, config api.ClientConfig, action string) util.JSONResponse {
+	if httpErr := checkNotManaged(req, db, api.ConfigKindClient, config.UserID); httpErr != nil {
+		return *httpErr
+	}
+	oldClient, err := cli.Update(config)
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).WithField("body", body).Error("Failed to Clients.Update")
+		util.GetLogger(req.Context()).WithError(err).WithField("body", config).Error("Failed to Clients.Update")
 		return util.MessageResponse(500, "Error storing token")
 	}
+	recordHistory(req, db, api.ConfigKindClient, config.UserID, "", "", action, config)
 
 	return util.JSONResponse{
 		Code: 200,
 		JSON: struct {
 			OldClient api.ClientConfig
 			NewClient api.ClientConfig
-		}{oldClient, body},
+		}{oldClient, config},
+	}
+}
+
+// ListClients represents an HTTP handler capable of processing /admin/listClients requests.
+type ListClients struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/listClients.
+//
+// The request body is ignored. Every configured client is returned. Clients hold access tokens,
+// so this needs an admin token with the "configure" scope.
+//
+// Request:
+//  POST /admin/listClients
+//  {}
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//       "Clients": [
+//         // api.ClientConfig
+//       ]
+//  }
+func (h *ListClients) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+
+	configs, err := h.Db.LoadMatrixClientConfigs()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadMatrixClientConfigs")
+		return util.MessageResponse(500, "Failed to load clients")
+	}
+	if configs == nil {
+		configs = []api.ClientConfig{}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Clients []api.ClientConfig
+		}{configs},
+	}
+}
+
+// DeleteClient represents an HTTP handler capable of processing /admin/deleteClient requests.
+type DeleteClient struct {
+	Db      *database.ServiceDB
+	Clients *clients.Clients
+}
+
+// OnIncomingRequest handles POST requests to /admin/deleteClient.
+//
+// The JSON object MUST contain the key "UserID" to identify the client to remove. The
+// client's /sync stream, if any, is stopped. This will return HTTP 409 if any services
+// still use this client: they must be deleted first.
+//
+// Request:
+//  POST /admin/deleteClient
+//  {
+//      "UserID": "@my_bot:localhost"
+//  }
+//
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//       "OldClient": {
+//         // The removed api.ClientConfig
+//       }
+//  }
+func (h *DeleteClient) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		UserID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.UserID == "" {
+		return util.MessageResponse(400, `Must supply a "UserID"`)
+	}
+	logger := util.GetLogger(req.Context()).WithField("user_id", body.UserID)
+
+	if httpErr := checkNotManaged(req, h.Db, api.ConfigKindClient, body.UserID); httpErr != nil {
+		return *httpErr
+	}
+
+	srvs, err := h.Db.LoadServicesForUser(body.UserID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to LoadServicesForUser")
+		return util.MessageResponse(500, "Failed to load services")
+	}
+	if len(srvs) > 0 {
+		var srvIDs []string
+		for _, srv := range srvs {
+			srvIDs = append(srvIDs, srv.ServiceID())
+		}
+		return util.MessageResponse(409, "Client is still used by services: "+strings.Join(srvIDs, ", "))
+	}
+
+	oldClient, err := h.Clients.Remove(body.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, "Client not found")
+		}
+		logger.WithError(err).Error("Failed to Clients.Remove")
+		return util.MessageResponse(500, "Error removing client")
+	}
+	recordHistory(req, h.Db, api.ConfigKindClient, oldClient.UserID, "", "", api.ConfigActionDelete, oldClient)
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			OldClient api.ClientConfig
+		}{oldClient},
 	}
 }
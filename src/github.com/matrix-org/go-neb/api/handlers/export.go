@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+)
+
+// Export represents an HTTP handler capable of processing /admin/export requests.
+type Export struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/export.
+//
+// Every client, realm, session and service is returned as a YAML config file, which can be
+// given to Go-NEB as CONFIG_FILE or sent to /admin/import. If "Redact" is true then access
+// tokens, API keys and other secrets are replaced with "<redacted>". Redacted files cannot be
+// imported.
+//
+// Request:
+//  POST /admin/export
+//  {
+//      "Redact": true
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "YAML": "clients:\n- AccessToken: <redacted>\n ..."
+//  }
+func (h *Export) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Redact bool
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	logger := util.GetLogger(req.Context()).WithField("redact", body.Redact)
+	logger.Print("Incoming export request")
+
+	cfg, err := database.Export(h.Db)
+	if err != nil {
+		logger.WithError(err).Error("Failed to export database")
+		return util.MessageResponse(500, "Failed to export database")
+	}
+	if body.Redact {
+		if err = cfg.Redact(); err != nil {
+			logger.WithError(err).Error("Failed to redact export")
+			return util.MessageResponse(500, "Failed to redact export")
+		}
+	}
+	b, err := api.MarshalYAML(cfg)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal export as YAML")
+		return util.MessageResponse(500, "Failed to export database")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			YAML string
+		}{string(b)},
+	}
+}
+
+// Import represents an HTTP handler capable of processing /admin/import requests.
+type Import struct {
+	db      *database.ServiceDB
+	clients *clients.Clients
+}
+
+// NewImport creates a new Import handler
+func NewImport(db *database.ServiceDB, clients *clients.Clients) *Import {
+	return &Import{
+		db:      db,
+		clients: clients,
+	}
+}
+
+// OnIncomingRequest handles POST requests to /admin/import.
+//
+// The "YAML" key MUST be a config file, such as one returned by /admin/export. Clients, realms,
+// sessions and then services are configured in turn exactly as if they had been sent to
+// /admin/configureClient, /admin/configureAuthRealm and /admin/configureService, replacing
+// any existing config with the same ID. Anything not in the file is left alone.
+//
+// The import is not atomic: it stops at the first client, realm, session or service which fails,
+// returning an error which says which one it was, but leaves everything before it in place. It is
+// safe to fix the file and import it again. Redacted files are refused.
+//
+// Request:
+//  POST /admin/import
+//  {
+//      "YAML": "clients:\n- AccessToken: MDASDASJDIASDJASDAFGFRGER\n ..."
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Clients": 2,
+//      "Realms": 1,
+//      "Sessions": 1,
+//      "Services": 4
+//  }
+func (h *Import) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		YAML string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	var cfg api.ConfigFile
+	if err := api.UnmarshalYAML([]byte(body.YAML), &cfg); err != nil {
+		return util.MessageResponse(400, err.Error())
+	}
+	if cfg.IsRedacted() {
+		return util.MessageResponse(400, "Cannot import a redacted config file")
+	}
+	logger := util.GetLogger(req.Context())
+	logger.WithFields(log.Fields{
+		"clients":  len(cfg.Clients),
+		"realms":   len(cfg.Realms),
+		"sessions": len(cfg.Sessions),
+		"services": len(cfg.Services),
+	}).Print("Incoming import request")
+
+	for i, c := range cfg.Clients {
+		if err := c.Check(); err != nil {
+			return importFailure("Clients", i, util.MessageResponse(400, "Error parsing client config"))
+		}
+		if res := configureClient(req, h.db, h.clients, c, api.ConfigActionImport); !res.Is2xx() {
+			return importFailure("Clients", i, res)
+		}
+	}
+
+	for i, r := range cfg.Realms {
+		if err := r.Check(); err != nil {
+			return importFailure("Realms", i, util.MessageResponse(400, err.Error()))
+		}
+		realm, err := types.CreateAuthRealm(r.ID, r.Type, r.Config)
+		if err != nil {
+			return importFailure("Realms", i, util.MessageResponse(400, "Error parsing config JSON"))
+		}
+		if res := configureRealm(req, h.db, realm, api.ConfigActionImport); !res.Is2xx() {
+			return importFailure("Realms", i, res)
+		}
+	}
+
+	for i, s := range cfg.Sessions {
+		if err := s.Check(); err != nil {
+			return importFailure("Sessions", i, util.MessageResponse(400, err.Error()))
+		}
+		if res := checkNotManaged(req, h.db, api.ConfigKindSession, api.SessionConfigID(s.RealmID, s.UserID)); res != nil {
+			return importFailure("Sessions", i, *res)
+		}
+		realm, err := h.db.LoadAuthRealm(s.RealmID)
+		if err != nil {
+			return importFailure("Sessions", i, util.MessageResponse(400, "Unknown RealmID"))
+		}
+		session := realm.AuthSession(s.SessionID, s.UserID, s.RealmID)
+		// dump the raw JSON config directly into the session, as InsertFromConfig does.
+		if err = json.Unmarshal(s.Config, session); err != nil {
+			return importFailure("Sessions", i, util.MessageResponse(400, "Error parsing config JSON"))
+		}
+		if _, err = h.db.StoreAuthSession(session); err != nil {
+			logger.WithError(err).Error("Failed to StoreAuthSession")
+			return importFailure("Sessions", i, util.MessageResponse(500, "Error storing session"))
+		}
+	}
+
+	configureService := NewConfigureService(h.db, h.clients)
+	for i, s := range cfg.Services {
+		if err := s.Check(); err != nil {
+			return importFailure("Services", i, util.MessageResponse(400, err.Error()))
+		}
+		if err := types.ValidateServiceConfig(s.Type, s.Config); err != nil {
+			return importFailure("Services", i, util.MessageResponse(400, "Invalid config: "+err.Error()))
+		}
+		service, err := types.CreateService(s.ID, s.Type, s.UserID, s.Config)
+		if err != nil {
+			return importFailure("Services", i, util.MessageResponse(400, "Error parsing config JSON"))
+		}
+		if res := configureService.configure(req, service, api.ConfigActionImport); !res.Is2xx() {
+			return importFailure("Services", i, res)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Clients  int
+			Realms   int
+			Sessions int
+			Services int
+		}{len(cfg.Clients), len(cfg.Realms), len(cfg.Sessions), len(cfg.Services)},
+	}
+}
+
+// importFailure prefixes the message of a failed response with the item in the config file
+// which caused it, keeping the status code.
+func importFailure(section string, index int, res util.JSONResponse) util.JSONResponse {
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if b, err := json.Marshal(res.JSON); err == nil {
+		json.Unmarshal(b, &msg)
+	}
+	return util.MessageResponse(res.Code, fmt.Sprintf("%s[%d]: %s", section, index, msg.Message))
+}
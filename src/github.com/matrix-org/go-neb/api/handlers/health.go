@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// A client which has failed to /sync this many times in a row is not ready.
+	readySyncFailures = 3
+	// A client which has failed to /sync this many times in a row (about 5 minutes) is not live.
+	liveSyncFailures = 30
+	// How long to wait for the database to respond before declaring it unreachable.
+	databasePingTimeout = 5 * time.Second
+)
+
+// Health represents an HTTP handler capable of processing /health/live and /health/ready requests.
+type Health struct {
+	db      *database.ServiceDB
+	clients *clients.Clients
+	ready   bool
+}
+
+// NewLiveness creates a new Health handler for /health/live
+func NewLiveness(db *database.ServiceDB, clients *clients.Clients) *Health {
+	return &Health{db, clients, false}
+}
+
+// NewReadiness creates a new Health handler for /health/ready
+func NewReadiness(db *database.ServiceDB, clients *clients.Clients) *Health {
+	return &Health{db, clients, true}
+}
+
+// OnIncomingRequest handles requests to /health/live and /health/ready.
+//
+// Both endpoints describe the health of the database, the /sync loop of every syncing client and
+// any poll loops which have stopped unexpectedly, for example because a service panicked. They
+// return HTTP 503 and list the "Problems" if Go-NEB is unhealthy, or HTTP 200 otherwise. Dead
+// poll loops are listed in "DeadPollLoops" but never make Go-NEB unhealthy.
+//
+// /health/live is unhealthy if something has been broken for long enough that restarting Go-NEB
+// is likely to help: a client has failed to /sync 30 times in a row.
+//
+// /health/ready is unhealthy if Go-NEB cannot currently do its job: the database is unreachable,
+// or a client has not yet managed to /sync or has failed to /sync 3 times in a row.
+//
+// Request:
+//  GET /health/ready
+// Response:
+//  HTTP/1.1 503 Service Unavailable
+//  {
+//      "Healthy": false,
+//      "Problems": [
+//          "@my_bot:localhost has failed to /sync 4 times in a row: ..."
+//      ],
+//      "Database": {
+//          "Reachable": true
+//      },
+//      "Clients": [
+//          {
+//              "UserID": "@my_bot:localhost",
+//              "LastSuccess": 1490000000000,
+//              "ConsecutiveFailures": 4,
+//              "LastError": "..."
+//          }
+//      ],
+//      "DeadPollLoops": []
+//  }
+func (h *Health) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	var problems []string
+
+	var dbHealth struct {
+		Reachable bool
+		Error     string `json:",omitempty"`
+	}
+	if err := h.db.Ping(databasePingTimeout); err != nil {
+		dbHealth.Error = err.Error()
+		if h.ready {
+			problems = append(problems, "Database is unreachable: "+err.Error())
+		}
+	} else {
+		dbHealth.Reachable = true
+	}
+
+	syncStates := h.clients.SyncStates()
+	for _, s := range syncStates {
+		if h.ready && s.LastSuccess == 0 && s.ConsecutiveFailures < readySyncFailures {
+			problems = append(problems, fmt.Sprintf("%s has not finished its first /sync", s.UserID))
+			continue
+		}
+		maxFailures := liveSyncFailures
+		if h.ready {
+			maxFailures = readySyncFailures
+		}
+		if s.ConsecutiveFailures >= maxFailures {
+			problems = append(problems, fmt.Sprintf(
+				"%s has failed to /sync %d times in a row: %s", s.UserID, s.ConsecutiveFailures, s.LastError,
+			))
+		}
+	}
+
+	// A dead poll loop only affects one service, which will most likely crash again if Go-NEB is
+	// restarted, so dead poll loops are listed without failing either check.
+	deadPollLoops := polling.DeadPollLoops()
+
+	code := 200
+	if len(problems) > 0 {
+		code = 503
+	} else {
+		problems = []string{}
+	}
+	return util.JSONResponse{
+		Code: code,
+		JSON: struct {
+			Healthy       bool
+			Problems      []string
+			Database      interface{}
+			Clients       []clients.SyncState
+			DeadPollLoops []polling.DeadPollLoop
+		}{code == 200, problems, dbHealth, syncStates, deadPollLoops},
+	}
+}
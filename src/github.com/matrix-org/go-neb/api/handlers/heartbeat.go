@@ -18,6 +18,7 @@ import (
 type Heartbeat struct{}
 
 // OnIncomingRequest returns an empty JSON object which can be used to detect liveness of Go-NEB.
+// It does not check anything: see Health for /health/live and /health/ready.
 //
 // Request:
 //  GET /test
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+)
+
+// recordHistory stores a new version of a config in the config history. The change has
+// already been made by this point, so failures are logged rather than failing the request.
+func recordHistory(req *http.Request, db *database.ServiceDB, kind, id, configType, userID, action string, config interface{}) {
+	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
+		"kind":   kind,
+		"id":     id,
+		"action": action,
+	})
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal config for history")
+		return
+	}
+	entry, err := db.StoreConfigHistory(api.ConfigHistoryEntry{
+		Kind:   kind,
+		ID:     id,
+		Type:   configType,
+		UserID: userID,
+		Action: action,
+		Actor:  historyActor(req),
+		Config: configJSON,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to StoreConfigHistory")
+		return
+	}
+	logger.WithFields(log.Fields{
+		"version": entry.Version,
+		"actor":   entry.Actor,
+	}).Info("Recorded config history")
+}
+
+// historyActor returns who is making this request: the name of the admin token used, or the
+// remote address if admin authentication is disabled.
+func historyActor(req *http.Request) string {
+	if token := adminTokenFromContext(req.Context()); token != nil {
+		return token.Name
+	}
+	return req.RemoteAddr
+}
+
+// GetConfigHistory represents an HTTP handler capable of processing /admin/getConfigHistory requests.
+type GetConfigHistory struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/getConfigHistory.
+//
+// The JSON object MUST contain the keys "Kind" (one of "service", "realm" or "client") and
+// "ID" (the service ID, realm ID or client user ID). Every recorded version of that config
+// is returned, newest first. "Diff" lists the changes from the previous version as JSON Pointer
+// paths with the old and new values. Configs hold access tokens and secrets, so this needs an
+// admin token with the "configure" scope.
+//
+// Request:
+//  POST /admin/getConfigHistory
+//  {
+//      "Kind": "service",
+//      "ID": "my_service_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "History": [
+//          {
+//              "Kind": "service",
+//              "ID": "my_service_id",
+//              "Version": 2,
+//              "Type": "github-webhook",
+//              "UserID": "@my_bot:localhost",
+//              "Action": "configure",
+//              "Actor": "deploy-bot",
+//              "Timestamp": 1490000000000,
+//              "Config": {
+//                  // service-specific config information
+//              },
+//              "Diff": [
+//                  {
+//                      "Path": "/Rooms/!foo:localhost/Repos/owner~1repo",
+//                      "New": { "Events": ["push"] }
+//                  }
+//              ]
+//          }
+//      ]
+//  }
+func (h *GetConfigHistory) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Kind string
+		ID   string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if !validConfigKind(body.Kind) || body.ID == "" {
+		return util.MessageResponse(400, `Must supply a "Kind" of "service", "realm" or "client" and an "ID"`)
+	}
+
+	history, err := h.Db.LoadConfigHistory(body.Kind, body.ID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadConfigHistory")
+		return util.MessageResponse(500, "Failed to load config history")
+	}
+	if history == nil {
+		history = []api.ConfigHistoryEntry{}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			History []api.ConfigHistoryEntry
+		}{history},
+	}
+}
+
+// RollbackConfig represents an HTTP handler capable of processing /admin/rollbackConfig requests.
+type RollbackConfig struct {
+	db      *database.ServiceDB
+	clients *clients.Clients
+}
+
+// NewRollbackConfig creates a new RollbackConfig handler
+func NewRollbackConfig(db *database.ServiceDB, clients *clients.Clients) *RollbackConfig {
+	return &RollbackConfig{
+		db:      db,
+		clients: clients,
+	}
+}
+
+// OnIncomingRequest handles POST requests to /admin/rollbackConfig.
+//
+// The JSON object MUST contain the keys "Kind", "ID" and "Version" to identify the version of
+// the config to restore. The config is applied exactly as if it had been sent to
+// /admin/configureService, /admin/configureAuthRealm or /admin/configureClient, so services are
+// registered again, and the response is the same as those endpoints. The rollback is recorded
+// as a new version in the history. Versions which record a deletion cannot be restored.
+//
+// Request:
+//  POST /admin/rollbackConfig
+//  {
+//      "Kind": "service",
+//      "ID": "my_service_id",
+//      "Version": 1
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "Type": "github-webhook",
+//      "OldConfig": {
+//          // old service-specific config information
+//      },
+//      "NewConfig": {
+//          // restored service-specific config information
+//      }
+//  }
+func (h *RollbackConfig) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Kind    string
+		ID      string
+		Version int64
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if !validConfigKind(body.Kind) || body.ID == "" || body.Version <= 0 {
+		return util.MessageResponse(400, `Must supply a "Kind" of "service", "realm" or "client", an "ID" and a "Version"`)
+	}
+	logger := util.GetLogger(req.Context())
+	logger.WithFields(log.Fields{
+		"kind":    body.Kind,
+		"id":      body.ID,
+		"version": body.Version,
+	}).Print("Incoming rollback config request")
+
+	entry, err := h.db.LoadConfigHistoryVersion(body.Kind, body.ID, body.Version)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, "Version not found")
+		}
+		logger.WithError(err).Error("Failed to LoadConfigHistoryVersion")
+		return util.MessageResponse(500, "Failed to load config history")
+	}
+	if entry.Action == api.ConfigActionDelete {
+		return util.MessageResponse(400, "Cannot roll back to a deleted config")
+	}
+
+	switch entry.Kind {
+	case api.ConfigKindService:
+		service, err := types.CreateService(entry.ID, entry.Type, entry.UserID, entry.Config)
+		if err != nil {
+			return util.MessageResponse(400, "Error parsing config JSON")
+		}
+		return NewConfigureService(h.db, h.clients).configure(req, service, api.ConfigActionRollback)
+	case api.ConfigKindRealm:
+		realm, err := types.CreateAuthRealm(entry.ID, entry.Type, entry.Config)
+		if err != nil {
+			return util.MessageResponse(400, "Error parsing config JSON")
+		}
+		return configureRealm(req, h.db, realm, api.ConfigActionRollback)
+	default:
+		var config api.ClientConfig
+		if err := json.Unmarshal(entry.Config, &config); err != nil {
+			return util.MessageResponse(400, "Error parsing config JSON")
+		}
+		return configureClient(req, h.db, h.clients, config, api.ConfigActionRollback)
+	}
+}
+
+func validConfigKind(kind string) bool {
+	return kind == api.ConfigKindService || kind == api.ConfigKindRealm || kind == api.ConfigKindClient
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+)
+
+// defaultWebhookDeliveriesLimit is how many webhook deliveries /admin/getWebhookDeliveries
+// returns if the request doesn't say.
+const defaultWebhookDeliveriesLimit = 50
+
+// GetWebhookDeliveries represents an HTTP handler capable of processing
+// /admin/getWebhookDeliveries requests.
+type GetWebhookDeliveries struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/getWebhookDeliveries.
+//
+// The JSON object MUST contain the key "ID" of a service, and MAY contain "Limit", the most
+// deliveries to return, which defaults to 50. The webhook deliveries for the service in the
+// webhook journal are returned, newest first, with the outcome of the last time the service
+// processed each of them. "StatusCode" is 0 if the service hasn't finished processing a delivery.
+// The journal is empty unless WEBHOOK_JOURNAL_RETENTION is set.
+//
+// Request:
+//  POST /admin/getWebhookDeliveries
+//  {
+//      "ID": "my_service_id",
+//      "Limit": 10
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Deliveries": [
+//          {
+//              "ID": "5f0c6a1b2e9d4c7f8a3b1d2e4f6a8c0b",
+//              "ServiceID": "my_service_id",
+//              "CorrelationID": "9b2f4e6d8a0c1e3f",
+//              "Method": "POST",
+//              "URL": "/services/hooks/bXlfc2VydmljZV9pZA",
+//              "Header": {
+//                  "X-Github-Event": ["push"]
+//              },
+//              "Body": "{\"ref\":\"refs/heads/master\"}",
+//              "Timestamp": 1490000000000,
+//              "StatusCode": 500,
+//              "Error": "responded with HTTP 500",
+//              "ProcessedTimestamp": 1490000000250,
+//              "Replays": 0
+//          }
+//      ]
+//  }
+func (h *GetWebhookDeliveries) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID    string
+		Limit int
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.Limit < 0 || body.Limit > database.MaxWebhookDeliveries {
+		return util.MessageResponse(400, `"Limit" must be between 1 and 1000`)
+	}
+	if body.Limit == 0 {
+		body.Limit = defaultWebhookDeliveriesLimit
+	}
+	service, httpErr := loadServiceForControl(req, h.Db, body.ID)
+	if httpErr != nil {
+		return *httpErr
+	}
+
+	deliveries, err := h.Db.LoadWebhookDeliveries(service.ServiceID(), body.Limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadWebhookDeliveries")
+		return util.MessageResponse(500, "Failed to load webhook deliveries")
+	}
+	if deliveries == nil {
+		deliveries = []api.WebhookDelivery{}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Deliveries []api.WebhookDelivery
+		}{deliveries},
+	}
+}
+
+// ReplayWebhook represents an HTTP handler capable of processing /admin/replayWebhook requests.
+type ReplayWebhook struct {
+	Db      *database.ServiceDB
+	Webhook *Webhook
+}
+
+// OnIncomingRequest handles POST requests to /admin/replayWebhook.
+//
+// The JSON object MUST contain the key "DeliveryID" of a webhook delivery in the webhook journal.
+// The delivery is passed to its service again, as if it had just been received, and the outcome
+// is recorded in the journal. The response of the service is returned, but is not sent to the
+// original sender of the webhook. Returns HTTP 404 if the delivery isn't in the journal, and
+// HTTP 409 if the service is paused.
+//
+// Request:
+//  POST /admin/replayWebhook
+//  {
+//      "DeliveryID": "5f0c6a1b2e9d4c7f8a3b1d2e4f6a8c0b"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "DeliveryID": "5f0c6a1b2e9d4c7f8a3b1d2e4f6a8c0b",
+//      "StatusCode": 200,
+//      "Body": ""
+//  }
+func (h *ReplayWebhook) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		DeliveryID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.DeliveryID == "" {
+		return util.MessageResponse(400, `Must supply a "DeliveryID"`)
+	}
+	logger := util.GetLogger(req.Context()).WithField("delivery_id", body.DeliveryID)
+
+	delivery, err := h.Db.LoadWebhookDelivery(body.DeliveryID)
+	if err == sql.ErrNoRows {
+		return util.MessageResponse(404, "Webhook delivery not found")
+	} else if err != nil {
+		logger.WithError(err).Error("Failed to LoadWebhookDelivery")
+		return util.MessageResponse(500, "Failed to load webhook delivery")
+	}
+	service, httpErr := loadServiceForControl(req, h.Db, delivery.ServiceID)
+	if httpErr != nil {
+		return *httpErr
+	}
+	pause, err := servicePause(h.Db, service.ServiceID())
+	if err != nil {
+		logger.WithError(err).Error("Failed to LoadServicePause")
+		return util.MessageResponse(500, "Failed to load service pause")
+	}
+	if pause != nil {
+		return util.MessageResponse(409, "Service is paused")
+	}
+
+	logger.WithField("service_id", service.ServiceID()).Print("Incoming replay webhook request")
+	rec, err := h.Webhook.Replay(req.Context(), service, delivery)
+	if err != nil {
+		logger.WithError(err).Error("Failed to replay webhook delivery")
+		return util.MessageResponse(500, "Failed to replay webhook delivery")
+	}
+	logger.WithFields(log.Fields{
+		"service_id":  service.ServiceID(),
+		"status_code": rec.Code,
+	}).Info("Replayed webhook delivery")
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			DeliveryID string
+			StatusCode int
+			Body       string
+		}{delivery.ID, rec.Code, rec.Body.String()},
+	}
+}
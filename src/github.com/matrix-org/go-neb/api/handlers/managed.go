@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/util"
+)
+
+// checkNotManaged returns an HTTP 403 response if the config of the given kind and ID is managed
+// by the config file, as such configs can only be changed by changing the file. Returns nil if
+// the config can be modified.
+func checkNotManaged(req *http.Request, db *database.ServiceDB, kind, id string) *util.JSONResponse {
+	managed, err := db.IsManagedConfig(kind, id)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to IsManagedConfig")
+		res := util.MessageResponse(500, "Failed to check whether config is managed")
+		return &res
+	}
+	if !managed {
+		return nil
+	}
+	util.GetLogger(req.Context()).WithFields(log.Fields{
+		"kind": kind,
+		"id":   id,
+	}).Warn("Refusing admin request: config is managed by the config file")
+	res := util.MessageResponse(403, "This "+kind+" is managed by the config file and cannot be modified over HTTP")
+	return &res
+}
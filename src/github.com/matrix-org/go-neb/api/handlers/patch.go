@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A jsonPatchOp is a single JSON Patch (RFC 6902) operation.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7386) to the given JSON document. The patch
+// MUST be a JSON object: any other value would replace the whole document.
+func applyMergePatch(doc []byte, patch json.RawMessage) ([]byte, error) {
+	var target interface{}
+	var p map[string]interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil || p == nil {
+		return nil, errors.New("merge patch must be a JSON object")
+	}
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// applyJSONPatch applies a list of JSON Patch (RFC 6902) operations to the given JSON document.
+// Either every operation is applied or, if any fails, an error is returned. The patched document
+// MUST still be a JSON object.
+func applyJSONPatch(doc []byte, ops []jsonPatchOp) ([]byte, error) {
+	var root interface{}
+	if err := json.Unmarshal(doc, &root); err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		var err error
+		if root, err = applyJSONPatchOp(root, op); err != nil {
+			return nil, fmt.Errorf("patch operation %d (%s %s): %s", i, op.Op, op.Path, err)
+		}
+	}
+	if _, ok := root.(map[string]interface{}); !ok {
+		return nil, errors.New("patched document must be a JSON object")
+	}
+	return json.Marshal(root)
+}
+
+func applyJSONPatchOp(root interface{}, op jsonPatchOp) (interface{}, error) {
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, errors.New(`missing "value"`)
+		}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return pointerAdd(root, op.Path, value)
+	case "remove":
+		root, _, err := pointerRemove(root, op.Path)
+		return root, err
+	case "replace":
+		root, _, err := pointerRemove(root, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(root, op.Path, value)
+	case "move":
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, errors.New("cannot move a value into itself")
+		}
+		root, moved, err := pointerRemove(root, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(root, op.Path, moved)
+	case "copy":
+		copied, err := pointerGet(root, op.From)
+		if err != nil {
+			return nil, err
+		}
+		// Deep copy so that later operations on one don't affect the other.
+		b, err := json.Marshal(copied)
+		if err != nil {
+			return nil, err
+		}
+		var clone interface{}
+		if err = json.Unmarshal(b, &clone); err != nil {
+			return nil, err
+		}
+		return pointerAdd(root, op.Path, clone)
+	case "test":
+		actual, err := pointerGet(root, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(actual, value) {
+			return nil, errors.New("test failed")
+		}
+		return root, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// splitPointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens.
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func pointerGet(root interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	cur := root
+	for _, t := range tokens {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("%q does not exist", pointer)
+			}
+			cur = v
+		case []interface{}:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, fmt.Errorf("%q does not exist", pointer)
+			}
+			cur = c[i]
+		default:
+			return nil, fmt.Errorf("%q does not exist", pointer)
+		}
+	}
+	return cur, nil
+}
+
+// pointerParent returns the container which the last token of the pointer refers into,
+// along with that token.
+func pointerParent(root interface{}, pointer string) (interface{}, string, error) {
+	i := strings.LastIndex(pointer, "/")
+	if i < 0 {
+		return nil, "", fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	parent, err := pointerGet(root, pointer[:i])
+	if err != nil {
+		return nil, "", err
+	}
+	tokens, _ := splitPointer(pointer[i:])
+	return parent, tokens[0], nil
+}
+
+// pointerSet replaces the container at the parent of pointer with newParent. This is needed
+// because appending to or removing from a slice may allocate a new slice.
+func pointerSet(root interface{}, pointer string, newParent interface{}) (interface{}, error) {
+	i := strings.LastIndex(pointer, "/")
+	parentPointer := pointer[:i]
+	if parentPointer == "" {
+		return newParent, nil
+	}
+	grandparent, token, err := pointerParent(root, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	switch g := grandparent.(type) {
+	case map[string]interface{}:
+		g[token] = newParent
+	case []interface{}:
+		idx, _ := strconv.Atoi(token)
+		g[idx] = newParent
+	}
+	return root, nil
+}
+
+func pointerAdd(root interface{}, pointer string, value interface{}) (interface{}, error) {
+	if pointer == "" {
+		return value, nil
+	}
+	parent, token, err := pointerParent(root, pointer)
+	if err != nil {
+		return nil, err
+	}
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[token] = value
+		return root, nil
+	case []interface{}:
+		idx := len(p)
+		if token != "-" {
+			if idx, err = strconv.Atoi(token); err != nil || idx < 0 || idx > len(p) {
+				return nil, fmt.Errorf("invalid array index %q", token)
+			}
+		}
+		p = append(p, nil)
+		copy(p[idx+1:], p[idx:])
+		p[idx] = value
+		return pointerSet(root, pointer, p)
+	}
+	return nil, fmt.Errorf("cannot add to %q", pointer)
+}
+
+func pointerRemove(root interface{}, pointer string) (interface{}, interface{}, error) {
+	if pointer == "" {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	parent, token, err := pointerParent(root, pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		v, ok := p[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%q does not exist", pointer)
+		}
+		delete(p, token)
+		return root, v, nil
+	case []interface{}:
+		idx, err := strconv.Atoi(token)
+		if err != nil || idx < 0 || idx >= len(p) {
+			return nil, nil, fmt.Errorf("%q does not exist", pointer)
+		}
+		v := p[idx]
+		p = append(p[:idx], p[idx+1:]...)
+		root, err = pointerSet(root, pointer, p)
+		return root, v, err
+	}
+	return nil, nil, fmt.Errorf("%q does not exist", pointer)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestApplyMergePatch(t *testing.T) {
+	doc := []byte(`{"a":"b","c":{"d":"e","f":"g"}}`)
+	got, err := applyMergePatch(doc, json.RawMessage(`{"a":"z","c":{"f":null}}`))
+	if err != nil {
+		t.Fatalf("TestApplyMergePatch: failed to apply patch: %s", err)
+	}
+	if want := `{"a":"z","c":{"d":"e"}}`; string(got) != want {
+		t.Errorf("TestApplyMergePatch: wanted %s, got %s", want, got)
+	}
+	for _, patch := range []string{`null`, `["a"]`, `"a"`} {
+		if got, err = applyMergePatch(doc, json.RawMessage(patch)); err == nil {
+			t.Errorf("TestApplyMergePatch: %s wanted an error, got %s", patch, got)
+		}
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	testCases := []struct {
+		ops     string
+		want    string
+		wantErr bool
+	}{
+		{`[{"op":"add","path":"/list/1","value":"x"}]`, `{"list":["a","x","b"],"obj":{"k/ey":1}}`, false},
+		{`[{"op":"add","path":"/list/-","value":"x"}]`, `{"list":["a","b","x"],"obj":{"k/ey":1}}`, false},
+		{`[{"op":"remove","path":"/list/0"}]`, `{"list":["b"],"obj":{"k/ey":1}}`, false},
+		{`[{"op":"replace","path":"/obj/k~1ey","value":2}]`, `{"list":["a","b"],"obj":{"k/ey":2}}`, false},
+		{`[{"op":"move","from":"/obj/k~1ey","path":"/moved"}]`, `{"list":["a","b"],"moved":1,"obj":{}}`, false},
+		{`[{"op":"copy","from":"/list","path":"/obj/list"}]`, `{"list":["a","b"],"obj":{"k/ey":1,"list":["a","b"]}}`, false},
+		{`[{"op":"test","path":"/list/0","value":"a"}]`, `{"list":["a","b"],"obj":{"k/ey":1}}`, false},
+		{`[{"op":"test","path":"/list/0","value":"b"}]`, "", true},
+		{`[{"op":"remove","path":"/missing"}]`, "", true},
+		{`[{"op":"add","path":"/list/5","value":"x"}]`, "", true},
+		{`[{"op":"frobnicate","path":"/list"}]`, "", true},
+		{`[{"op":"add","path":"","value":["a"]}]`, "", true},
+	}
+	for _, tc := range testCases {
+		var ops []jsonPatchOp
+		if err := json.Unmarshal([]byte(tc.ops), &ops); err != nil {
+			t.Fatalf("TestApplyJSONPatch: bad test case %s: %s", tc.ops, err)
+		}
+		got, err := applyJSONPatch([]byte(`{"list":["a","b"],"obj":{"k/ey":1}}`), ops)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("TestApplyJSONPatch: %s wanted an error, got %s", tc.ops, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TestApplyJSONPatch: %s failed: %s", tc.ops, err)
+		} else if string(got) != tc.want {
+			t.Errorf("TestApplyJSONPatch: %s wanted %s, got %s", tc.ops, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/control"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+)
+
+// PauseService represents an HTTP handler capable of processing /admin/pauseService requests.
+type PauseService struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/pauseService.
+//
+// The JSON object MUST contain the key "ID" of the service to pause. A paused service stops
+// polling and ignores its commands and expansions. Webhooks for it are answered with HTTP 200
+// but dropped, or stored and delivered when the service is resumed if "QueueWebhooks" is true.
+// The service config is left alone, so the service can be resumed with /admin/resumeService.
+// Pausing a service which is already paused replaces the existing pause.
+//
+// Request:
+//  POST /admin/pauseService
+//  {
+//      "ID": "my_service_id",
+//      "QueueWebhooks": true
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ServiceID": "my_service_id",
+//      "PausedBy": "ops",
+//      "QueueWebhooks": true,
+//      "Timestamp": 1490000000000
+//  }
+func (h *PauseService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID            string
+		QueueWebhooks bool
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	service, httpErr := loadServiceForControl(req, h.Db, body.ID)
+	if httpErr != nil {
+		return *httpErr
+	}
+	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
+		"service_id":     body.ID,
+		"queue_webhooks": body.QueueWebhooks,
+	})
+	logger.Print("Incoming pause service request")
+
+	pause, err := control.Pause(service, historyActor(req), body.QueueWebhooks)
+	if err != nil {
+		logger.WithError(err).Error("Failed to pause service")
+		return util.MessageResponse(500, "Failed to pause service")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: pause,
+	}
+}
+
+// ResumeService represents an HTTP handler capable of processing /admin/resumeService requests.
+type ResumeService struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/resumeService.
+//
+// The JSON object MUST contain the key "ID" of a paused service. Polling is started again and
+// any webhooks queued while the service was paused are moved to the webhook queue, to be
+// delivered to it in the background in the order they were received. Returns HTTP 400 if the
+// service is not paused.
+//
+// Request:
+//  POST /admin/resumeService
+//  {
+//      "ID": "my_service_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "QueuedWebhooks": 3
+//  }
+func (h *ResumeService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	service, httpErr := loadServiceForControl(req, h.Db, body.ID)
+	if httpErr != nil {
+		return *httpErr
+	}
+	logger := util.GetLogger(req.Context()).WithField("service_id", body.ID)
+	logger.Print("Incoming resume service request")
+
+	queued, err := control.Resume(service)
+	if err == control.ErrNotPaused {
+		return util.MessageResponse(400, "Service is not paused")
+	} else if err != nil {
+		logger.WithError(err).Error("Failed to resume service")
+		return util.MessageResponse(500, "Failed to resume service")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID             string
+			QueuedWebhooks int
+		}{body.ID, queued},
+	}
+}
+
+// loadServiceForControl loads the service with the given ID for pausing, resuming or inspecting
+// it, returning an HTTP error response if it can't be loaded or the admin token can't access it.
+func loadServiceForControl(req *http.Request, db *database.ServiceDB, serviceID string) (types.Service, *util.JSONResponse) {
+	if serviceID == "" {
+		res := util.MessageResponse(400, `Must supply a "ID"`)
+		return nil, &res
+	}
+	service, err := db.LoadService(serviceID)
+	if err == sql.ErrNoRows {
+		res := util.MessageResponse(404, "Service not found")
+		return nil, &res
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadService")
+		res := util.MessageResponse(500, "Failed to load service")
+		return nil, &res
+	}
+	if httpErr := checkServiceAccess(req, service.ServiceType(), service.ServiceUserID()); httpErr != nil {
+		return nil, httpErr
+	}
+	return service, nil
+}
+
+// servicePause returns the pause for a service, or nil if the service is not paused.
+func servicePause(db *database.ServiceDB, serviceID string) (*api.ServicePause, error) {
+	pause, err := db.LoadServicePause(serviceID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &pause, nil
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/util"
+)
+
+// GetPollQueue represents an HTTP handler capable of processing /admin/getPollQueue requests.
+type GetPollQueue struct{}
+
+// OnIncomingRequest handles POST requests to /admin/getPollQueue.
+//
+// The response lists every service which is being polled, ordered by when it will next be polled,
+// along with the size of the poll worker pool and how many workers are busy. "NextPoll" is a unix
+// timestamp in milliseconds, or 0 while the service is being polled. Services whose polls keep
+// failing are backed off, and "ConsecutiveFailures" counts how many times in a row they have failed.
+//
+// Request:
+//  POST /admin/getPollQueue
+//  {}
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Workers": 10,
+//      "BusyWorkers": 1,
+//      "Queue": [
+//          {
+//              "ServiceID": "my_rss_service",
+//              "ServiceType": "rssbot",
+//              "NextPoll": 0,
+//              "Polling": true,
+//              "ConsecutiveFailures": 0
+//          },
+//          {
+//              "ServiceID": "my_travis_service",
+//              "ServiceType": "travis",
+//              "NextPoll": 1490000030000,
+//              "Polling": false,
+//              "ConsecutiveFailures": 2
+//          }
+//      ]
+//  }
+func (h *GetPollQueue) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	queue, workers, busy := polling.Queue()
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Workers     int
+			BusyWorkers int
+			Queue       []polling.QueuedPoll
+		}{workers, busy, queue},
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+)
+
+// typeSchema is the JSON Schema for the config of a single service or realm type.
+type typeSchema struct {
+	Type   string
+	Schema *types.JSONSchema
+}
+
+func sortedTypeSchemas(schemas map[string]*types.JSONSchema) []typeSchema {
+	result := make([]typeSchema, 0, len(schemas))
+	for t, schema := range schemas {
+		result = append(result, typeSchema{t, schema})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Type < result[j].Type
+	})
+	return result
+}
+
+// ServiceTypes represents an HTTP handler capable of processing /admin/serviceTypes requests.
+type ServiceTypes struct{}
+
+// OnIncomingRequest handles POST requests to /admin/serviceTypes.
+//
+// The request body is ignored. Every service type known to Go-NEB is returned along with a
+// JSON Schema describing the "Config" it takes in /admin/configureService. Fields which are
+// populated by Go-NEB have "readOnly": true and do not need to be supplied.
+//
+// Request:
+//  POST /admin/serviceTypes
+//  {}
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ServiceTypes": [
+//          {
+//              "Type": "travis-ci",
+//              "Schema": {
+//                  "$schema": "http://json-schema.org/draft-07/schema#",
+//                  "type": "object",
+//                  "properties": {
+//                      "webhook_url": { "type": "string", "readOnly": true },
+//                      "rooms": { ... }
+//                  }
+//              }
+//          }
+//      ]
+//  }
+func (h *ServiceTypes) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ServiceTypes []typeSchema
+		}{sortedTypeSchemas(types.ServiceSchemas())},
+	}
+}
+
+// RealmTypes represents an HTTP handler capable of processing /admin/realmTypes requests.
+type RealmTypes struct{}
+
+// OnIncomingRequest handles POST requests to /admin/realmTypes.
+//
+// The request body is ignored. Every auth realm type known to Go-NEB is returned along with a
+// JSON Schema describing the "Config" it takes in /admin/configureAuthRealm.
+//
+// Request:
+//  POST /admin/realmTypes
+//  {}
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "RealmTypes": [
+//          {
+//              "Type": "github",
+//              "Schema": {
+//                  "$schema": "http://json-schema.org/draft-07/schema#",
+//                  "type": "object",
+//                  "properties": {
+//                      "ClientSecret": { "type": "string" },
+//                      ...
+//                  }
+//              }
+//          }
+//      ]
+//  }
+func (h *RealmTypes) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			RealmTypes []typeSchema
+		}{sortedTypeSchemas(types.AuthRealmSchemas())},
+	}
+}
@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
@@ -14,42 +17,47 @@ import (
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/status"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/util"
 )
 
-// ConfigureService represents an HTTP handler which can process /admin/configureService requests.
-type ConfigureService struct {
-	db               *database.ServiceDB
-	clients          *clients.Clients
+// Have mutexes around each service to queue up multiple requests for the same service ID.
+// These are shared between every handler which modifies services.
+var (
 	mapMutex         sync.Mutex
-	mutexByServiceID map[string]*sync.Mutex
-}
-
-// NewConfigureService creates a new ConfigureService handler
-func NewConfigureService(db *database.ServiceDB, clients *clients.Clients) *ConfigureService {
-	return &ConfigureService{
-		db:               db,
-		clients:          clients,
-		mutexByServiceID: make(map[string]*sync.Mutex),
-	}
-}
+	mutexByServiceID = make(map[string]*sync.Mutex)
+)
 
-func (s *ConfigureService) getMutexForServiceID(serviceID string) *sync.Mutex {
-	s.mapMutex.Lock()
-	defer s.mapMutex.Unlock()
-	m := s.mutexByServiceID[serviceID]
+func getMutexForServiceID(serviceID string) *sync.Mutex {
+	mapMutex.Lock()
+	defer mapMutex.Unlock()
+	m := mutexByServiceID[serviceID]
 	if m == nil {
 		// XXX TODO: There's a memory leak here. The amount of mutexes created is unbounded, as there will be 1 per service which are never deleted.
 		// A better solution would be to have a striped hash map with a bounded pool of mutexes. We can't live with a single global mutex because the Register()
 		// function this is protecting does many many HTTP requests which can take a long time on bad networks and will head of line block other services.
 		m = &sync.Mutex{}
-		s.mutexByServiceID[serviceID] = m
+		mutexByServiceID[serviceID] = m
 	}
 	return m
 }
 
+// ConfigureService represents an HTTP handler which can process /admin/configureService requests.
+type ConfigureService struct {
+	db      *database.ServiceDB
+	clients *clients.Clients
+}
+
+// NewConfigureService creates a new ConfigureService handler
+func NewConfigureService(db *database.ServiceDB, clients *clients.Clients) *ConfigureService {
+	return &ConfigureService{
+		db:      db,
+		clients: clients,
+	}
+}
+
 // OnIncomingRequest handles POST requests to /admin/configureService.
 //
 // The request body MUST be of type "api.ConfigureServiceRequest".
@@ -76,6 +84,41 @@ func (s *ConfigureService) getMutexForServiceID(serviceID string) *sync.Mutex {
 //          // new service-specific config information
 //      },
 //  }
+//
+// If the "dry_run" query parameter is "true", the config is parsed and checked and the client is
+// checked, but the service is not registered or stored. Services which support it (see
+// types.DryRunner) also check their config as Register would and describe what Register would
+// do, without doing it. This will return HTTP 400 if Register would fail.
+//
+// Request:
+//  POST /admin/configureService?dry_run=true
+//  {
+//      // As above
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "Type": "github-webhook",
+//      "DryRun": true,
+//      "OldConfig": {
+//          // old service-specific config information
+//      },
+//      "NewConfig": {
+//          // new service-specific config information
+//      },
+//      "Diff": [
+//          {
+//              "Path": "/Rooms/!new_room:localhost",
+//              "New": { "Repos": { "owner/repo": { "Events": ["push"] } } }
+//          }
+//      ],
+//      "Plan": {
+//          // Omitted (null) if the service type does not support dry runs.
+//          "JoinRooms": ["!new_room:localhost"],
+//          "AddWebhooks": ["owner/repo"]
+//      }
+//  }
 func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONResponse {
 	if req.Method != "POST" {
 		return util.MessageResponse(405, "Unsupported Method")
@@ -85,6 +128,9 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 	if httpErr != nil {
 		return *httpErr
 	}
+	if httpErr = checkServiceAccess(req, service.ServiceType(), service.ServiceUserID()); httpErr != nil {
+		return *httpErr
+	}
 	logger := util.GetLogger(req.Context())
 	logger.WithFields(log.Fields{
 		"service_id":      service.ServiceID(),
@@ -92,16 +138,35 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 		"service_user_id": service.ServiceUserID(),
 	}).Print("Incoming configure service request")
 
-	// Have mutexes around each service to queue up multiple requests for the same service ID
-	mut := s.getMutexForServiceID(service.ServiceID())
-	mut.Lock()
-	defer mut.Unlock()
+	if dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry_run")); dryRun {
+		return s.dryRun(req, service)
+	}
+	return s.configure(req, service, api.ConfigActionConfigure)
+}
+
+// dryRun performs every check which configure does without registering or storing the service.
+func (s *ConfigureService) dryRun(req *http.Request, service types.Service) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+
+	if httpErr := checkNotManaged(req, s.db, api.ConfigKindService, service.ServiceID()); httpErr != nil {
+		return *httpErr
+	}
 
 	old, err := s.db.LoadService(service.ServiceID())
 	if err != nil && err != sql.ErrNoRows {
 		logger.WithError(err).Error("Failed to LoadService")
 		return util.MessageResponse(500, "Error loading old service")
 	}
+	var oldJSON []byte
+	if old != nil {
+		if httpErr := checkServiceAccess(req, old.ServiceType(), old.ServiceUserID()); httpErr != nil {
+			return *httpErr
+		}
+		if oldJSON, err = json.Marshal(old); err != nil {
+			logger.WithError(err).Error("Failed to marshal old service")
+			return util.MessageResponse(500, "Error loading old service")
+		}
+	}
 
 	client, err := s.clients.Client(service.ServiceUserID())
 	if err != nil {
@@ -112,14 +177,118 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 		return util.MessageResponse(400, err.Error())
 	}
 
-	if err = service.Register(old, client); err != nil {
-		return util.MessageResponse(500, "Failed to register service: "+err.Error())
+	var plan *types.RegisterPlan
+	if dr, ok := service.(types.DryRunner); ok {
+		p, err := dr.DryRun(old, client)
+		if err != nil {
+			return util.MessageResponse(400, "Failed to register service: "+err.Error())
+		}
+		plan = &p
 	}
 
-	oldService, err := s.db.StoreService(service)
+	newJSON, err := json.Marshal(service)
 	if err != nil {
-		logger.WithError(err).Error("Failed to StoreService")
-		return util.MessageResponse(500, "Error storing service")
+		logger.WithError(err).Error("Failed to marshal service")
+		return util.MessageResponse(500, "Error marshalling service")
+	}
+	diff, err := api.DiffJSON(oldJSON, newJSON)
+	if err != nil {
+		logger.WithError(err).Error("Failed to diff service")
+		return util.MessageResponse(500, "Error diffing service")
+	}
+	if diff == nil {
+		diff = []api.ConfigChange{}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID        string
+			Type      string
+			DryRun    bool
+			OldConfig types.Service
+			NewConfig types.Service
+			Diff      []api.ConfigChange
+			Plan      *types.RegisterPlan
+		}{service.ServiceID(), service.ServiceType(), true, old, service, diff, plan},
+	}
+}
+
+// configure registers and stores the given service, replacing any existing service with the
+// same ID, and records the change in the config history with the given action.
+func (s *ConfigureService) configure(req *http.Request, service types.Service, action string) util.JSONResponse {
+	// Have mutexes around each service to queue up multiple requests for the same service ID
+	mut := getMutexForServiceID(service.ServiceID())
+	mut.Lock()
+	defer mut.Unlock()
+
+	return s.configureLocked(req, service, action)
+}
+
+// maxStoreAttempts is how many times to try storing a service which keeps being changed by
+// something else, e.g. a poll loop, before giving up.
+const maxStoreAttempts = 3
+
+// configureLocked is like configure but the caller MUST already hold the mutex for the service ID.
+//
+// If the service's ServiceVersion is 0, it replaces whatever is stored: if the stored service is
+// changed by something else while this is registering it, the stored service is loaded again and
+// registering is retried. Otherwise the stored service MUST still be that version, and HTTP 409
+// is returned if it isn't.
+func (s *ConfigureService) configureLocked(req *http.Request, service types.Service, action string) util.JSONResponse {
+	logger := util.GetLogger(req.Context())
+
+	if httpErr := checkNotManaged(req, s.db, api.ConfigKindService, service.ServiceID()); httpErr != nil {
+		return *httpErr
+	}
+
+	client, err := s.clients.Client(service.ServiceUserID())
+	if err != nil {
+		return util.MessageResponse(400, "Unknown matrix client")
+	}
+
+	if err := checkClientForService(service, client); err != nil {
+		return util.MessageResponse(400, err.Error())
+	}
+
+	expectedVersion := service.ServiceVersion()
+	var old, oldService types.Service
+	for attempt := 1; ; attempt++ {
+		old, err = s.db.LoadService(service.ServiceID())
+		if err != nil && err != sql.ErrNoRows {
+			logger.WithError(err).Error("Failed to LoadService")
+			return util.MessageResponse(500, "Error loading old service")
+		}
+		var oldVersion int64
+		if old != nil {
+			// Don't let restricted tokens take over services they can't otherwise touch.
+			if httpErr := checkServiceAccess(req, old.ServiceType(), old.ServiceUserID()); httpErr != nil {
+				return *httpErr
+			}
+			oldVersion = old.ServiceVersion()
+		}
+		if expectedVersion != 0 && expectedVersion != oldVersion {
+			return util.MessageResponse(409, "Service has been modified since it was read")
+		}
+		service.SetServiceVersion(oldVersion)
+
+		if err = service.Register(old, client); err != nil {
+			return util.MessageResponse(500, "Failed to register service: "+err.Error())
+		}
+
+		oldService, err = s.db.StoreService(service)
+		if err == database.ErrServiceConflict {
+			if expectedVersion == 0 && attempt < maxStoreAttempts {
+				logger.WithField("attempt", attempt).Warn("Service was changed while registering it, retrying")
+				continue
+			}
+			return util.MessageResponse(409, "Service has been modified since it was read")
+		}
+		if err != nil {
+			logger.WithError(err).Error("Failed to StoreService")
+			return util.MessageResponse(500, "Error storing service")
+		}
+		break
 	}
 
 	// Start any polling NOW because they may decide to stop it in PostRegister, and we want to make
@@ -135,8 +304,9 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 
 	service.PostRegister(old)
 	metrics.IncrementConfigureService(service.ServiceType())
+	recordHistory(req, s.db, api.ConfigKindService, service.ServiceID(), service.ServiceType(), service.ServiceUserID(), action, service)
 
-	return util.JSONResponse{
+	res := util.JSONResponse{
 		Code: 200,
 		JSON: struct {
 			ID        string
@@ -145,6 +315,21 @@ func (s *ConfigureService) OnIncomingRequest(req *http.Request) util.JSONRespons
 			NewConfig types.Service
 		}{service.ServiceID(), service.ServiceType(), oldService, service},
 	}
+	if etag, err := serviceETag(service); err == nil {
+		res.Headers = map[string]string{"ETag": etag}
+	}
+	return res
+}
+
+// serviceETag returns an opaque quoted string which changes whenever the stored config of the
+// service changes.
+func serviceETag(service types.Service) (string, error) {
+	serviceJSON, err := json.Marshal(service)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(serviceJSON)
+	return `"` + hex.EncodeToString(hash[:]) + `"`, nil
 }
 
 func (s *ConfigureService) createService(req *http.Request) (types.Service, *util.JSONResponse) {
@@ -159,6 +344,11 @@ func (s *ConfigureService) createService(req *http.Request) (types.Service, *uti
 		return nil, &res
 	}
 
+	if err := types.ValidateServiceConfig(body.Type, body.Config); err != nil {
+		res := util.MessageResponse(400, "Invalid config: "+err.Error())
+		return nil, &res
+	}
+
 	service, err := types.CreateService(body.ID, body.Type, body.UserID, body.Config)
 	if err != nil {
 		res := util.MessageResponse(400, "Error parsing config JSON")
@@ -189,8 +379,11 @@ type GetService struct {
 //      "Type": "github",
 //      "Config": {
 //          // service-specific config information
-//      }
+//      },
+//      "ETag": "\"3c6e0b8a9c15224a8228b9a98ca1531d...\""
 //  }
+//
+// If the service is paused, "Paused" describes the pause, as returned by /admin/pauseService.
 func (h *GetService) OnIncomingRequest(req *http.Request) util.JSONResponse {
 	if req.Method != "POST" {
 		return util.MessageResponse(405, "Unsupported Method")
@@ -214,6 +407,19 @@ func (h *GetService) OnIncomingRequest(req *http.Request) util.JSONResponse {
 		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadService")
 		return util.MessageResponse(500, `Failed to load service`)
 	}
+	if httpErr := checkServiceAccess(req, srv.ServiceType(), srv.ServiceUserID()); httpErr != nil {
+		return *httpErr
+	}
+	etag, err := serviceETag(srv)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to marshal service")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+	pause, err := servicePause(h.Db, srv.ServiceID())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadServicePause")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
 
 	return util.JSONResponse{
 		Code: 200,
@@ -221,10 +427,365 @@ func (h *GetService) OnIncomingRequest(req *http.Request) util.JSONResponse {
 			ID     string
 			Type   string
 			Config types.Service
+			ETag   string
+			Paused *api.ServicePause `json:",omitempty"`
+		}{srv.ServiceID(), srv.ServiceType(), srv, etag, pause},
+		Headers: map[string]string{"ETag": etag},
+	}
+}
+
+// DeleteService represents an HTTP handler which can process /admin/deleteService requests.
+type DeleteService struct {
+	db      *database.ServiceDB
+	clients *clients.Clients
+}
+
+// NewDeleteService creates a new DeleteService handler
+func NewDeleteService(db *database.ServiceDB, clients *clients.Clients) *DeleteService {
+	return &DeleteService{
+		db:      db,
+		clients: clients,
+	}
+}
+
+// OnIncomingRequest handles POST requests to /admin/deleteService.
+//
+// The request body MUST be a JSON body which has an "ID" key which represents
+// the service ID to delete. Any polling for this service is stopped and the service
+// is given the chance to clean up after itself (e.g. removing webhooks) before it is
+// removed from the database.
+//
+// Request:
+//  POST /admin/deleteService
+//  {
+//      "ID": "my_service_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "Type": "github",
+//      "OldConfig": {
+//          // service-specific config information
+//      }
+//  }
+func (h *DeleteService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.ID == "" {
+		return util.MessageResponse(400, `Must supply a "ID"`)
+	}
+
+	mut := getMutexForServiceID(body.ID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	logger := util.GetLogger(req.Context()).WithField("service_id", body.ID)
+
+	srv, err := h.db.LoadService(body.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, `Service not found`)
+		}
+		logger.WithError(err).Error("Failed to LoadService")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+	if httpErr := checkServiceAccess(req, srv.ServiceType(), srv.ServiceUserID()); httpErr != nil {
+		return *httpErr
+	}
+	if httpErr := checkNotManaged(req, h.db, api.ConfigKindService, srv.ServiceID()); httpErr != nil {
+		return *httpErr
+	}
+	logger.WithFields(log.Fields{
+		"service_type":    srv.ServiceType(),
+		"service_user_id": srv.ServiceUserID(),
+	}).Print("Incoming delete service request")
+
+	if _, ok := srv.(types.Poller); ok {
+		polling.StopPolling(srv)
+	}
+
+	client, err := h.clients.Client(srv.ServiceUserID())
+	if err != nil {
+		// Still let the service tidy up after itself, it just can't talk to Matrix.
+		logger.WithError(err).Warn("Failed to load client for service being deleted")
+		client = nil
+	}
+	srv.Unregister(client)
+
+	if err := h.db.DeleteService(srv.ServiceID()); err != nil {
+		logger.WithError(err).Error("Failed to DeleteService")
+		return util.MessageResponse(500, "Error deleting service")
+	}
+	status.Forget(srv.ServiceID())
+	recordHistory(req, h.db, api.ConfigKindService, srv.ServiceID(), srv.ServiceType(), srv.ServiceUserID(), api.ConfigActionDelete, srv)
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID        string
+			Type      string
+			OldConfig types.Service
 		}{srv.ServiceID(), srv.ServiceType(), srv},
 	}
 }
 
+// PatchService represents an HTTP handler which can process /admin/patchService requests.
+type PatchService struct {
+	configure *ConfigureService
+}
+
+// NewPatchService creates a new PatchService handler
+func NewPatchService(db *database.ServiceDB, clients *clients.Clients) *PatchService {
+	return &PatchService{NewConfigureService(db, clients)}
+}
+
+// OnIncomingRequest handles POST requests to /admin/patchService.
+//
+// This changes part of the config of an existing service without re-sending all of it. The
+// request body MUST contain the service "ID" and exactly one of "MergePatch", a JSON Merge Patch
+// (RFC 7386), or "Patch", a list of JSON Patch (RFC 6902) operations. These are applied to the
+// service config as returned by /admin/getService, so keys MUST be spelled the same way. The
+// service type and user ID cannot be changed.
+//
+// To avoid overwriting concurrent changes, the "ETag" returned by /admin/getService MUST be
+// supplied, either in the body or in an "If-Match" header, otherwise this returns HTTP 428. If the
+// service has changed since then, this returns HTTP 412 and the caller should fetch the service again and retry. Changes made by Go-NEB
+// itself while the patch is being applied, e.g. by a poll loop, are kept: the patch is applied
+// again to the new version, and HTTP 409 is returned if that keeps happening.
+//
+// The patched service is validated and registered exactly as if it had been sent to
+// /admin/configureService, and the response is the same, with the new ETag in an "ETag" header.
+//
+// Request:
+//  POST /admin/patchService
+//  {
+//      "ID": "my_service_id",
+//      "ETag": "\"3c6e0b8a9c15224a8228b9a98ca1531d...\"",
+//      "MergePatch": {
+//          "Rooms": {
+//              "!new_room:localhost": {
+//                  "Repos": { "owner/repo": { "Events": ["push"] } }
+//              }
+//          }
+//      }
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "Type": "github-webhook",
+//      "OldConfig": {
+//          // old service-specific config information
+//      },
+//      "NewConfig": {
+//          // new service-specific config information
+//      }
+//  }
+func (h *PatchService) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID         string
+		ETag       string
+		MergePatch json.RawMessage
+		Patch      []jsonPatchOp
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	if body.ID == "" {
+		return util.MessageResponse(400, `Must supply a "ID"`)
+	}
+	if (len(body.MergePatch) == 0) == (body.Patch == nil) {
+		return util.MessageResponse(400, `Must supply exactly one of "MergePatch" or "Patch"`)
+	}
+	if body.ETag == "" {
+		body.ETag = req.Header.Get("If-Match")
+	}
+	if body.ETag == "" {
+		return util.MessageResponse(428, `Must supply an "ETag" or an "If-Match" header`)
+	}
+
+	mut := getMutexForServiceID(body.ID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	// If something else changes the service while it is being patched, patch the new version
+	// instead of overwriting the change.
+	for attempt := 1; ; attempt++ {
+		res := h.patchLocked(req, body.ID, body.ETag, body.MergePatch, body.Patch)
+		if res.Code != 409 || attempt == maxStoreAttempts {
+			return res
+		}
+	}
+}
+
+// patchLocked applies a patch to the stored service. The caller MUST already hold the mutex for
+// the service ID. Returns HTTP 409 if the service was changed while the patch was being applied.
+func (h *PatchService) patchLocked(req *http.Request, serviceID, etag string, mergePatch json.RawMessage, patch []jsonPatchOp) util.JSONResponse {
+	logger := util.GetLogger(req.Context()).WithField("service_id", serviceID)
+
+	old, err := h.configure.db.LoadService(serviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return util.MessageResponse(404, `Service not found`)
+		}
+		logger.WithError(err).Error("Failed to LoadService")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+	if httpErr := checkServiceAccess(req, old.ServiceType(), old.ServiceUserID()); httpErr != nil {
+		return *httpErr
+	}
+	logger.WithFields(log.Fields{
+		"service_type":    old.ServiceType(),
+		"service_user_id": old.ServiceUserID(),
+	}).Print("Incoming patch service request")
+
+	oldJSON, err := json.Marshal(old)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal service")
+		return util.MessageResponse(500, `Failed to load service`)
+	}
+	if oldETag, _ := serviceETag(old); oldETag != etag {
+		return util.MessageResponse(412, "Service has been modified since it was read")
+	}
+
+	var newJSON []byte
+	if len(mergePatch) > 0 {
+		newJSON, err = applyMergePatch(oldJSON, mergePatch)
+	} else {
+		newJSON, err = applyJSONPatch(oldJSON, patch)
+	}
+	if err != nil {
+		return util.MessageResponse(400, "Failed to apply patch: "+err.Error())
+	}
+
+	if err = types.ValidateServiceConfig(old.ServiceType(), newJSON); err != nil {
+		return util.MessageResponse(400, "Invalid config: "+err.Error())
+	}
+	service, err := types.CreateService(old.ServiceID(), old.ServiceType(), old.ServiceUserID(), newJSON)
+	if err != nil {
+		return util.MessageResponse(400, "Error parsing config JSON")
+	}
+	service.SetServiceVersion(old.ServiceVersion())
+
+	return h.configure.configureLocked(req, service, api.ConfigActionPatch)
+}
+
+// ListServices represents an HTTP handler which can process /admin/listServices requests.
+type ListServices struct {
+	Db *database.ServiceDB
+}
+
+// The default and maximum number of services returned by a single /admin/listServices request.
+const (
+	defaultListServicesLimit = 100
+	maxListServicesLimit     = 1000
+)
+
+// OnIncomingRequest handles POST requests to /admin/listServices.
+//
+// All keys in the request body are optional. "Type" and "UserID" filter the services
+// returned to only those with that service type or service user ID. Services are returned
+// in order of their ID, up to "Limit" (default 100, max 1000) at a time. To fetch the next
+// page, pass the "NextBatch" value from the previous response as "From". "NextBatch" is
+// omitted when there are no more services. Services which the admin token cannot access are
+// left out, so a page may contain fewer than "Limit" services even if there are more to come.
+//
+// Request:
+//  POST /admin/listServices
+//  {
+//      "Type": "github-webhook",
+//      "UserID": "@my_bot:localhost",
+//      "Limit": 50,
+//      "From": "my_service_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "Services": [
+//          {
+//              "ID": "my_service_id_2",
+//              "Type": "github-webhook",
+//              "UserID": "@my_bot:localhost",
+//              "Config": {
+//                  // service-specific config information
+//              }
+//          }
+//      ],
+//      "NextBatch": "my_service_id_2"
+//  }
+func (h *ListServices) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		Type   string
+		UserID string
+		Limit  int
+		From   string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+
+	if body.Limit < 0 {
+		return util.MessageResponse(400, `"Limit" must not be negative`)
+	}
+	if body.Limit == 0 {
+		body.Limit = defaultListServicesLimit
+	}
+	if body.Limit > maxListServicesLimit {
+		body.Limit = maxListServicesLimit
+	}
+
+	// Fetch one more than asked for so we know whether there is another page.
+	srvs, err := h.Db.LoadServices(body.Type, body.UserID, body.From, body.Limit+1)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadServices")
+		return util.MessageResponse(500, `Failed to load services`)
+	}
+
+	var nextBatch string
+	if len(srvs) > body.Limit {
+		srvs = srvs[:body.Limit]
+		nextBatch = srvs[len(srvs)-1].ServiceID()
+	}
+
+	type serviceInfo struct {
+		ID     string
+		Type   string
+		UserID string
+		Config types.Service
+	}
+	token := adminTokenFromContext(req.Context())
+	services := []serviceInfo{}
+	for _, srv := range srvs {
+		if token != nil && !token.AllowsService(srv.ServiceType(), srv.ServiceUserID()) {
+			continue
+		}
+		services = append(services, serviceInfo{srv.ServiceID(), srv.ServiceType(), srv.ServiceUserID(), srv})
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Services  []serviceInfo
+			NextBatch string `json:",omitempty"`
+		}{services, nextBatch},
+	}
+}
+
 func checkClientForService(service types.Service, client *gomatrix.Client) error {
 	// If there are any commands or expansions for this Service then the service user ID
 	// MUST be a syncing client or else the Service will never get the incoming command/expansion!
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/util"
+)
+
+// GetServiceStatus represents an HTTP handler capable of processing /admin/getServiceStatus requests.
+type GetServiceStatus struct {
+	Db *database.ServiceDB
+}
+
+// OnIncomingRequest handles POST requests to /admin/getServiceStatus.
+//
+// The JSON object MUST contain the key "ID" of the service. The response describes the outcome
+// of the last command, webhook, poll and message send of the service, and its most recent failure
+// of any kind. Timestamps are unix timestamps in milliseconds. Outcomes are omitted if the service
+// has not done that since Go-NEB started, as statuses are not persisted. "Paused" describes the
+// pause, if the service is paused.
+//
+// Request:
+//  POST /admin/getServiceStatus
+//  {
+//      "ID": "my_service_id"
+//  }
+// Response:
+//  HTTP/1.1 200 OK
+//  {
+//      "ID": "my_service_id",
+//      "Type": "github-webhook",
+//      "Status": {
+//          "LastWebhook": {
+//              "Timestamp": 1490000000000,
+//              "Detail": "POST /services/hooks/bXlfc2VydmljZV9pZA",
+//              "Error": "responded with HTTP 400"
+//          },
+//          "LastSend": {
+//              "Timestamp": 1489999000000,
+//              "Detail": "!qmElAGdFYCHoCJuaNt:localhost"
+//          },
+//          "LastError": {
+//              "Timestamp": 1490000000000,
+//              "Detail": "POST /services/hooks/bXlfc2VydmljZV9pZA",
+//              "Error": "responded with HTTP 400"
+//          },
+//          "LastErrorKind": "webhook"
+//      }
+//  }
+func (h *GetServiceStatus) OnIncomingRequest(req *http.Request) util.JSONResponse {
+	if req.Method != "POST" {
+		return util.MessageResponse(405, "Unsupported Method")
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.MessageResponse(400, "Error parsing request JSON")
+	}
+	service, httpErr := loadServiceForControl(req, h.Db, body.ID)
+	if httpErr != nil {
+		return *httpErr
+	}
+	pause, err := servicePause(h.Db, service.ServiceID())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to LoadServicePause")
+		return util.MessageResponse(500, "Failed to load service")
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			ID     string
+			Type   string
+			Paused *api.ServicePause `json:",omitempty"`
+			Status status.ServiceStatus
+		}{service.ServiceID(), service.ServiceType(), pause, status.Get(service.ServiceID())},
+	}
+}
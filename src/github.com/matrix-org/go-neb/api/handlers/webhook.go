@@ -1,66 +1,315 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
 	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/tracing"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
 )
 
+// maxWebhookBodySize is the largest webhook body which is accepted. Github's limit is 25MB.
+const maxWebhookBodySize = 25 << 20
+
+// webhookJournalSweepInterval is how often webhook deliveries which are older than the journal
+// retention are removed from the webhook journal.
+const webhookJournalSweepInterval = 10 * time.Minute
+
+// journalOmittedHeaders are the request headers which aren't kept in the webhook journal, as they
+// may hold credentials.
+var journalOmittedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
 // Webhook represents an HTTP handler capable of accepting webhook requests on behalf of services.
 type Webhook struct {
 	db      *database.ServiceDB
 	clients *clients.Clients
+	// How long webhook deliveries are kept in the webhook journal, or 0 if they aren't.
+	journalRetention time.Duration
+	// Signalled when a webhook is queued, so that it is handled straight away.
+	queued chan struct{}
+	// How long to wait before handling a queued webhook again after it has failed.
+	retryDelay func(attempts int) time.Duration
 }
 
 // NewWebhook returns a new webhook HTTP handler
 func NewWebhook(db *database.ServiceDB, cli *clients.Clients) *Webhook {
-	return &Webhook{db, cli}
+	return &Webhook{db: db, clients: cli, queued: make(chan struct{}, 1), retryDelay: webhookRetryDelay}
+}
+
+// SetJournalRetention turns on the webhook journal, which keeps each webhook passed to a service
+// for the given time with the outcome of processing it, so that it can be inspected and replayed.
+// The journal is turned off if retention is 0.
+func (wh *Webhook) SetJournalRetention(retention time.Duration) {
+	wh.journalRetention = retention
+}
+
+// StartJournalSweep starts removing expired webhook deliveries from the webhook journal in the
+// background. Does nothing if the journal is off.
+func (wh *Webhook) StartJournalSweep() {
+	if wh.journalRetention <= 0 {
+		return
+	}
+	go func() {
+		for {
+			count, err := wh.db.DeleteExpiredWebhookDeliveries(time.Now().Add(-wh.journalRetention))
+			if err != nil {
+				log.WithError(err).Error("Failed to remove expired webhook deliveries")
+			} else if count > 0 {
+				log.WithField("count", count).Info("Removed expired webhook deliveries")
+			}
+			time.Sleep(webhookJournalSweepInterval)
+		}
+	}()
 }
 
 // Handle an incoming webhook HTTP request.
 //
 // The webhook MUST have a known base64 encoded service ID as the last path segment
 // in order for this request to be passed to the correct service, or else this will return
-// HTTP 400. If the base64 encoded service ID is unknown, this will return HTTP 404.
+// HTTP 400. If the base64 encoded service ID is unknown, this will return HTTP 404. Bodies larger
+// than 25MB are rejected with HTTP 413.
+// If the service is paused, this will return HTTP 200 and drop or queue the webhook.
 // Beyond this, the exact response is determined by the specific Service implementation.
+// The request is logged with the correlation ID in its X-Request-ID header, or a new one if it
+// doesn't have one, and the response carries the correlation ID in the same header.
+// If the webhook journal is on, the request is kept in it with the outcome of processing it.
+// Webhooks for services which are a types.AsyncWebhookHandler are verified, answered with HTTP 202
+// and queued to be handled in the background, unless verification fails.
 func (wh *Webhook) Handle(w http.ResponseWriter, req *http.Request) {
-	log.WithField("path", req.URL.Path).Print("Incoming webhook request")
+	correlationID := logging.RequestCorrelationID(req)
+	w.Header().Set(logging.CorrelationIDHeader, correlationID)
+	ctx := logging.WithCorrelationID(req.Context(), correlationID)
+	req = req.WithContext(ctx)
+	logger := logging.Logger(ctx)
+	logger.WithField("path", req.URL.Path).Print("Incoming webhook request")
 	segments := strings.Split(req.URL.Path, "/")
 	// last path segment is the service ID which we will pass the incoming request to,
 	// but we've base64d it.
 	base64srvID := segments[len(segments)-1]
 	bytesSrvID, err := base64.RawURLEncoding.DecodeString(base64srvID)
 	if err != nil {
-		log.WithError(err).WithField("base64_service_id", base64srvID).Print(
+		logger.WithError(err).WithField("base64_service_id", base64srvID).Print(
 			"Not a b64 encoded string",
 		)
 		w.WriteHeader(400)
 		return
 	}
 	srvID := string(bytesSrvID)
+	tracing.FromContext(ctx).SetAttribute("service_id", srvID)
 
-	service, err := wh.db.LoadService(srvID)
+	_, loadSpan := tracing.Begin(ctx, "LoadCachedService", tracing.KindInternal)
+	service, err := wh.db.LoadCachedService(srvID)
+	loadSpan.SetError(err)
+	loadSpan.End()
 	if err != nil {
-		log.WithError(err).WithField("service_id", srvID).Print("Failed to load service")
+		logger.WithError(err).WithField("service_id", srvID).Print("Failed to load service")
 		w.WriteHeader(404)
 		return
 	}
+	req.Body = http.MaxBytesReader(w, req.Body, maxWebhookBodySize)
+	if pause, err := wh.db.LoadCachedServicePause(srvID); err == nil {
+		wh.handlePaused(w, req, pause)
+		return
+	} else if err != sql.ErrNoRows {
+		logger.WithError(err).WithField("service_id", srvID).Print("Failed to load service pause")
+		w.WriteHeader(500)
+		return
+	}
 	cli, err := wh.clients.Client(service.ServiceUserID())
 	if err != nil {
-		log.WithError(err).WithField("user_id", service.ServiceUserID()).Print(
+		logger.WithError(err).WithField("user_id", service.ServiceUserID()).Print(
 			"Failed to retrieve matrix client instance")
 		w.WriteHeader(500)
 		return
 	}
-	log.WithFields(log.Fields{
+	logger.WithFields(log.Fields{
 		"service_id":   service.ServiceID(),
 		"service_type": service.ServiceType(),
 	}).Print("Incoming webhook for service")
+	asyncHandler, async := service.(types.AsyncWebhookHandler)
+	var body []byte
+	if wh.journalRetention > 0 || async {
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			logger.WithError(err).Print("Failed to read webhook body")
+			if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+				w.WriteHeader(413)
+			} else {
+				w.WriteHeader(400)
+			}
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	deliveryID := ""
+	if wh.journalRetention > 0 {
+		header := make(http.Header, len(req.Header))
+		for name, values := range req.Header {
+			header[name] = values
+		}
+		for _, name := range journalOmittedHeaders {
+			header.Del(name)
+		}
+		deliveryID = randomID()
+		err = wh.db.StoreWebhookDelivery(api.WebhookDelivery{
+			ID:            deliveryID,
+			ServiceID:     service.ServiceID(),
+			CorrelationID: correlationID,
+			Method:        req.Method,
+			URL:           req.URL.RequestURI(),
+			Header:        header,
+			Body:          string(body),
+			Timestamp:     time.Now().UnixNano() / 1000000,
+		})
+		if err != nil {
+			// The webhook can still be processed, it just can't be replayed.
+			logger.WithError(err).Error("Failed to store webhook delivery")
+			deliveryID = ""
+		}
+	}
+	if async {
+		wh.enqueue(ctx, w, req, body, asyncHandler, deliveryID)
+		return
+	}
+	code, webhookErr := wh.deliver(ctx, w, req, service, cli)
+	status.Record(service.ServiceID(), status.KindWebhook, req.Method+" "+req.URL.Path, webhookErr)
+	if deliveryID != "" {
+		wh.storeOutcome(deliveryID, code, webhookErr, false)
+	}
+}
+
+// Replay passes a webhook delivery from the webhook journal to its service again, as if it had
+// just been received. The service must not be paused. The outcome is recorded in the journal and
+// the status of the service, and the response of the service is returned.
+func (wh *Webhook) Replay(ctx context.Context, service types.Service, delivery api.WebhookDelivery) (*httptest.ResponseRecorder, error) {
+	cli, err := wh.clients.Client(service.ServiceUserID())
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(delivery.Method, delivery.URL, strings.NewReader(delivery.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = delivery.Header
+	ctx = logging.WithCorrelationID(ctx, logging.NewCorrelationID())
+	req = req.WithContext(ctx)
+	logging.Logger(ctx).WithFields(log.Fields{
+		"service_id":              service.ServiceID(),
+		"delivery_id":             delivery.ID,
+		"original_correlation_id": delivery.CorrelationID,
+	}).Print("Replaying webhook delivery")
+
+	rec := httptest.NewRecorder()
+	code, webhookErr := wh.deliver(ctx, rec, req, service, cli)
+	status.Record(service.ServiceID(), status.KindWebhook, "replayed "+req.Method+" "+req.URL.Path, webhookErr)
+	wh.storeOutcome(delivery.ID, code, webhookErr, true)
+	return rec, nil
+}
+
+// deliver passes a webhook request to a service. Returns the HTTP status code the service
+// responded with, and an error if that status code is a failure.
+func (wh *Webhook) deliver(ctx context.Context, w http.ResponseWriter, req *http.Request, service types.Service, cli *gomatrix.Client) (int, error) {
 	metrics.IncrementWebhook(service.ServiceType())
-	service.OnReceiveWebhook(w, req, cli)
+	rec := &statusRecorder{ResponseWriter: w, code: 200}
+	start := time.Now()
+	hookCtx, hookSpan := tracing.Begin(ctx, "OnReceiveWebhook", tracing.KindInternal,
+		tracing.Attribute{"service_id", service.ServiceID()},
+		tracing.Attribute{"service_type", service.ServiceType()},
+	)
+	service.OnReceiveWebhook(rec, req, tracing.MatrixClient(hookCtx, status.Client(service.ServiceID(), cli)))
+	metrics.ObserveWebhook(service.ServiceType(), time.Since(start))
+	var webhookErr error
+	if rec.code >= 400 {
+		webhookErr = fmt.Errorf("responded with HTTP %d", rec.code)
+	}
+	hookSpan.SetError(webhookErr)
+	hookSpan.End()
+	return rec.code, webhookErr
+}
+
+// storeOutcome records the outcome of processing a webhook delivery in the webhook journal.
+func (wh *Webhook) storeOutcome(deliveryID string, code int, webhookErr error, replayed bool) {
+	errMsg := ""
+	if webhookErr != nil {
+		errMsg = webhookErr.Error()
+	}
+	if err := wh.db.StoreWebhookDeliveryOutcome(deliveryID, code, errMsg, replayed); err != nil {
+		log.WithError(err).WithField("delivery_id", deliveryID).Error("Failed to store webhook delivery outcome")
+	}
+}
+
+// randomID returns a new random ID for a webhook delivery or a queued webhook.
+func randomID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// statusRecorder remembers the status code which was written to an http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// handlePaused acknowledges a webhook for a paused service, so that the sender doesn't retry or
+// disable it. The webhook is queued if the pause asks for it, or otherwise dropped.
+func (wh *Webhook) handlePaused(w http.ResponseWriter, req *http.Request, pause api.ServicePause) {
+	logger := log.WithFields(log.Fields{
+		"service_id":     pause.ServiceID,
+		"queue_webhooks": pause.QueueWebhooks,
+	})
+	if !pause.QueueWebhooks {
+		logger.Print("Dropping webhook for paused service")
+		status.Record(pause.ServiceID, status.KindWebhook, "dropped while paused", nil)
+		w.WriteHeader(200)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithError(err).Print("Failed to read webhook body")
+		if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+			w.WriteHeader(413)
+		} else {
+			w.WriteHeader(400)
+		}
+		return
+	}
+	err = wh.db.StoreQueuedWebhook(api.QueuedWebhook{
+		ServiceID: pause.ServiceID,
+		Method:    req.Method,
+		URL:       req.URL.RequestURI(),
+		Header:    queuedHeader(req.Header),
+		Body:      body,
+		Timestamp: time.Now().UnixNano() / 1000000,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to queue webhook for paused service")
+		w.WriteHeader(500)
+		return
+	}
+	logger.Print("Queued webhook for paused service")
+	status.Record(pause.ServiceID, status.KindWebhook, "queued while paused", nil)
+	w.WriteHeader(200)
 }
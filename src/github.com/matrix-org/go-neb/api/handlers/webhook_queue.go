@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/tracing"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/util"
+)
+
+// Webhooks for services which are a types.AsyncWebhookHandler are queued in the database, so that
+// webhooks which have been acknowledged aren't lost if Go-NEB restarts, and can be handled by any
+// instance when several are running. Webhooks which were queued while a service was paused are
+// moved to the same queue when it is resumed, whatever the type of the service.
+const (
+	// webhookQueueWorkers is how many queued webhooks each instance handles at once.
+	webhookQueueWorkers = 10
+	// webhookQueueInterval is how often the queue is checked for webhooks which are due, if
+	// nothing is queued on this instance in the meantime.
+	webhookQueueInterval = 5 * time.Second
+	// webhookClaimTime is how long an instance has to handle a queued webhook before it may be
+	// handled again, e.g. because the instance died part way through.
+	webhookClaimTime = 5 * time.Minute
+	// maxWebhookAttempts is how many times handling a queued webhook may fail before it is given up on.
+	maxWebhookAttempts = 8
+	// The delay before handling a queued webhook again after it fails doubles each time it
+	// fails, between these limits.
+	minWebhookRetry = 30 * time.Second
+	maxWebhookRetry = time.Hour
+	// pausedWebhookRetry is how often a queued webhook for a paused service is checked, to see
+	// whether the service has been resumed.
+	pausedWebhookRetry = time.Minute
+)
+
+// queuedWebhookHeaders are the only headers which are kept with a queued webhook, as the rest
+// aren't needed to handle it and may hold credentials, e.g. Authorization or Cookie. "Signature"
+// is sent by Travis-CI.
+var queuedWebhookHeaders = []string{"Content-Type", "Signature", "X-GitHub-Event", "X-Hub-Signature"}
+
+// queuedHeader returns the queuedWebhookHeaders of a webhook request.
+func queuedHeader(reqHeader http.Header) http.Header {
+	header := make(http.Header)
+	for _, name := range queuedWebhookHeaders {
+		if value := reqHeader.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	return header
+}
+
+// enqueue verifies a webhook for a service which handles its webhooks in the background. If the
+// service accepts it, it is queued and answered with HTTP 202.
+func (wh *Webhook) enqueue(ctx context.Context, w http.ResponseWriter, req *http.Request, body []byte, handler types.AsyncWebhookHandler, deliveryID string) {
+	logger := logging.Logger(ctx).WithFields(log.Fields{
+		"service_id":   handler.ServiceID(),
+		"service_type": handler.ServiceType(),
+	})
+	metrics.IncrementWebhook(handler.ServiceType())
+	_, span := tracing.Begin(ctx, "VerifyWebhook", tracing.KindInternal,
+		tracing.Attribute{"service_id", handler.ServiceID()},
+		tracing.Attribute{"service_type", handler.ServiceType()},
+	)
+	if res := handler.VerifyWebhook(req, body); res != nil {
+		var verifyErr error
+		if res.Code >= 400 {
+			verifyErr = fmt.Errorf("responded with HTTP %d", res.Code)
+		}
+		span.SetError(verifyErr)
+		span.End()
+		logger.WithField("status_code", res.Code).Print("Answered webhook without queueing it")
+		status.Record(handler.ServiceID(), status.KindWebhook, req.Method+" "+req.URL.Path, verifyErr)
+		if deliveryID != "" {
+			wh.storeOutcome(deliveryID, res.Code, verifyErr, false)
+		}
+		writeJSONResponse(w, *res)
+		return
+	}
+	span.End()
+
+	now := time.Now().UnixNano() / 1000000
+	err := wh.db.StoreWebhookJob(api.WebhookJob{
+		ID:                   randomID(),
+		ServiceID:            handler.ServiceID(),
+		DeliveryID:           deliveryID,
+		CorrelationID:        logging.CorrelationID(ctx),
+		Method:               req.Method,
+		URL:                  req.URL.RequestURI(),
+		Header:               queuedHeader(req.Header),
+		Body:                 body,
+		Timestamp:            now,
+		NextAttemptTimestamp: now,
+	})
+	if err != nil {
+		// The sender will retry the webhook, as it hasn't been acknowledged.
+		logger.WithError(err).Error("Failed to queue webhook")
+		status.Record(handler.ServiceID(), status.KindWebhook, req.Method+" "+req.URL.Path, err)
+		w.WriteHeader(500)
+		return
+	}
+	logger.Print("Queued webhook")
+	select {
+	case wh.queued <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(202)
+}
+
+// StartQueue starts handling queued webhooks in the background.
+func (wh *Webhook) StartQueue() {
+	go wh.runQueue()
+}
+
+func (wh *Webhook) runQueue() {
+	ticker := time.NewTicker(webhookQueueInterval)
+	defer ticker.Stop()
+	for {
+		jobs, err := wh.db.ClaimWebhookJobs(webhookQueueWorkers, webhookClaimTime)
+		if err != nil {
+			log.WithError(err).Error("Failed to load queued webhooks")
+		}
+		var wg sync.WaitGroup
+		for _, job := range jobs {
+			wg.Add(1)
+			go func(job api.WebhookJob) {
+				defer wg.Done()
+				wh.handleJob(job)
+			}(job)
+		}
+		wg.Wait()
+		if len(jobs) == webhookQueueWorkers {
+			// There may be more which are due already.
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-wh.queued:
+		}
+	}
+}
+
+// handleJob passes a queued webhook to its service, and removes it from the queue once it has been
+// handled, or reschedules it if handling it failed.
+func (wh *Webhook) handleJob(job api.WebhookJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			wh.retryJob(log.WithField("job_id", job.ID), job, "", job.SentRooms, fmt.Errorf("panicked: %v", r))
+		}
+	}()
+	ctx := logging.WithCorrelationID(context.Background(), job.CorrelationID)
+	logger := logging.Logger(ctx).WithFields(log.Fields{
+		"service_id": job.ServiceID,
+		"job_id":     job.ID,
+	})
+	service, err := wh.db.LoadCachedService(job.ServiceID)
+	if err == sql.ErrNoRows {
+		logger.Print("Dropping queued webhook for deleted service")
+		wh.deleteJob(logger, job)
+		return
+	} else if err != nil {
+		wh.retryJob(logger, job, "", job.SentRooms, err)
+		return
+	}
+	if pause, err := servicePause(wh.db, job.ServiceID); err != nil {
+		wh.retryJob(logger, job, service.ServiceType(), job.SentRooms, err)
+		return
+	} else if pause != nil && !pause.QueueWebhooks {
+		logger.Print("Dropping queued webhook for paused service")
+		status.Record(job.ServiceID, status.KindWebhook, "dropped while paused", nil)
+		wh.deleteJob(logger, job)
+		return
+	} else if pause != nil {
+		// Hold on to the webhook until the service is resumed, without counting this as a failure.
+		err = wh.db.RescheduleWebhookJob(job.ID, job.Attempts, time.Now().Add(pausedWebhookRetry), "service is paused", job.SentRooms)
+		if err != nil {
+			logger.WithError(err).Error("Failed to reschedule queued webhook")
+		}
+		return
+	}
+	cli, err := wh.clients.Client(service.ServiceUserID())
+	if err != nil {
+		wh.retryJob(logger, job, service.ServiceType(), job.SentRooms, err)
+		return
+	}
+	req, err := http.NewRequest(job.Method, job.URL, bytes.NewReader(job.Body))
+	if err != nil {
+		logger.WithError(err).Error("Dropping queued webhook which can't be rebuilt")
+		wh.deleteJob(logger, job)
+		return
+	}
+	req.Header = job.Header
+	req = req.WithContext(ctx)
+
+	handler, ok := service.(types.AsyncWebhookHandler)
+	if !ok {
+		// Webhooks which were queued while the service was paused. Their sender has long since
+		// been answered, so the response is only used to tell whether handling them failed.
+		code, err := wh.deliver(ctx, httptest.NewRecorder(), req, service, cli)
+		status.Record(service.ServiceID(), status.KindWebhook, "queued "+job.Method+" "+req.URL.Path, err)
+		if code >= 500 {
+			wh.retryJob(logger, job, service.ServiceType(), job.SentRooms, err)
+			return
+		}
+		// The service rejected the webhook if it responded with a 4xx, so it isn't retried.
+		logger.WithField("status_code", code).Print("Handled queued webhook")
+		wh.deleteJob(logger, job)
+		return
+	}
+	start := time.Now()
+	hookCtx, span := tracing.Begin(ctx, "HandleWebhook", tracing.KindInternal,
+		tracing.Attribute{"service_id", service.ServiceID()},
+		tracing.Attribute{"service_type", service.ServiceType()},
+	)
+	progress := types.NewWebhookProgress(job.SentRooms)
+	err = handler.HandleWebhook(req, job.Body, tracing.MatrixClient(hookCtx, status.Client(service.ServiceID(), cli)), progress)
+	metrics.ObserveWebhook(service.ServiceType(), time.Since(start))
+	span.SetError(err)
+	span.End()
+	status.Record(service.ServiceID(), status.KindWebhook, "queued "+job.Method+" "+req.URL.Path, err)
+	if job.DeliveryID != "" {
+		code := 200
+		if err != nil {
+			code = 500
+		}
+		wh.storeOutcome(job.DeliveryID, code, err, false)
+	}
+	if err != nil {
+		wh.retryJob(logger, job, service.ServiceType(), progress.SentRooms(), err)
+		return
+	}
+	logger.Print("Handled queued webhook")
+	wh.deleteJob(logger, job)
+}
+
+// retryJob reschedules a queued webhook after handling it failed, having sent it into sentRooms,
+// or gives up on it if it has failed too many times.
+func (wh *Webhook) retryJob(logger *log.Entry, job api.WebhookJob, serviceType string, sentRooms []string, jobErr error) {
+	attempts := job.Attempts + 1
+	logger = logger.WithError(jobErr).WithField("attempts", attempts)
+	if attempts >= maxWebhookAttempts {
+		logger.Error("Giving up on queued webhook")
+		metrics.IncrementWebhookAbandoned(serviceType)
+		wh.deleteJob(logger, job)
+		return
+	}
+	delay := wh.retryDelay(attempts)
+	logger.WithField("retry_in", delay).Warn("Failed to handle queued webhook")
+	metrics.IncrementWebhookRetry(serviceType)
+	if err := wh.db.RescheduleWebhookJob(job.ID, attempts, time.Now().Add(delay), jobErr.Error(), sentRooms); err != nil {
+		// It will be handled again once the claim on it runs out.
+		logger.WithError(err).Error("Failed to reschedule queued webhook")
+	}
+}
+
+func (wh *Webhook) deleteJob(logger *log.Entry, job api.WebhookJob) {
+	if err := wh.db.DeleteWebhookJob(job.ID); err != nil {
+		// It will be handled again once the claim on it runs out.
+		logger.WithError(err).Error("Failed to remove webhook from queue")
+	}
+}
+
+// webhookRetryDelay returns how long to wait before handling a queued webhook again after it has
+// failed the given number of times.
+func webhookRetryDelay(attempts int) time.Duration {
+	d := minWebhookRetry
+	for i := 1; i < attempts && d < maxWebhookRetry; i++ {
+		d *= 2
+	}
+	if d > maxWebhookRetry {
+		d = maxWebhookRetry
+	}
+	return d
+}
+
+// writeJSONResponse writes a response in the same way as util.MakeJSONAPI.
+func writeJSONResponse(w http.ResponseWriter, res util.JSONResponse) {
+	for name, value := range res.Headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Code)
+	if err := json.NewEncoder(w).Encode(res.JSON); err != nil {
+		log.WithError(err).Error("Failed to write webhook response")
+	}
+}
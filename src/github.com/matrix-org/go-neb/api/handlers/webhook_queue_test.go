@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const asyncTestServiceType = "async-webhook-test"
+
+// asyncTestService sends every webhook into each of its rooms.
+type asyncTestService struct {
+	types.DefaultService
+	Rooms []string
+}
+
+func (s *asyncTestService) VerifyWebhook(req *http.Request, body []byte) *util.JSONResponse {
+	if req.Header.Get("X-Hub-Signature") != "good" {
+		res := util.MessageResponse(403, "Bad signature")
+		return &res
+	}
+	return nil
+}
+
+func (s *asyncTestService) HandleWebhook(req *http.Request, body []byte, cli *gomatrix.Client, progress *types.WebhookProgress) error {
+	for _, roomID := range s.Rooms {
+		progress.SendMessageEvent(cli, roomID, "m.room.message", gomatrix.TextMessage{MsgType: "m.notice", Body: string(body)})
+	}
+	return progress.Err()
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &asyncTestService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, asyncTestServiceType)}
+	})
+}
+
+// testHomeserver counts the messages sent into each room. Sending into "!forbidden" always fails
+// with 403, and sending into "!flaky" fails with 502 while flaky is true.
+type testHomeserver struct {
+	mu    sync.Mutex
+	sent  map[string]int
+	flaky bool
+}
+
+func (h *testHomeserver) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	segs := strings.Split(req.URL.Path, "/")
+	var roomID string
+	for i, seg := range segs {
+		if seg == "rooms" && i+1 < len(segs) {
+			roomID = segs[i+1]
+		}
+	}
+	code, body := 200, `{"event_id":"$ev"}`
+	switch {
+	case roomID == "!forbidden":
+		code, body = 403, `{"errcode":"M_FORBIDDEN","error":"not in room"}`
+	case roomID == "!flaky" && h.flaky:
+		code, body = 502, `Bad Gateway`
+	default:
+		h.sent[roomID]++
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    req,
+	}, nil
+}
+
+func (h *testHomeserver) count(roomID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sent[roomID]
+}
+
+func newQueueTest(t *testing.T, rooms ...string) (*Webhook, *database.ServiceDB, *testHomeserver, string) {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	hs := &testHomeserver{sent: make(map[string]int), flaky: true}
+	_, err = db.StoreMatrixClientConfig(api.ClientConfig{
+		UserID:        "@bot:localhost",
+		HomeserverURL: "https://hs.localhost",
+		AccessToken:   "token",
+	})
+	if err != nil {
+		t.Fatalf("failed to store client: %s", err)
+	}
+	service := &asyncTestService{
+		DefaultService: types.NewDefaultService("svc", "@bot:localhost", asyncTestServiceType),
+		Rooms:          rooms,
+	}
+	if _, err = db.StoreService(service); err != nil {
+		t.Fatalf("failed to store service: %s", err)
+	}
+	wh := NewWebhook(db, clients.New(db, &http.Client{Transport: hs}))
+	// Make retries due straight away.
+	wh.retryDelay = func(attempts int) time.Duration { return 0 }
+	return wh, db, hs, "/services/hooks/" + base64.RawURLEncoding.EncodeToString([]byte("svc"))
+}
+
+func postWebhook(wh *Webhook, path, signature, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature", signature)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rec := httptest.NewRecorder()
+	wh.Handle(rec, req)
+	return rec
+}
+
+// runDueJobs handles every queued webhook which is due. Returns them as they were before being
+// handled.
+func runDueJobs(t *testing.T, wh *Webhook, db *database.ServiceDB) []api.WebhookJob {
+	jobs, err := db.ClaimWebhookJobs(100, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to claim jobs: %s", err)
+	}
+	for _, job := range jobs {
+		wh.handleJob(job)
+	}
+	return jobs
+}
+
+func TestQueuedWebhookIsOnlyRetriedForFailedRooms(t *testing.T) {
+	wh, db, hs, path := newQueueTest(t, "!ok", "!forbidden", "!flaky")
+
+	if rec := postWebhook(wh, path, "bad", "event"); rec.Code != 403 {
+		t.Fatalf("want a bad signature to be rejected with 403, got %d", rec.Code)
+	}
+	if jobs := runDueJobs(t, wh, db); len(jobs) != 0 {
+		t.Fatalf("want nothing queued for a rejected webhook, got %+v", jobs)
+	}
+
+	if rec := postWebhook(wh, path, "good", "event"); rec.Code != 202 {
+		t.Fatalf("want the webhook to be acknowledged with 202, got %d", rec.Code)
+	}
+	if jobs := runDueJobs(t, wh, db); len(jobs) != 1 {
+		t.Fatalf("want 1 queued webhook, got %+v", jobs)
+	} else if jobs[0].Header.Get("X-Hub-Signature") != "good" || jobs[0].Header.Get("Authorization") != "" {
+		t.Errorf("want only the headers needed to handle the webhook to be queued, got %v", jobs[0].Header)
+	}
+	if hs.count("!ok") != 1 || hs.count("!flaky") != 0 {
+		t.Fatalf("want only !ok to get the webhook, got %v", hs.sent)
+	}
+
+	// !flaky failed with 502, so the webhook is retried, but only for the rooms which failed.
+	hs.flaky = false
+	jobs := runDueJobs(t, wh, db)
+	if len(jobs) != 1 || jobs[0].Attempts != 1 || len(jobs[0].SentRooms) != 1 || jobs[0].SentRooms[0] != "!ok" {
+		t.Fatalf("want the webhook to be retried after sending into !ok, got %+v", jobs)
+	}
+	if hs.count("!ok") != 1 || hs.count("!flaky") != 1 {
+		t.Errorf("want each room to get the webhook exactly once, got %v", hs.sent)
+	}
+	// !forbidden failing with 403 isn't worth retrying, so the webhook is done.
+	if jobs := runDueJobs(t, wh, db); len(jobs) != 0 {
+		t.Errorf("want the webhook to be done, got %+v", jobs)
+	}
+}
+
+func TestQueuedWebhookIsGivenUpOn(t *testing.T) {
+	wh, db, hs, path := newQueueTest(t, "!ok", "!flaky")
+	if rec := postWebhook(wh, path, "good", "event"); rec.Code != 202 {
+		t.Fatalf("want the webhook to be acknowledged with 202, got %d", rec.Code)
+	}
+	for attempt := 1; attempt <= maxWebhookAttempts; attempt++ {
+		jobs := runDueJobs(t, wh, db)
+		if len(jobs) != 1 || jobs[0].Attempts != attempt-1 {
+			t.Fatalf("attempt %d: want 1 queued webhook which failed %d times, got %+v", attempt, attempt-1, jobs)
+		}
+	}
+	if jobs := runDueJobs(t, wh, db); len(jobs) != 0 {
+		t.Errorf("want the webhook to be given up on after %d attempts, got %+v", maxWebhookAttempts, jobs)
+	}
+	if hs.count("!ok") != 1 {
+		t.Errorf("want !ok to get the webhook once, got %d", hs.count("!ok"))
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, minWebhookRetry},
+		{2, 2 * minWebhookRetry},
+		{20, maxWebhookRetry},
+	} {
+		if got := webhookRetryDelay(tc.attempts); got != tc.want {
+			t.Errorf("TestWebhookRetryDelay: %d attempts: want %s, got %s", tc.attempts, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+)
+
+func TestWebhookJournalOmitsCredentials(t *testing.T) {
+	wh, db, _, path := newQueueTest(t, "!ok")
+	wh.SetJournalRetention(time.Hour)
+
+	if rec := postWebhook(wh, path, "good", "event"); rec.Code != 202 {
+		t.Fatalf("want the webhook to be acknowledged with 202, got %d", rec.Code)
+	}
+	deliveries, err := db.LoadWebhookDeliveries("svc", 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("want 1 webhook in the journal, got %+v (err %v)", deliveries, err)
+	}
+	if deliveries[0].Header.Get("X-Hub-Signature") != "good" || deliveries[0].Header.Get("Authorization") != "" {
+		t.Errorf("want the journal to keep the signature but not the Authorization header, got %v", deliveries[0].Header)
+	}
+}
+
+func TestWebhookTooLarge(t *testing.T) {
+	wh, db, _, path := newQueueTest(t, "!ok")
+	if rec := postWebhook(wh, path, "good", strings.Repeat("a", maxWebhookBodySize+1)); rec.Code != 413 {
+		t.Fatalf("want a webhook which is too large to be rejected with 413, got %d", rec.Code)
+	}
+	if jobs := runDueJobs(t, wh, db); len(jobs) != 0 {
+		t.Errorf("want nothing queued for a webhook which is too large, got %+v", jobs)
+	}
+}
+
+func TestPausedWebhookIsQueued(t *testing.T) {
+	wh, db, hs, path := newQueueTest(t, "!ok")
+	if err := db.StoreServicePause(api.ServicePause{ServiceID: "svc", QueueWebhooks: true}); err != nil {
+		t.Fatalf("failed to pause service: %s", err)
+	}
+
+	if rec := postWebhook(wh, path, "good", strings.Repeat("a", maxWebhookBodySize+1)); rec.Code != 413 {
+		t.Fatalf("want a webhook which is too large to be rejected with 413, got %d", rec.Code)
+	}
+	if rec := postWebhook(wh, path, "good", "\xff\x00event"); rec.Code != 200 {
+		t.Fatalf("want the webhook to be acknowledged with 200, got %d", rec.Code)
+	}
+	if jobs := runDueJobs(t, wh, db); len(jobs) != 0 {
+		t.Fatalf("want nothing handled while the service is paused, got %+v", jobs)
+	}
+	if queued, err := db.DeleteServicePause("svc"); err != nil || queued != 1 {
+		t.Fatalf("want 1 queued webhook, got %d (err %v)", queued, err)
+	}
+	jobs := runDueJobs(t, wh, db)
+	if len(jobs) != 1 {
+		t.Fatalf("want the queued webhook to be handled after resuming, got %+v", jobs)
+	}
+	if string(jobs[0].Body) != "\xff\x00event" {
+		t.Errorf("want the body to be queued unchanged, got %q", jobs[0].Body)
+	}
+	if jobs[0].Header.Get("X-Hub-Signature") != "good" || jobs[0].Header.Get("Authorization") != "" {
+		t.Errorf("want only the headers needed to handle the webhook to be queued, got %v", jobs[0].Header)
+	}
+	if hs.sent["!ok"] != 1 {
+		t.Errorf("want the queued webhook to be sent into the room, got %v", hs.sent)
+	}
+	if jobs = runDueJobs(t, wh, db); len(jobs) != 0 {
+		t.Errorf("want the queued webhook to be removed once handled, got %+v", jobs)
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// UnmarshalYAML parses YAML into the given NEB type.
+func UnmarshalYAML(data []byte, v interface{}) error {
+	// ::Horrible hacks ahead::
+	// The config is represented as YAML, and we want to convert that into NEB types.
+	// However, NEB types make liberal use of json.RawMessage which the YAML parser
+	// doesn't like. We can't implement MarshalYAML/UnmarshalYAML as a custom type easily
+	// because YAML is insane and supports numbers as keys. The YAML parser therefore has the
+	// generic form of map[interface{}]interface{} - but the JSON parser doesn't know
+	// how to parse that.
+	//
+	// The hack that follows gets around this by type asserting all parsed YAML keys as
+	// strings then re-encoding/decoding as JSON. That is:
+	// YAML bytes -> map[interface]interface -> map[string]interface -> JSON bytes -> NEB types
+
+	// Convert to map[interface]interface
+	var cfg map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("Failed to unmarshal YAML: %s", err)
+	}
+
+	// Convert to map[string]interface
+	dict := convertKeysToStrings(cfg)
+
+	// Convert to JSON bytes
+	b, err := json.Marshal(dict)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal config as JSON: %s", err)
+	}
+
+	// Finally, Convert to NEB types
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("Failed to convert to config file: %s", err)
+	}
+	return nil
+}
+
+// MarshalYAML converts the given NEB type into YAML. This is the reverse of UnmarshalYAML: the
+// type is encoded as JSON first so that json.RawMessage fields and JSON struct tags are respected.
+// Map keys are sorted.
+func MarshalYAML(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err = json.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+func convertKeysToStrings(iface interface{}) interface{} {
+	obj, isObj := iface.(map[interface{}]interface{})
+	if isObj {
+		strObj := make(map[string]interface{})
+		for k, v := range obj {
+			strObj[k.(string)] = convertKeysToStrings(v) // handle nested objects
+		}
+		return strObj
+	}
+
+	arr, isArr := iface.([]interface{})
+	if isArr {
+		for i := range arr {
+			arr[i] = convertKeysToStrings(arr[i]) // handle nested objects
+		}
+		return arr
+	}
+	return iface // base type like string or number
+}
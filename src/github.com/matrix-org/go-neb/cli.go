@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+)
+
+const cliUsage = `Usage:
+  go-neb                          Run Go-NEB, configured by environment variables.
+  go-neb export [-redact] [-o F]  Write the contents of DATABASE_URL to stdout (or F) as a config file.
+  go-neb import [-url U] FILE     Import a config file into a running Go-NEB via /admin/import.
+  go-neb --migrate-only           Apply any pending schema migrations to DATABASE_URL and exit.
+  go-neb reencrypt                Encrypt every secret in DATABASE_URL with the first ENCRYPTION_KEYS key.
+`
+
+// runCommand runs the given go-neb subcommand and returns the exit code.
+func runCommand(e envVars, command string, args []string) int {
+	var err error
+	switch command {
+	case "export":
+		err = exportCommand(e, args)
+	case "import":
+		err = importCommand(args)
+	case "--migrate-only", "-migrate-only":
+		err = migrateCommand(e)
+	case "reencrypt":
+		err = reencryptCommand(e)
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "go-neb %s: %s\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+// migrateCommand applies any pending schema migrations, so that upgrades can be run as a separate
+// step before starting the new version of Go-NEB.
+func migrateCommand(e envVars) error {
+	db, err := database.Open(e.DatabaseType, e.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database schema is at version %d\n", version)
+	return nil
+}
+
+// reencryptCommand rewrites every secret in the database which isn't encrypted with the current
+// master key, after encryption is first turned on or a new key is added. Go-NEB should be stopped
+// while this runs, so that it doesn't write values with the old key at the same time.
+func reencryptCommand(e envVars) error {
+	db, err := openDatabase(e, database.Open)
+	if err != nil {
+		return err
+	}
+	count, err := db.Reencrypt()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Re-encrypted %d rows\n", count)
+	return nil
+}
+
+// openDatabase opens DATABASE_URL with open and the encryption keys, if any, so that secrets can
+// be read.
+func openDatabase(e envVars, open func(databaseType, databaseURL string) (*database.ServiceDB, error)) (*database.ServiceDB, error) {
+	keys, err := loadKeyring(e)
+	if err != nil {
+		return nil, err
+	}
+	db, err := open(e.DatabaseType, e.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	db.SetKeyring(keys)
+	return db, nil
+}
+
+// exportCommand dumps the database as a config file. This reads the database directly, so
+// it works whether or not Go-NEB is running. The schema isn't migrated, so exporting never
+// changes the database: it fails if schema migrations are pending.
+func exportCommand(e envVars, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	redact := flags.Bool("redact", false, "Replace access tokens, API keys and other secrets with \""+api.RedactedValue+"\"")
+	out := flags.String("o", "", "The file to write to. Defaults to stdout.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// The base URL is only used to work out webhook URLs for services, which aren't exported,
+	// so don't insist on it.
+	types.BaseURL(e.BaseURL)
+
+	db, err := openDatabase(e, database.OpenWithoutMigrating)
+	if err != nil {
+		return err
+	}
+	cfg, err := database.Export(db)
+	if err != nil {
+		return err
+	}
+	if *redact {
+		if err = cfg.Redact(); err != nil {
+			return err
+		}
+	}
+	b, err := api.MarshalYAML(cfg)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(*out, b, 0600)
+}
+
+// importCommand sends a config file to a running Go-NEB, so that it goes through exactly the same
+// checks as configuring things via the /admin HTTP API. The admin token, if one is needed, is
+// read from ADMIN_TOKEN.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	baseURL := flags.String("url", "http://localhost:4050", "The URL which Go-NEB's /admin HTTP API is listening on.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a single config file to import")
+	}
+
+	contents, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	reqBody, err := json.Marshal(struct {
+		YAML string
+	}{string(contents)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(*baseURL, "/")+"/admin/import", bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("HTTP %d: %s", res.StatusCode, resBody)
+	}
+	fmt.Printf("%s\n", resBody)
+	return nil
+}
@@ -1,6 +1,7 @@
 package clients
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
@@ -11,8 +12,11 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 	shellwords "github.com/mattn/go-shellwords"
@@ -25,6 +29,12 @@ type Clients struct {
 	dbMutex    sync.Mutex
 	mapMutex   sync.Mutex
 	clients    map[string]clientEntry
+	// True if this instance doesn't run /sync loops, e.g. because another instance is the leader.
+	syncDisabled bool
+	// Returns commands which are run for every client, regardless of its services.
+	builtinCommands func(cli *gomatrix.Client) []types.Command
+	healthMutex     sync.Mutex
+	syncStates      map[string]SyncState // user_id => SyncState
 }
 
 // New makes a new collection of matrix clients
@@ -33,10 +43,17 @@ func New(db database.Storer, cli *http.Client) *Clients {
 		db:         db,
 		httpClient: cli,
 		clients:    make(map[string]clientEntry), // user_id => clientEntry
+		syncStates: make(map[string]SyncState),
 	}
 	return clients
 }
 
+// SetBuiltinCommands sets a function which returns commands to run for every client, in addition
+// to the commands of its services.
+func (c *Clients) SetBuiltinCommands(cmds func(cli *gomatrix.Client) []types.Command) {
+	c.builtinCommands = cmds
+}
+
 // Client gets a client for the userID
 func (c *Clients) Client(userID string) (*gomatrix.Client, error) {
 	entry := c.getClient(userID)
@@ -53,6 +70,32 @@ func (c *Clients) Update(config api.ClientConfig) (api.ClientConfig, error) {
 	return old.config, err
 }
 
+// Remove stops the /sync stream for a matrix client, if any, and deletes its config.
+// It is up to the caller to make sure that no services still use this client.
+// Returns the removed config.
+func (c *Clients) Remove(userID string) (api.ClientConfig, error) {
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+
+	config, err := c.db.LoadMatrixClientConfig(userID)
+	if err != nil {
+		return config, err
+	}
+	if err = c.db.DeleteMatrixClientConfig(userID); err != nil {
+		return config, err
+	}
+
+	c.mapMutex.Lock()
+	entry := c.clients[userID]
+	delete(c.clients, userID)
+	c.mapMutex.Unlock()
+
+	if entry.client != nil && entry.syncing {
+		entry.client.StopSync()
+	}
+	return config, nil
+}
+
 // Start listening on client /sync streams
 func (c *Clients) Start() error {
 	configs, err := c.db.LoadMatrixClientConfigs()
@@ -69,9 +112,69 @@ func (c *Clients) Start() error {
 	return nil
 }
 
+// SetSyncing sets whether this instance runs the /sync loops of clients which are configured to
+// sync. Clients can still be used to send messages when it doesn't. Defaults to true.
+func (c *Clients) SetSyncing(enabled bool) error {
+	c.mapMutex.Lock()
+	c.syncDisabled = !enabled
+	c.mapMutex.Unlock()
+	return c.Reconcile()
+}
+
+// Reconcile brings the clients of this instance up to date with the database, e.g. because they
+// were configured through another Go-NEB instance which shares the database. Clients which have
+// changed or been deleted are dropped, stopping their /sync loops, and if this instance is syncing,
+// /sync loops are started for any syncing clients which don't have one.
+func (c *Clients) Reconcile() error {
+	configs, err := c.db.LoadMatrixClientConfigs()
+	if err != nil {
+		return err
+	}
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+
+	stored := make(map[string]api.ClientConfig)
+	for _, cfg := range configs {
+		stored[cfg.UserID] = cfg
+	}
+	c.mapMutex.Lock()
+	syncing := !c.syncDisabled
+	var dropped []clientEntry
+	for userID, entry := range c.clients {
+		cfg, ok := stored[userID]
+		if !ok || cfg != entry.config || entry.syncing != (syncing && cfg.Sync) {
+			delete(c.clients, userID)
+			dropped = append(dropped, entry)
+		}
+	}
+	c.mapMutex.Unlock()
+	for _, entry := range dropped {
+		if entry.syncing {
+			entry.client.StopSync()
+		}
+	}
+
+	if !syncing {
+		return nil
+	}
+	for _, cfg := range configs {
+		if !cfg.Sync || c.getClient(cfg.UserID).client != nil {
+			continue
+		}
+		entry := clientEntry{config: cfg, syncing: true}
+		if entry.client, err = c.newClient(cfg, true); err != nil {
+			return err
+		}
+		c.setClient(entry)
+	}
+	return nil
+}
+
 type clientEntry struct {
 	config api.ClientConfig
 	client *gomatrix.Client
+	// True if this instance is running the client's /sync loop.
+	syncing bool
 }
 
 func (c *Clients) getClient(userID string) clientEntry {
@@ -80,6 +183,13 @@ func (c *Clients) getClient(userID string) clientEntry {
 	return c.clients[userID]
 }
 
+// shouldSync returns true if this instance should run the /sync loop of a client with the config.
+func (c *Clients) shouldSync(config api.ClientConfig) bool {
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	return config.Sync && !c.syncDisabled
+}
+
 func (c *Clients) setClient(client clientEntry) {
 	c.mapMutex.Lock()
 	defer c.mapMutex.Unlock()
@@ -102,7 +212,8 @@ func (c *Clients) loadClientFromDB(userID string) (entry clientEntry, err error)
 		return
 	}
 
-	if entry.client, err = c.newClient(entry.config); err != nil {
+	entry.syncing = c.shouldSync(entry.config)
+	if entry.client, err = c.newClient(entry.config, entry.syncing); err != nil {
 		return
 	}
 
@@ -122,8 +233,9 @@ func (c *Clients) updateClientInDB(newConfig api.ClientConfig) (new clientEntry,
 	}
 
 	new.config = newConfig
+	new.syncing = c.shouldSync(new.config)
 
-	if new.client, err = c.newClient(new.config); err != nil {
+	if new.client, err = c.newClient(new.config, new.syncing); err != nil {
 		return
 	}
 
@@ -140,13 +252,14 @@ func (c *Clients) updateClientInDB(newConfig api.ClientConfig) (new clientEntry,
 	}
 
 	if old.config, err = c.db.StoreMatrixClientConfig(new.config); err != nil {
-		new.client.StopSync()
+		if new.syncing {
+			new.client.StopSync()
+		}
 		return
 	}
 
-	if old.client != nil {
+	if old.client != nil && old.syncing {
 		old.client.StopSync()
-		return
 	}
 
 	c.setClient(new)
@@ -154,9 +267,21 @@ func (c *Clients) updateClientInDB(newConfig api.ClientConfig) (new clientEntry,
 }
 
 func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event) {
-	services, err := c.db.LoadServicesForUser(client.UserID)
+	ctx := logging.WithCorrelationID(context.Background(), logging.NewCorrelationID())
+	logger := logging.Logger(ctx)
+	ctx, span := tracing.Begin(ctx, "m.room.message", tracing.KindInternal,
+		tracing.Attribute{"room_id", event.RoomID},
+		tracing.Attribute{"event_id", event.ID},
+		tracing.Attribute{"service_user_id", client.UserID},
+	)
+	defer span.End()
+
+	_, loadSpan := tracing.Begin(ctx, "LoadCachedServicesForUser", tracing.KindInternal)
+	services, err := c.db.LoadCachedServicesForUser(client.UserID)
+	loadSpan.SetError(err)
+	loadSpan.End()
 	if err != nil {
-		log.WithFields(log.Fields{
+		logger.WithFields(log.Fields{
 			log.ErrorKey:      err,
 			"room_id":         event.RoomID,
 			"service_user_id": client.UserID,
@@ -179,27 +304,53 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 	body = strings.Replace(body, `“`, `"`, -1)
 	body = strings.Replace(body, `”`, `"`, -1)
 
-	var responses []interface{}
+	// Responses are sent by the client which the service was given, so that sends are tracked.
+	type response struct {
+		client  *gomatrix.Client
+		content interface{}
+	}
+	var responses []response
 
-	for _, service := range services {
-		if body[0] == '!' { // message is a command
-			args, err := shellwords.Parse(body[1:])
-			if err != nil {
-				args = strings.Split(body[1:], " ")
+	var args []string
+	if body[0] == '!' { // message is a command
+		args, err = shellwords.Parse(body[1:])
+		if err != nil {
+			args = strings.Split(body[1:], " ")
+		}
+		if c.builtinCommands != nil {
+			_, cmdSpan := tracing.Begin(ctx, "command", tracing.KindInternal)
+			if content := runCommandForService(ctx, c.builtinCommands(client), event, args, ""); content != nil {
+				responses = append(responses, response{tracing.MatrixClient(ctx, client), content})
 			}
+			cmdSpan.End()
+		}
+	}
 
-			if response := runCommandForService(service.Commands(client), event, args); response != nil {
-				responses = append(responses, response)
+	for _, service := range services {
+		if _, err := c.db.LoadCachedServicePause(service.ServiceID()); err == nil {
+			continue // paused services ignore commands and expansions
+		}
+		serviceCtx, serviceSpan := tracing.Begin(ctx, "command", tracing.KindInternal,
+			tracing.Attribute{"service_id", service.ServiceID()},
+			tracing.Attribute{"service_type", service.ServiceType()},
+		)
+		serviceClient := tracing.MatrixClient(serviceCtx, status.Client(service.ServiceID(), client))
+		if body[0] == '!' { // message is a command
+			if content := runCommandForService(ctx, service.Commands(serviceClient), event, args, service.ServiceID()); content != nil {
+				responses = append(responses, response{serviceClient, content})
 			}
 		} else { // message isn't a command, it might need expanding
-			expansions := runExpansionsForService(service.Expansions(client), event, body)
-			responses = append(responses, expansions...)
+			for _, content := range runExpansionsForService(service.Expansions(serviceClient), event, body) {
+				responses = append(responses, response{serviceClient, content})
+			}
 		}
+		serviceSpan.End()
 	}
 
-	for _, content := range responses {
-		if _, err := client.SendMessageEvent(event.RoomID, "m.room.message", content); err != nil {
-			log.WithFields(log.Fields{
+	for _, res := range responses {
+		content := res.content
+		if _, err := res.client.SendMessageEvent(event.RoomID, "m.room.message", content); err != nil {
+			logger.WithFields(log.Fields{
 				log.ErrorKey: err,
 				"room_id":    event.RoomID,
 				"user_id":    event.Sender,
@@ -212,8 +363,9 @@ func (c *Clients) onMessageEvent(client *gomatrix.Client, event *gomatrix.Event)
 // runCommandForService runs a single command read from a matrix event. Runs
 // the matching command with the longest path. Returns the JSON encodable
 // content of a single matrix message event to use as a response or nil if no
-// response is appropriate.
-func runCommandForService(cmds []types.Command, event *gomatrix.Event, arguments []string) interface{} {
+// response is appropriate. The outcome is recorded in the status of the service
+// with the given ID, if any, and logged with the correlation ID in ctx.
+func runCommandForService(ctx context.Context, cmds []types.Command, event *gomatrix.Event, arguments []string, serviceID string) interface{} {
 	var bestMatch *types.Command
 	for i, command := range cmds {
 		matches := command.Matches(arguments)
@@ -228,15 +380,22 @@ func runCommandForService(cmds []types.Command, event *gomatrix.Event, arguments
 	}
 
 	cmdArgs := arguments[len(bestMatch.Path):]
-	log.WithFields(log.Fields{
+	logger := logging.Logger(ctx)
+	logger.WithFields(log.Fields{
 		"room_id": event.RoomID,
 		"user_id": event.Sender,
 		"command": bestMatch.Path,
 	}).Info("Executing command")
+	start := time.Now()
 	content, err := bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	took := time.Since(start)
+	cmdPath := strings.Join(bestMatch.Path, " ")
+	if serviceID != "" {
+		status.Record(serviceID, status.KindCommand, cmdPath, err)
+	}
 	if err != nil {
 		if content != nil {
-			log.WithFields(log.Fields{
+			logger.WithFields(log.Fields{
 				log.ErrorKey: err,
 				"room_id":    event.RoomID,
 				"user_id":    event.Sender,
@@ -245,9 +404,11 @@ func runCommandForService(cmds []types.Command, event *gomatrix.Event, arguments
 			}).Warn("Command returned both error and content.")
 		}
 		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusFailure)
+		metrics.ObserveCommand(cmdPath, metrics.StatusFailure, took)
 		content = gomatrix.TextMessage{"m.notice", err.Error()}
 	} else {
 		metrics.IncrementCommand(bestMatch.Path[0], metrics.StatusSuccess)
+		metrics.ObserveCommand(cmdPath, metrics.StatusSuccess, took)
 	}
 
 	return content
@@ -328,12 +489,16 @@ func (c *Clients) onRoomMemberEvent(client *gomatrix.Client, event *gomatrix.Eve
 	}
 }
 
-func (c *Clients) newClient(config api.ClientConfig) (*gomatrix.Client, error) {
+// newClient makes a client with the config, and starts its /sync loop if sync is true.
+func (c *Clients) newClient(config api.ClientConfig, sync bool) (*gomatrix.Client, error) {
 	client, err := gomatrix.NewClient(config.HomeserverURL, config.UserID, config.AccessToken)
 	if err != nil {
 		return nil, err
 	}
-	client.Client = c.httpClient
+	// Trace every request to the homeserver.
+	httpClient := *c.httpClient
+	httpClient.Transport = &sendFailureRecorder{tracing.MatrixTransport(httpClient.Transport, config.HomeserverURL)}
+	client.Client = &httpClient
 	syncer := client.Syncer.(*gomatrix.DefaultSyncer)
 	nebStore := &matrix.NEBStore{
 		InMemoryStore: *gomatrix.NewInMemoryStore(),
@@ -342,6 +507,7 @@ func (c *Clients) newClient(config api.ClientConfig) (*gomatrix.Client, error) {
 	}
 	client.Store = nebStore
 	syncer.Store = nebStore
+	client.Syncer = &healthSyncer{syncer, c}
 
 	// TODO: Check that the access token is valid for the userID by peforming
 	// a request against the server.
@@ -362,20 +528,26 @@ func (c *Clients) newClient(config api.ClientConfig) (*gomatrix.Client, error) {
 
 	log.WithFields(log.Fields{
 		"user_id":         config.UserID,
-		"sync":            config.Sync,
+		"sync":            sync,
 		"auto_join_rooms": config.AutoJoinRooms,
 		"since":           nebStore.LoadNextBatch(config.UserID),
 	}).Info("Created new client")
 
-	if config.Sync {
+	if sync {
 		go func() {
 			for {
 				if e := client.Sync(); e != nil {
+					c.syncFailed(config.UserID, e)
 					log.WithFields(log.Fields{
 						log.ErrorKey: e,
 						"user_id":    config.UserID,
 					}).Error("Fatal Sync() error")
 					time.Sleep(10 * time.Second)
+					if c.getClient(config.UserID).client != client {
+						// Replaced or removed while we were waiting to retry.
+						log.WithField("user_id", config.UserID).Info("Stopping Sync()")
+						return
+					}
 				} else {
 					log.WithField("user_id", config.UserID).Info("Stopping Sync()")
 					return
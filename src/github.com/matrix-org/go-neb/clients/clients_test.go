@@ -6,9 +6,11 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 var commandParseTests = []struct {
@@ -37,7 +39,7 @@ type MockStore struct {
 	service types.Service
 }
 
-func (d *MockStore) LoadServicesForUser(userID string) ([]types.Service, error) {
+func (d *MockStore) LoadCachedServicesForUser(userID string) ([]types.Service, error) {
 	return []types.Service{d.service}, nil
 }
 
@@ -93,3 +95,72 @@ func TestCommandParsing(t *testing.T) {
 	}
 
 }
+
+const benchServiceType = "clients-bench"
+
+func TestUpdateReplacesClient(t *testing.T) {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestUpdateReplacesClient: failed to open database: %s", err)
+	}
+	clients := New(db, &http.Client{})
+	for _, token := range []string{"old_token", "new_token"} {
+		if _, err = clients.Update(api.ClientConfig{
+			UserID:        "@bot:localhost",
+			HomeserverURL: "https://hs.localhost",
+			AccessToken:   token,
+		}); err != nil {
+			t.Fatalf("TestUpdateReplacesClient: failed to update client: %s", err)
+		}
+		cli, err := clients.Client("@bot:localhost")
+		if err != nil {
+			t.Fatalf("TestUpdateReplacesClient: failed to get client: %s", err)
+		}
+		if cli.AccessToken != token {
+			t.Errorf("TestUpdateReplacesClient: expected client with access token %s, got %s", token, cli.AccessToken)
+		}
+	}
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &MockService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, benchServiceType)}
+	})
+}
+
+// BenchmarkOnMessageEvent measures handling a message sent to a bot with the given number of
+// services, which happens for every message the bot sees. Every other service is paused.
+func BenchmarkOnMessageEvent(b *testing.B) {
+	for _, count := range []int{1, 10, 100} {
+		db, err := database.Open("sqlite3", ":memory:")
+		if err != nil {
+			b.Fatalf("failed to open database: %s", err)
+		}
+		for i := 0; i < count; i++ {
+			s, _ := types.CreateService(fmt.Sprintf("svc%d", i), benchServiceType, "@bot:localhost", []byte(`{}`))
+			if _, err = db.StoreService(s); err != nil {
+				b.Fatalf("failed to store service: %s", err)
+			}
+			if i%2 == 1 {
+				if err = db.StoreServicePause(api.ServicePause{ServiceID: s.ServiceID()}); err != nil {
+					b.Fatalf("failed to pause service: %s", err)
+				}
+			}
+		}
+		clients := New(db, &http.Client{})
+		mxCli, _ := gomatrix.NewClient("https://hs.localhost", "@bot:localhost", "token")
+		for _, body := range []string{"!unknown command", "just chatting"} {
+			event := gomatrix.Event{
+				Type:    "m.room.message",
+				Sender:  "@someone:localhost",
+				RoomID:  "!room:localhost",
+				Content: map[string]interface{}{"body": body, "msgtype": "m.text"},
+			}
+			b.Run(fmt.Sprintf("%d services/%s", count, body), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					clients.onMessageEvent(mxCli, &event)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package clients
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/gomatrix"
+)
+
+// A SyncState describes the health of the /sync loop of a syncing client.
+type SyncState struct {
+	UserID string
+	// When a /sync request last succeeded, as a unix timestamp in milliseconds. 0 if none has yet.
+	LastSuccess int64
+	// The number of /sync requests which have failed since the last one which succeeded.
+	ConsecutiveFailures int
+	// The error from the most recent failed /sync request, if any.
+	LastError string `json:",omitempty"`
+}
+
+// healthSyncer wraps the syncer of a client to record whether its /sync requests are succeeding.
+type healthSyncer struct {
+	*gomatrix.DefaultSyncer
+	clients *Clients
+}
+
+func (s *healthSyncer) ProcessResponse(res *gomatrix.RespSync, since string) error {
+	s.clients.syncSucceeded(s.UserID)
+	return s.DefaultSyncer.ProcessResponse(res, since)
+}
+
+func (s *healthSyncer) OnFailedSync(res *gomatrix.RespSync, err error) (time.Duration, error) {
+	s.clients.syncFailed(s.UserID, err)
+	return s.DefaultSyncer.OnFailedSync(res, err)
+}
+
+func (c *Clients) syncSucceeded(userID string) {
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+	c.syncStates[userID] = SyncState{
+		UserID:      userID,
+		LastSuccess: time.Now().UnixNano() / 1000000,
+	}
+}
+
+func (c *Clients) syncFailed(userID string, err error) {
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+	state := c.syncStates[userID]
+	state.UserID = userID
+	state.ConsecutiveFailures++
+	state.LastError = syncErrorMessage(err)
+	c.syncStates[userID] = state
+}
+
+// syncErrorMessage describes why a /sync request failed, without the URL of the request, as it
+// contains the access token of the client and the error is served by the public health checks.
+func syncErrorMessage(err error) string {
+	if urlErr, ok := err.(*url.Error); ok {
+		u, parseErr := url.Parse(urlErr.URL)
+		if parseErr == nil {
+			u.RawQuery = ""
+			return logging.Redact(fmt.Sprintf("%s %s: %s", urlErr.Op, u.String(), urlErr.Err))
+		}
+		return logging.Redact(fmt.Sprintf("%s: %s", urlErr.Op, urlErr.Err))
+	}
+	return logging.Redact(err.Error())
+}
+
+// SyncStates returns the health of the /sync loop of every syncing client, ordered by user ID.
+func (c *Clients) SyncStates() []SyncState {
+	c.mapMutex.Lock()
+	var userIDs []string
+	for userID, entry := range c.clients {
+		if entry.syncing {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	c.mapMutex.Unlock()
+	sort.Strings(userIDs)
+
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+	states := make([]SyncState, len(userIDs))
+	for i, userID := range userIDs {
+		states[i] = c.syncStates[userID]
+		states[i].UserID = userID
+	}
+	return states
+}
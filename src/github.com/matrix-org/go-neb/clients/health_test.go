@@ -0,0 +1,28 @@
+package clients
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSyncErrorMessageHidesAccessToken(t *testing.T) {
+	for _, err := range []error{
+		&url.Error{
+			Op:  "Get",
+			URL: "https://hs.example/_matrix/client/r0/sync?since=s1&timeout=30000&access_token=s3cr3t",
+			Err: errors.New("dial tcp: connection refused"),
+		},
+		errors.New(`Get "https://hs.example/_matrix/client/r0/sync?access_token=s3cr3t": EOF`),
+	} {
+		msg := syncErrorMessage(err)
+		if strings.Contains(msg, "s3cr3t") {
+			t.Errorf("TestSyncErrorMessageHidesAccessToken: message contains the access token: %s", msg)
+		}
+	}
+	urlErr := &url.Error{Op: "Get", URL: "https://hs.example/sync?access_token=s3cr3t", Err: errors.New("EOF")}
+	if want := "Get https://hs.example/sync: EOF"; syncErrorMessage(urlErr) != want {
+		t.Errorf("TestSyncErrorMessageHidesAccessToken: want %q, got %q", want, syncErrorMessage(urlErr))
+	}
+}
@@ -0,0 +1,101 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	syncingClientsDesc = prometheus.NewDesc(
+		"goneb_syncing_clients",
+		"The number of clients whose /sync loop is running on this instance",
+		nil, nil,
+	)
+	syncLagDesc = prometheus.NewDesc(
+		"goneb_sync_lag_seconds",
+		"How long it has been since a client's last successful /sync",
+		[]string{"user_id"}, nil,
+	)
+)
+
+// Collector returns a prometheus.Collector which reports how many clients are syncing and how long
+// it has been since each last synced successfully. Register it once per Clients.
+func (c *Clients) Collector() prometheus.Collector {
+	return &syncCollector{c}
+}
+
+type syncCollector struct {
+	clients *Clients
+}
+
+func (s *syncCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- syncingClientsDesc
+	ch <- syncLagDesc
+}
+
+func (s *syncCollector) Collect(ch chan<- prometheus.Metric) {
+	states := s.clients.SyncStates()
+	ch <- prometheus.MustNewConstMetric(syncingClientsDesc, prometheus.GaugeValue, float64(len(states)))
+	now := time.Now().UnixNano() / 1000000
+	for _, state := range states {
+		if state.LastSuccess == 0 {
+			// It hasn't synced yet, so there's nothing to lag behind.
+			continue
+		}
+		lag := float64(now-state.LastSuccess) / 1000
+		ch <- prometheus.MustNewConstMetric(syncLagDesc, prometheus.GaugeValue, lag, state.UserID)
+	}
+}
+
+// sendFailureRecorder is an http.RoundTripper which counts requests to send events into rooms
+// which fail, by matrix errcode.
+type sendFailureRecorder struct {
+	base http.RoundTripper
+}
+
+func (t *sendFailureRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if _, ok := status.SentToRoom(req); !ok {
+		return res, err
+	}
+	if err != nil {
+		metrics.IncrementSendFailure("network_error")
+	} else if res.StatusCode < 200 || res.StatusCode >= 300 {
+		metrics.IncrementSendFailure(responseErrcode(res))
+	}
+	return res, err
+}
+
+// responseErrcode returns the matrix errcode of a failed response, or its HTTP status code if it
+// doesn't have one. The body can still be read afterwards.
+func responseErrcode(res *http.Response) string {
+	fallback := fmt.Sprintf("HTTP %d", res.StatusCode)
+	if res.Body == nil {
+		return fallback
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return fallback
+	}
+	var respErr struct {
+		Errcode string `json:"errcode"`
+	}
+	if json.Unmarshal(body, &respErr) != nil || respErr.Errcode == "" {
+		return fallback
+	}
+	return respErr.Errcode
+}
@@ -0,0 +1,29 @@
+package clients
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestResponseErrcode(t *testing.T) {
+	for _, tc := range []struct {
+		code    int
+		body    string
+		errcode string
+	}{
+		{403, `{"errcode":"M_FORBIDDEN","error":"You are not in this room"}`, "M_FORBIDDEN"},
+		{502, `<html>Bad Gateway</html>`, "HTTP 502"},
+		{500, `{}`, "HTTP 500"},
+	} {
+		res := &http.Response{StatusCode: tc.code, Body: ioutil.NopCloser(bytes.NewBufferString(tc.body))}
+		if errcode := responseErrcode(res); errcode != tc.errcode {
+			t.Errorf("TestResponseErrcode: want %q, got %q", tc.errcode, errcode)
+		}
+		// The body must still be readable by gomatrix.
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != tc.body {
+			t.Errorf("TestResponseErrcode: want body %q to be preserved, got %q", tc.body, body)
+		}
+	}
+}
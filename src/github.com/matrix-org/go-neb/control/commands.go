@@ -0,0 +1,179 @@
+package control
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+// powerLevels is the content of an m.room.power_levels event.
+type powerLevels struct {
+	Users        map[string]int `json:"users"`
+	UsersDefault int            `json:"users_default"`
+	Events       map[string]int `json:"events"`
+	StateDefault *int           `json:"state_default"`
+}
+
+// Commands returns the "!neb" commands which room admins can use to control the services of the
+// given client. They are run for every message sent to a syncing client, before any service.
+// A service can be controlled by the user it acts on behalf of (see types.OwnedService) from any
+// room, and by room admins from the rooms it is configured with (see types.RoomService).
+//
+//  !neb pause <service_id> [queue]
+//  !neb resume <service_id>
+//  !neb status [service_id]
+func Commands(cli *gomatrix.Client) []types.Command {
+	return []types.Command{
+		{
+			Path:      []string{"neb", "status"},
+			Arguments: []string{"[service_id]"},
+			Help:      "Show what a service has done recently, or a summary of the services you can control from this room.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				if len(args) > 1 {
+					return nil, fmt.Errorf("Usage: !neb status [service_id]")
+				}
+				if len(args) == 1 {
+					service, err := controllableService(cli, roomID, userID, args[0])
+					if err != nil {
+						return nil, err
+					}
+					return &gomatrix.TextMessage{"m.notice", serviceStatusText(service)}, nil
+				}
+				services, err := database.GetServiceDB().LoadServicesForUser(cli.UserID)
+				if err != nil {
+					return nil, fmt.Errorf("Failed to load services")
+				}
+				isAdmin := checkRoomAdmin(cli, roomID, userID) == nil
+				var controllable []types.Service
+				for _, service := range services {
+					if isOwner(service, userID) || (isAdmin && isServiceRoom(service, roomID)) {
+						controllable = append(controllable, service)
+					}
+				}
+				return &gomatrix.TextMessage{"m.notice", servicesSummaryText(controllable)}, nil
+			},
+		},
+		{
+			Path:      []string{"neb", "pause"},
+			Arguments: []string{"service_id", "[queue]"},
+			Help:      "Pause a service, dropping its webhooks, or queueing them if 'queue' is given.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "queue") {
+					return nil, fmt.Errorf("Usage: !neb pause <service_id> [queue]")
+				}
+				service, err := controllableService(cli, roomID, userID, args[0])
+				if err != nil {
+					return nil, err
+				}
+				queue := len(args) == 2
+				if _, err = Pause(service, userID, queue); err != nil {
+					return nil, fmt.Errorf("Failed to pause %s", args[0])
+				}
+				what := "dropped"
+				if queue {
+					what = "queued"
+				}
+				return &gomatrix.TextMessage{"m.notice", fmt.Sprintf(
+					"Paused %s. Webhooks will be %s until it is resumed with !neb resume %s", args[0], what, args[0],
+				)}, nil
+			},
+		},
+		{
+			Path:      []string{"neb", "resume"},
+			Arguments: []string{"service_id"},
+			Help:      "Resume a paused service, delivering any queued webhooks.",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				if len(args) != 1 {
+					return nil, fmt.Errorf("Usage: !neb resume <service_id>")
+				}
+				service, err := controllableService(cli, roomID, userID, args[0])
+				if err != nil {
+					return nil, err
+				}
+				queued, err := Resume(service)
+				if err == ErrNotPaused {
+					return nil, fmt.Errorf("%s is not paused", args[0])
+				} else if err != nil {
+					return nil, fmt.Errorf("Failed to resume %s", args[0])
+				}
+				return &gomatrix.TextMessage{"m.notice", fmt.Sprintf(
+					"Resumed %s. Delivering %d queued webhooks.", args[0], queued,
+				)}, nil
+			},
+		},
+	}
+}
+
+// controllableService loads the service with the given ID, checking that it belongs to this
+// client and that the user can control it from the room: either the service acts on behalf of
+// the user, or the user is an admin of the room and the service is configured with the room.
+func controllableService(cli *gomatrix.Client, roomID, userID, serviceID string) (types.Service, error) {
+	service, err := database.GetServiceDB().LoadService(serviceID)
+	if err == sql.ErrNoRows || (err == nil && service.ServiceUserID() != cli.UserID) {
+		return nil, fmt.Errorf("Unknown service %s", serviceID)
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to load service %s", serviceID)
+	}
+	if isOwner(service, userID) {
+		return service, nil
+	}
+	if !isServiceRoom(service, roomID) {
+		return nil, fmt.Errorf("%s can only be controlled from the rooms it is configured with", serviceID)
+	}
+	if err = checkRoomAdmin(cli, roomID, userID); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// isOwner returns true if the service acts on behalf of the user.
+func isOwner(service types.Service, userID string) bool {
+	owned, ok := service.(types.OwnedService)
+	return ok && owned.ServiceOwner() == userID
+}
+
+// isServiceRoom returns true if the service is configured with the room.
+func isServiceRoom(service types.Service, roomID string) bool {
+	roomService, ok := service.(types.RoomService)
+	if !ok {
+		return false
+	}
+	for _, r := range roomService.ServiceRooms() {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRoomAdmin returns an error unless the user is an admin of the room, i.e. can change its
+// power levels.
+func checkRoomAdmin(cli *gomatrix.Client, roomID, userID string) error {
+	resBytes, err := cli.SendJSON("GET", cli.BuildURL("rooms", roomID, "state", "m.room.power_levels"), nil)
+	if err != nil {
+		return fmt.Errorf("Failed to load the power levels of this room")
+	}
+	var levels powerLevels
+	if err = json.Unmarshal(resBytes, &levels); err != nil {
+		return fmt.Errorf("Failed to load the power levels of this room")
+	}
+	userLevel, ok := levels.Users[userID]
+	if !ok {
+		userLevel = levels.UsersDefault
+	}
+	required, ok := levels.Events["m.room.power_levels"]
+	if !ok {
+		required = 50
+		if levels.StateDefault != nil {
+			required = *levels.StateDefault
+		}
+	}
+	if userLevel < required {
+		return fmt.Errorf("Only room admins can control services")
+	}
+	return nil
+}
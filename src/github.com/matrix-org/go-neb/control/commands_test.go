@@ -0,0 +1,142 @@
+package control
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const controlTestServiceType = "control-test"
+
+// controlTestService is configured with Rooms, and acts on behalf of Owner.
+type controlTestService struct {
+	types.DefaultService
+	Rooms []string
+	Owner string
+}
+
+func (s *controlTestService) ServiceRooms() []string { return s.Rooms }
+func (s *controlTestService) ServiceOwner() string   { return s.Owner }
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &controlTestService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, controlTestServiceType)}
+	})
+}
+
+// powerLevelsTransport answers requests for the power levels of any room with @admin:localhost
+// as the only admin, and every other request with an empty JSON object.
+type powerLevelsTransport struct{}
+
+func (t powerLevelsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := `{}`
+	if strings.HasSuffix(req.URL.Path, "/state/m.room.power_levels") {
+		body = `{"users":{"@admin:localhost":100,"@bot:localhost":100},"users_default":0}`
+	}
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    req,
+	}, nil
+}
+
+func newCommandsTest(t *testing.T) map[string]types.Command {
+	db, err := database.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	database.SetServiceDB(db)
+	_, err = db.StoreMatrixClientConfig(api.ClientConfig{
+		UserID:        "@bot:localhost",
+		HomeserverURL: "https://hs.localhost",
+		AccessToken:   "token",
+	})
+	if err != nil {
+		t.Fatalf("failed to store client: %s", err)
+	}
+	cli, err := clients.New(db, &http.Client{Transport: powerLevelsTransport{}}).Client("@bot:localhost")
+	if err != nil {
+		t.Fatalf("failed to load client: %s", err)
+	}
+	service := &controlTestService{
+		DefaultService: types.NewDefaultService("svc", "@bot:localhost", controlTestServiceType),
+		Rooms:          []string{"!room:localhost"},
+		Owner:          "@owner:localhost",
+	}
+	if _, err = db.StoreService(service); err != nil {
+		t.Fatalf("failed to store service: %s", err)
+	}
+	cmds := make(map[string]types.Command)
+	for _, cmd := range Commands(cli) {
+		cmds[cmd.Path[1]] = cmd
+	}
+	return cmds
+}
+
+func runCommand(cmds map[string]types.Command, roomID, userID, name string, args ...string) (string, error) {
+	content, err := cmds[name].Command(roomID, userID, args)
+	if err != nil {
+		return "", err
+	}
+	return content.(*gomatrix.TextMessage).Body, nil
+}
+
+func TestNebCommands(t *testing.T) {
+	cmds := newCommandsTest(t)
+
+	if _, err := runCommand(cmds, "!room:localhost", "@admin:localhost", "pause", "svc"); err != nil {
+		t.Fatalf("want a room admin to pause the service, got %s", err)
+	}
+	if _, err := database.GetServiceDB().LoadServicePause("svc"); err != nil {
+		t.Errorf("want the service to be paused, got %s", err)
+	}
+	body, err := runCommand(cmds, "!room:localhost", "@admin:localhost", "status")
+	if err != nil || !strings.Contains(body, "svc (control-test): paused by @admin:localhost") {
+		t.Errorf("want the summary to show the paused service, got %q (err %v)", body, err)
+	}
+	// The owner can control the service from rooms it isn't configured with.
+	if body, err = runCommand(cmds, "!elsewhere:localhost", "@owner:localhost", "resume", "svc"); err != nil {
+		t.Fatalf("want the owner to resume the service, got %s", err)
+	}
+	if body != "Resumed svc. Delivering 0 queued webhooks." {
+		t.Errorf("want the service to be resumed, got %q", body)
+	}
+}
+
+func TestNebCommandsRejected(t *testing.T) {
+	cmds := newCommandsTest(t)
+
+	for _, tc := range []struct {
+		name, roomID, userID string
+		args                 []string
+	}{
+		// Only room admins can control services from the room.
+		{"pause", "!room:localhost", "@alice:localhost", []string{"svc"}},
+		// Room admins can only control services configured with the room.
+		{"pause", "!elsewhere:localhost", "@admin:localhost", []string{"svc"}},
+		{"resume", "!elsewhere:localhost", "@admin:localhost", []string{"svc"}},
+		{"status", "!elsewhere:localhost", "@admin:localhost", []string{"svc"}},
+		{"pause", "!room:localhost", "@admin:localhost", []string{"unknown"}},
+	} {
+		if _, err := runCommand(cmds, tc.roomID, tc.userID, tc.name, tc.args...); err == nil {
+			t.Errorf("want %s %v by %s in %s to be rejected", tc.name, tc.args, tc.userID, tc.roomID)
+		}
+	}
+	if _, err := database.GetServiceDB().LoadServicePause("svc"); err == nil {
+		t.Errorf("want the service not to be paused")
+	}
+	body, err := runCommand(cmds, "!elsewhere:localhost", "@admin:localhost", "status")
+	if err != nil || strings.Contains(body, "svc") {
+		t.Errorf("want the summary to leave out services which can't be controlled from the room, got %q (err %v)", body, err)
+	}
+}
@@ -0,0 +1,73 @@
+// Package control lets admins pause and resume services while Go-NEB is running, either via the
+// /admin HTTP API or with "!neb" commands in Matrix rooms.
+package control
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/types"
+)
+
+// ErrNotPaused is returned when resuming a service which is not paused.
+var ErrNotPaused = errors.New("service is not paused")
+
+// Pause pauses a service. Its polling is stopped, its commands and expansions are ignored and
+// webhooks for it are acknowledged but dropped, or queued if queueWebhooks is true. Pausing a
+// service which is already paused replaces the existing pause, keeping any queued webhooks.
+func Pause(service types.Service, pausedBy string, queueWebhooks bool) (api.ServicePause, error) {
+	pause := api.ServicePause{
+		ServiceID:     service.ServiceID(),
+		PausedBy:      pausedBy,
+		QueueWebhooks: queueWebhooks,
+		Timestamp:     time.Now().UnixNano() / 1000000,
+	}
+	if err := database.GetServiceDB().StoreServicePause(pause); err != nil {
+		return pause, err
+	}
+	if _, ok := service.(types.Poller); ok {
+		polling.StopPolling(service)
+	}
+	log.WithFields(log.Fields{
+		"service_id":     service.ServiceID(),
+		"service_type":   service.ServiceType(),
+		"paused_by":      pausedBy,
+		"queue_webhooks": queueWebhooks,
+	}).Info("Paused service")
+	return pause, nil
+}
+
+// Resume resumes a paused service, starting polling again if needed. Any webhooks which were
+// queued while it was paused are moved to the webhook queue, to be handled in the background in
+// the order they were received. Returns the number of webhooks which were queued.
+// Returns ErrNotPaused if the service is not paused.
+func Resume(service types.Service) (int, error) {
+	db := database.GetServiceDB()
+	logger := log.WithFields(log.Fields{
+		"service_id":   service.ServiceID(),
+		"service_type": service.ServiceType(),
+	})
+	if _, err := db.LoadServicePause(service.ServiceID()); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrNotPaused
+		}
+		return 0, err
+	}
+	queued, err := db.DeleteServicePause(service.ServiceID())
+	if err != nil {
+		return 0, err
+	}
+	logger.WithField("queued_webhooks", queued).Info("Resumed service")
+
+	if _, ok := service.(types.Poller); ok {
+		if err := polling.StartPolling(service); err != nil {
+			logger.WithError(err).Error("Failed to start poll loop.")
+		}
+	}
+	return queued, nil
+}
@@ -0,0 +1,76 @@
+package control
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+)
+
+// serviceStatusText describes what a service has done recently, for "!neb status <service_id>".
+func serviceStatusText(service types.Service) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s (%s): %s\n", service.ServiceID(), service.ServiceType(), pauseText(service.ServiceID()))
+	s := status.Get(service.ServiceID())
+	fmt.Fprintf(&buf, "Last command: %s\n", outcomeText(s.LastCommand))
+	fmt.Fprintf(&buf, "Last webhook: %s\n", outcomeText(s.LastWebhook))
+	fmt.Fprintf(&buf, "Last poll: %s\n", outcomeText(s.LastPoll))
+	fmt.Fprintf(&buf, "Last send: %s", outcomeText(s.LastSend))
+	if s.LastError != nil {
+		fmt.Fprintf(&buf, "\nLast error (%s): %s", s.LastErrorKind, outcomeText(s.LastError))
+	}
+	if s.LastPanic != nil {
+		fmt.Fprintf(&buf, "\nLast panic: %s", outcomeText(s.LastPanic))
+	}
+	return buf.String()
+}
+
+// servicesSummaryText lists every service with its last error, for "!neb status".
+func servicesSummaryText(services []types.Service) string {
+	if len(services) == 0 {
+		return "You can't control any of this bot's services from this room."
+	}
+	var buf bytes.Buffer
+	for i, service := range services {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "%s (%s): %s", service.ServiceID(), service.ServiceType(), pauseText(service.ServiceID()))
+		if s := status.Get(service.ServiceID()); s.LastError != nil {
+			fmt.Fprintf(&buf, ", last %s failed %s", s.LastErrorKind, outcomeText(s.LastError))
+		}
+	}
+	return buf.String()
+}
+
+func pauseText(serviceID string) string {
+	pause, err := database.GetServiceDB().LoadServicePause(serviceID)
+	if err == sql.ErrNoRows {
+		return "running"
+	} else if err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("paused by %s at %s", pause.PausedBy, timestampText(pause.Timestamp))
+}
+
+func outcomeText(o *status.Outcome) string {
+	if o == nil {
+		return "never"
+	}
+	text := timestampText(o.Timestamp)
+	if o.Detail != "" {
+		text += " (" + o.Detail + ")"
+	}
+	if o.Error != "" {
+		return text + ": " + o.Error
+	}
+	return text + ": OK"
+}
+
+func timestampText(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
@@ -1,8 +1,12 @@
 package database
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
@@ -12,8 +16,20 @@ import (
 // A ServiceDB stores the configuration for the services
 type ServiceDB struct {
 	db *sql.DB
+	// "sqlite3" or "postgres"
+	databaseType string
+	keys         *Keyring
+	registry     *serviceRegistry
 }
 
+// MaxWebhookDeliveries is how many webhook deliveries are kept in the webhook journal for each
+// service, however recent they are.
+const MaxWebhookDeliveries = 1000
+
+// ErrServiceConflict is returned by StoreService if the service has been changed or deleted
+// since it was loaded.
+var ErrServiceConflict = errors.New("service has been changed since it was loaded")
+
 // A single global instance of the service DB.
 var globalServiceDB Storer
 
@@ -27,36 +43,86 @@ func GetServiceDB() Storer {
 	return globalServiceDB
 }
 
-// Open a SQL database to use as a ServiceDB. This will automatically create
-// the necessary database tables if they aren't already present.
+// Open a SQL database to use as a ServiceDB. This will automatically apply any
+// schema migrations which haven't been applied yet, and fails if the database has
+// a newer schema than this version of Go-NEB supports.
 func Open(databaseType, databaseURL string) (serviceDB *ServiceDB, err error) {
-	db, err := sql.Open(databaseType, databaseURL)
+	db, err := openSQL(databaseType, databaseURL)
 	if err != nil {
 		return
 	}
-	if _, err = db.Exec(schemaSQL); err != nil {
+	if err = migrate(db, databaseType); err != nil {
+		return
+	}
+	serviceDB = &ServiceDB{db: db, databaseType: databaseType, registry: newServiceRegistry()}
+	return
+}
+
+// OpenWithoutMigrating opens a SQL database to use as a ServiceDB without changing its schema,
+// e.g. to export it. Fails if the database doesn't have exactly the schema which this version of
+// Go-NEB expects, so schema migrations must be applied with Open first.
+func OpenWithoutMigrating(databaseType, databaseURL string) (serviceDB *ServiceDB, err error) {
+	db, err := openSQL(databaseType, databaseURL)
+	if err != nil {
 		return
 	}
+	if err = checkSchemaVersion(db); err != nil {
+		db.Close()
+		return
+	}
+	serviceDB = &ServiceDB{db: db, databaseType: databaseType, registry: newServiceRegistry()}
+	return
+}
+
+func openSQL(databaseType, databaseURL string) (*sql.DB, error) {
+	db, err := sql.Open(databaseType, databaseURL)
+	if err != nil {
+		return nil, err
+	}
 	if databaseType == "sqlite3" {
 		// Fix for "database is locked" errors
 		// https://github.com/mattn/go-sqlite3/issues/274
 		db.SetMaxOpenConns(1)
 	}
-	serviceDB = &ServiceDB{db: db}
+	return db, nil
+}
+
+// SetKeyring sets the master keys used to encrypt secrets in the database. Values are encrypted
+// when they are next written: use Reencrypt to encrypt everything which is already stored. A nil
+// Keyring stores new values as plain text.
+func (d *ServiceDB) SetKeyring(keys *Keyring) {
+	d.keys = keys
+}
+
+// Reencrypt rewrites every stored secret which isn't encrypted with the current master key, e.g.
+// after encryption is first enabled or the key is rotated. Returns the number of rows rewritten.
+// Every value must be decryptable with the current Keyring, otherwise nothing is rewritten.
+func (d *ServiceDB) Reencrypt() (count int, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		count, err = reencryptTxn(txn, d.keys)
+		return err
+	})
 	return
 }
 
+// Ping checks that the database can still be reached, giving up after the timeout.
+func (d *ServiceDB) Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.db.PingContext(ctx)
+}
+
 // StoreMatrixClientConfig stores the Matrix client config for a bot service.
 // If a config already exists then it will be updated, otherwise a new config
 // will be inserted. The previous config is returned.
 func (d *ServiceDB) StoreMatrixClientConfig(config api.ClientConfig) (oldConfig api.ClientConfig, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		oldConfig, err = selectMatrixClientConfigTxn(txn, config.UserID)
+		oldConfig, err = selectMatrixClientConfigTxn(txn, d.keys, config.UserID)
 		now := time.Now()
 		if err == nil {
-			return updateMatrixClientConfigTxn(txn, now, config)
+			return updateMatrixClientConfigTxn(txn, d.keys, now, config)
 		} else if err == sql.ErrNoRows {
-			return insertMatrixClientConfigTxn(txn, now, config)
+			return insertMatrixClientConfigTxn(txn, d.keys, now, config)
 		} else {
 			return err
 		}
@@ -67,7 +133,7 @@ func (d *ServiceDB) StoreMatrixClientConfig(config api.ClientConfig) (oldConfig
 // LoadMatrixClientConfigs loads all Matrix client configs from the database.
 func (d *ServiceDB) LoadMatrixClientConfigs() (configs []api.ClientConfig, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		configs, err = selectMatrixClientConfigsTxn(txn)
+		configs, err = selectMatrixClientConfigsTxn(txn, d.keys)
 		return err
 	})
 	return
@@ -77,12 +143,21 @@ func (d *ServiceDB) LoadMatrixClientConfigs() (configs []api.ClientConfig, err e
 // Returns sql.ErrNoRows if the client isn't in the database.
 func (d *ServiceDB) LoadMatrixClientConfig(userID string) (config api.ClientConfig, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		config, err = selectMatrixClientConfigTxn(txn, userID)
+		config, err = selectMatrixClientConfigTxn(txn, d.keys, userID)
 		return err
 	})
 	return
 }
 
+// DeleteMatrixClientConfig deletes the Matrix client config for the given user.
+// No error is returned if the client did not exist in the first place.
+func (d *ServiceDB) DeleteMatrixClientConfig(userID string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteMatrixClientConfigTxn(txn, userID)
+	})
+	return
+}
+
 // UpdateNextBatch updates the next_batch token for the given user.
 func (d *ServiceDB) UpdateNextBatch(userID, nextBatch string) (err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
@@ -104,17 +179,297 @@ func (d *ServiceDB) LoadNextBatch(userID string) (nextBatch string, err error) {
 // Returns sql.ErrNoRows if the service isn't in the database.
 func (d *ServiceDB) LoadService(serviceID string) (service types.Service, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		service, err = selectServiceTxn(txn, serviceID)
+		service, err = selectServiceTxn(txn, d.keys, serviceID)
 		return err
 	})
 	return
 }
 
+// LoadCachedService is like LoadService but may return a cached service, which is shared with
+// other callers and MUST NOT be modified. This is for looking up the service for every incoming
+// webhook without querying the database each time.
+func (d *ServiceDB) LoadCachedService(serviceID string) (service types.Service, err error) {
+	epoch := d.registry.refresh(d.db)
+	if s, ok := d.registry.service(serviceID); ok {
+		return s, nil
+	}
+	if service, err = d.LoadService(serviceID); err == nil {
+		d.registry.addService(epoch, service)
+	}
+	return
+}
+
 // DeleteService deletes the given service from the database.
 func (d *ServiceDB) DeleteService(serviceID string) (err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteServicePauseTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err := deleteQueuedWebhooksTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err := deleteWebhookDeliveriesTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err := deleteWebhookJobsTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err := deleteServiceStatesTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err := incrementServiceGenerationTxn(txn); err != nil {
+			return err
+		}
 		return deleteServiceTxn(txn, serviceID)
 	})
+	d.registry.invalidate()
+	return
+}
+
+// StoreServicePause pauses a service, replacing any existing pause for that service.
+func (d *ServiceDB) StoreServicePause(pause api.ServicePause) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteServicePauseTxn(txn, pause.ServiceID); err != nil {
+			return err
+		}
+		if err := incrementServiceGenerationTxn(txn); err != nil {
+			return err
+		}
+		return insertServicePauseTxn(txn, pause)
+	})
+	d.registry.invalidate()
+	return
+}
+
+// LoadServicePause loads the pause for a service.
+// Returns sql.ErrNoRows if the service is not paused.
+func (d *ServiceDB) LoadServicePause(serviceID string) (pause api.ServicePause, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		pause, err = selectServicePauseTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// LoadCachedServicePause is like LoadServicePause but may return a cached pause. This is for
+// checking whether a service is paused for every incoming message and webhook without querying
+// the database each time.
+func (d *ServiceDB) LoadCachedServicePause(serviceID string) (pause api.ServicePause, err error) {
+	epoch := d.registry.refresh(d.db)
+	if p, ok := d.registry.pause(serviceID); ok {
+		if p == nil {
+			return pause, sql.ErrNoRows
+		}
+		return *p, nil
+	}
+	pause, err = d.LoadServicePause(serviceID)
+	if err == nil {
+		d.registry.addPause(epoch, serviceID, &pause)
+	} else if err == sql.ErrNoRows {
+		d.registry.addPause(epoch, serviceID, nil)
+	}
+	return
+}
+
+// DeleteServicePause resumes a service. Any webhooks which were queued while the service was
+// paused are moved to the webhook queue, to be handled in the background oldest first. Returns
+// how many webhooks were moved.
+func (d *ServiceDB) DeleteServicePause(serviceID string) (queued int, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		webhooks, err := selectQueuedWebhooksTxn(txn, d.keys, serviceID)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixNano() / 1000000
+		for _, webhook := range webhooks {
+			err = insertWebhookJobTxn(txn, d.keys, api.WebhookJob{
+				ID:                   newRowID(),
+				ServiceID:            serviceID,
+				Method:               webhook.Method,
+				URL:                  webhook.URL,
+				Header:               webhook.Header,
+				Body:                 webhook.Body,
+				Timestamp:            webhook.Timestamp,
+				NextAttemptTimestamp: now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err = deleteQueuedWebhooksTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = incrementServiceGenerationTxn(txn); err != nil {
+			return err
+		}
+		queued = len(webhooks)
+		return deleteServicePauseTxn(txn, serviceID)
+	})
+	d.registry.invalidate()
+	return
+}
+
+// newRowID returns a random ID for a queued webhook, or a webhook moved to the webhook queue.
+func newRowID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// StoreQueuedWebhook stores a webhook for a paused service.
+func (d *ServiceDB) StoreQueuedWebhook(webhook api.QueuedWebhook) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertQueuedWebhookTxn(txn, d.keys, newRowID(), webhook)
+	})
+	return
+}
+
+// StoreWebhookDelivery adds a webhook delivery to the webhook journal. All but the newest
+// MaxWebhookDeliveries deliveries for the same service are removed.
+func (d *ServiceDB) StoreWebhookDelivery(delivery api.WebhookDelivery) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := insertWebhookDeliveryTxn(txn, d.keys, delivery); err != nil {
+			return err
+		}
+		return deleteOldestWebhookDeliveriesTxn(txn, delivery.ServiceID, MaxWebhookDeliveries)
+	})
+	return
+}
+
+// DeleteExpiredWebhookDeliveries removes every webhook delivery which was received before the
+// given time from the webhook journal. Returns how many were removed.
+func (d *ServiceDB) DeleteExpiredWebhookDeliveries(before time.Time) (count int64, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		count, err = deleteExpiredWebhookDeliveriesTxn(txn, before.UnixNano()/1000000)
+		return err
+	})
+	return
+}
+
+// StoreWebhookDeliveryOutcome records the outcome of processing a webhook delivery in the webhook
+// journal, counting it as a replay if replayed is true.
+func (d *ServiceDB) StoreWebhookDeliveryOutcome(deliveryID string, statusCode int, errMsg string, replayed bool) (err error) {
+	processed := time.Now().UnixNano() / 1000000
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateWebhookDeliveryOutcomeTxn(txn, deliveryID, statusCode, errMsg, processed, replayed)
+	})
+	return
+}
+
+// LoadWebhookDeliveries loads up to limit of the webhook deliveries for a service from the webhook
+// journal, newest first.
+func (d *ServiceDB) LoadWebhookDeliveries(serviceID string, limit int) (deliveries []api.WebhookDelivery, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		deliveries, err = selectWebhookDeliveriesTxn(txn, d.keys, serviceID, limit)
+		return err
+	})
+	return
+}
+
+// LoadWebhookDelivery loads a webhook delivery from the webhook journal.
+// Returns sql.ErrNoRows if the delivery isn't in the journal.
+func (d *ServiceDB) LoadWebhookDelivery(deliveryID string) (delivery api.WebhookDelivery, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		delivery, err = selectWebhookDeliveryTxn(txn, d.keys, deliveryID)
+		return err
+	})
+	return
+}
+
+// StoreWebhookJob adds a webhook to the queue of webhooks to handle in the background.
+func (d *ServiceDB) StoreWebhookJob(job api.WebhookJob) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return insertWebhookJobTxn(txn, d.keys, job)
+	})
+	return
+}
+
+// ClaimWebhookJobs returns up to limit queued webhooks which are due to be handled, oldest first.
+// They are claimed for claimFor, during which they are not returned again by this or any other
+// instance, so they must be deleted or rescheduled before then or they will be handled twice.
+func (d *ServiceDB) ClaimWebhookJobs(limit int, claimFor time.Duration) (jobs []api.WebhookJob, err error) {
+	now := time.Now()
+	claimUntil := now.Add(claimFor).UnixNano() / 1000000
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		due, err := selectDueWebhookJobsTxn(txn, d.keys, now.UnixNano()/1000000, limit)
+		if err != nil {
+			return err
+		}
+		jobs = nil
+		for _, job := range due {
+			claimed, err := claimWebhookJobTxn(txn, job, claimUntil)
+			if err != nil {
+				return err
+			}
+			if claimed {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// RescheduleWebhookJob records that a queued webhook has failed attempts times and has been sent
+// into sentRooms, and puts off handling it again until nextAttempt.
+func (d *ServiceDB) RescheduleWebhookJob(jobID string, attempts int, nextAttempt time.Time, lastError string, sentRooms []string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return updateWebhookJobTxn(txn, jobID, attempts, nextAttempt.UnixNano()/1000000, lastError, sentRooms)
+	})
+	return
+}
+
+// DeleteWebhookJob removes a webhook from the queue of webhooks to handle in the background.
+func (d *ServiceDB) DeleteWebhookJob(jobID string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteWebhookJobTxn(txn, jobID)
+	})
+	return
+}
+
+// StoreServiceState stores a value in the state store of a service, replacing any existing
+// value with the same namespace and key. Any expired values for the service are removed.
+func (d *ServiceDB) StoreServiceState(state api.ServiceState) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		now := time.Now()
+		if err := deleteExpiredServiceStateTxn(txn, now, state.ServiceID); err != nil {
+			return err
+		}
+		if err := deleteServiceStateTxn(txn, state.ServiceID, state.Namespace, state.Key); err != nil {
+			return err
+		}
+		return insertServiceStateTxn(txn, now, state)
+	})
+	return
+}
+
+// LoadServiceState loads a value from the state store of a service.
+// Returns sql.ErrNoRows if there is no value or it has expired.
+func (d *ServiceDB) LoadServiceState(serviceID, namespace, key string) (state api.ServiceState, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		state, err = selectServiceStateTxn(txn, time.Now(), serviceID, namespace, key)
+		return err
+	})
+	return
+}
+
+// ScanServiceState loads every value in a namespace of the state store of a service whose key
+// starts with the given prefix, ordered by key. An empty prefix loads the whole namespace.
+// Returns an empty list if there aren't any.
+func (d *ServiceDB) ScanServiceState(serviceID, namespace, prefix string) (states []api.ServiceState, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		states, err = selectServiceStatesByPrefixTxn(txn, time.Now(), serviceID, namespace, prefix)
+		return err
+	})
+	return
+}
+
+// DeleteServiceState deletes a value from the state store of a service. It is not an error if
+// there is no such value.
+func (d *ServiceDB) DeleteServiceState(serviceID, namespace, key string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteServiceStateTxn(txn, serviceID, namespace, key)
+	})
 	return
 }
 
@@ -122,7 +477,7 @@ func (d *ServiceDB) DeleteService(serviceID string) (err error) {
 // Returns an empty list if there aren't any services configured.
 func (d *ServiceDB) LoadServicesForUser(serviceUserID string) (services []types.Service, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		services, err = selectServicesForUserTxn(txn, serviceUserID)
+		services, err = selectServicesForUserTxn(txn, d.keys, serviceUserID)
 		if err != nil {
 			return err
 		}
@@ -131,11 +486,25 @@ func (d *ServiceDB) LoadServicesForUser(serviceUserID string) (services []types.
 	return
 }
 
+// LoadCachedServicesForUser is like LoadServicesForUser but may return cached services, which are
+// shared with other callers and MUST NOT be modified. This is for looking up the services for
+// every incoming message without querying the database each time.
+func (d *ServiceDB) LoadCachedServicesForUser(serviceUserID string) (services []types.Service, err error) {
+	epoch := d.registry.refresh(d.db)
+	if s, ok := d.registry.servicesForUser(serviceUserID); ok {
+		return s, nil
+	}
+	if services, err = d.LoadServicesForUser(serviceUserID); err == nil {
+		d.registry.addServicesForUser(epoch, serviceUserID, services)
+	}
+	return
+}
+
 // LoadServicesByType loads all the bot services configured for a given type.
 // Returns an empty list if there aren't any services configured.
 func (d *ServiceDB) LoadServicesByType(serviceType string) (services []types.Service, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		services, err = selectServicesByTypeTxn(txn, serviceType)
+		services, err = selectServicesByTypeTxn(txn, d.keys, serviceType)
 		if err != nil {
 			return err
 		}
@@ -144,20 +513,55 @@ func (d *ServiceDB) LoadServicesByType(serviceType string) (services []types.Ser
 	return
 }
 
+// LoadServices loads up to 'limit' bot services ordered by service ID, starting after the
+// service ID 'from'. An empty 'from' starts from the beginning. If 'serviceType' or
+// 'serviceUserID' are not empty, only services with that type or user ID are returned.
+// A 'limit' of 0 or less returns every matching service.
+// Returns an empty list if there aren't any matching services.
+func (d *ServiceDB) LoadServices(serviceType, serviceUserID, from string, limit int) (services []types.Service, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		services, err = selectServicesTxn(txn, d.keys, serviceType, serviceUserID, from, limit)
+		return err
+	})
+	return
+}
+
 // StoreService stores a service into the database either by inserting a new
 // service or updating an existing service. Returns the old service if there
 // was one.
+//
+// The service's ServiceVersion MUST be the version of the stored service which it is replacing,
+// or 0 if it is a new service. If the stored service has changed since then, nothing is stored
+// and ErrServiceConflict is returned: load the service again and retry. On success, the service's
+// version is set to the newly stored version.
 func (d *ServiceDB) StoreService(service types.Service) (oldService types.Service, err error) {
+	var version int64
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		oldService, err = selectServiceTxn(txn, service.ServiceID())
+		oldService, err = selectServiceTxn(txn, d.keys, service.ServiceID())
 		if err == sql.ErrNoRows {
-			return insertServiceTxn(txn, time.Now(), service)
+			if service.ServiceVersion() != 0 {
+				// It has been deleted since it was loaded.
+				return ErrServiceConflict
+			}
+			version = 1
+			if err := incrementServiceGenerationTxn(txn); err != nil {
+				return err
+			}
+			return insertServiceTxn(txn, d.keys, time.Now(), service)
 		} else if err != nil {
 			return err
 		} else {
-			return updateServiceTxn(txn, time.Now(), service)
+			version = service.ServiceVersion() + 1
+			if err := incrementServiceGenerationTxn(txn); err != nil {
+				return err
+			}
+			return updateServiceTxn(txn, d.keys, time.Now(), service, version)
 		}
 	})
+	if err == nil {
+		service.SetServiceVersion(version)
+		d.registry.invalidate()
+	}
 	return
 }
 
@@ -165,7 +569,7 @@ func (d *ServiceDB) StoreService(service types.Service) (oldService types.Servic
 // Returns sql.ErrNoRows if the realm isn't in the database.
 func (d *ServiceDB) LoadAuthRealm(realmID string) (realm types.AuthRealm, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		realm, err = selectRealmTxn(txn, realmID)
+		realm, err = selectRealmTxn(txn, d.keys, realmID)
 		return err
 	})
 	return
@@ -176,24 +580,47 @@ func (d *ServiceDB) LoadAuthRealm(realmID string) (realm types.AuthRealm, err er
 // Returns an empty list if there are no realms with that type.
 func (d *ServiceDB) LoadAuthRealmsByType(realmType string) (realms []types.AuthRealm, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		realms, err = selectRealmsByTypeTxn(txn, realmType)
+		realms, err = selectRealmsByTypeTxn(txn, d.keys, realmType)
+		return err
+	})
+	return
+}
+
+// LoadAuthRealms loads all auth realms from the database.
+// The realms are ordered based on their realm ID.
+// Returns an empty list if there are no realms.
+func (d *ServiceDB) LoadAuthRealms() (realms []types.AuthRealm, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		realms, err = selectRealmsTxn(txn, d.keys)
 		return err
 	})
 	return
 }
 
+// DeleteAuthRealm deletes the given auth realm along with every auth session on that realm.
+// No error is returned if the realm did not exist in the first place.
+func (d *ServiceDB) DeleteAuthRealm(realmID string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteAuthSessionsByRealmTxn(txn, realmID); err != nil {
+			return err
+		}
+		return deleteRealmTxn(txn, realmID)
+	})
+	return
+}
+
 // StoreAuthRealm stores the given AuthRealm, clobbering based on the realm ID.
 // This function updates the time added/updated values. The previous realm, if any, is
 // returned.
 func (d *ServiceDB) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		old, err = selectRealmTxn(txn, realm.ID())
+		old, err = selectRealmTxn(txn, d.keys, realm.ID())
 		if err == sql.ErrNoRows {
-			return insertRealmTxn(txn, time.Now(), realm)
+			return insertRealmTxn(txn, d.keys, time.Now(), realm)
 		} else if err != nil {
 			return err
 		} else {
-			return updateRealmTxn(txn, time.Now(), realm)
+			return updateRealmTxn(txn, d.keys, time.Now(), realm)
 		}
 	})
 	return
@@ -204,13 +631,13 @@ func (d *ServiceDB) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm,
 // The previous session, if any, is returned.
 func (d *ServiceDB) StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		old, err = selectAuthSessionByUserTxn(txn, session.RealmID(), session.UserID())
+		old, err = selectAuthSessionByUserTxn(txn, d.keys, session.RealmID(), session.UserID())
 		if err == sql.ErrNoRows {
-			return insertAuthSessionTxn(txn, time.Now(), session)
+			return insertAuthSessionTxn(txn, d.keys, time.Now(), session)
 		} else if err != nil {
 			return err
 		} else {
-			return updateAuthSessionTxn(txn, time.Now(), session)
+			return updateAuthSessionTxn(txn, d.keys, time.Now(), session)
 		}
 	})
 	return
@@ -229,7 +656,7 @@ func (d *ServiceDB) RemoveAuthSession(realmID, userID string) error {
 // Returns sql.ErrNoRows if the session isn't in the database.
 func (d *ServiceDB) LoadAuthSessionByUser(realmID, userID string) (session types.AuthSession, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		session, err = selectAuthSessionByUserTxn(txn, realmID, userID)
+		session, err = selectAuthSessionByUserTxn(txn, d.keys, realmID, userID)
 		return err
 	})
 	return
@@ -240,7 +667,18 @@ func (d *ServiceDB) LoadAuthSessionByUser(realmID, userID string) (session types
 // Returns sql.ErrNoRows if the session isn't in the database.
 func (d *ServiceDB) LoadAuthSessionByID(realmID, sessionID string) (session types.AuthSession, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		session, err = selectAuthSessionByIDTxn(txn, realmID, sessionID)
+		session, err = selectAuthSessionByIDTxn(txn, d.keys, realmID, sessionID)
+		return err
+	})
+	return
+}
+
+// LoadAuthSessionsByRealm loads all AuthSessions on the given realm from the database.
+// The sessions are ordered based on their user ID.
+// Returns an empty list if there are no sessions on that realm.
+func (d *ServiceDB) LoadAuthSessionsByRealm(realmID string) (sessions []types.AuthSession, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		sessions, err = selectAuthSessionsByRealmTxn(txn, d.keys, realmID)
 		return err
 	})
 	return
@@ -273,6 +711,110 @@ func (d *ServiceDB) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOpt
 	return
 }
 
+// StoreConfigHistory records a new version of the config for a service, realm or client. The
+// Version, Timestamp and Diff of the entry are populated based on the previous version, if any.
+// Returns the entry which was stored.
+func (d *ServiceDB) StoreConfigHistory(entry api.ConfigHistoryEntry) (stored api.ConfigHistoryEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		prevVersion, prevJSON, err := selectLatestConfigHistoryTxn(txn, d.keys, entry.Kind, entry.ID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		entry.Version = prevVersion + 1
+		entry.Timestamp = time.Now().UnixNano() / 1000000
+		if entry.Action == api.ConfigActionDelete {
+			entry.Diff, err = api.DiffJSON(entry.Config, nil)
+		} else {
+			entry.Diff, err = api.DiffJSON(prevJSON, entry.Config)
+		}
+		if err != nil {
+			return err
+		}
+		stored = entry
+		return insertConfigHistoryTxn(txn, d.keys, entry)
+	})
+	return
+}
+
+// LoadConfigHistory loads every recorded version of the config for the given kind and ID,
+// newest first. Returns an empty list if there is no history.
+func (d *ServiceDB) LoadConfigHistory(kind, id string) (entries []api.ConfigHistoryEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		entries, err = selectConfigHistoryTxn(txn, d.keys, kind, id)
+		return err
+	})
+	return
+}
+
+// LoadConfigHistoryVersion loads a single version of the config for the given kind and ID.
+// Returns sql.ErrNoRows if the version doesn't exist.
+func (d *ServiceDB) LoadConfigHistoryVersion(kind, id string, version int64) (entry api.ConfigHistoryEntry, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		entry, err = selectConfigHistoryVersionTxn(txn, d.keys, kind, id, version)
+		return err
+	})
+	return
+}
+
+// StoreManagedConfig marks the given IDs as the complete set of configs of the given kind which are
+// managed by a config file. Any other configs of that kind which were previously managed no longer are.
+func (d *ServiceDB) StoreManagedConfig(kind string, ids []string) (err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteManagedConfigTxn(txn, kind); err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if err := insertManagedConfigTxn(txn, kind, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// IsManagedConfig returns true if the config of the given kind and ID is managed by a config file.
+func (d *ServiceDB) IsManagedConfig(kind, id string) (managed bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		managed, err = selectManagedConfigTxn(txn, kind, id)
+		return err
+	})
+	return
+}
+
+// AcquireLease takes or renews the named lease for the owner until ttl from now. Returns false if
+// another owner holds a lease which hasn't expired yet. Only one owner can hold a lease at a time,
+// even if several try to acquire it at once: one of them succeeds and the others return false or
+// an error. Leases are timed by the database server's clock, so that instances with clocks which
+// disagree can't both hold a lease.
+func (d *ServiceDB) AcquireLease(name, owner string, ttl time.Duration) (acquired bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		now, err := selectNowTxn(txn, d.databaseType)
+		if err != nil {
+			return err
+		}
+		expires := now + ttl.Nanoseconds()/1000000
+		if acquired, err = updateLeaseTxn(txn, name, owner, expires, now); err != nil || acquired {
+			return err
+		}
+		exists, err := selectLeaseExistsTxn(txn, name)
+		if err != nil || exists {
+			return err
+		}
+		if err = insertLeaseTxn(txn, name, owner, expires); err != nil {
+			return err
+		}
+		acquired = true
+		return nil
+	})
+	return
+}
+
 // InsertFromConfig inserts entries from the config file into the database. This only really
 // makes sense for in-memory databases.
 func (d *ServiceDB) InsertFromConfig(cfg *api.ConfigFile) error {
@@ -0,0 +1,259 @@
+package database
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+)
+
+type versionedService struct {
+	types.DefaultService
+	Value string
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &versionedService{DefaultService: types.NewDefaultService(serviceID, serviceUserID, "db-test")}
+	})
+}
+
+func TestStoreServiceConflict(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestStoreServiceConflict: failed to open database: %s", err)
+	}
+	created, _ := types.CreateService("svc", "db-test", "@bot:localhost", []byte(`{"Value":"one"}`))
+	if _, err = db.StoreService(created); err != nil {
+		t.Fatalf("TestStoreServiceConflict: failed to store new service: %s", err)
+	}
+	if created.ServiceVersion() != 1 {
+		t.Errorf("TestStoreServiceConflict: expected new service to be version 1, got %d", created.ServiceVersion())
+	}
+
+	first, _ := db.LoadService("svc")
+	second, _ := db.LoadService("svc")
+	first.(*versionedService).Value = "two"
+	if _, err = db.StoreService(first); err != nil {
+		t.Fatalf("TestStoreServiceConflict: failed to store loaded service: %s", err)
+	}
+	second.(*versionedService).Value = "stale"
+	if _, err = db.StoreService(second); err != ErrServiceConflict {
+		t.Errorf("TestStoreServiceConflict: expected storing a stale service to conflict, got %v", err)
+	}
+	if _, err = db.StoreService(created); err != ErrServiceConflict {
+		t.Errorf("TestStoreServiceConflict: expected storing a stale new service to conflict, got %v", err)
+	}
+
+	stored, err := db.LoadService("svc")
+	if err != nil {
+		t.Fatalf("TestStoreServiceConflict: failed to load service: %s", err)
+	}
+	if stored.(*versionedService).Value != "two" || stored.ServiceVersion() != 2 {
+		t.Errorf("TestStoreServiceConflict: expected version 2 with value 'two', got %d %+v", stored.ServiceVersion(), stored)
+	}
+}
+
+func TestServiceState(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestServiceState: failed to open database: %s", err)
+	}
+	expired := time.Now().Add(-time.Minute).UnixNano() / 1000000
+	for _, state := range []api.ServiceState{
+		{ServiceID: "svc", Namespace: "feeds", Key: "a/1", Value: []byte("one")},
+		{ServiceID: "svc", Namespace: "feeds", Key: "a/2", Value: []byte("\xfftwo")}, // not valid UTF-8
+		{ServiceID: "svc", Namespace: "feeds", Key: "a/3", Value: []byte("old"), ExpiresTimestamp: expired},
+		{ServiceID: "svc", Namespace: "feeds", Key: "b/1", Value: []byte("other prefix")},
+		{ServiceID: "svc", Namespace: "other", Key: "a/1", Value: []byte("other namespace")},
+		{ServiceID: "svc", Namespace: "feeds", Key: "a/1", Value: []byte("replaced")},
+	} {
+		if err = db.StoreServiceState(state); err != nil {
+			t.Fatalf("TestServiceState: failed to store %s: %s", state.Key, err)
+		}
+	}
+
+	states, err := db.ScanServiceState("svc", "feeds", "a/")
+	if err != nil {
+		t.Fatalf("TestServiceState: failed to scan: %s", err)
+	}
+	if len(states) != 2 || string(states[0].Value) != "replaced" || string(states[1].Value) != "\xfftwo" {
+		t.Errorf("TestServiceState: expected [replaced \\xfftwo], got %+v", states)
+	}
+	if _, err = db.LoadServiceState("svc", "feeds", "a/3"); err != sql.ErrNoRows {
+		t.Errorf("TestServiceState: expected expired value to not be found, got %v", err)
+	}
+
+	if err = db.DeleteServiceState("svc", "feeds", "a/2"); err != nil {
+		t.Fatalf("TestServiceState: failed to delete: %s", err)
+	}
+	if _, err = db.LoadServiceState("svc", "feeds", "a/2"); err != sql.ErrNoRows {
+		t.Errorf("TestServiceState: expected deleted value to not be found, got %v", err)
+	}
+	if err = db.DeleteService("svc"); err != nil {
+		t.Fatalf("TestServiceState: failed to delete service: %s", err)
+	}
+	if states, _ = db.ScanServiceState("svc", "other", ""); len(states) != 0 {
+		t.Errorf("TestServiceState: expected deleting the service to delete its state, got %+v", states)
+	}
+}
+
+func TestAcquireLease(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestAcquireLease: failed to open database: %s", err)
+	}
+	for _, step := range []struct {
+		owner    string
+		ttl      time.Duration
+		acquired bool
+	}{
+		{"a", time.Minute, true},  // nobody holds it
+		{"b", time.Minute, false}, // a holds it
+		{"a", -time.Second, true}, // a renews it, but it expires straight away
+		{"b", time.Minute, true},  // a's lease has expired
+		{"a", time.Minute, false}, // b holds it
+		{"b", time.Minute, true},  // b renews it
+	} {
+		acquired, err := db.AcquireLease("leader", step.owner, step.ttl)
+		if err != nil {
+			t.Fatalf("TestAcquireLease: %s failed to acquire lease: %s", step.owner, err)
+		}
+		if acquired != step.acquired {
+			t.Fatalf("TestAcquireLease: %s: want acquired=%v, got %v", step.owner, step.acquired, acquired)
+		}
+	}
+	// Other leases are independent.
+	if acquired, err := db.AcquireLease("other", "a", time.Minute); err != nil || !acquired {
+		t.Errorf("TestAcquireLease: expected to acquire another lease, got %v %v", acquired, err)
+	}
+	// Leases are timed by the database's clock.
+	var expires, now int64
+	err = db.db.QueryRow("SELECT time_expires_ms FROM leases WHERE lease_name = 'other'").Scan(&expires)
+	if err != nil {
+		t.Fatalf("TestAcquireLease: failed to select lease: %s", err)
+	}
+	if err = db.db.QueryRow(selectNowSQL["sqlite3"]).Scan(&now); err != nil {
+		t.Fatalf("TestAcquireLease: failed to select the time: %s", err)
+	}
+	if d := time.Duration(expires-now) * time.Millisecond; d <= 0 || d > time.Minute {
+		t.Errorf("TestAcquireLease: want the lease to expire within a minute of the database's time, got %s", d)
+	}
+	if local := time.Now().UnixNano() / 1000000; now < local-5000 || now > local+5000 {
+		t.Errorf("TestAcquireLease: want the database's time to be about %d, got %d", local, now)
+	}
+}
+
+func TestWebhookJournal(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestWebhookJournal: failed to open database: %s", err)
+	}
+	now := time.Now().UnixNano() / 1000000
+	store := func(id, serviceID string, timestamp int64) {
+		err := db.StoreWebhookDelivery(api.WebhookDelivery{
+			ID:        id,
+			ServiceID: serviceID,
+			Method:    "POST",
+			URL:       "/services/hooks/abc",
+			Header:    http.Header{"X-Github-Event": []string{"push"}},
+			Body:      `{"ref":"refs/heads/master"}`,
+			Timestamp: timestamp,
+		})
+		if err != nil {
+			t.Fatalf("TestWebhookJournal: failed to store delivery %s: %s", id, err)
+		}
+	}
+	store("old", "svc", now-2*time.Hour.Nanoseconds()/1000000)
+	store("other", "other_svc", now-2000)
+	store("first", "svc", now-1000)
+	store("second", "svc", now)
+
+	if err := db.StoreWebhookDeliveryOutcome("first", 500, "responded with HTTP 500", false); err != nil {
+		t.Fatalf("TestWebhookJournal: failed to store outcome: %s", err)
+	}
+	if err := db.StoreWebhookDeliveryOutcome("first", 200, "", true); err != nil {
+		t.Fatalf("TestWebhookJournal: failed to store replay outcome: %s", err)
+	}
+
+	if deliveries, err := db.LoadWebhookDeliveries("svc", 10); err != nil || len(deliveries) != 3 {
+		t.Fatalf("TestWebhookJournal: want 3 deliveries before sweeping, got %+v (err %v)", deliveries, err)
+	}
+	if count, err := db.DeleteExpiredWebhookDeliveries(time.Now().Add(-time.Hour)); err != nil || count != 1 {
+		t.Fatalf("TestWebhookJournal: want 1 expired delivery to be deleted, got %d (err %v)", count, err)
+	}
+	deliveries, err := db.LoadWebhookDeliveries("svc", 10)
+	if err != nil {
+		t.Fatalf("TestWebhookJournal: failed to load deliveries: %s", err)
+	}
+	// "old" has expired, and newer deliveries for other services are left alone.
+	if len(deliveries) != 2 || deliveries[0].ID != "second" || deliveries[1].ID != "first" {
+		t.Fatalf("TestWebhookJournal: want [second first], got %+v", deliveries)
+	}
+	first := deliveries[1]
+	if first.StatusCode != 200 || first.Error != "" || first.Replays != 1 || first.ProcessedTimestamp == 0 {
+		t.Errorf("TestWebhookJournal: want replayed outcome, got %+v", first)
+	}
+	if first.Header.Get("X-Github-Event") != "push" || first.Body != `{"ref":"refs/heads/master"}` {
+		t.Errorf("TestWebhookJournal: want request to round trip, got %+v", first)
+	}
+	if _, err := db.LoadWebhookDelivery("other"); err != nil {
+		t.Errorf("TestWebhookJournal: want other service's delivery to be kept, got %s", err)
+	}
+	if _, err := db.LoadWebhookDelivery("old"); err != sql.ErrNoRows {
+		t.Errorf("TestWebhookJournal: want sql.ErrNoRows for expired delivery, got %v", err)
+	}
+}
+
+func TestWebhookJobs(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestWebhookJobs: failed to open database: %s", err)
+	}
+	now := time.Now().UnixNano() / 1000000
+	for _, job := range []api.WebhookJob{
+		{ID: "due", ServiceID: "svc", NextAttemptTimestamp: now - 1000},
+		{ID: "later", ServiceID: "svc", NextAttemptTimestamp: now + time.Hour.Nanoseconds()/1000000},
+	} {
+		job.Method = "POST"
+		job.URL = "/services/hooks/abc"
+		job.Body = []byte(`{"ref":"refs/heads/master"}`)
+		if err := db.StoreWebhookJob(job); err != nil {
+			t.Fatalf("TestWebhookJobs: failed to store job %s: %s", job.ID, err)
+		}
+	}
+
+	jobs, err := db.ClaimWebhookJobs(10, time.Minute)
+	if err != nil {
+		t.Fatalf("TestWebhookJobs: failed to claim jobs: %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "due" || string(jobs[0].Body) != `{"ref":"refs/heads/master"}` {
+		t.Fatalf("TestWebhookJobs: want [due], got %+v", jobs)
+	}
+	// A claimed job isn't handed out again until the claim runs out.
+	if jobs, err = db.ClaimWebhookJobs(10, time.Minute); err != nil || len(jobs) != 0 {
+		t.Fatalf("TestWebhookJobs: want no jobs while claimed, got %+v (err %v)", jobs, err)
+	}
+
+	if err := db.RescheduleWebhookJob("due", 1, time.Now().Add(-time.Second), "send failed", []string{"!a:localhost"}); err != nil {
+		t.Fatalf("TestWebhookJobs: failed to reschedule job: %s", err)
+	}
+	jobs, err = db.ClaimWebhookJobs(10, time.Minute)
+	if err != nil || len(jobs) != 1 || jobs[0].Attempts != 1 || jobs[0].LastError != "send failed" ||
+		len(jobs[0].SentRooms) != 1 || jobs[0].SentRooms[0] != "!a:localhost" {
+		t.Fatalf("TestWebhookJobs: want rescheduled job, got %+v (err %v)", jobs, err)
+	}
+
+	if err := db.DeleteWebhookJob("due"); err != nil {
+		t.Fatalf("TestWebhookJobs: failed to delete job: %s", err)
+	}
+	if err := db.RescheduleWebhookJob("later", 0, time.Now().Add(-time.Second), "", nil); err != nil {
+		t.Fatalf("TestWebhookJobs: failed to reschedule job: %s", err)
+	}
+	if jobs, err = db.ClaimWebhookJobs(10, time.Minute); err != nil || len(jobs) != 1 || jobs[0].ID != "later" {
+		t.Fatalf("TestWebhookJobs: want [later] after deleting due, got %+v (err %v)", jobs, err)
+	}
+}
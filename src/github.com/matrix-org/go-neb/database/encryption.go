@@ -0,0 +1,325 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// sealedPrefix marks a value which has been encrypted by a Keyring. Values without it are plain text,
+// e.g. because they were written before encryption was enabled.
+const sealedPrefix = "neb-sealed:v1:"
+
+// A Keyring holds the master keys used to encrypt secrets at rest: Matrix access tokens, auth realm
+// and session configs (which hold third-party tokens and private keys), service configs, and the
+// config history of all of these.
+//
+// Values are encrypted with envelope encryption: each value is encrypted with a new random data key
+// using AES-256-GCM, and the data key is encrypted with the current master key. The ID of the master
+// key is stored alongside the value, so older master keys can still decrypt values after the
+// current key has been rotated.
+//
+// A nil *Keyring stores values as plain text.
+type Keyring struct {
+	currentID string
+	keys      map[string]cipher.AEAD // key ID => AEAD
+}
+
+// ParseKeyring parses master keys in the form "id:base64key", separated by commas or newlines.
+// Each key MUST be 32 bytes before base64 encoding. The first key is used to encrypt new values,
+// and every key can be used to decrypt. Returns nil if there are no keys.
+func ParseKeyring(spec string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	entries := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New(`encryption keys must be in the form "id:base64key"`)
+		}
+		id := parts[0]
+		if _, exists := k.keys[id]; exists {
+			return nil, fmt.Errorf("encryption key %q is listed more than once", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q is not valid base64: %s", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes, got %d", id, len(key))
+		}
+		if k.keys[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		if k.currentID == "" {
+			k.currentID = id
+		}
+	}
+	if k.currentID == "" {
+		return nil, nil
+	}
+	return k, nil
+}
+
+// LoadKeyring parses master keys from the given string, or if it is empty from the given file,
+// as described by ParseKeyring. Returns nil if neither is set.
+func LoadKeyring(keys, keysFile string) (*Keyring, error) {
+	if keys == "" && keysFile != "" {
+		contents, err := ioutil.ReadFile(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = string(contents)
+	}
+	return ParseKeyring(keys)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt returns nonce || ciphertext.
+func encrypt(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// seal encrypts a value with a new data key, which is encrypted with the current master key.
+func (k *Keyring) seal(plaintext []byte) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	wrappedKey, err := encrypt(k.keys[k.currentID], dataKey)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := encrypt(dataAEAD, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + k.currentID + ":" + base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// open decrypts a value written by seal. Values which aren't encrypted are returned as they are.
+func (k *Keyring) open(stored []byte) ([]byte, error) {
+	if !strings.HasPrefix(string(stored), sealedPrefix) {
+		return stored, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(string(stored), sealedPrefix), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed encrypted value")
+	}
+	if k == nil {
+		return nil, errors.New("value is encrypted but no encryption keys are configured")
+	}
+	masterAEAD, ok := k.keys[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("value is encrypted with unknown key %q", parts[0])
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := decrypt(masterAEAD, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key with key %q: %s", parts[0], err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(dataAEAD, ciphertext)
+}
+
+// isCurrent returns true if the stored value is encrypted with the current master key, or is plain
+// text and there is no current master key.
+func (k *Keyring) isCurrent(stored []byte) bool {
+	if k == nil {
+		return !strings.HasPrefix(string(stored), sealedPrefix)
+	}
+	return strings.HasPrefix(string(stored), sealedPrefix+k.currentID+":")
+}
+
+// value returns a driver.Valuer which encrypts the plaintext when it is written to the database.
+func (k *Keyring) value(plaintext []byte) driver.Valuer {
+	return sealedValue{k, plaintext}
+}
+
+// scan returns a sql.Scanner which decrypts a value read from the database into dest.
+func (k *Keyring) scan(dest *[]byte) sql.Scanner {
+	return sealedScanner{k, dest}
+}
+
+type sealedValue struct {
+	keys      *Keyring
+	plaintext []byte
+}
+
+func (v sealedValue) Value() (driver.Value, error) {
+	if v.plaintext != nil && len(v.plaintext) == 0 {
+		// The SQLite driver writes an empty []byte as NULL. There is nothing to hide in an empty value.
+		return "", nil
+	}
+	if v.keys == nil || v.plaintext == nil {
+		return v.plaintext, nil
+	}
+	return v.keys.seal(v.plaintext)
+}
+
+type sealedScanner struct {
+	keys *Keyring
+	dest *[]byte
+}
+
+func (s sealedScanner) Scan(src interface{}) error {
+	var stored []byte
+	switch v := src.(type) {
+	case nil:
+		*s.dest = nil
+		return nil
+	case []byte:
+		stored = v
+	case string:
+		stored = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into an encrypted value", src)
+	}
+	plaintext, err := s.keys.open(stored)
+	if err != nil {
+		return err
+	}
+	// src may be reused by the driver once Scan returns.
+	*s.dest = append([]byte(nil), plaintext...)
+	return nil
+}
+
+// sealedColumns lists the encrypted columns of each table, along with the columns which identify
+// a row.
+var sealedColumns = []struct {
+	table   string
+	keys    []string
+	columns []string
+}{
+	{"matrix_clients", []string{"user_id"}, []string{"client_json"}},
+	{"services", []string{"service_id"}, []string{"service_json"}},
+	{"auth_realms", []string{"realm_id"}, []string{"realm_json"}},
+	{"auth_sessions", []string{"realm_id", "user_id"}, []string{"session_json"}},
+	{"config_history", []string{"kind", "id", "version"}, []string{"config_json", "diff_json"}},
+	{"webhook_jobs", []string{"job_id"}, []string{"header_json", "body_base64"}},
+	{"webhook_deliveries", []string{"delivery_id"}, []string{"header_json", "body"}},
+	{"queued_webhooks", []string{"webhook_id"}, []string{"header_json", "body_base64"}},
+}
+
+// reencryptTxn rewrites every encrypted column which isn't encrypted with the current master key,
+// including plain text values. Returns the number of rows which were rewritten.
+func reencryptTxn(txn *sql.Tx, keys *Keyring) (int, error) {
+	count := 0
+	for _, t := range sealedColumns {
+		cols := append(append([]string{}, t.keys...), t.columns...)
+		rows, err := txn.Query("SELECT " + strings.Join(cols, ", ") + " FROM " + t.table)
+		if err != nil {
+			return count, err
+		}
+		// Read every row before updating any, as some drivers can't do both at once.
+		var stale [][]interface{}
+		for rows.Next() {
+			ids := make([]interface{}, len(t.keys))
+			stored := make([][]byte, len(t.columns))
+			dest := make([]interface{}, len(cols))
+			for i := range ids {
+				dest[i] = &ids[i]
+			}
+			for i := range stored {
+				dest[len(ids)+i] = &stored[i]
+			}
+			if err = rows.Scan(dest...); err != nil {
+				rows.Close()
+				return count, err
+			}
+			for i, id := range ids {
+				// Some drivers return TEXT as []byte, which wouldn't match the column in the WHERE.
+				if b, ok := id.([]byte); ok {
+					ids[i] = string(b)
+				}
+			}
+			current := true
+			for _, v := range stored {
+				current = current && (v == nil || keys.isCurrent(v))
+			}
+			if current {
+				continue
+			}
+			args := make([]interface{}, 0, len(cols))
+			for _, v := range stored {
+				plaintext, err := keys.open(v)
+				if err != nil {
+					rows.Close()
+					return count, fmt.Errorf("%s: %s", t.table, err)
+				}
+				if v == nil {
+					plaintext = nil
+				}
+				args = append(args, keys.value(plaintext))
+			}
+			stale = append(stale, append(args, ids...))
+		}
+		if err = rows.Err(); err != nil {
+			rows.Close()
+			return count, err
+		}
+		rows.Close()
+
+		var set, where []string
+		for i, c := range t.columns {
+			set = append(set, fmt.Sprintf("%s = $%d", c, i+1))
+		}
+		for i, k := range t.keys {
+			where = append(where, fmt.Sprintf("%s = $%d", k, len(t.columns)+i+1))
+		}
+		updateSQL := "UPDATE " + t.table + " SET " + strings.Join(set, ", ") + " WHERE " + strings.Join(where, " AND ")
+		for _, args := range stale {
+			if _, err = txn.Exec(updateSQL, args...); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
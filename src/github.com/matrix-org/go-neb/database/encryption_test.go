@@ -0,0 +1,251 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestParseKeyring(t *testing.T) {
+	if keys, err := ParseKeyring(""); err != nil || keys != nil {
+		t.Errorf("TestParseKeyring: expected no keyring for no keys, got %v %v", keys, err)
+	}
+	keys, err := ParseKeyring("new:" + testKey('a') + "\nold:" + testKey('b') + "\n")
+	if err != nil {
+		t.Fatalf("TestParseKeyring: failed to parse keys: %s", err)
+	}
+	if keys.currentID != "new" || len(keys.keys) != 2 {
+		t.Errorf("TestParseKeyring: expected current key 'new' of 2 keys, got %q of %d", keys.currentID, len(keys.keys))
+	}
+	for _, spec := range []string{"nokey", "short:" + testKey('a')[:8], "dup:" + testKey('a') + ",dup:" + testKey('b')} {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Errorf("TestParseKeyring: expected %q to fail", spec)
+		}
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKeys, _ := ParseKeyring("old:" + testKey('a'))
+	newKeys, _ := ParseKeyring("new:" + testKey('b') + ",old:" + testKey('a'))
+	sealed, err := oldKeys.seal([]byte("secret"))
+	if err != nil {
+		t.Fatalf("TestKeyringRotation: failed to seal: %s", err)
+	}
+	if strings.Contains(sealed, "secret") {
+		t.Errorf("TestKeyringRotation: sealed value contains the plaintext: %s", sealed)
+	}
+	if plaintext, err := newKeys.open([]byte(sealed)); err != nil || string(plaintext) != "secret" {
+		t.Errorf("TestKeyringRotation: expected rotated keyring to open old value, got %q %v", plaintext, err)
+	}
+	if newKeys.isCurrent([]byte(sealed)) {
+		t.Errorf("TestKeyringRotation: expected value sealed with the old key not to be current")
+	}
+	if _, err := (*Keyring)(nil).open([]byte(sealed)); err == nil {
+		t.Errorf("TestKeyringRotation: expected opening a sealed value without keys to fail")
+	}
+	if plaintext, err := newKeys.open([]byte(`{"plain":true}`)); err != nil || string(plaintext) != `{"plain":true}` {
+		t.Errorf("TestKeyringRotation: expected plain text to pass through, got %q %v", plaintext, err)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestReencrypt: failed to open database: %s", err)
+	}
+	config := api.ClientConfig{UserID: "@alice:localhost", HomeserverURL: "http://localhost", AccessToken: "s3cr3t"}
+	if _, err = db.StoreMatrixClientConfig(config); err != nil {
+		t.Fatalf("TestReencrypt: failed to store client: %s", err)
+	}
+
+	keys, _ := ParseKeyring("k1:" + testKey('a'))
+	db.SetKeyring(keys)
+	count, err := db.Reencrypt()
+	if err != nil || count != 1 {
+		t.Fatalf("TestReencrypt: expected 1 row to be re-encrypted, got %d %v", count, err)
+	}
+	var stored string
+	if err = db.db.QueryRow("SELECT client_json FROM matrix_clients").Scan(&stored); err != nil {
+		t.Fatalf("TestReencrypt: failed to select client: %s", err)
+	}
+	if strings.Contains(stored, "s3cr3t") || !strings.HasPrefix(stored, sealedPrefix) {
+		t.Errorf("TestReencrypt: expected client to be encrypted, got %s", stored)
+	}
+	loaded, err := db.LoadMatrixClientConfig(config.UserID)
+	if err != nil || loaded.AccessToken != "s3cr3t" {
+		t.Errorf("TestReencrypt: expected to load the decrypted client, got %+v %v", loaded, err)
+	}
+	if count, err = db.Reencrypt(); err != nil || count != 0 {
+		t.Errorf("TestReencrypt: expected nothing to re-encrypt, got %d %v", count, err)
+	}
+
+	db.SetKeyring(nil)
+	if _, err = db.LoadMatrixClientConfig(config.UserID); err == nil || err == sql.ErrNoRows {
+		t.Errorf("TestReencrypt: expected loading without keys to fail, got %v", err)
+	}
+}
+
+type testRealm struct {
+	id     string
+	Secret string
+}
+
+type testSession struct {
+	id, userID, realmID string
+	Token               string
+}
+
+func (r *testRealm) ID() string                                                           { return r.id }
+func (r *testRealm) Type() string                                                         { return "encryption-test" }
+func (r *testRealm) Init() error                                                          { return nil }
+func (r *testRealm) Register() error                                                      { return nil }
+func (r *testRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request)           {}
+func (r *testRealm) RequestAuthSession(userID string, config json.RawMessage) interface{} { return nil }
+func (r *testRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &testSession{id: id, userID: userID, realmID: realmID}
+}
+
+func (s *testSession) ID() string          { return s.id }
+func (s *testSession) UserID() string      { return s.userID }
+func (s *testSession) RealmID() string     { return s.realmID }
+func (s *testSession) Authenticated() bool { return s.Token != "" }
+func (s *testSession) Info() interface{}   { return nil }
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &testRealm{id: realmID}
+	})
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to open database: %s", err)
+	}
+	keys, _ := ParseKeyring("k1:" + testKey('a'))
+	db.SetKeyring(keys)
+
+	realm, err := types.CreateAuthRealm("realm", "encryption-test", []byte(`{"Secret":"realm-s3cr3t"}`))
+	if err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to create realm: %s", err)
+	}
+	if _, err = db.StoreAuthRealm(realm); err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to store realm: %s", err)
+	}
+	session := &testSession{id: "sess", userID: "@alice:localhost", realmID: "realm", Token: "session-s3cr3t"}
+	if _, err = db.StoreAuthSession(session); err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to store session: %s", err)
+	}
+	// Storing it again goes through the update path.
+	if _, err = db.StoreAuthSession(session); err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to update session: %s", err)
+	}
+	service, _ := types.CreateService("svc", "db-test", "@bot:localhost", []byte(`{"Value":"service-s3cr3t"}`))
+	if _, err = db.StoreService(service); err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to store service: %s", err)
+	}
+	// Webhook payloads needn't be valid UTF-8.
+	body := []byte("\xff{\"secret\":\"body-s3cr3t\"}")
+	err = db.StoreWebhookJob(api.WebhookJob{
+		ID:        "job",
+		ServiceID: "svc",
+		Header:    http.Header{"X-Hub-Signature": []string{"sha1=header-s3cr3t"}},
+		Body:      body,
+	})
+	if err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to store webhook job: %s", err)
+	}
+	err = db.StoreWebhookDelivery(api.WebhookDelivery{
+		ID:        "delivery",
+		ServiceID: "svc",
+		Header:    http.Header{"X-Hub-Signature": []string{"sha1=header-s3cr3t"}},
+		Body:      `{"secret":"body-s3cr3t"}`,
+	})
+	if err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to store webhook delivery: %s", err)
+	}
+	if err = db.StoreServicePause(api.ServicePause{ServiceID: "svc", QueueWebhooks: true}); err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to pause service: %s", err)
+	}
+	err = db.StoreQueuedWebhook(api.QueuedWebhook{
+		ServiceID: "svc",
+		Header:    http.Header{"X-Hub-Signature": []string{"sha1=header-s3cr3t"}},
+		Body:      body,
+		Timestamp: 1,
+	})
+	if err != nil {
+		t.Fatalf("TestEncryptedRoundTrip: failed to store queued webhook: %s", err)
+	}
+
+	for _, q := range []string{
+		"SELECT realm_json FROM auth_realms",
+		"SELECT session_json FROM auth_sessions",
+		"SELECT service_json FROM services",
+		"SELECT header_json FROM webhook_jobs",
+		"SELECT body_base64 FROM webhook_jobs",
+		"SELECT header_json FROM webhook_deliveries",
+		"SELECT body FROM webhook_deliveries",
+		"SELECT header_json FROM queued_webhooks",
+		"SELECT body_base64 FROM queued_webhooks",
+	} {
+		var stored string
+		if err = db.db.QueryRow(q).Scan(&stored); err != nil {
+			t.Fatalf("TestEncryptedRoundTrip: %s failed: %s", q, err)
+		}
+		if strings.Contains(stored, "s3cr3t") || !strings.HasPrefix(stored, sealedPrefix) {
+			t.Errorf("TestEncryptedRoundTrip: %s: expected an encrypted value, got %s", q, stored)
+		}
+	}
+
+	loadedRealm, err := db.LoadAuthRealm("realm")
+	if err != nil || loadedRealm.(*testRealm).Secret != "realm-s3cr3t" {
+		t.Errorf("TestEncryptedRoundTrip: expected to load the decrypted realm, got %+v %v", loadedRealm, err)
+	}
+	for name, load := range map[string]func() (types.AuthSession, error){
+		"by user": func() (types.AuthSession, error) { return db.LoadAuthSessionByUser("realm", "@alice:localhost") },
+		"by ID":   func() (types.AuthSession, error) { return db.LoadAuthSessionByID("realm", "sess") },
+	} {
+		loaded, err := load()
+		if err != nil || loaded.(*testSession).Token != "session-s3cr3t" {
+			t.Errorf("TestEncryptedRoundTrip: expected to load the decrypted session %s, got %+v %v", name, loaded, err)
+		}
+	}
+	sessions, err := db.LoadAuthSessionsByRealm("realm")
+	if err != nil || len(sessions) != 1 || sessions[0].(*testSession).Token != "session-s3cr3t" {
+		t.Errorf("TestEncryptedRoundTrip: expected to load the decrypted sessions by realm, got %+v %v", sessions, err)
+	}
+	loadedService, err := db.LoadService("svc")
+	if err != nil || loadedService.(*versionedService).Value != "service-s3cr3t" {
+		t.Errorf("TestEncryptedRoundTrip: expected to load the decrypted service, got %+v %v", loadedService, err)
+	}
+	delivery, err := db.LoadWebhookDelivery("delivery")
+	if err != nil || delivery.Body != `{"secret":"body-s3cr3t"}` ||
+		delivery.Header.Get("X-Hub-Signature") != "sha1=header-s3cr3t" {
+		t.Errorf("TestEncryptedRoundTrip: expected to load the decrypted webhook delivery, got %+v %v", delivery, err)
+	}
+	// Resuming the service moves the queued webhook to the webhook queue.
+	if queued, err := db.DeleteServicePause("svc"); err != nil || queued != 1 {
+		t.Fatalf("TestEncryptedRoundTrip: expected to resume the service with 1 queued webhook, got %d %v", queued, err)
+	}
+	jobs, err := db.ClaimWebhookJobs(2, time.Minute)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("TestEncryptedRoundTrip: expected to load 2 webhook jobs, got %+v %v", jobs, err)
+	}
+	for _, job := range jobs {
+		if !bytes.Equal(job.Body, body) || job.Header.Get("X-Hub-Signature") != "sha1=header-s3cr3t" {
+			t.Errorf("TestEncryptedRoundTrip: expected to load the decrypted webhook job, got %+v", job)
+		}
+	}
+}
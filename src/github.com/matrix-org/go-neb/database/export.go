@@ -0,0 +1,77 @@
+package database
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/go-neb/api"
+)
+
+// Export dumps every client, realm, session and service in the database into a ConfigFile
+// which can be used to run Go-NEB in config mode, or imported into another database.
+// Secrets are included: call ConfigFile.Redact to remove them.
+func Export(db Storer) (*api.ConfigFile, error) {
+	cfg := &api.ConfigFile{
+		Clients:  []api.ClientConfig{},
+		Realms:   []api.ConfigureAuthRealmRequest{},
+		Services: []api.ConfigureServiceRequest{},
+		Sessions: []api.Session{},
+	}
+
+	clients, err := db.LoadMatrixClientConfigs()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Clients = append(cfg.Clients, clients...)
+
+	realms, err := db.LoadAuthRealms()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range realms {
+		realmJSON, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Realms = append(cfg.Realms, api.ConfigureAuthRealmRequest{
+			ID:     r.ID(),
+			Type:   r.Type(),
+			Config: realmJSON,
+		})
+
+		sessions, err := db.LoadAuthSessionsByRealm(r.ID())
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sessions {
+			// This is the inverse of InsertFromConfig, which dumps the raw JSON into the session.
+			sessionJSON, err := json.Marshal(s)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Sessions = append(cfg.Sessions, api.Session{
+				SessionID: s.ID(),
+				RealmID:   s.RealmID(),
+				UserID:    s.UserID(),
+				Config:    sessionJSON,
+			})
+		}
+	}
+
+	services, err := db.LoadServices("", "", "", 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range services {
+		serviceJSON, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Services = append(cfg.Services, api.ConfigureServiceRequest{
+			ID:     s.ServiceID(),
+			Type:   s.ServiceType(),
+			UserID: s.ServiceUserID(),
+			Config: serviceJSON,
+		})
+	}
+	return cfg, nil
+}
@@ -1,6 +1,9 @@
 package database
 
 import (
+	"database/sql"
+	"time"
+
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
 )
@@ -10,28 +13,66 @@ type Storer interface {
 	StoreMatrixClientConfig(config api.ClientConfig) (oldConfig api.ClientConfig, err error)
 	LoadMatrixClientConfigs() (configs []api.ClientConfig, err error)
 	LoadMatrixClientConfig(userID string) (config api.ClientConfig, err error)
+	DeleteMatrixClientConfig(userID string) (err error)
 
 	UpdateNextBatch(userID, nextBatch string) (err error)
 	LoadNextBatch(userID string) (nextBatch string, err error)
 
 	LoadService(serviceID string) (service types.Service, err error)
+	LoadCachedService(serviceID string) (service types.Service, err error)
 	DeleteService(serviceID string) (err error)
 	LoadServicesForUser(serviceUserID string) (services []types.Service, err error)
+	LoadCachedServicesForUser(serviceUserID string) (services []types.Service, err error)
 	LoadServicesByType(serviceType string) (services []types.Service, err error)
+	LoadServices(serviceType, serviceUserID, from string, limit int) (services []types.Service, err error)
 	StoreService(service types.Service) (oldService types.Service, err error)
 
 	LoadAuthRealm(realmID string) (realm types.AuthRealm, err error)
 	LoadAuthRealmsByType(realmType string) (realms []types.AuthRealm, err error)
+	LoadAuthRealms() (realms []types.AuthRealm, err error)
 	StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error)
+	DeleteAuthRealm(realmID string) (err error)
 
 	StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error)
 	LoadAuthSessionByUser(realmID, userID string) (session types.AuthSession, err error)
 	LoadAuthSessionByID(realmID, sessionID string) (session types.AuthSession, err error)
+	LoadAuthSessionsByRealm(realmID string) (sessions []types.AuthSession, err error)
 	RemoveAuthSession(realmID, userID string) error
 
 	LoadBotOptions(userID, roomID string) (opts types.BotOptions, err error)
 	StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOptions, err error)
 
+	StoreConfigHistory(entry api.ConfigHistoryEntry) (stored api.ConfigHistoryEntry, err error)
+	LoadConfigHistory(kind, id string) (entries []api.ConfigHistoryEntry, err error)
+	LoadConfigHistoryVersion(kind, id string, version int64) (entry api.ConfigHistoryEntry, err error)
+
+	StoreServicePause(pause api.ServicePause) error
+	LoadServicePause(serviceID string) (pause api.ServicePause, err error)
+	LoadCachedServicePause(serviceID string) (pause api.ServicePause, err error)
+	DeleteServicePause(serviceID string) (queued int, err error)
+	StoreQueuedWebhook(webhook api.QueuedWebhook) error
+
+	StoreWebhookDelivery(delivery api.WebhookDelivery) error
+	DeleteExpiredWebhookDeliveries(before time.Time) (count int64, err error)
+	StoreWebhookDeliveryOutcome(deliveryID string, statusCode int, errMsg string, replayed bool) error
+	LoadWebhookDeliveries(serviceID string, limit int) (deliveries []api.WebhookDelivery, err error)
+	LoadWebhookDelivery(deliveryID string) (delivery api.WebhookDelivery, err error)
+
+	StoreWebhookJob(job api.WebhookJob) error
+	ClaimWebhookJobs(limit int, claimFor time.Duration) (jobs []api.WebhookJob, err error)
+	RescheduleWebhookJob(jobID string, attempts int, nextAttempt time.Time, lastError string, sentRooms []string) error
+	DeleteWebhookJob(jobID string) error
+
+	StoreServiceState(state api.ServiceState) error
+	LoadServiceState(serviceID, namespace, key string) (state api.ServiceState, err error)
+	ScanServiceState(serviceID, namespace, prefix string) (states []api.ServiceState, err error)
+	DeleteServiceState(serviceID, namespace, key string) error
+
+	StoreManagedConfig(kind string, ids []string) error
+	IsManagedConfig(kind, id string) (managed bool, err error)
+
+	AcquireLease(name, owner string, ttl time.Duration) (acquired bool, err error)
+
 	InsertFromConfig(cfg *api.ConfigFile) error
 }
 
@@ -54,6 +95,11 @@ func (s *NopStorage) LoadMatrixClientConfig(userID string) (config api.ClientCon
 	return
 }
 
+// DeleteMatrixClientConfig NOP
+func (s *NopStorage) DeleteMatrixClientConfig(userID string) (err error) {
+	return
+}
+
 // UpdateNextBatch NOP
 func (s *NopStorage) UpdateNextBatch(userID, nextBatch string) (err error) {
 	return
@@ -69,6 +115,11 @@ func (s *NopStorage) LoadService(serviceID string) (service types.Service, err e
 	return
 }
 
+// LoadCachedService NOP
+func (s *NopStorage) LoadCachedService(serviceID string) (service types.Service, err error) {
+	return
+}
+
 // DeleteService NOP
 func (s *NopStorage) DeleteService(serviceID string) (err error) {
 	return
@@ -79,11 +130,21 @@ func (s *NopStorage) LoadServicesForUser(serviceUserID string) (services []types
 	return
 }
 
+// LoadCachedServicesForUser NOP
+func (s *NopStorage) LoadCachedServicesForUser(serviceUserID string) (services []types.Service, err error) {
+	return
+}
+
 // LoadServicesByType NOP
 func (s *NopStorage) LoadServicesByType(serviceType string) (services []types.Service, err error) {
 	return
 }
 
+// LoadServices NOP
+func (s *NopStorage) LoadServices(serviceType, serviceUserID, from string, limit int) (services []types.Service, err error) {
+	return
+}
+
 // StoreService NOP
 func (s *NopStorage) StoreService(service types.Service) (oldService types.Service, err error) {
 	return
@@ -99,11 +160,21 @@ func (s *NopStorage) LoadAuthRealmsByType(realmType string) (realms []types.Auth
 	return
 }
 
+// LoadAuthRealms NOP
+func (s *NopStorage) LoadAuthRealms() (realms []types.AuthRealm, err error) {
+	return
+}
+
 // StoreAuthRealm NOP
 func (s *NopStorage) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error) {
 	return
 }
 
+// DeleteAuthRealm NOP
+func (s *NopStorage) DeleteAuthRealm(realmID string) (err error) {
+	return
+}
+
 // StoreAuthSession NOP
 func (s *NopStorage) StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error) {
 	return
@@ -119,6 +190,11 @@ func (s *NopStorage) LoadAuthSessionByID(realmID, sessionID string) (session typ
 	return
 }
 
+// LoadAuthSessionsByRealm NOP
+func (s *NopStorage) LoadAuthSessionsByRealm(realmID string) (sessions []types.AuthSession, err error) {
+	return
+}
+
 // RemoveAuthSession NOP
 func (s *NopStorage) RemoveAuthSession(realmID, userID string) error {
 	return nil
@@ -134,6 +210,126 @@ func (s *NopStorage) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOp
 	return
 }
 
+// StoreConfigHistory NOP
+func (s *NopStorage) StoreConfigHistory(entry api.ConfigHistoryEntry) (stored api.ConfigHistoryEntry, err error) {
+	return
+}
+
+// LoadConfigHistory NOP
+func (s *NopStorage) LoadConfigHistory(kind, id string) (entries []api.ConfigHistoryEntry, err error) {
+	return
+}
+
+// LoadConfigHistoryVersion NOP
+func (s *NopStorage) LoadConfigHistoryVersion(kind, id string, version int64) (entry api.ConfigHistoryEntry, err error) {
+	return
+}
+
+// StoreServicePause NOP
+func (s *NopStorage) StoreServicePause(pause api.ServicePause) error {
+	return nil
+}
+
+// LoadServicePause NOP
+func (s *NopStorage) LoadServicePause(serviceID string) (pause api.ServicePause, err error) {
+	return pause, sql.ErrNoRows
+}
+
+// LoadCachedServicePause NOP
+func (s *NopStorage) LoadCachedServicePause(serviceID string) (pause api.ServicePause, err error) {
+	return pause, sql.ErrNoRows
+}
+
+// DeleteServicePause NOP
+func (s *NopStorage) DeleteServicePause(serviceID string) (queued int, err error) {
+	return
+}
+
+// StoreQueuedWebhook NOP
+func (s *NopStorage) StoreQueuedWebhook(webhook api.QueuedWebhook) error {
+	return nil
+}
+
+// StoreWebhookDelivery NOP
+func (s *NopStorage) StoreWebhookDelivery(delivery api.WebhookDelivery) error {
+	return nil
+}
+
+// DeleteExpiredWebhookDeliveries NOP
+func (s *NopStorage) DeleteExpiredWebhookDeliveries(before time.Time) (count int64, err error) {
+	return
+}
+
+// StoreWebhookDeliveryOutcome NOP
+func (s *NopStorage) StoreWebhookDeliveryOutcome(deliveryID string, statusCode int, errMsg string, replayed bool) error {
+	return nil
+}
+
+// LoadWebhookDeliveries NOP
+func (s *NopStorage) LoadWebhookDeliveries(serviceID string, limit int) (deliveries []api.WebhookDelivery, err error) {
+	return
+}
+
+// LoadWebhookDelivery NOP
+func (s *NopStorage) LoadWebhookDelivery(deliveryID string) (delivery api.WebhookDelivery, err error) {
+	return
+}
+
+// StoreWebhookJob NOP
+func (s *NopStorage) StoreWebhookJob(job api.WebhookJob) error {
+	return nil
+}
+
+// ClaimWebhookJobs NOP
+func (s *NopStorage) ClaimWebhookJobs(limit int, claimFor time.Duration) (jobs []api.WebhookJob, err error) {
+	return
+}
+
+// RescheduleWebhookJob NOP
+func (s *NopStorage) RescheduleWebhookJob(jobID string, attempts int, nextAttempt time.Time, lastError string, sentRooms []string) error {
+	return nil
+}
+
+// DeleteWebhookJob NOP
+func (s *NopStorage) DeleteWebhookJob(jobID string) error {
+	return nil
+}
+
+// StoreServiceState NOP
+func (s *NopStorage) StoreServiceState(state api.ServiceState) error {
+	return nil
+}
+
+// LoadServiceState NOP
+func (s *NopStorage) LoadServiceState(serviceID, namespace, key string) (state api.ServiceState, err error) {
+	return state, sql.ErrNoRows
+}
+
+// ScanServiceState NOP
+func (s *NopStorage) ScanServiceState(serviceID, namespace, prefix string) (states []api.ServiceState, err error) {
+	return
+}
+
+// DeleteServiceState NOP
+func (s *NopStorage) DeleteServiceState(serviceID, namespace, key string) error {
+	return nil
+}
+
+// StoreManagedConfig NOP
+func (s *NopStorage) StoreManagedConfig(kind string, ids []string) error {
+	return nil
+}
+
+// IsManagedConfig NOP
+func (s *NopStorage) IsManagedConfig(kind, id string) (managed bool, err error) {
+	return
+}
+
+// AcquireLease NOP
+func (s *NopStorage) AcquireLease(name, owner string, ttl time.Duration) (acquired bool, err error) {
+	return
+}
+
 // InsertFromConfig NOP
 func (s *NopStorage) InsertFromConfig(cfg *api.ConfigFile) error {
 	return nil
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A migration is a single, ordered change to the database schema. Migrations are applied in
+// order of Version, each in its own transaction, and are recorded in the schema_migrations table
+// so that each is only applied once.
+//
+// Migrations MUST NOT be changed once released: add a new migration instead. Their SQL MUST be
+// idempotent (e.g. "CREATE TABLE IF NOT EXISTS") so that a migration which was applied but not
+// recorded, e.g. because of a crash, can safely be applied again. Where a database type has no
+// idempotent form of a statement, set AppliedSQL to detect that the migration was already applied.
+type migration struct {
+	Version     int
+	Description string
+	// The SQL to run for every database type, unless overridden below.
+	SQL string
+	// The SQL to run for each database type ("sqlite3", "postgres") where it differs from SQL.
+	DialectSQL map[string]string
+	// A query for each database type which returns a row if the changes this migration makes
+	// are already in the database, in which case the migration is recorded without running SQL.
+	AppliedSQL map[string]string
+}
+
+// migrations is every migration, in order. The latest version is the schema version which this
+// version of Go-NEB expects.
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "Create the tables which existed before schema migrations",
+		SQL:         schemaSQL,
+	},
+	{
+		Version:     2,
+		Description: "Add the per-service state store",
+		SQL: `
+CREATE TABLE IF NOT EXISTS service_state (
+	service_id TEXT NOT NULL,
+	namespace TEXT NOT NULL,
+	state_key TEXT NOT NULL,
+	state_value_base64 TEXT NOT NULL,
+	time_expires_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(service_id, namespace, state_key)
+);
+`,
+	},
+	{
+		Version:     3,
+		Description: "Add a version to services for optimistic concurrency control",
+		SQL: `
+ALTER TABLE services ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+`,
+		DialectSQL: map[string]string{
+			"postgres": `
+ALTER TABLE services ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+`,
+		},
+		// SQLite has no "ADD COLUMN IF NOT EXISTS".
+		AppliedSQL: map[string]string{
+			"sqlite3": `SELECT 1 FROM pragma_table_info('services') WHERE name = 'version'`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "Add a generation which changes whenever any service changes",
+		SQL: `
+CREATE TABLE IF NOT EXISTS service_generation (
+	generation BIGINT NOT NULL
+);
+INSERT INTO service_generation(generation) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM service_generation);
+`,
+	},
+	{
+		Version:     5,
+		Description: "Add leases for electing which instance syncs clients and polls services",
+		SQL: `
+CREATE TABLE IF NOT EXISTS leases (
+	lease_name TEXT NOT NULL PRIMARY KEY,
+	owner TEXT NOT NULL,
+	time_expires_ms BIGINT NOT NULL
+);
+`,
+	},
+	{
+		Version:     6,
+		Description: "Add the webhook journal",
+		SQL: `
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	delivery_id TEXT NOT NULL PRIMARY KEY,
+	service_id TEXT NOT NULL,
+	correlation_id TEXT NOT NULL,
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	header_json TEXT NOT NULL,
+	body TEXT NOT NULL,
+	time_received_ms BIGINT NOT NULL,
+	status_code BIGINT NOT NULL,
+	error TEXT NOT NULL,
+	time_processed_ms BIGINT NOT NULL,
+	replays BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_service_idx ON webhook_deliveries(service_id, time_received_ms);
+`,
+	},
+	{
+		Version:     7,
+		Description: "Add the queue of webhooks to handle in the background",
+		SQL: `
+CREATE TABLE IF NOT EXISTS webhook_jobs (
+	job_id TEXT NOT NULL PRIMARY KEY,
+	service_id TEXT NOT NULL,
+	delivery_id TEXT NOT NULL,
+	correlation_id TEXT NOT NULL,
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	header_json TEXT NOT NULL,
+	body_base64 TEXT NOT NULL,
+	time_received_ms BIGINT NOT NULL,
+	attempts BIGINT NOT NULL,
+	time_next_attempt_ms BIGINT NOT NULL,
+	last_error TEXT NOT NULL,
+	sent_rooms_json TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS webhook_jobs_next_attempt_idx ON webhook_jobs(time_next_attempt_ms);
+`,
+	},
+}
+
+const createSchemaMigrationsSQL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT NOT NULL PRIMARY KEY,
+	description TEXT NOT NULL,
+	time_applied_ms BIGINT NOT NULL
+);
+`
+
+// migrationsLockID identifies the Postgres advisory lock which is held while migrating, so that
+// instances which start at the same time apply each migration once, in order.
+const migrationsLockID = 0x6e6562 // "neb"
+
+var lockMigrationsSQL = map[string]string{
+	"postgres": `SELECT pg_advisory_lock($1)`,
+}
+
+var unlockMigrationsSQL = map[string]string{
+	"postgres": `SELECT pg_advisory_unlock($1)`,
+}
+
+const selectSchemaVersionSQL = `
+SELECT COALESCE(MAX(version), 0) FROM schema_migrations
+`
+
+const insertSchemaMigrationSQL = `
+INSERT INTO schema_migrations(version, description, time_applied_ms) VALUES ($1, $2, $3)
+`
+
+// LatestSchemaVersion returns the schema version which this version of Go-NEB expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// migrate applies every migration which hasn't been applied to the database yet. Returns an error
+// without changing anything if the database has a newer schema than this version of Go-NEB knows
+// about, as it is not safe to run an older Go-NEB against it. On Postgres, migrations are run while
+// holding an advisory lock, so several instances can start against the same database at once.
+func migrate(db *sql.DB, databaseType string) error {
+	// Session locks belong to a connection, so everything has to be run on the same one.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if lock, ok := lockMigrationsSQL[databaseType]; ok {
+		if _, err = conn.ExecContext(ctx, lock, migrationsLockID); err != nil {
+			return fmt.Errorf("failed to lock schema migrations: %s", err)
+		}
+		defer conn.ExecContext(ctx, unlockMigrationsSQL[databaseType], migrationsLockID)
+	}
+
+	if _, err = conn.ExecContext(ctx, createSchemaMigrationsSQL); err != nil {
+		return err
+	}
+	var current int
+	if err = conn.QueryRowContext(ctx, selectSchemaVersionSQL).Scan(&current); err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		return newerSchemaError(current)
+	}
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err = applyMigration(ctx, conn, databaseType, m); err != nil {
+			return fmt.Errorf("schema migration %d (%s) failed: %s", m.Version, m.Description, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a migration and records it in a single transaction.
+func applyMigration(ctx context.Context, conn *sql.Conn, databaseType string, m migration) (err error) {
+	txn, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+		} else {
+			err = txn.Commit()
+		}
+	}()
+	applied := false
+	if appliedSQL, ok := m.AppliedSQL[databaseType]; ok {
+		var row int
+		switch err = txn.QueryRow(appliedSQL).Scan(&row); err {
+		case nil:
+			applied = true
+		case sql.ErrNoRows:
+			err = nil
+		default:
+			return
+		}
+	}
+	if !applied {
+		query := m.SQL
+		if dialectSQL, ok := m.DialectSQL[databaseType]; ok {
+			query = dialectSQL
+		}
+		if _, err = txn.Exec(query); err != nil {
+			return
+		}
+	}
+	_, err = txn.Exec(insertSchemaMigrationSQL, m.Version, m.Description, time.Now().UnixNano()/1000000)
+	return
+}
+
+func schemaVersion(db *sql.DB) (version int, err error) {
+	err = db.QueryRow(selectSchemaVersionSQL).Scan(&version)
+	return
+}
+
+// checkSchemaVersion returns an error unless every migration has been applied to the database,
+// and no newer ones.
+func checkSchemaVersion(db *sql.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed to read the database schema version: %s", err)
+	}
+	if latest := LatestSchemaVersion(); version < latest {
+		return fmt.Errorf(
+			"database schema version %d is older than this version of Go-NEB expects (%d): run go-neb --migrate-only first",
+			version, latest,
+		)
+	} else if version > latest {
+		return newerSchemaError(version)
+	}
+	return nil
+}
+
+func newerSchemaError(version int) error {
+	return fmt.Errorf(
+		"database schema version %d is newer than this version of Go-NEB supports (%d): upgrade Go-NEB",
+		version, LatestSchemaVersion(),
+	)
+}
+
+// SchemaVersion returns the version of the database schema.
+func (d *ServiceDB) SchemaVersion() (int, error) {
+	return schemaVersion(d.db)
+}
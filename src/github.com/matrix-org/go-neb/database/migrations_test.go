@@ -0,0 +1,98 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestMigrateIsIdempotent: failed to open database: %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	for i := 0; i < 2; i++ {
+		if err = migrate(db, "sqlite3"); err != nil {
+			t.Fatalf("TestMigrateIsIdempotent: migration %d failed: %s", i, err)
+		}
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatalf("TestMigrateIsIdempotent: failed to get schema version: %s", err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("TestMigrateIsIdempotent: expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestMigrateRefusesNewerDatabase: failed to open database: %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	if err = migrate(db, "sqlite3"); err != nil {
+		t.Fatalf("TestMigrateRefusesNewerDatabase: migration failed: %s", err)
+	}
+	if _, err = db.Exec(insertSchemaMigrationSQL, LatestSchemaVersion()+1, "From the future", 0); err != nil {
+		t.Fatalf("TestMigrateRefusesNewerDatabase: failed to insert future migration: %s", err)
+	}
+	if err = migrate(db, "sqlite3"); err == nil {
+		t.Errorf("TestMigrateRefusesNewerDatabase: expected migrating a newer database to fail")
+	}
+}
+
+func TestMigrateReappliesUnrecordedMigrations(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestMigrateReappliesUnrecordedMigrations: failed to open database: %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	if err = migrate(db, "sqlite3"); err != nil {
+		t.Fatalf("TestMigrateReappliesUnrecordedMigrations: migration failed: %s", err)
+	}
+	// Forget every migration, as if each had been applied but Go-NEB crashed before recording it.
+	if _, err = db.Exec("DELETE FROM schema_migrations"); err != nil {
+		t.Fatalf("TestMigrateReappliesUnrecordedMigrations: failed to forget migrations: %s", err)
+	}
+	if err = migrate(db, "sqlite3"); err != nil {
+		t.Fatalf("TestMigrateReappliesUnrecordedMigrations: expected migrations to be applied again, got %s", err)
+	}
+	var generations int
+	if err = db.QueryRow("SELECT COUNT(*) FROM service_generation").Scan(&generations); err != nil {
+		t.Fatalf("TestMigrateReappliesUnrecordedMigrations: failed to count generations: %s", err)
+	}
+	if generations != 1 {
+		t.Errorf("TestMigrateReappliesUnrecordedMigrations: expected 1 service generation, got %d", generations)
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("TestCheckSchemaVersion: failed to open database: %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	if err = checkSchemaVersion(db); err == nil {
+		t.Errorf("TestCheckSchemaVersion: expected a database without a schema to be refused")
+	}
+	if err = migrate(db, "sqlite3"); err != nil {
+		t.Fatalf("TestCheckSchemaVersion: migration failed: %s", err)
+	}
+	if err = checkSchemaVersion(db); err != nil {
+		t.Errorf("TestCheckSchemaVersion: expected a migrated database to be accepted, got %s", err)
+	}
+
+	// Pretend the latest migration hasn't been applied.
+	if _, err = db.Exec("DELETE FROM schema_migrations WHERE version = $1", LatestSchemaVersion()); err != nil {
+		t.Fatalf("TestCheckSchemaVersion: failed to forget migration: %s", err)
+	}
+	if err = checkSchemaVersion(db); err == nil {
+		t.Errorf("TestCheckSchemaVersion: expected a database with pending migrations to be refused")
+	}
+	if version, err := schemaVersion(db); err != nil || version != LatestSchemaVersion()-1 {
+		t.Errorf("TestCheckSchemaVersion: expected the schema to be left at version %d, got %d %v", LatestSchemaVersion()-1, version, err)
+	}
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+)
+
+// registryRefreshInterval is how often the registry checks whether another Go-NEB process sharing
+// the database has changed any services.
+const registryRefreshInterval = 5 * time.Second
+
+// serviceRegistry caches services and their pauses loaded from the database, so that looking up
+// the services for every incoming message and webhook doesn't query the database and unmarshal the
+// JSON of every service each time.
+//
+// Every change to the services and service_pauses tables increments the generation in the
+// service_generation table in the same transaction. The cache is dropped whenever this process changes a service, and
+// whenever the generation has changed when it is next checked, which picks up changes made by
+// other processes within registryRefreshInterval.
+type serviceRegistry struct {
+	mu         sync.Mutex
+	generation int64
+	checked    time.Time
+	// epoch is incremented whenever the cache is dropped, so that services which were loaded
+	// from the database before a change aren't cached after it.
+	epoch  int64
+	byID   map[string]types.Service
+	byUser map[string][]types.Service
+	// The pause of each service, or nil if it isn't paused.
+	pauses map[string]*api.ServicePause
+}
+
+func newServiceRegistry() *serviceRegistry {
+	return &serviceRegistry{
+		byID:   make(map[string]types.Service),
+		byUser: make(map[string][]types.Service),
+		pauses: make(map[string]*api.ServicePause),
+	}
+}
+
+// refresh drops the cache if the generation in the database has changed since it was last
+// checked. Returns the current epoch, which must be passed to add.
+func (r *serviceRegistry) refresh(db *sql.DB) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < registryRefreshInterval {
+		return r.epoch
+	}
+	var generation int64
+	if err := db.QueryRow(selectServiceGenerationSQL).Scan(&generation); err != nil {
+		// Don't trust the cache if we can't tell whether it is stale.
+		r.dropLocked()
+		return r.epoch
+	}
+	if generation != r.generation {
+		r.dropLocked()
+		r.generation = generation
+	}
+	r.checked = time.Now()
+	return r.epoch
+}
+
+// invalidate drops the cache after this process has changed a service.
+func (r *serviceRegistry) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dropLocked()
+	// Pick up the new generation next time, so that we don't drop the cache again for our own change.
+	r.checked = time.Time{}
+}
+
+func (r *serviceRegistry) dropLocked() {
+	r.epoch++
+	r.byID = make(map[string]types.Service)
+	r.byUser = make(map[string][]types.Service)
+	r.pauses = make(map[string]*api.ServicePause)
+}
+
+func (r *serviceRegistry) service(serviceID string) (types.Service, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.byID[serviceID]
+	return s, ok
+}
+
+func (r *serviceRegistry) servicesForUser(userID string) ([]types.Service, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.byUser[userID]
+	return s, ok
+}
+
+func (r *serviceRegistry) pause(serviceID string) (*api.ServicePause, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pauses[serviceID]
+	return p, ok
+}
+
+func (r *serviceRegistry) addService(epoch int64, service types.Service) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if epoch == r.epoch {
+		r.byID[service.ServiceID()] = service
+	}
+}
+
+func (r *serviceRegistry) addServicesForUser(epoch int64, userID string, services []types.Service) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if epoch == r.epoch {
+		r.byUser[userID] = services
+	}
+}
+
+func (r *serviceRegistry) addPause(epoch int64, serviceID string, pause *api.ServicePause) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if epoch == r.epoch {
+		r.pauses[serviceID] = pause
+	}
+}
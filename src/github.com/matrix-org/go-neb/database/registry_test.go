@@ -0,0 +1,145 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/types"
+)
+
+func openWithServices(tb testing.TB, userID string, count int) *ServiceDB {
+	db, err := Open("sqlite3", ":memory:")
+	if err != nil {
+		tb.Fatalf("failed to open database: %s", err)
+	}
+	for i := 0; i < count; i++ {
+		s, _ := types.CreateService(fmt.Sprintf("svc%d", i), "db-test", userID, []byte(`{"Value":"some config"}`))
+		if _, err = db.StoreService(s); err != nil {
+			tb.Fatalf("failed to store service: %s", err)
+		}
+	}
+	return db
+}
+
+func TestServiceRegistryInvalidation(t *testing.T) {
+	db := openWithServices(t, "@bot:localhost", 1)
+	services, err := db.LoadCachedServicesForUser("@bot:localhost")
+	if err != nil || len(services) != 1 {
+		t.Fatalf("TestServiceRegistryInvalidation: expected 1 service, got %d %v", len(services), err)
+	}
+	if cached, _ := db.LoadCachedServicesForUser("@bot:localhost"); cached[0] != services[0] {
+		t.Errorf("TestServiceRegistryInvalidation: expected the second load to be cached")
+	}
+
+	// Changes made by this process are seen straight away.
+	s, _ := db.LoadService("svc0")
+	s.(*versionedService).Value = "changed"
+	if _, err = db.StoreService(s); err != nil {
+		t.Fatalf("TestServiceRegistryInvalidation: failed to store service: %s", err)
+	}
+	cached, _ := db.LoadCachedService("svc0")
+	if cached.(*versionedService).Value != "changed" {
+		t.Errorf("TestServiceRegistryInvalidation: expected the stored change, got %+v", cached)
+	}
+
+	// Changes made by another process are seen once the generation is next checked.
+	if _, err = db.db.Exec("UPDATE services SET service_json = '{\"Value\":\"elsewhere\"}'"); err != nil {
+		t.Fatalf("TestServiceRegistryInvalidation: failed to update service: %s", err)
+	}
+	if _, err = db.db.Exec(incrementServiceGenerationSQL); err != nil {
+		t.Fatalf("TestServiceRegistryInvalidation: failed to increment generation: %s", err)
+	}
+	if cached, _ = db.LoadCachedService("svc0"); cached.(*versionedService).Value != "changed" {
+		t.Errorf("TestServiceRegistryInvalidation: expected the cache to be used until it is checked, got %+v", cached)
+	}
+	db.registry.checked = time.Now().Add(-registryRefreshInterval)
+	if cached, _ = db.LoadCachedService("svc0"); cached.(*versionedService).Value != "elsewhere" {
+		t.Errorf("TestServiceRegistryInvalidation: expected the change from elsewhere, got %+v", cached)
+	}
+
+	if err = db.DeleteService("svc0"); err != nil {
+		t.Fatalf("TestServiceRegistryInvalidation: failed to delete service: %s", err)
+	}
+	if services, _ = db.LoadCachedServicesForUser("@bot:localhost"); len(services) != 0 {
+		t.Errorf("TestServiceRegistryInvalidation: expected no services after deleting, got %d", len(services))
+	}
+}
+
+func TestServiceRegistryPauses(t *testing.T) {
+	db := openWithServices(t, "@bot:localhost", 1)
+	if _, err := db.LoadCachedServicePause("svc0"); err != sql.ErrNoRows {
+		t.Fatalf("TestServiceRegistryPauses: expected sql.ErrNoRows for a running service, got %v", err)
+	}
+
+	// Pausing and resuming in this process are seen straight away.
+	if err := db.StoreServicePause(api.ServicePause{ServiceID: "svc0", PausedBy: "@admin:localhost"}); err != nil {
+		t.Fatalf("TestServiceRegistryPauses: failed to pause service: %s", err)
+	}
+	if pause, err := db.LoadCachedServicePause("svc0"); err != nil || pause.PausedBy != "@admin:localhost" {
+		t.Errorf("TestServiceRegistryPauses: expected the service to be paused, got %+v %v", pause, err)
+	}
+	if _, err := db.DeleteServicePause("svc0"); err != nil {
+		t.Fatalf("TestServiceRegistryPauses: failed to resume service: %s", err)
+	}
+	if _, err := db.LoadCachedServicePause("svc0"); err != sql.ErrNoRows {
+		t.Errorf("TestServiceRegistryPauses: expected the service to be resumed, got %v", err)
+	}
+
+	// Pausing in another process is seen once the generation is next checked.
+	other := &ServiceDB{db: db.db, registry: newServiceRegistry()}
+	if err := other.StoreServicePause(api.ServicePause{ServiceID: "svc0", PausedBy: "@other:localhost"}); err != nil {
+		t.Fatalf("TestServiceRegistryPauses: failed to pause service: %s", err)
+	}
+	if _, err := db.LoadCachedServicePause("svc0"); err != sql.ErrNoRows {
+		t.Errorf("TestServiceRegistryPauses: expected the cache to be used until it is checked, got %v", err)
+	}
+	db.registry.checked = time.Now().Add(-registryRefreshInterval)
+	if pause, err := db.LoadCachedServicePause("svc0"); err != nil || pause.PausedBy != "@other:localhost" {
+		t.Errorf("TestServiceRegistryPauses: expected the pause from elsewhere, got %+v %v", pause, err)
+	}
+}
+
+// BenchmarkServicesPerMessage measures looking up the services for a bot user, which happens for
+// every message the bot sees, with and without the registry.
+func BenchmarkServicesPerMessage(b *testing.B) {
+	for _, count := range []int{1, 10, 100} {
+		db := openWithServices(b, "@bot:localhost", count)
+		b.Run(fmt.Sprintf("uncached/%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.LoadServicesForUser("@bot:localhost"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("cached/%d", count), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := db.LoadCachedServicesForUser("@bot:localhost"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkServicePerWebhook measures looking up the service for every incoming webhook, with and
+// without the registry.
+func BenchmarkServicePerWebhook(b *testing.B) {
+	db := openWithServices(b, "@bot:localhost", 100)
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.LoadService("svc50"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.LoadCachedService("svc50"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -2,14 +2,18 @@ package database
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/types"
 )
 
+// schemaSQL is the schema from before schema migrations existed, and is applied as migration 1.
+// Do not change it: add new tables, columns and indexes as migrations in migrations.go.
 const schemaSQL = `
 CREATE TABLE IF NOT EXISTS services (
 	service_id TEXT NOT NULL,
@@ -60,15 +64,52 @@ CREATE TABLE IF NOT EXISTS bot_options (
 	time_updated_ms BIGINT NOT NULL,
 	UNIQUE(user_id, room_id)
 );
+
+CREATE TABLE IF NOT EXISTS config_history (
+	kind TEXT NOT NULL,
+	id TEXT NOT NULL,
+	version BIGINT NOT NULL,
+	config_type TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	config_json TEXT NOT NULL,
+	diff_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(kind, id, version)
+);
+
+CREATE TABLE IF NOT EXISTS managed_config (
+	kind TEXT NOT NULL,
+	id TEXT NOT NULL,
+	UNIQUE(kind, id)
+);
+
+CREATE TABLE IF NOT EXISTS paused_services (
+	service_id TEXT NOT NULL UNIQUE,
+	paused_by TEXT NOT NULL,
+	queue_webhooks BOOLEAN NOT NULL,
+	time_paused_ms BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS queued_webhooks (
+	webhook_id TEXT NOT NULL PRIMARY KEY,
+	service_id TEXT NOT NULL,
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	header_json TEXT NOT NULL,
+	body_base64 TEXT NOT NULL,
+	time_received_ms BIGINT NOT NULL
+);
 `
 
 const selectMatrixClientConfigSQL = `
 SELECT client_json FROM matrix_clients WHERE user_id = $1
 `
 
-func selectMatrixClientConfigTxn(txn *sql.Tx, userID string) (config api.ClientConfig, err error) {
+func selectMatrixClientConfigTxn(txn *sql.Tx, keys *Keyring, userID string) (config api.ClientConfig, err error) {
 	var configJSON []byte
-	err = txn.QueryRow(selectMatrixClientConfigSQL, userID).Scan(&configJSON)
+	err = txn.QueryRow(selectMatrixClientConfigSQL, userID).Scan(keys.scan(&configJSON))
 	if err != nil {
 		return
 	}
@@ -80,7 +121,7 @@ const selectMatrixClientConfigsSQL = `
 SELECT client_json FROM matrix_clients
 `
 
-func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []api.ClientConfig, err error) {
+func selectMatrixClientConfigsTxn(txn *sql.Tx, keys *Keyring) (configs []api.ClientConfig, err error) {
 	rows, err := txn.Query(selectMatrixClientConfigsSQL)
 	if err != nil {
 		return
@@ -89,7 +130,7 @@ func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []api.ClientConfig, err
 	for rows.Next() {
 		var config api.ClientConfig
 		var configJSON []byte
-		if err = rows.Scan(&configJSON); err != nil {
+		if err = rows.Scan(keys.scan(&configJSON)); err != nil {
 			return
 		}
 		if err = json.Unmarshal(configJSON, &config); err != nil {
@@ -106,13 +147,13 @@ INSERT INTO matrix_clients(
 ) VALUES ($1, $2, '', $3, $4)
 `
 
-func insertMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientConfig) error {
+func insertMatrixClientConfigTxn(txn *sql.Tx, keys *Keyring, now time.Time, config api.ClientConfig) error {
 	t := now.UnixNano() / 1000000
 	configJSON, err := json.Marshal(&config)
 	if err != nil {
 		return err
 	}
-	_, err = txn.Exec(insertMatrixClientConfigSQL, config.UserID, configJSON, t, t)
+	_, err = txn.Exec(insertMatrixClientConfigSQL, config.UserID, keys.value(configJSON), t, t)
 	return err
 }
 
@@ -121,13 +162,22 @@ UPDATE matrix_clients SET client_json = $1, time_updated_ms = $2
 	WHERE user_id = $3
 `
 
-func updateMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config api.ClientConfig) error {
+func updateMatrixClientConfigTxn(txn *sql.Tx, keys *Keyring, now time.Time, config api.ClientConfig) error {
 	t := now.UnixNano() / 1000000
 	configJSON, err := json.Marshal(&config)
 	if err != nil {
 		return err
 	}
-	_, err = txn.Exec(updateMatrixClientConfigSQL, configJSON, t, config.UserID)
+	_, err = txn.Exec(updateMatrixClientConfigSQL, keys.value(configJSON), t, config.UserID)
+	return err
+}
+
+const deleteMatrixClientConfigSQL = `
+DELETE FROM matrix_clients WHERE user_id = $1
+`
+
+func deleteMatrixClientConfigTxn(txn *sql.Tx, userID string) error {
+	_, err := txn.Exec(deleteMatrixClientConfigSQL, userID)
 	return err
 }
 
@@ -154,46 +204,70 @@ func selectNextBatchTxn(txn *sql.Tx, userID string) (string, error) {
 }
 
 const selectServiceSQL = `
-SELECT service_type, service_user_id, service_json FROM services
+SELECT service_type, service_user_id, service_json, version FROM services
 	WHERE service_id = $1
 `
 
-func selectServiceTxn(txn *sql.Tx, serviceID string) (types.Service, error) {
+func selectServiceTxn(txn *sql.Tx, keys *Keyring, serviceID string) (types.Service, error) {
 	var serviceType string
 	var serviceUserID string
 	var serviceJSON []byte
+	var version int64
 	row := txn.QueryRow(selectServiceSQL, serviceID)
-	if err := row.Scan(&serviceType, &serviceUserID, &serviceJSON); err != nil {
+	if err := row.Scan(&serviceType, &serviceUserID, keys.scan(&serviceJSON), &version); err != nil {
+		return nil, err
+	}
+	return createServiceVersion(serviceID, serviceType, serviceUserID, serviceJSON, version)
+}
+
+// createServiceVersion creates a service loaded from the database, remembering which version
+// of the stored config it was loaded from.
+func createServiceVersion(serviceID, serviceType, serviceUserID string, serviceJSON []byte, version int64) (types.Service, error) {
+	s, err := types.CreateService(serviceID, serviceType, serviceUserID, serviceJSON)
+	if err != nil {
 		return nil, err
 	}
-	return types.CreateService(serviceID, serviceType, serviceUserID, serviceJSON)
+	s.SetServiceVersion(version)
+	return s, nil
 }
 
 const updateServiceSQL = `
-UPDATE services SET service_type=$1, service_user_id=$2, service_json=$3, time_updated_ms=$4
-	WHERE service_id=$5
+UPDATE services SET service_type=$1, service_user_id=$2, service_json=$3, time_updated_ms=$4, version=$5
+	WHERE service_id=$6 AND version=$7
 `
 
-func updateServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
+// updateServiceTxn updates the service if the stored version is the version it was loaded from,
+// returning ErrServiceConflict if not.
+func updateServiceTxn(txn *sql.Tx, keys *Keyring, now time.Time, service types.Service, version int64) error {
 	serviceJSON, err := json.Marshal(service)
 	if err != nil {
 		return err
 	}
 	t := now.UnixNano() / 1000000
-	_, err = txn.Exec(
-		updateServiceSQL, service.ServiceType(), service.ServiceUserID(), serviceJSON, t,
-		service.ServiceID(),
+	res, err := txn.Exec(
+		updateServiceSQL, service.ServiceType(), service.ServiceUserID(), keys.value(serviceJSON), t,
+		version, service.ServiceID(), service.ServiceVersion(),
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrServiceConflict
+	}
+	return nil
 }
 
 const insertServiceSQL = `
 INSERT INTO services(
-	service_id, service_type, service_user_id, service_json, time_added_ms, time_updated_ms
-) VALUES ($1, $2, $3, $4, $5, $6)
+	service_id, service_type, service_user_id, service_json, time_added_ms, time_updated_ms, version
+) VALUES ($1, $2, $3, $4, $5, $6, 1)
 `
 
-func insertServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
+func insertServiceTxn(txn *sql.Tx, keys *Keyring, now time.Time, service types.Service) error {
 	serviceJSON, err := json.Marshal(service)
 	if err != nil {
 		return err
@@ -201,16 +275,16 @@ func insertServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		insertServiceSQL,
-		service.ServiceID(), service.ServiceType(), service.ServiceUserID(), serviceJSON, t, t,
+		service.ServiceID(), service.ServiceType(), service.ServiceUserID(), keys.value(serviceJSON), t, t,
 	)
 	return err
 }
 
 const selectServicesForUserSQL = `
-SELECT service_id, service_type, service_json FROM services WHERE service_user_id=$1 ORDER BY service_id
+SELECT service_id, service_type, service_json, version FROM services WHERE service_user_id=$1 ORDER BY service_id
 `
 
-func selectServicesForUserTxn(txn *sql.Tx, userID string) (srvs []types.Service, err error) {
+func selectServicesForUserTxn(txn *sql.Tx, keys *Keyring, userID string) (srvs []types.Service, err error) {
 	rows, err := txn.Query(selectServicesForUserSQL, userID)
 	if err != nil {
 		return
@@ -221,10 +295,11 @@ func selectServicesForUserTxn(txn *sql.Tx, userID string) (srvs []types.Service,
 		var serviceID string
 		var serviceType string
 		var serviceJSON []byte
-		if err = rows.Scan(&serviceID, &serviceType, &serviceJSON); err != nil {
+		var version int64
+		if err = rows.Scan(&serviceID, &serviceType, keys.scan(&serviceJSON), &version); err != nil {
 			return
 		}
-		s, err = types.CreateService(serviceID, serviceType, userID, serviceJSON)
+		s, err = createServiceVersion(serviceID, serviceType, userID, serviceJSON, version)
 		if err != nil {
 			return
 		}
@@ -234,10 +309,10 @@ func selectServicesForUserTxn(txn *sql.Tx, userID string) (srvs []types.Service,
 }
 
 const selectServicesByTypeSQL = `
-SELECT service_id, service_user_id, service_json FROM services WHERE service_type=$1 ORDER BY service_id
+SELECT service_id, service_user_id, service_json, version FROM services WHERE service_type=$1 ORDER BY service_id
 `
 
-func selectServicesByTypeTxn(txn *sql.Tx, serviceType string) (srvs []types.Service, err error) {
+func selectServicesByTypeTxn(txn *sql.Tx, keys *Keyring, serviceType string) (srvs []types.Service, err error) {
 	rows, err := txn.Query(selectServicesByTypeSQL, serviceType)
 	if err != nil {
 		return
@@ -248,10 +323,11 @@ func selectServicesByTypeTxn(txn *sql.Tx, serviceType string) (srvs []types.Serv
 		var serviceID string
 		var serviceUserID string
 		var serviceJSON []byte
-		if err = rows.Scan(&serviceID, &serviceUserID, &serviceJSON); err != nil {
+		var version int64
+		if err = rows.Scan(&serviceID, &serviceUserID, keys.scan(&serviceJSON), &version); err != nil {
 			return
 		}
-		s, err = types.CreateService(serviceID, serviceType, serviceUserID, serviceJSON)
+		s, err = createServiceVersion(serviceID, serviceType, serviceUserID, serviceJSON, version)
 		if err != nil {
 			return
 		}
@@ -260,6 +336,55 @@ func selectServicesByTypeTxn(txn *sql.Tx, serviceType string) (srvs []types.Serv
 	return
 }
 
+const selectServicesSQL = `
+SELECT service_id, service_type, service_user_id, service_json, version FROM services
+	WHERE ($1 = '' OR service_type = $1) AND ($2 = '' OR service_user_id = $2) AND service_id > $3
+	ORDER BY service_id LIMIT $4
+`
+
+func selectServicesTxn(txn *sql.Tx, keys *Keyring, serviceType, serviceUserID, from string, limit int) (srvs []types.Service, err error) {
+	if limit <= 0 {
+		limit = math.MaxInt32 // portable "no limit" for sqlite3 and postgres
+	}
+	rows, err := txn.Query(selectServicesSQL, serviceType, serviceUserID, from, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s types.Service
+		var serviceID string
+		var sType string
+		var sUserID string
+		var serviceJSON []byte
+		var version int64
+		if err = rows.Scan(&serviceID, &sType, &sUserID, keys.scan(&serviceJSON), &version); err != nil {
+			return
+		}
+		s, err = createServiceVersion(serviceID, sType, sUserID, serviceJSON, version)
+		if err != nil {
+			return
+		}
+		srvs = append(srvs, s)
+	}
+	return
+}
+
+const selectServiceGenerationSQL = `
+SELECT generation FROM service_generation
+`
+
+const incrementServiceGenerationSQL = `
+UPDATE service_generation SET generation = generation + 1
+`
+
+// incrementServiceGenerationTxn records that a service has changed, so that other processes
+// drop any cached services.
+func incrementServiceGenerationTxn(txn *sql.Tx) error {
+	_, err := txn.Exec(incrementServiceGenerationSQL)
+	return err
+}
+
 const deleteServiceSQL = `
 DELETE FROM services WHERE service_id = $1
 `
@@ -275,7 +400,7 @@ INSERT INTO auth_realms(
 ) VALUES ($1, $2, $3, $4, $5)
 `
 
-func insertRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
+func insertRealmTxn(txn *sql.Tx, keys *Keyring, now time.Time, realm types.AuthRealm) error {
 	realmJSON, err := json.Marshal(realm)
 	if err != nil {
 		return err
@@ -283,7 +408,7 @@ func insertRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		insertRealmSQL,
-		realm.ID(), realm.Type(), realmJSON, t, t,
+		realm.ID(), realm.Type(), keys.value(realmJSON), t, t,
 	)
 	return err
 }
@@ -292,11 +417,11 @@ const selectRealmSQL = `
 SELECT realm_type, realm_json FROM auth_realms WHERE realm_id = $1
 `
 
-func selectRealmTxn(txn *sql.Tx, realmID string) (types.AuthRealm, error) {
+func selectRealmTxn(txn *sql.Tx, keys *Keyring, realmID string) (types.AuthRealm, error) {
 	var realmType string
 	var realmJSON []byte
 	row := txn.QueryRow(selectRealmSQL, realmID)
-	if err := row.Scan(&realmType, &realmJSON); err != nil {
+	if err := row.Scan(&realmType, keys.scan(&realmJSON)); err != nil {
 		return nil, err
 	}
 	return types.CreateAuthRealm(realmID, realmType, realmJSON)
@@ -306,7 +431,7 @@ const selectRealmsByTypeSQL = `
 SELECT realm_id, realm_json FROM auth_realms WHERE realm_type = $1 ORDER BY realm_id
 `
 
-func selectRealmsByTypeTxn(txn *sql.Tx, realmType string) (realms []types.AuthRealm, err error) {
+func selectRealmsByTypeTxn(txn *sql.Tx, keys *Keyring, realmType string) (realms []types.AuthRealm, err error) {
 	rows, err := txn.Query(selectRealmsByTypeSQL, realmType)
 	if err != nil {
 		return
@@ -316,7 +441,7 @@ func selectRealmsByTypeTxn(txn *sql.Tx, realmType string) (realms []types.AuthRe
 		var realm types.AuthRealm
 		var realmID string
 		var realmJSON []byte
-		if err = rows.Scan(&realmID, &realmJSON); err != nil {
+		if err = rows.Scan(&realmID, keys.scan(&realmJSON)); err != nil {
 			return
 		}
 		realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON)
@@ -328,19 +453,55 @@ func selectRealmsByTypeTxn(txn *sql.Tx, realmType string) (realms []types.AuthRe
 	return
 }
 
+const selectRealmsSQL = `
+SELECT realm_id, realm_type, realm_json FROM auth_realms ORDER BY realm_id
+`
+
+func selectRealmsTxn(txn *sql.Tx, keys *Keyring) (realms []types.AuthRealm, err error) {
+	rows, err := txn.Query(selectRealmsSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realm types.AuthRealm
+		var realmID string
+		var realmType string
+		var realmJSON []byte
+		if err = rows.Scan(&realmID, &realmType, keys.scan(&realmJSON)); err != nil {
+			return
+		}
+		realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON)
+		if err != nil {
+			return
+		}
+		realms = append(realms, realm)
+	}
+	return
+}
+
+const deleteRealmSQL = `
+DELETE FROM auth_realms WHERE realm_id = $1
+`
+
+func deleteRealmTxn(txn *sql.Tx, realmID string) error {
+	_, err := txn.Exec(deleteRealmSQL, realmID)
+	return err
+}
+
 const updateRealmSQL = `
 UPDATE auth_realms SET realm_type=$1, realm_json=$2, time_updated_ms=$3
 	WHERE realm_id=$4
 `
 
-func updateRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
+func updateRealmTxn(txn *sql.Tx, keys *Keyring, now time.Time, realm types.AuthRealm) error {
 	realmJSON, err := json.Marshal(realm)
 	if err != nil {
 		return err
 	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
-		updateRealmSQL, realm.Type(), realmJSON, t,
+		updateRealmSQL, realm.Type(), keys.value(realmJSON), t,
 		realm.ID(),
 	)
 	return err
@@ -352,7 +513,7 @@ INSERT INTO auth_sessions(
 ) VALUES ($1, $2, $3, $4, $5, $6)
 `
 
-func insertAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
+func insertAuthSessionTxn(txn *sql.Tx, keys *Keyring, now time.Time, session types.AuthSession) error {
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
 		return err
@@ -360,7 +521,7 @@ func insertAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession)
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		insertAuthSessionSQL,
-		session.ID(), session.RealmID(), session.UserID(), sessionJSON, t, t,
+		session.ID(), session.RealmID(), session.UserID(), keys.value(sessionJSON), t, t,
 	)
 	return err
 }
@@ -374,19 +535,67 @@ func deleteAuthSessionTxn(txn *sql.Tx, realmID, userID string) error {
 	return err
 }
 
+const deleteAuthSessionsByRealmSQL = `
+DELETE FROM auth_sessions WHERE realm_id=$1
+`
+
+func deleteAuthSessionsByRealmTxn(txn *sql.Tx, realmID string) error {
+	_, err := txn.Exec(deleteAuthSessionsByRealmSQL, realmID)
+	return err
+}
+
+const selectAuthSessionsByRealmSQL = `
+SELECT session_id, user_id, realm_type, realm_json, session_json FROM auth_sessions
+	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
+	WHERE auth_sessions.realm_id = $1 ORDER BY auth_sessions.user_id
+`
+
+func selectAuthSessionsByRealmTxn(txn *sql.Tx, keys *Keyring, realmID string) (sessions []types.AuthSession, err error) {
+	rows, err := txn.Query(selectAuthSessionsByRealmSQL, realmID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var userID string
+		var realmType string
+		var realmJSON []byte
+		var sessionJSON []byte
+		if err = rows.Scan(&id, &userID, &realmType, keys.scan(&realmJSON), keys.scan(&sessionJSON)); err != nil {
+			return
+		}
+		var realm types.AuthRealm
+		realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON)
+		if err != nil {
+			return
+		}
+		session := realm.AuthSession(id, userID, realmID)
+		if session == nil {
+			err = fmt.Errorf("Cannot create session for given realm")
+			return
+		}
+		if err = json.Unmarshal(sessionJSON, session); err != nil {
+			return
+		}
+		sessions = append(sessions, session)
+	}
+	return
+}
+
 const selectAuthSessionByUserSQL = `
 SELECT session_id, realm_type, realm_json, session_json FROM auth_sessions
 	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
 	WHERE auth_sessions.realm_id = $1 AND auth_sessions.user_id = $2
 `
 
-func selectAuthSessionByUserTxn(txn *sql.Tx, realmID, userID string) (types.AuthSession, error) {
+func selectAuthSessionByUserTxn(txn *sql.Tx, keys *Keyring, realmID, userID string) (types.AuthSession, error) {
 	var id string
 	var realmType string
 	var realmJSON []byte
 	var sessionJSON []byte
 	row := txn.QueryRow(selectAuthSessionByUserSQL, realmID, userID)
-	if err := row.Scan(&id, &realmType, &realmJSON, &sessionJSON); err != nil {
+	if err := row.Scan(&id, &realmType, keys.scan(&realmJSON), keys.scan(&sessionJSON)); err != nil {
 		return nil, err
 	}
 	realm, err := types.CreateAuthRealm(realmID, realmType, realmJSON)
@@ -409,13 +618,13 @@ SELECT user_id, realm_type, realm_json, session_json FROM auth_sessions
 	WHERE auth_sessions.realm_id = $1 AND auth_sessions.session_id = $2
 `
 
-func selectAuthSessionByIDTxn(txn *sql.Tx, realmID, id string) (types.AuthSession, error) {
+func selectAuthSessionByIDTxn(txn *sql.Tx, keys *Keyring, realmID, id string) (types.AuthSession, error) {
 	var userID string
 	var realmType string
 	var realmJSON []byte
 	var sessionJSON []byte
 	row := txn.QueryRow(selectAuthSessionByIDSQL, realmID, id)
-	if err := row.Scan(&userID, &realmType, &realmJSON, &sessionJSON); err != nil {
+	if err := row.Scan(&userID, &realmType, keys.scan(&realmJSON), keys.scan(&sessionJSON)); err != nil {
 		return nil, err
 	}
 	realm, err := types.CreateAuthRealm(realmID, realmType, realmJSON)
@@ -437,14 +646,14 @@ UPDATE auth_sessions SET session_id=$1, session_json=$2, time_updated_ms=$3
 	WHERE realm_id=$4 AND user_id=$5
 `
 
-func updateAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
+func updateAuthSessionTxn(txn *sql.Tx, keys *Keyring, now time.Time, session types.AuthSession) error {
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
 		return err
 	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
-		updateAuthSessionSQL, session.ID(), sessionJSON, t,
+		updateAuthSessionSQL, session.ID(), keys.value(sessionJSON), t,
 		session.RealmID(), session.UserID(),
 	)
 	return err
@@ -494,3 +703,549 @@ func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) erro
 	_, err = txn.Exec(updateBotOptionsSQL, optsJSON, opts.SetByUserID, t, opts.UserID, opts.RoomID)
 	return err
 }
+
+const selectLatestConfigHistorySQL = `
+SELECT version, config_json FROM config_history WHERE kind = $1 AND id = $2
+	ORDER BY version DESC LIMIT 1
+`
+
+func selectLatestConfigHistoryTxn(txn *sql.Tx, keys *Keyring, kind, id string) (version int64, configJSON []byte, err error) {
+	err = txn.QueryRow(selectLatestConfigHistorySQL, kind, id).Scan(&version, keys.scan(&configJSON))
+	return
+}
+
+const insertConfigHistorySQL = `
+INSERT INTO config_history(
+	kind, id, version, config_type, user_id, action, actor, config_json, diff_json, time_added_ms
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+`
+
+func insertConfigHistoryTxn(txn *sql.Tx, keys *Keyring, entry api.ConfigHistoryEntry) error {
+	diffJSON, err := json.Marshal(entry.Diff)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(
+		insertConfigHistorySQL, entry.Kind, entry.ID, entry.Version, entry.Type, entry.UserID,
+		entry.Action, entry.Actor, keys.value(entry.Config), keys.value(diffJSON), entry.Timestamp,
+	)
+	return err
+}
+
+const selectConfigHistorySQL = `
+SELECT version, config_type, user_id, action, actor, config_json, diff_json, time_added_ms
+	FROM config_history WHERE kind = $1 AND id = $2 ORDER BY version DESC
+`
+
+func selectConfigHistoryTxn(txn *sql.Tx, keys *Keyring, kind, id string) (entries []api.ConfigHistoryEntry, err error) {
+	rows, err := txn.Query(selectConfigHistorySQL, kind, id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry api.ConfigHistoryEntry
+		if entry, err = scanConfigHistory(rows, keys, kind, id); err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+const selectConfigHistoryVersionSQL = `
+SELECT version, config_type, user_id, action, actor, config_json, diff_json, time_added_ms
+	FROM config_history WHERE kind = $1 AND id = $2 AND version = $3
+`
+
+func selectConfigHistoryVersionTxn(txn *sql.Tx, keys *Keyring, kind, id string, version int64) (api.ConfigHistoryEntry, error) {
+	return scanConfigHistory(txn.QueryRow(selectConfigHistoryVersionSQL, kind, id, version), keys, kind, id)
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanConfigHistory(row scanner, keys *Keyring, kind, id string) (entry api.ConfigHistoryEntry, err error) {
+	var configJSON []byte
+	var diffJSON []byte
+	entry.Kind = kind
+	entry.ID = id
+	err = row.Scan(
+		&entry.Version, &entry.Type, &entry.UserID, &entry.Action, &entry.Actor,
+		keys.scan(&configJSON), keys.scan(&diffJSON), &entry.Timestamp,
+	)
+	if err != nil {
+		return
+	}
+	entry.Config = json.RawMessage(configJSON)
+	err = json.Unmarshal(diffJSON, &entry.Diff)
+	return
+}
+
+const deleteManagedConfigSQL = `
+DELETE FROM managed_config WHERE kind = $1
+`
+
+func deleteManagedConfigTxn(txn *sql.Tx, kind string) error {
+	_, err := txn.Exec(deleteManagedConfigSQL, kind)
+	return err
+}
+
+const insertManagedConfigSQL = `
+INSERT INTO managed_config(kind, id) VALUES ($1, $2)
+`
+
+func insertManagedConfigTxn(txn *sql.Tx, kind, id string) error {
+	_, err := txn.Exec(insertManagedConfigSQL, kind, id)
+	return err
+}
+
+const selectManagedConfigSQL = `
+SELECT count(*) FROM managed_config WHERE kind = $1 AND id = $2
+`
+
+func selectManagedConfigTxn(txn *sql.Tx, kind, id string) (managed bool, err error) {
+	var count int
+	err = txn.QueryRow(selectManagedConfigSQL, kind, id).Scan(&count)
+	managed = count > 0
+	return
+}
+
+const insertServicePauseSQL = `
+INSERT INTO paused_services(service_id, paused_by, queue_webhooks, time_paused_ms)
+VALUES ($1, $2, $3, $4)
+`
+
+func insertServicePauseTxn(txn *sql.Tx, pause api.ServicePause) error {
+	_, err := txn.Exec(insertServicePauseSQL, pause.ServiceID, pause.PausedBy, pause.QueueWebhooks, pause.Timestamp)
+	return err
+}
+
+const selectServicePauseSQL = `
+SELECT paused_by, queue_webhooks, time_paused_ms FROM paused_services WHERE service_id = $1
+`
+
+func selectServicePauseTxn(txn *sql.Tx, serviceID string) (pause api.ServicePause, err error) {
+	pause.ServiceID = serviceID
+	err = txn.QueryRow(selectServicePauseSQL, serviceID).Scan(&pause.PausedBy, &pause.QueueWebhooks, &pause.Timestamp)
+	return
+}
+
+const deleteServicePauseSQL = `
+DELETE FROM paused_services WHERE service_id = $1
+`
+
+func deleteServicePauseTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteServicePauseSQL, serviceID)
+	return err
+}
+
+const insertQueuedWebhookSQL = `
+INSERT INTO queued_webhooks(webhook_id, service_id, method, url, header_json, body_base64, time_received_ms)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+func insertQueuedWebhookTxn(txn *sql.Tx, keys *Keyring, webhookID string, webhook api.QueuedWebhook) error {
+	headerJSON, err := json.Marshal(webhook.Header)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertQueuedWebhookSQL, webhookID, webhook.ServiceID, webhook.Method, webhook.URL,
+		keys.value(headerJSON), keys.value([]byte(base64.StdEncoding.EncodeToString(webhook.Body))), webhook.Timestamp)
+	return err
+}
+
+const selectQueuedWebhooksSQL = `
+SELECT method, url, header_json, body_base64, time_received_ms FROM queued_webhooks
+WHERE service_id = $1 ORDER BY time_received_ms
+`
+
+func selectQueuedWebhooksTxn(txn *sql.Tx, keys *Keyring, serviceID string) (webhooks []api.QueuedWebhook, err error) {
+	rows, err := txn.Query(selectQueuedWebhooksSQL, serviceID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var headerJSON, bodyBase64 []byte
+		webhook := api.QueuedWebhook{ServiceID: serviceID}
+		err = rows.Scan(&webhook.Method, &webhook.URL, keys.scan(&headerJSON), keys.scan(&bodyBase64), &webhook.Timestamp)
+		if err != nil {
+			return
+		}
+		if webhook.Body, err = base64.StdEncoding.DecodeString(string(bodyBase64)); err != nil {
+			return
+		}
+		if err = json.Unmarshal(headerJSON, &webhook.Header); err != nil {
+			return
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	err = rows.Err()
+	return
+}
+
+const deleteQueuedWebhooksSQL = `
+DELETE FROM queued_webhooks WHERE service_id = $1
+`
+
+func deleteQueuedWebhooksTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteQueuedWebhooksSQL, serviceID)
+	return err
+}
+
+const insertServiceStateSQL = `
+INSERT INTO service_state(service_id, namespace, state_key, state_value_base64, time_expires_ms, time_updated_ms)
+VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+// insertServiceStateTxn stores the value as base64, as values need not be valid UTF-8.
+func insertServiceStateTxn(txn *sql.Tx, now time.Time, state api.ServiceState) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(insertServiceStateSQL, state.ServiceID, state.Namespace, state.Key,
+		base64.StdEncoding.EncodeToString(state.Value), state.ExpiresTimestamp, t)
+	return err
+}
+
+const selectServiceStateSQL = `
+SELECT state_value_base64, time_expires_ms FROM service_state
+WHERE service_id = $1 AND namespace = $2 AND state_key = $3 AND (time_expires_ms = 0 OR time_expires_ms > $4)
+`
+
+func selectServiceStateTxn(txn *sql.Tx, now time.Time, serviceID, namespace, key string) (state api.ServiceState, err error) {
+	t := now.UnixNano() / 1000000
+	state = api.ServiceState{ServiceID: serviceID, Namespace: namespace, Key: key}
+	var valueBase64 string
+	err = txn.QueryRow(selectServiceStateSQL, serviceID, namespace, key, t).Scan(&valueBase64, &state.ExpiresTimestamp)
+	if err != nil {
+		return
+	}
+	state.Value, err = base64.StdEncoding.DecodeString(valueBase64)
+	return
+}
+
+const selectServiceStatesByPrefixSQL = `
+SELECT state_key, state_value_base64, time_expires_ms FROM service_state
+WHERE service_id = $1 AND namespace = $2 AND substr(state_key, 1, length($3)) = $3
+AND (time_expires_ms = 0 OR time_expires_ms > $4)
+ORDER BY state_key
+`
+
+func selectServiceStatesByPrefixTxn(txn *sql.Tx, now time.Time, serviceID, namespace, prefix string) (states []api.ServiceState, err error) {
+	t := now.UnixNano() / 1000000
+	rows, err := txn.Query(selectServiceStatesByPrefixSQL, serviceID, namespace, prefix, t)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		state := api.ServiceState{ServiceID: serviceID, Namespace: namespace}
+		var valueBase64 string
+		if err = rows.Scan(&state.Key, &valueBase64, &state.ExpiresTimestamp); err != nil {
+			return
+		}
+		if state.Value, err = base64.StdEncoding.DecodeString(valueBase64); err != nil {
+			return
+		}
+		states = append(states, state)
+	}
+	err = rows.Err()
+	return
+}
+
+const deleteServiceStateSQL = `
+DELETE FROM service_state WHERE service_id = $1 AND namespace = $2 AND state_key = $3
+`
+
+func deleteServiceStateTxn(txn *sql.Tx, serviceID, namespace, key string) error {
+	_, err := txn.Exec(deleteServiceStateSQL, serviceID, namespace, key)
+	return err
+}
+
+const deleteExpiredServiceStateSQL = `
+DELETE FROM service_state WHERE service_id = $1 AND time_expires_ms != 0 AND time_expires_ms <= $2
+`
+
+func deleteExpiredServiceStateTxn(txn *sql.Tx, now time.Time, serviceID string) error {
+	t := now.UnixNano() / 1000000
+	_, err := txn.Exec(deleteExpiredServiceStateSQL, serviceID, t)
+	return err
+}
+
+const deleteServiceStatesSQL = `
+DELETE FROM service_state WHERE service_id = $1
+`
+
+func deleteServiceStatesTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteServiceStatesSQL, serviceID)
+	return err
+}
+
+// selectNowSQL selects the time on the database server in milliseconds since the epoch, for each
+// database type.
+var selectNowSQL = map[string]string{
+	"sqlite3":  `SELECT CAST((julianday('now') - 2440587.5) * 86400000 AS BIGINT)`,
+	"postgres": `SELECT CAST(EXTRACT(EPOCH FROM clock_timestamp()) * 1000 AS BIGINT)`,
+}
+
+func selectNowTxn(txn *sql.Tx, databaseType string) (now int64, err error) {
+	query, ok := selectNowSQL[databaseType]
+	if !ok {
+		return 0, fmt.Errorf("unsupported database type %s", databaseType)
+	}
+	err = txn.QueryRow(query).Scan(&now)
+	return
+}
+
+const updateLeaseSQL = `
+UPDATE leases SET owner = $1, time_expires_ms = $2
+	WHERE lease_name = $3 AND (owner = $1 OR time_expires_ms < $4)
+`
+
+// updateLeaseTxn renews the lease if the owner holds it, or takes it over if it has expired.
+// Returns false if someone else holds it, or if it doesn't exist.
+func updateLeaseTxn(txn *sql.Tx, name, owner string, expires, now int64) (bool, error) {
+	res, err := txn.Exec(updateLeaseSQL, owner, expires, name, now)
+	if err != nil {
+		return false, err
+	}
+	updated, err := res.RowsAffected()
+	return updated > 0, err
+}
+
+const selectLeaseExistsSQL = `
+SELECT COUNT(*) FROM leases WHERE lease_name = $1
+`
+
+func selectLeaseExistsTxn(txn *sql.Tx, name string) (bool, error) {
+	var count int
+	err := txn.QueryRow(selectLeaseExistsSQL, name).Scan(&count)
+	return count > 0, err
+}
+
+const insertLeaseSQL = `
+INSERT INTO leases(lease_name, owner, time_expires_ms) VALUES ($1, $2, $3)
+`
+
+func insertLeaseTxn(txn *sql.Tx, name, owner string, expires int64) error {
+	_, err := txn.Exec(insertLeaseSQL, name, owner, expires)
+	return err
+}
+
+const insertWebhookDeliverySQL = `
+INSERT INTO webhook_deliveries(delivery_id, service_id, correlation_id, method, url, header_json, body,
+	time_received_ms, status_code, error, time_processed_ms, replays)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 0, '', 0, 0)
+`
+
+func insertWebhookDeliveryTxn(txn *sql.Tx, keys *Keyring, delivery api.WebhookDelivery) error {
+	headerJSON, err := json.Marshal(delivery.Header)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertWebhookDeliverySQL, delivery.ID, delivery.ServiceID, delivery.CorrelationID,
+		delivery.Method, delivery.URL, keys.value(headerJSON), keys.value([]byte(delivery.Body)), delivery.Timestamp)
+	return err
+}
+
+const deleteOldestWebhookDeliveriesSQL = `
+DELETE FROM webhook_deliveries WHERE service_id = $1 AND delivery_id NOT IN (
+	SELECT delivery_id FROM webhook_deliveries WHERE service_id = $1 ORDER BY time_received_ms DESC LIMIT $2
+)
+`
+
+// deleteOldestWebhookDeliveriesTxn removes all but the newest keep deliveries for the service.
+func deleteOldestWebhookDeliveriesTxn(txn *sql.Tx, serviceID string, keep int) error {
+	_, err := txn.Exec(deleteOldestWebhookDeliveriesSQL, serviceID, keep)
+	return err
+}
+
+const deleteExpiredWebhookDeliveriesSQL = `
+DELETE FROM webhook_deliveries WHERE time_received_ms < $1
+`
+
+func deleteExpiredWebhookDeliveriesTxn(txn *sql.Tx, cutoff int64) (int64, error) {
+	res, err := txn.Exec(deleteExpiredWebhookDeliveriesSQL, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const updateWebhookDeliveryOutcomeSQL = `
+UPDATE webhook_deliveries SET status_code = $1, error = $2, time_processed_ms = $3, replays = replays + $4
+WHERE delivery_id = $5
+`
+
+func updateWebhookDeliveryOutcomeTxn(txn *sql.Tx, deliveryID string, statusCode int, errMsg string, processed int64, replayed bool) error {
+	replays := 0
+	if replayed {
+		replays = 1
+	}
+	_, err := txn.Exec(updateWebhookDeliveryOutcomeSQL, statusCode, errMsg, processed, replays, deliveryID)
+	return err
+}
+
+const selectWebhookDeliveriesSQL = `
+SELECT delivery_id, service_id, correlation_id, method, url, header_json, body, time_received_ms,
+	status_code, error, time_processed_ms, replays
+FROM webhook_deliveries WHERE service_id = $1 ORDER BY time_received_ms DESC LIMIT $2
+`
+
+func selectWebhookDeliveriesTxn(txn *sql.Tx, keys *Keyring, serviceID string, limit int) (deliveries []api.WebhookDelivery, err error) {
+	rows, err := txn.Query(selectWebhookDeliveriesSQL, serviceID, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var delivery api.WebhookDelivery
+		if delivery, err = scanWebhookDelivery(rows, keys); err != nil {
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	err = rows.Err()
+	return
+}
+
+const selectWebhookDeliverySQL = `
+SELECT delivery_id, service_id, correlation_id, method, url, header_json, body, time_received_ms,
+	status_code, error, time_processed_ms, replays
+FROM webhook_deliveries WHERE delivery_id = $1
+`
+
+func selectWebhookDeliveryTxn(txn *sql.Tx, keys *Keyring, deliveryID string) (api.WebhookDelivery, error) {
+	return scanWebhookDelivery(txn.QueryRow(selectWebhookDeliverySQL, deliveryID), keys)
+}
+
+func scanWebhookDelivery(row scanner, keys *Keyring) (delivery api.WebhookDelivery, err error) {
+	var headerJSON, body []byte
+	err = row.Scan(&delivery.ID, &delivery.ServiceID, &delivery.CorrelationID, &delivery.Method,
+		&delivery.URL, keys.scan(&headerJSON), keys.scan(&body), &delivery.Timestamp, &delivery.StatusCode,
+		&delivery.Error, &delivery.ProcessedTimestamp, &delivery.Replays)
+	if err != nil {
+		return
+	}
+	delivery.Body = string(body)
+	err = json.Unmarshal(headerJSON, &delivery.Header)
+	return
+}
+
+const deleteWebhookDeliveriesSQL = `
+DELETE FROM webhook_deliveries WHERE service_id = $1
+`
+
+func deleteWebhookDeliveriesTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteWebhookDeliveriesSQL, serviceID)
+	return err
+}
+
+const insertWebhookJobSQL = `
+INSERT INTO webhook_jobs(job_id, service_id, delivery_id, correlation_id, method, url, header_json, body_base64,
+	time_received_ms, attempts, time_next_attempt_ms, last_error, sent_rooms_json)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+`
+
+// insertWebhookJobTxn stores the body as base64, as webhook payloads need not be valid UTF-8.
+func insertWebhookJobTxn(txn *sql.Tx, keys *Keyring, job api.WebhookJob) error {
+	headerJSON, err := json.Marshal(job.Header)
+	if err != nil {
+		return err
+	}
+	sentRoomsJSON, err := json.Marshal(job.SentRooms)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertWebhookJobSQL, job.ID, job.ServiceID, job.DeliveryID, job.CorrelationID,
+		job.Method, job.URL, keys.value(headerJSON), keys.value([]byte(base64.StdEncoding.EncodeToString(job.Body))),
+		job.Timestamp, job.Attempts,
+		job.NextAttemptTimestamp, job.LastError, sentRoomsJSON)
+	return err
+}
+
+const selectDueWebhookJobsSQL = `
+SELECT job_id, service_id, delivery_id, correlation_id, method, url, header_json, body_base64, time_received_ms,
+	attempts, time_next_attempt_ms, last_error, sent_rooms_json
+FROM webhook_jobs WHERE time_next_attempt_ms <= $1 ORDER BY time_next_attempt_ms, time_received_ms LIMIT $2
+`
+
+func selectDueWebhookJobsTxn(txn *sql.Tx, keys *Keyring, now int64, limit int) (jobs []api.WebhookJob, err error) {
+	rows, err := txn.Query(selectDueWebhookJobsSQL, now, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var headerJSON, bodyBase64, sentRoomsJSON []byte
+		var job api.WebhookJob
+		err = rows.Scan(&job.ID, &job.ServiceID, &job.DeliveryID, &job.CorrelationID, &job.Method,
+			&job.URL, keys.scan(&headerJSON), keys.scan(&bodyBase64), &job.Timestamp, &job.Attempts, &job.NextAttemptTimestamp,
+			&job.LastError, &sentRoomsJSON)
+		if err != nil {
+			return
+		}
+		if err = json.Unmarshal(headerJSON, &job.Header); err != nil {
+			return
+		}
+		if job.Body, err = base64.StdEncoding.DecodeString(string(bodyBase64)); err != nil {
+			return
+		}
+		if err = json.Unmarshal(sentRoomsJSON, &job.SentRooms); err != nil {
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	err = rows.Err()
+	return
+}
+
+const claimWebhookJobSQL = `
+UPDATE webhook_jobs SET time_next_attempt_ms = $1 WHERE job_id = $2 AND time_next_attempt_ms = $3
+`
+
+// claimWebhookJobTxn puts off the next attempt at handling the job until claimUntil, so that no
+// other instance handles it in the meantime. Returns false if the job has already been claimed,
+// or handled, since it was loaded.
+func claimWebhookJobTxn(txn *sql.Tx, job api.WebhookJob, claimUntil int64) (bool, error) {
+	res, err := txn.Exec(claimWebhookJobSQL, claimUntil, job.ID, job.NextAttemptTimestamp)
+	if err != nil {
+		return false, err
+	}
+	updated, err := res.RowsAffected()
+	return updated > 0, err
+}
+
+const updateWebhookJobSQL = `
+UPDATE webhook_jobs SET attempts = $1, time_next_attempt_ms = $2, last_error = $3, sent_rooms_json = $4
+WHERE job_id = $5
+`
+
+func updateWebhookJobTxn(txn *sql.Tx, jobID string, attempts int, nextAttempt int64, lastError string, sentRooms []string) error {
+	sentRoomsJSON, err := json.Marshal(sentRooms)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(updateWebhookJobSQL, attempts, nextAttempt, lastError, sentRoomsJSON, jobID)
+	return err
+}
+
+const deleteWebhookJobSQL = `
+DELETE FROM webhook_jobs WHERE job_id = $1
+`
+
+func deleteWebhookJobTxn(txn *sql.Tx, jobID string) error {
+	_, err := txn.Exec(deleteWebhookJobSQL, jobID)
+	return err
+}
+
+const deleteWebhookJobsSQL = `
+DELETE FROM webhook_jobs WHERE service_id = $1
+`
+
+func deleteWebhookJobsTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteWebhookJobsSQL, serviceID)
+	return err
+}
@@ -1,20 +1,23 @@
 package main
 
 import (
-	"encoding/json"
+	"database/sql"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"path/filepath"
+	"strconv"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/matrix-org/dugong"
 	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/api/handlers"
 	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/control"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/leader"
+	"github.com/matrix-org/go-neb/logging"
 	_ "github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/polling"
 	_ "github.com/matrix-org/go-neb/realms/github"
@@ -30,52 +33,18 @@ import (
 	_ "github.com/matrix-org/go-neb/services/slackapi"
 	_ "github.com/matrix-org/go-neb/services/travisci"
 	_ "github.com/matrix-org/go-neb/services/wikipedia"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/util"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
-	yaml "gopkg.in/yaml.v2"
 )
 
 // loadFromConfig loads a config file and returns a ConfigFile
 func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigFile, error) {
-	// ::Horrible hacks ahead::
-	// The config is represented as YAML, and we want to convert that into NEB types.
-	// However, NEB types make liberal use of json.RawMessage which the YAML parser
-	// doesn't like. We can't implement MarshalYAML/UnmarshalYAML as a custom type easily
-	// because YAML is insane and supports numbers as keys. The YAML parser therefore has the
-	// generic form of map[interface{}]interface{} - but the JSON parser doesn't know
-	// how to parse that.
-	//
-	// The hack that follows gets around this by type asserting all parsed YAML keys as
-	// strings then re-encoding/decoding as JSON. That is:
-	// YAML bytes -> map[interface]interface -> map[string]interface -> JSON bytes -> NEB types
-
-	// Convert to YAML bytes
-	contents, err := ioutil.ReadFile(configFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Convert to map[interface]interface
-	var cfg map[interface{}]interface{}
-	if err = yaml.Unmarshal(contents, &cfg); err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal YAML: %s", err)
-	}
-
-	// Convert to map[string]interface
-	dict := convertKeysToStrings(cfg)
-
-	// Convert to JSON bytes
-	b, err := json.Marshal(dict)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to marshal config as JSON: %s", err)
-	}
-
-	// Finally, Convert to NEB types
 	var c api.ConfigFile
-	if err := json.Unmarshal(b, &c); err != nil {
-		return nil, fmt.Errorf("Failed to convert to config file: %s", err)
+	if err := loadYAML(configFilePath, &c); err != nil {
+		return nil, err
 	}
 
 	// sanity check (at least 1 client and 1 service)
@@ -86,24 +55,27 @@ func loadFromConfig(db *database.ServiceDB, configFilePath string) (*api.ConfigF
 	return &c, nil
 }
 
-func convertKeysToStrings(iface interface{}) interface{} {
-	obj, isObj := iface.(map[interface{}]interface{})
-	if isObj {
-		strObj := make(map[string]interface{})
-		for k, v := range obj {
-			strObj[k.(string)] = convertKeysToStrings(v) // handle nested objects
+// loadAdminTokens loads the admin tokens file and returns the tokens in it
+func loadAdminTokens(tokensFilePath string) ([]api.AdminToken, error) {
+	var f api.AdminTokensFile
+	if err := loadYAML(tokensFilePath, &f); err != nil {
+		return nil, err
+	}
+	for i, t := range f.Tokens {
+		if err := t.Check(); err != nil {
+			return nil, fmt.Errorf("Tokens[%d] : %s", i, err)
 		}
-		return strObj
 	}
+	return f.Tokens, nil
+}
 
-	arr, isArr := iface.([]interface{})
-	if isArr {
-		for i := range arr {
-			arr[i] = convertKeysToStrings(arr[i]) // handle nested objects
-		}
-		return arr
+// loadYAML loads a YAML file into the given NEB type
+func loadYAML(filePath string, v interface{}) error {
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
 	}
-	return iface // base type like string or number
+	return api.UnmarshalYAML(contents, v)
 }
 
 func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.ConfigureServiceRequest) error {
@@ -122,7 +94,17 @@ func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.Configure
 			return fmt.Errorf("config: Service[%d] : %s", i, err)
 		}
 
-		if err = service.Register(nil, c); err != nil {
+		// A persistent database may already have an older version of this service.
+		old, err := database.GetServiceDB().LoadService(s.ID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("config: Service[%d] : %s", i, err)
+		}
+
+		if old != nil {
+			// The config file replaces whatever is stored.
+			service.SetServiceVersion(old.ServiceVersion())
+		}
+		if err = service.Register(old, c); err != nil {
 			return fmt.Errorf("config: Service[%d] : %s", i, err)
 		}
 		if _, err := database.GetServiceDB().StoreService(service); err != nil {
@@ -133,6 +115,36 @@ func insertServicesFromConfig(clis *clients.Clients, serviceReqs []api.Configure
 	return nil
 }
 
+// markManagedConfig records every client, realm, session and service in the config file as
+// managed, so that the /admin HTTP API refuses to modify them.
+func markManagedConfig(db *database.ServiceDB, cfg *api.ConfigFile) error {
+	var clientIDs, realmIDs, sessionIDs, serviceIDs []string
+	for _, c := range cfg.Clients {
+		clientIDs = append(clientIDs, c.UserID)
+	}
+	for _, r := range cfg.Realms {
+		realmIDs = append(realmIDs, r.ID)
+	}
+	for _, s := range cfg.Sessions {
+		sessionIDs = append(sessionIDs, api.SessionConfigID(s.RealmID, s.UserID))
+	}
+	for _, s := range cfg.Services {
+		serviceIDs = append(serviceIDs, s.ID)
+	}
+	managed := map[string][]string{
+		api.ConfigKindClient:  clientIDs,
+		api.ConfigKindRealm:   realmIDs,
+		api.ConfigKindSession: sessionIDs,
+		api.ConfigKindService: serviceIDs,
+	}
+	for kind, ids := range managed {
+		if err := db.StoreManagedConfig(kind, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func loadDatabase(databaseType, databaseURL, configYAML string) (*database.ServiceDB, error) {
 	if configYAML != "" {
 		databaseType = "sqlite3"
@@ -146,7 +158,13 @@ func loadDatabase(databaseType, databaseURL, configYAML string) (*database.Servi
 	return db, err
 }
 
-func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
+// loadKeyring loads the master keys used to encrypt secrets in the database. ENCRYPTION_KEYS is
+// read here rather than kept in envVars, as envVars is logged at startup.
+func loadKeyring(e envVars) (*database.Keyring, error) {
+	return database.LoadKeyring(os.Getenv("ENCRYPTION_KEYS"), e.EncryptionKeysFile)
+}
+
+func setup(e envVars, mux *http.ServeMux, adminMux *http.ServeMux, matrixClient *http.Client) {
 	err := types.BaseURL(e.BaseURL)
 	if err != nil {
 		log.WithError(err).Panic("Failed to get base url")
@@ -156,6 +174,14 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 	if err != nil {
 		log.WithError(err).Panic("Failed to open database")
 	}
+	keys, err := loadKeyring(e)
+	if err != nil {
+		log.WithError(err).Panic("Failed to load encryption keys")
+	}
+	if keys != nil {
+		log.Info("Encrypting secrets in the database")
+	}
+	db.SetKeyring(keys)
 
 	// Populate the database from the config file if one was supplied.
 	var cfg *api.ConfigFile
@@ -171,15 +197,66 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 		log.Info("Inserted ", len(cfg.Sessions), " sessions")
 	}
 
+	// Apply the managed config file to the persistent database if one was supplied. Unlike
+	// CONFIG_FILE, the /admin HTTP API stays available for everything not in the file.
+	var managedCfg *api.ConfigFile
+	if e.ConfigFile == "" && e.ManagedConfigFile != "" {
+		managedCfg = &api.ConfigFile{}
+		if err = loadYAML(e.ManagedConfigFile, managedCfg); err != nil {
+			log.WithError(err).WithField("managed_config_file", e.ManagedConfigFile).Panic("Failed to load managed config file")
+		}
+		if err = db.InsertFromConfig(managedCfg); err != nil {
+			log.WithError(err).Panic("Failed to persist managed config data into DB")
+		}
+		// Mark everything now, so that entries which are no longer in the file can be modified again.
+		if err = markManagedConfig(db, managedCfg); err != nil {
+			log.WithError(err).Panic("Failed to mark managed config")
+		}
+		log.Info("Inserted ", len(managedCfg.Clients), " managed clients")
+		log.Info("Inserted ", len(managedCfg.Realms), " managed realms")
+		log.Info("Inserted ", len(managedCfg.Sessions), " managed sessions")
+	}
+
+	var adminTokens []api.AdminToken
+	if e.AdminTokensFile != "" {
+		if adminTokens, err = loadAdminTokens(e.AdminTokensFile); err != nil {
+			log.WithError(err).WithField("admin_tokens_file", e.AdminTokensFile).Panic("Failed to load admin tokens file")
+		}
+		log.Info("Loaded ", len(adminTokens), " admin tokens")
+	} else if e.ConfigFile == "" {
+		log.Warn("ADMIN_TOKENS_FILE is not set: the /admin HTTP API is unauthenticated")
+	}
+	admin := handlers.NewAdminAuth(adminTokens)
+
 	clients := clients.New(db, matrixClient)
-	if err := clients.Start(); err != nil {
+	clients.SetBuiltinCommands(control.Commands)
+	prometheus.MustRegister(clients.Collector())
+	if e.LeaderElection {
+		// Nothing is synced or polled until this instance is elected leader.
+		if err := clients.SetSyncing(false); err != nil {
+			log.WithError(err).Panic("Failed to start up clients")
+		}
+		polling.Stop()
+	} else if err := clients.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start up clients")
 	}
 
 	// Handle non-admin paths for normal NEB functioning
 	mux.Handle("/metrics", prometheus.Handler())
 	mux.Handle("/test", prometheus.InstrumentHandler("test", util.MakeJSONAPI(&handlers.Heartbeat{})))
+	mux.Handle("/health/live", prometheus.InstrumentHandler("healthLive", util.MakeJSONAPI(handlers.NewLiveness(db, clients))))
+	mux.Handle("/health/ready", prometheus.InstrumentHandler("healthReady", util.MakeJSONAPI(handlers.NewReadiness(db, clients))))
 	wh := handlers.NewWebhook(db, clients)
+	if e.WebhookJournalRetention != "" {
+		retention, err := time.ParseDuration(e.WebhookJournalRetention)
+		if err != nil || retention <= 0 {
+			log.WithField("WEBHOOK_JOURNAL_RETENTION", e.WebhookJournalRetention).Panic(
+				"WEBHOOK_JOURNAL_RETENTION must be a positive duration, e.g. 168h")
+		}
+		wh.SetJournalRetention(retention)
+		wh.StartJournalSweep()
+	}
+	wh.StartQueue()
 	mux.HandleFunc("/services/hooks/", prometheus.InstrumentHandlerFunc("webhookHandler", util.Protect(wh.Handle)))
 	rh := &handlers.RealmRedirect{db}
 	mux.HandleFunc("/realms/redirects/", prometheus.InstrumentHandlerFunc("realmRedirectHandler", util.Protect(rh.Handle)))
@@ -193,55 +270,181 @@ func setup(e envVars, mux *http.ServeMux, matrixClient *http.Client) {
 
 		log.Info("Inserted ", len(cfg.Services), " services")
 	} else {
-		mux.Handle("/admin/getService", prometheus.InstrumentHandler("getService", util.MakeJSONAPI(&handlers.GetService{db})))
-		mux.Handle("/admin/getSession", prometheus.InstrumentHandler("getSession", util.MakeJSONAPI(&handlers.GetSession{db})))
-		mux.Handle("/admin/configureClient", prometheus.InstrumentHandler("configureClient", util.MakeJSONAPI(&handlers.ConfigureClient{clients})))
-		mux.Handle("/admin/configureService", prometheus.InstrumentHandler("configureService", util.MakeJSONAPI(handlers.NewConfigureService(db, clients))))
-		mux.Handle("/admin/configureAuthRealm", prometheus.InstrumentHandler("configureAuthRealm", util.MakeJSONAPI(&handlers.ConfigureAuthRealm{db})))
-		mux.Handle("/admin/requestAuthSession", prometheus.InstrumentHandler("requestAuthSession", util.MakeJSONAPI(&handlers.RequestAuthSession{db})))
-		mux.Handle("/admin/removeAuthSession", prometheus.InstrumentHandler("removeAuthSession", util.MakeJSONAPI(&handlers.RemoveAuthSession{db})))
+		if managedCfg != nil {
+			if err := insertServicesFromConfig(clients, managedCfg.Services); err != nil {
+				log.WithError(err).Panic("Failed to insert managed services")
+			}
+			log.Info("Inserted ", len(managedCfg.Services), " managed services")
+		}
+
+		adminMux.Handle("/admin/getService", prometheus.InstrumentHandler("getService", util.MakeJSONAPI(admin.ReadService(&handlers.GetService{db}))))
+		adminMux.Handle("/admin/deleteService", prometheus.InstrumentHandler("deleteService", util.MakeJSONAPI(admin.ConfigureService(handlers.NewDeleteService(db, clients)))))
+		adminMux.Handle("/admin/listServices", prometheus.InstrumentHandler("listServices", util.MakeJSONAPI(admin.ReadService(&handlers.ListServices{db}))))
+		adminMux.Handle("/admin/serviceTypes", prometheus.InstrumentHandler("serviceTypes", util.MakeJSONAPI(admin.Read(&handlers.ServiceTypes{}))))
+		adminMux.Handle("/admin/getSession", prometheus.InstrumentHandler("getSession", util.MakeJSONAPI(admin.Configure(&handlers.GetSession{db}))))
+		adminMux.Handle("/admin/configureClient", prometheus.InstrumentHandler("configureClient", util.MakeJSONAPI(admin.Configure(&handlers.ConfigureClient{clients, db}))))
+		adminMux.Handle("/admin/configureService", prometheus.InstrumentHandler("configureService", util.MakeJSONAPI(admin.ConfigureService(handlers.NewConfigureService(db, clients)))))
+		adminMux.Handle("/admin/pauseService", prometheus.InstrumentHandler("pauseService", util.MakeJSONAPI(admin.ConfigureService(&handlers.PauseService{db}))))
+		adminMux.Handle("/admin/resumeService", prometheus.InstrumentHandler("resumeService", util.MakeJSONAPI(admin.ConfigureService(&handlers.ResumeService{db}))))
+		adminMux.Handle("/admin/getServiceStatus", prometheus.InstrumentHandler("getServiceStatus", util.MakeJSONAPI(admin.ReadService(&handlers.GetServiceStatus{db}))))
+		adminMux.Handle("/admin/patchService", prometheus.InstrumentHandler("patchService", util.MakeJSONAPI(admin.ConfigureService(handlers.NewPatchService(db, clients)))))
+		adminMux.Handle("/admin/listClients", prometheus.InstrumentHandler("listClients", util.MakeJSONAPI(admin.Configure(&handlers.ListClients{db}))))
+		adminMux.Handle("/admin/deleteClient", prometheus.InstrumentHandler("deleteClient", util.MakeJSONAPI(admin.Configure(&handlers.DeleteClient{db, clients}))))
+		adminMux.Handle("/admin/configureAuthRealm", prometheus.InstrumentHandler("configureAuthRealm", util.MakeJSONAPI(admin.Configure(&handlers.ConfigureAuthRealm{db}))))
+		adminMux.Handle("/admin/listRealms", prometheus.InstrumentHandler("listRealms", util.MakeJSONAPI(admin.Configure(&handlers.ListRealms{db}))))
+		adminMux.Handle("/admin/realmTypes", prometheus.InstrumentHandler("realmTypes", util.MakeJSONAPI(admin.Read(&handlers.RealmTypes{}))))
+		adminMux.Handle("/admin/deleteRealm", prometheus.InstrumentHandler("deleteRealm", util.MakeJSONAPI(admin.Configure(&handlers.DeleteRealm{db}))))
+		adminMux.Handle("/admin/listSessions", prometheus.InstrumentHandler("listSessions", util.MakeJSONAPI(admin.Configure(&handlers.ListSessions{db}))))
+		adminMux.Handle("/admin/requestAuthSession", prometheus.InstrumentHandler("requestAuthSession", util.MakeJSONAPI(admin.Configure(&handlers.RequestAuthSession{db}))))
+		adminMux.Handle("/admin/removeAuthSession", prometheus.InstrumentHandler("removeAuthSession", util.MakeJSONAPI(admin.Configure(&handlers.RemoveAuthSession{db}))))
+		adminMux.Handle("/admin/getConfigHistory", prometheus.InstrumentHandler("getConfigHistory", util.MakeJSONAPI(admin.Configure(&handlers.GetConfigHistory{db}))))
+		adminMux.Handle("/admin/rollbackConfig", prometheus.InstrumentHandler("rollbackConfig", util.MakeJSONAPI(admin.Configure(handlers.NewRollbackConfig(db, clients)))))
+		adminMux.Handle("/admin/getWebhookDeliveries", prometheus.InstrumentHandler("getWebhookDeliveries", util.MakeJSONAPI(admin.ReadService(&handlers.GetWebhookDeliveries{db}))))
+		adminMux.Handle("/admin/replayWebhook", prometheus.InstrumentHandler("replayWebhook", util.MakeJSONAPI(admin.ConfigureService(&handlers.ReplayWebhook{db, wh}))))
+		adminMux.Handle("/admin/getPollQueue", prometheus.InstrumentHandler("getPollQueue", util.MakeJSONAPI(admin.Read(&handlers.GetPollQueue{}))))
+		adminMux.Handle("/admin/export", prometheus.InstrumentHandler("export", util.MakeJSONAPI(admin.Configure(&handlers.Export{db}))))
+		adminMux.Handle("/admin/import", prometheus.InstrumentHandler("import", util.MakeJSONAPI(admin.Configure(handlers.NewImport(db, clients)))))
 	}
 	polling.SetClients(clients)
-	if err := polling.Start(); err != nil {
+	if e.PollWorkers != "" {
+		workers, err := strconv.Atoi(e.PollWorkers)
+		if err != nil || workers < 1 {
+			log.WithField("POLL_WORKERS", e.PollWorkers).Panic("POLL_WORKERS must be a positive number")
+		}
+		polling.SetWorkers(workers)
+	}
+	polling.SetAlertRoom(e.PollAlertRoom)
+	if e.LeaderElection {
+		go newElector(db, clients, e.InstanceID).Run()
+	} else if err := polling.Start(); err != nil {
 		log.WithError(err).Panic("Failed to start polling")
 	}
 }
 
+// setupTracing turns on tracing if TRACING=1, exporting spans to the OTLP collector at
+// OTEL_EXPORTER_OTLP_ENDPOINT, or to stdout if that isn't set.
+func setupTracing(e envVars) {
+	if !e.Tracing {
+		return
+	}
+	serviceName := e.TracingServiceName
+	if serviceName == "" {
+		serviceName = "go-neb"
+	}
+	if e.OTLPEndpoint == "" {
+		log.Info("Tracing to stdout")
+		tracing.Start(tracing.NewStdoutExporter(os.Stdout))
+		return
+	}
+	log.WithField("endpoint", e.OTLPEndpoint).Info("Tracing to an OTLP collector")
+	tracing.Start(tracing.NewOTLPExporter(e.OTLPEndpoint, serviceName))
+}
+
+// newElector makes an Elector which syncs clients and polls services while this instance is the
+// leader, and picks up clients and services configured through other instances whether or not it
+// is the leader.
+func newElector(db *database.ServiceDB, clients *clients.Clients, instanceID string) *leader.Elector {
+	if instanceID == "" {
+		hostname, _ := os.Hostname()
+		instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	log.WithField("instance_id", instanceID).Info("Taking part in leader election")
+	return leader.New(db, instanceID, func() {
+		if err := clients.SetSyncing(true); err != nil {
+			log.WithError(err).Error("Failed to start syncing clients")
+		}
+		if err := polling.Start(); err != nil {
+			log.WithError(err).Error("Failed to start polling")
+		}
+	}, func() {
+		if err := clients.SetSyncing(false); err != nil {
+			log.WithError(err).Error("Failed to stop syncing clients")
+		}
+		polling.Stop()
+	}, func() {
+		if err := clients.Reconcile(); err != nil {
+			log.WithError(err).Error("Failed to reconcile clients")
+		}
+		if err := polling.Reconcile(); err != nil {
+			log.WithError(err).Error("Failed to reconcile polled services")
+		}
+	}, func() {
+		// Webhooks are handled by every instance, so their clients must be kept up to date too.
+		if err := clients.Reconcile(); err != nil {
+			log.WithError(err).Error("Failed to reconcile clients")
+		}
+	})
+}
+
 type envVars struct {
-	BindAddress  string
-	DatabaseType string
-	DatabaseURL  string
-	BaseURL      string
-	LogDir       string
-	ConfigFile   string
+	BindAddress             string
+	AdminBindAddress        string
+	AdminTokensFile         string
+	DatabaseType            string
+	DatabaseURL             string
+	BaseURL                 string
+	LogDir                  string
+	LogFormat               string
+	ConfigFile              string
+	ManagedConfigFile       string
+	EncryptionKeysFile      string
+	PollWorkers             string
+	PollAlertRoom           string
+	WebhookJournalRetention string
+	LeaderElection          bool
+	InstanceID              string
+	Tracing                 bool
+	OTLPEndpoint            string
+	TracingServiceName      string
 }
 
 func main() {
 	e := envVars{
-		BindAddress:  os.Getenv("BIND_ADDRESS"),
-		DatabaseType: os.Getenv("DATABASE_TYPE"),
-		DatabaseURL:  os.Getenv("DATABASE_URL"),
-		BaseURL:      os.Getenv("BASE_URL"),
-		LogDir:       os.Getenv("LOG_DIR"),
-		ConfigFile:   os.Getenv("CONFIG_FILE"),
-	}
-
-	if e.LogDir != "" {
-		log.AddHook(dugong.NewFSHook(
-			filepath.Join(e.LogDir, "info.log"),
-			filepath.Join(e.LogDir, "warn.log"),
-			filepath.Join(e.LogDir, "error.log"),
-			&log.TextFormatter{
-				TimestampFormat:  "2006-01-02 15:04:05.000000",
-				DisableColors:    true,
-				DisableTimestamp: false,
-				DisableSorting:   false,
-			}, &dugong.DailyRotationSchedule{GZip: false},
-		))
+		BindAddress:             os.Getenv("BIND_ADDRESS"),
+		AdminBindAddress:        os.Getenv("ADMIN_BIND_ADDRESS"),
+		AdminTokensFile:         os.Getenv("ADMIN_TOKENS_FILE"),
+		DatabaseType:            os.Getenv("DATABASE_TYPE"),
+		DatabaseURL:             os.Getenv("DATABASE_URL"),
+		BaseURL:                 os.Getenv("BASE_URL"),
+		LogDir:                  os.Getenv("LOG_DIR"),
+		LogFormat:               os.Getenv("LOG_FORMAT"),
+		ConfigFile:              os.Getenv("CONFIG_FILE"),
+		ManagedConfigFile:       os.Getenv("MANAGED_CONFIG_FILE"),
+		EncryptionKeysFile:      os.Getenv("ENCRYPTION_KEYS_FILE"),
+		PollWorkers:             os.Getenv("POLL_WORKERS"),
+		PollAlertRoom:           os.Getenv("POLL_ALERT_ROOM"),
+		WebhookJournalRetention: os.Getenv("WEBHOOK_JOURNAL_RETENTION"),
+		LeaderElection:          os.Getenv("LEADER_ELECTION") == "1",
+		InstanceID:              os.Getenv("INSTANCE_ID"),
+		Tracing:                 os.Getenv("TRACING") == "1",
+		OTLPEndpoint:            os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		TracingServiceName:      os.Getenv("OTEL_SERVICE_NAME"),
+	}
+
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(e, os.Args[1], os.Args[2:]))
+	}
+
+	if err := logging.Setup(e.LogFormat, e.LogDir); err != nil {
+		log.WithError(err).Panic("Failed to set up logging")
 	}
 
 	log.Infof("Go-NEB (%+v)", e)
 
-	setup(e, http.DefaultServeMux, http.DefaultClient)
-	log.Fatal(http.ListenAndServe(e.BindAddress, nil))
+	// Serve the /admin API on its own listener if asked to, so it can be kept off the public
+	// interface which webhooks arrive on.
+	adminMux := http.DefaultServeMux
+	if e.AdminBindAddress != "" {
+		adminMux = http.NewServeMux()
+	}
+
+	setupTracing(e)
+	setup(e, http.DefaultServeMux, adminMux, http.DefaultClient)
+
+	if e.AdminBindAddress != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(e.AdminBindAddress, tracing.Handler(adminMux)))
+		}()
+	}
+	log.Fatal(http.ListenAndServe(e.BindAddress, tracing.Handler(http.DefaultServeMux)))
 }
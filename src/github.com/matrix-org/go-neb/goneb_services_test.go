@@ -2,10 +2,18 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
+
+	"github.com/matrix-org/go-neb/api"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
 )
 
 var mux = http.NewServeMux()
@@ -16,7 +24,7 @@ func TestMain(m *testing.M) {
 		BaseURL:      "http://go.neb",
 		DatabaseType: "sqlite3",
 		DatabaseURL:  ":memory:",
-	}, mux, &http.Client{
+	}, mux, mux, &http.Client{
 		Transport: mxTripper,
 	})
 	exitCode := m.Run()
@@ -54,3 +62,605 @@ func TestConfigureClient(t *testing.T) {
 
 	<-syncChan
 }
+
+func TestListAndDeleteServices(t *testing.T) {
+	for _, id := range []string{"echo1", "echo2", "echo3"} {
+		srv, err := types.CreateService(id, "echo", "@zelda:hyrule", []byte(`{}`))
+		if err != nil {
+			t.Fatalf("TestListAndDeleteServices: failed to create service: %s", err)
+		}
+		if _, err = database.GetServiceDB().StoreService(srv); err != nil {
+			t.Fatalf("TestListAndDeleteServices: failed to store service: %s", err)
+		}
+	}
+
+	var listRes struct {
+		Services []struct {
+			ID     string
+			UserID string
+		}
+		NextBatch string
+	}
+	mockWriter := httptest.NewRecorder()
+	mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/listServices", bytes.NewBufferString(`
+	{
+		"UserID":"@zelda:hyrule",
+		"Limit":2
+	}`))
+	mux.ServeHTTP(mockWriter, mockReq)
+	if mockWriter.Code != 200 {
+		t.Fatalf("TestListAndDeleteServices wanted HTTP status 200, got %d", mockWriter.Code)
+	}
+	if err := json.NewDecoder(mockWriter.Body).Decode(&listRes); err != nil {
+		t.Fatalf("TestListAndDeleteServices: failed to decode response: %s", err)
+	}
+	if len(listRes.Services) != 2 || listRes.Services[0].ID != "echo1" || listRes.NextBatch != "echo2" {
+		t.Fatalf("TestListAndDeleteServices: unexpected first page: %+v", listRes)
+	}
+
+	mockWriter = httptest.NewRecorder()
+	mockReq, _ = http.NewRequest("POST", "http://go.neb/admin/deleteService", bytes.NewBufferString(`
+	{
+		"ID":"echo3"
+	}`))
+	mux.ServeHTTP(mockWriter, mockReq)
+	if mockWriter.Code != 200 {
+		t.Fatalf("TestListAndDeleteServices wanted HTTP status 200, got %d", mockWriter.Code)
+	}
+
+	listRes.Services = nil
+	listRes.NextBatch = ""
+	mockWriter = httptest.NewRecorder()
+	mockReq, _ = http.NewRequest("POST", "http://go.neb/admin/listServices", bytes.NewBufferString(`
+	{
+		"UserID":"@zelda:hyrule",
+		"From":"echo2"
+	}`))
+	mux.ServeHTTP(mockWriter, mockReq)
+	if err := json.NewDecoder(mockWriter.Body).Decode(&listRes); err != nil {
+		t.Fatalf("TestListAndDeleteServices: failed to decode response: %s", err)
+	}
+	if len(listRes.Services) != 0 || listRes.NextBatch != "" {
+		t.Fatalf("TestListAndDeleteServices: expected deleted service to be gone, got %+v", listRes)
+	}
+}
+
+func TestDeleteClientInUse(t *testing.T) {
+	db := database.GetServiceDB()
+	if _, err := db.StoreMatrixClientConfig(api.ClientConfig{
+		UserID:        "@ganon:hyrule",
+		HomeserverURL: "http://hyrule.loz",
+		AccessToken:   "itsasecrettoeverybody",
+	}); err != nil {
+		t.Fatalf("TestDeleteClientInUse: failed to store client: %s", err)
+	}
+	srv, err := types.CreateService("ganon_echo", "echo", "@ganon:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("TestDeleteClientInUse: failed to create service: %s", err)
+	}
+	if _, err = db.StoreService(srv); err != nil {
+		t.Fatalf("TestDeleteClientInUse: failed to store service: %s", err)
+	}
+
+	deleteClient := func() int {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/deleteClient", bytes.NewBufferString(`
+		{
+			"UserID":"@ganon:hyrule"
+		}`))
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter.Code
+	}
+
+	if code := deleteClient(); code != 409 {
+		t.Errorf("TestDeleteClientInUse wanted HTTP status 409 whilst in use, got %d", code)
+	}
+	if err = db.DeleteService("ganon_echo"); err != nil {
+		t.Fatalf("TestDeleteClientInUse: failed to delete service: %s", err)
+	}
+	if code := deleteClient(); code != 200 {
+		t.Errorf("TestDeleteClientInUse wanted HTTP status 200, got %d", code)
+	}
+	if code := deleteClient(); code != 404 {
+		t.Errorf("TestDeleteClientInUse wanted HTTP status 404 once deleted, got %d", code)
+	}
+}
+
+func TestConfigHistoryAndRollback(t *testing.T) {
+	post := func(path, body string) *httptest.ResponseRecorder {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/"+path, bytes.NewBufferString(body))
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter
+	}
+	for _, token := range []string{"firsttoken", "secondtoken"} {
+		res := post("configureClient", `{
+			"UserID":"@zora:hyrule",
+			"HomeserverURL":"http://hyrule.loz",
+			"AccessToken":"`+token+`"
+		}`)
+		if res.Code != 200 {
+			t.Fatalf("TestConfigHistoryAndRollback: configureClient wanted HTTP status 200, got %d", res.Code)
+		}
+	}
+
+	getHistory := func() []api.ConfigHistoryEntry {
+		res := post("getConfigHistory", `{"Kind":"client","ID":"@zora:hyrule"}`)
+		if res.Code != 200 {
+			t.Fatalf("TestConfigHistoryAndRollback: getConfigHistory wanted HTTP status 200, got %d", res.Code)
+		}
+		var body struct {
+			History []api.ConfigHistoryEntry
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("TestConfigHistoryAndRollback: failed to decode history: %s", err)
+		}
+		return body.History
+	}
+
+	history := getHistory()
+	if len(history) != 2 || history[0].Version != 2 || history[0].Action != api.ConfigActionConfigure {
+		t.Fatalf("TestConfigHistoryAndRollback: expected 2 versions, got %+v", history)
+	}
+	wantDiff := api.ConfigChange{Path: "/AccessToken", Old: "firsttoken", New: "secondtoken"}
+	if len(history[0].Diff) != 1 || history[0].Diff[0] != wantDiff {
+		t.Errorf("TestConfigHistoryAndRollback: expected diff %+v, got %+v", wantDiff, history[0].Diff)
+	}
+
+	if res := post("rollbackConfig", `{"Kind":"client","ID":"@zora:hyrule","Version":1}`); res.Code != 200 {
+		t.Fatalf("TestConfigHistoryAndRollback: rollbackConfig wanted HTTP status 200, got %d", res.Code)
+	}
+	cfg, err := database.GetServiceDB().LoadMatrixClientConfig("@zora:hyrule")
+	if err != nil || cfg.AccessToken != "firsttoken" {
+		t.Errorf("TestConfigHistoryAndRollback: expected rolled back token, got %+v (err=%v)", cfg, err)
+	}
+	history = getHistory()
+	if len(history) != 3 || history[0].Action != api.ConfigActionRollback {
+		t.Errorf("TestConfigHistoryAndRollback: expected rollback to be recorded, got %+v", history)
+	}
+
+	if res := post("rollbackConfig", `{"Kind":"client","ID":"@zora:hyrule","Version":9}`); res.Code != 404 {
+		t.Errorf("TestConfigHistoryAndRollback: rollbackConfig to unknown version wanted HTTP status 404, got %d", res.Code)
+	}
+}
+
+func TestServiceTypesAndValidation(t *testing.T) {
+	mockWriter := httptest.NewRecorder()
+	mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/serviceTypes", bytes.NewBufferString(`{}`))
+	mux.ServeHTTP(mockWriter, mockReq)
+	if mockWriter.Code != 200 {
+		t.Fatalf("TestServiceTypesAndValidation: serviceTypes wanted HTTP status 200, got %d", mockWriter.Code)
+	}
+	var res struct {
+		ServiceTypes []struct {
+			Type   string
+			Schema types.JSONSchema
+		}
+	}
+	if err := json.NewDecoder(mockWriter.Body).Decode(&res); err != nil {
+		t.Fatalf("TestServiceTypesAndValidation: failed to decode response: %s", err)
+	}
+	schemas := make(map[string]*types.JSONSchema)
+	for i := range res.ServiceTypes {
+		schemas[res.ServiceTypes[i].Type] = &res.ServiceTypes[i].Schema
+	}
+	readOnly := map[string]string{
+		"travis-ci":      "webhook_url",
+		"slackapi":       "webhook_url",
+		"github-webhook": "WebhookURL",
+		"jira":           "WebhookURL",
+	}
+	for serviceType, field := range readOnly {
+		schema := schemas[serviceType]
+		if schema == nil {
+			t.Fatalf("TestServiceTypesAndValidation: %s missing from %+v", serviceType, res.ServiceTypes)
+		}
+		if prop := schema.Properties[field]; prop == nil || !prop.ReadOnly {
+			t.Errorf("TestServiceTypesAndValidation: expected %s of %s to be read-only, got %+v", field, serviceType, prop)
+		}
+	}
+
+	configure := func(config string) int {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/configureService", bytes.NewBufferString(`{
+			"ID": "travis_validation",
+			"Type": "travis-ci",
+			"UserID": "@link:hyrule",
+			"Config": `+config+`
+		}`))
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter.Code
+	}
+	badConfigs := []string{
+		`{"rooms": {"!foo:hyrule": {"repos": {"owner/repo": {"template": 5}}}}}`,
+		`{"rooms": []}`,
+	}
+	for _, config := range badConfigs {
+		if code := configure(config); code != 400 {
+			t.Errorf("TestServiceTypesAndValidation: config %s wanted HTTP status 400, got %d", config, code)
+		}
+	}
+	// Keys which older versions of Go-NEB used are accepted.
+	if config := `{"rooms": {}, "removed_key": true}`; configure(config) != 200 {
+		t.Errorf("TestServiceTypesAndValidation: config %s wanted HTTP status 200", config)
+	}
+}
+
+func TestPatchService(t *testing.T) {
+	if _, err := database.GetServiceDB().StoreMatrixClientConfig(api.ClientConfig{
+		UserID:        "@mido:hyrule",
+		HomeserverURL: "http://hyrule.loz",
+		AccessToken:   "heyyoudontgetcocky",
+	}); err != nil {
+		t.Fatalf("TestPatchService: failed to store client: %s", err)
+	}
+	for _, roomID := range []string{"!forest:hyrule", "!deku:hyrule"} {
+		mxTripper.Handle("POST", "/_matrix/client/r0/join/"+roomID, func(req *http.Request) (*http.Response, error) {
+			return newResponse(200, `{}`), nil
+		})
+	}
+	post := func(path, body string) *httptest.ResponseRecorder {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/"+path, bytes.NewBufferString(body))
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter
+	}
+
+	res := post("configureService", `{
+		"ID": "travis_patch",
+		"Type": "travis-ci",
+		"UserID": "@mido:hyrule",
+		"Config": {"rooms": {"!forest:hyrule": {"repos": {"kokiri/forest": {}}}}}
+	}`)
+	if res.Code != 200 {
+		t.Fatalf("TestPatchService: configureService wanted HTTP status 200, got %d", res.Code)
+	}
+	etag := res.Header().Get("ETag")
+
+	res = post("patchService", `{
+		"ID": "travis_patch",
+		"ETag": `+strconv.Quote(etag)+`,
+		"MergePatch": {"rooms": {"!deku:hyrule": {"repos": {"kokiri/deku": {"template": "%{result}"}}}}}
+	}`)
+	if res.Code != 200 {
+		t.Fatalf("TestPatchService: patchService wanted HTTP status 200, got %d: %s", res.Code, res.Body.String())
+	}
+	srv, err := database.GetServiceDB().LoadService("travis_patch")
+	if err != nil {
+		t.Fatalf("TestPatchService: failed to load service: %s", err)
+	}
+	srvJSON, _ := json.Marshal(srv)
+	for _, want := range []string{"kokiri/forest", "kokiri/deku"} {
+		if !bytes.Contains(srvJSON, []byte(want)) {
+			t.Errorf("TestPatchService: expected patched service to contain %s, got %s", want, srvJSON)
+		}
+	}
+
+	res = post("patchService", `{
+		"ID": "travis_patch",
+		"ETag": `+strconv.Quote(etag)+`,
+		"Patch": [{"op": "remove", "path": "/rooms/!forest:hyrule"}]
+	}`)
+	if res.Code != 412 {
+		t.Errorf("TestPatchService: patchService with stale ETag wanted HTTP status 412, got %d", res.Code)
+	}
+
+	res = post("patchService", `{
+		"ID": "travis_patch",
+		"Patch": [{"op": "remove", "path": "/rooms/!forest:hyrule"}]
+	}`)
+	if res.Code != 428 {
+		t.Errorf("TestPatchService: patchService without an ETag wanted HTTP status 428, got %d", res.Code)
+	}
+
+	etag = getServiceETag(t, "travis_patch")
+	for _, patch := range []string{
+		`"Patch": [{"op": "test", "path": "/rooms/!forest:hyrule/repos/kokiri~1forest/template", "value": "nope"}]`,
+		`"Patch": [{"op": "add", "path": "", "value": null}]`,
+		`"MergePatch": null`,
+		`"MergePatch": ["rooms"]`,
+	} {
+		res = post("patchService", `{
+			"ID": "travis_patch",
+			"ETag": `+strconv.Quote(etag)+`,
+			`+patch+`
+		}`)
+		if res.Code != 400 {
+			t.Errorf("TestPatchService: patchService with %s wanted HTTP status 400, got %d", patch, res.Code)
+		}
+	}
+	if getServiceETag(t, "travis_patch") != etag {
+		t.Errorf("TestPatchService: expected rejected patches not to change the service")
+	}
+}
+
+func getServiceETag(t *testing.T, serviceID string) string {
+	mockWriter := httptest.NewRecorder()
+	mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/getService", bytes.NewBufferString(`{"ID": `+strconv.Quote(serviceID)+`}`))
+	mux.ServeHTTP(mockWriter, mockReq)
+	if mockWriter.Code != 200 {
+		t.Fatalf("getService wanted HTTP status 200, got %d", mockWriter.Code)
+	}
+	return mockWriter.Header().Get("ETag")
+}
+
+func TestConfigureServiceDryRun(t *testing.T) {
+	if _, err := database.GetServiceDB().StoreMatrixClientConfig(api.ClientConfig{
+		UserID:        "@saria:hyrule",
+		HomeserverURL: "http://hyrule.loz",
+		AccessToken:   "sariassong",
+	}); err != nil {
+		t.Fatalf("TestConfigureServiceDryRun: failed to store client: %s", err)
+	}
+	dryRun := func(repo string) *httptest.ResponseRecorder {
+		mockWriter := httptest.NewRecorder()
+		// No handler is registered for joining this room, so actually joining it would panic.
+		mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/configureService?dry_run=true", bytes.NewBufferString(`{
+			"ID": "travis_dry_run",
+			"Type": "travis-ci",
+			"UserID": "@saria:hyrule",
+			"Config": {"rooms": {"!lostwoods:hyrule": {"repos": {"`+repo+`": {}}}}}
+		}`))
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter
+	}
+
+	res := dryRun("kokiri/lostwoods")
+	if res.Code != 200 {
+		t.Fatalf("TestConfigureServiceDryRun wanted HTTP status 200, got %d: %s", res.Code, res.Body.String())
+	}
+	var body struct {
+		DryRun bool
+		Diff   []api.ConfigChange
+		Plan   *types.RegisterPlan
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("TestConfigureServiceDryRun: failed to decode response: %s", err)
+	}
+	if !body.DryRun || len(body.Diff) == 0 {
+		t.Errorf("TestConfigureServiceDryRun: expected a dry run with a diff, got %+v", body)
+	}
+	if body.Plan == nil || len(body.Plan.JoinRooms) != 1 || body.Plan.JoinRooms[0] != "!lostwoods:hyrule" {
+		t.Errorf("TestConfigureServiceDryRun: expected to plan to join !lostwoods:hyrule, got %+v", body.Plan)
+	}
+	if _, err := database.GetServiceDB().LoadService("travis_dry_run"); err != sql.ErrNoRows {
+		t.Errorf("TestConfigureServiceDryRun: expected service not to be stored, got err=%v", err)
+	}
+
+	if res = dryRun("not-a-repo"); res.Code != 400 {
+		t.Errorf("TestConfigureServiceDryRun: invalid repo wanted HTTP status 400, got %d", res.Code)
+	}
+
+	// Fields which Go-NEB fills in, like the travis-ci webhook_url, aren't changes.
+	mxTripper.Handle("POST", "/_matrix/client/r0/join/!kokiri:hyrule", func(req *http.Request) (*http.Response, error) {
+		return newResponse(200, `{}`), nil
+	})
+	config := `{
+		"ID": "travis_dry_run_unchanged",
+		"Type": "travis-ci",
+		"UserID": "@saria:hyrule",
+		"Config": {"rooms": {"!kokiri:hyrule": {"repos": {"kokiri/village": {}}}}}
+	}`
+	for _, path := range []string{"configureService", "configureService?dry_run=true"} {
+		res = httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/"+path, bytes.NewBufferString(config))
+		mux.ServeHTTP(res, mockReq)
+		if res.Code != 200 {
+			t.Fatalf("TestConfigureServiceDryRun: %s wanted HTTP status 200, got %d: %s", path, res.Code, res.Body.String())
+		}
+	}
+	body.Diff = nil
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("TestConfigureServiceDryRun: failed to decode response: %s", err)
+	}
+	if len(body.Diff) != 0 {
+		t.Errorf("TestConfigureServiceDryRun: expected no diff against the same config, got %+v", body.Diff)
+	}
+}
+
+func TestExportAndImport(t *testing.T) {
+	mxTripper.Handle("POST", "/_matrix/client/r0/join/!gerudo:hyrule", func(req *http.Request) (*http.Response, error) {
+		return newResponse(200, `{}`), nil
+	})
+	post := func(path, body string) *httptest.ResponseRecorder {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/"+path, bytes.NewBufferString(body))
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter
+	}
+	importYAML := func(yaml string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(struct{ YAML string }{yaml})
+		return post("import", string(b))
+	}
+
+	res := importYAML(`
+clients:
+  - UserID: "@nabooru:hyrule"
+    AccessToken: "spiritoftemple"
+    HomeserverURL: "http://hyrule.loz"
+services:
+  - ID: "travis_import"
+    Type: "travis-ci"
+    UserID: "@nabooru:hyrule"
+    Config:
+      rooms:
+        "!gerudo:hyrule":
+          repos:
+            "gerudo/fortress": {}
+`)
+	if res.Code != 200 {
+		t.Fatalf("TestExportAndImport: import wanted HTTP status 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if _, err := database.GetServiceDB().LoadService("travis_import"); err != nil {
+		t.Fatalf("TestExportAndImport: expected imported service to exist: %s", err)
+	}
+
+	export := func(redact bool) api.ConfigFile {
+		res := post("export", `{"Redact":`+strconv.FormatBool(redact)+`}`)
+		if res.Code != 200 {
+			t.Fatalf("TestExportAndImport: export wanted HTTP status 200, got %d", res.Code)
+		}
+		var body struct {
+			YAML string
+		}
+		var cfg api.ConfigFile
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("TestExportAndImport: failed to decode export: %s", err)
+		}
+		if err := api.UnmarshalYAML([]byte(body.YAML), &cfg); err != nil {
+			t.Fatalf("TestExportAndImport: export is not a valid config file: %s", err)
+		}
+		return cfg
+	}
+
+	cfg := export(false)
+	var found bool
+	for _, c := range cfg.Clients {
+		if c.UserID == "@nabooru:hyrule" {
+			found = c.AccessToken == "spiritoftemple"
+		}
+	}
+	if !found {
+		t.Errorf("TestExportAndImport: expected export to contain imported client, got %+v", cfg.Clients)
+	}
+
+	cfg = export(true)
+	if !cfg.IsRedacted() {
+		t.Errorf("TestExportAndImport: expected redacted export, got %+v", cfg)
+	}
+	for _, c := range cfg.Clients {
+		if c.AccessToken != api.RedactedValue {
+			t.Errorf("TestExportAndImport: expected access token to be redacted, got %s", c.AccessToken)
+		}
+	}
+	yamlBytes, _ := api.MarshalYAML(cfg)
+	if res = importYAML(string(yamlBytes)); res.Code != 400 {
+		t.Errorf("TestExportAndImport: importing redacted export wanted HTTP status 400, got %d", res.Code)
+	}
+}
+
+func TestManagedConfigIsReadOnly(t *testing.T) {
+	db := database.GetServiceDB()
+	if _, err := db.StoreMatrixClientConfig(api.ClientConfig{
+		UserID:        "@rauru:hyrule",
+		HomeserverURL: "http://hyrule.loz",
+		AccessToken:   "sageoflight",
+	}); err != nil {
+		t.Fatalf("TestManagedConfigIsReadOnly: failed to store client: %s", err)
+	}
+	srv, err := types.CreateService("echo_managed", "echo", "@rauru:hyrule", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("TestManagedConfigIsReadOnly: failed to create service: %s", err)
+	}
+	if _, err = db.StoreService(srv); err != nil {
+		t.Fatalf("TestManagedConfigIsReadOnly: failed to store service: %s", err)
+	}
+	if err = db.StoreManagedConfig(api.ConfigKindService, []string{"echo_managed"}); err != nil {
+		t.Fatalf("TestManagedConfigIsReadOnly: failed to mark service as managed: %s", err)
+	}
+	if err = db.StoreManagedConfig(api.ConfigKindClient, []string{"@rauru:hyrule"}); err != nil {
+		t.Fatalf("TestManagedConfigIsReadOnly: failed to mark client as managed: %s", err)
+	}
+	defer db.StoreManagedConfig(api.ConfigKindService, nil)
+	defer db.StoreManagedConfig(api.ConfigKindClient, nil)
+
+	post := func(path, body string) int {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb/admin/"+path, bytes.NewBufferString(body))
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter.Code
+	}
+
+	refused := []struct {
+		path string
+		body string
+	}{
+		{"configureService", `{"ID":"echo_managed","Type":"echo","UserID":"@rauru:hyrule","Config":{}}`},
+		{"deleteService", `{"ID":"echo_managed"}`},
+		{"configureClient", `{"UserID":"@rauru:hyrule","HomeserverURL":"http://hyrule.loz","AccessToken":"changed"}`},
+		{"deleteClient", `{"UserID":"@rauru:hyrule"}`},
+	}
+	for _, r := range refused {
+		if code := post(r.path, r.body); code != 403 {
+			t.Errorf("TestManagedConfigIsReadOnly: %s wanted HTTP status 403, got %d", r.path, code)
+		}
+	}
+	if _, err = db.LoadService("echo_managed"); err != nil {
+		t.Errorf("TestManagedConfigIsReadOnly: expected managed service to still exist: %s", err)
+	}
+
+	// Services which are not in the config file can still be configured over HTTP.
+	if code := post("configureService", `{"ID":"travis_unmanaged","Type":"travis-ci","UserID":"@rauru:hyrule","Config":{"rooms":{}}}`); code != 200 {
+		t.Errorf("TestManagedConfigIsReadOnly: configuring unmanaged service wanted HTTP status 200, got %d", code)
+	}
+}
+
+func TestPauseAndResumeService(t *testing.T) {
+	db := database.GetServiceDB()
+	if _, err := db.StoreMatrixClientConfig(api.ClientConfig{
+		UserID:        "@impa:hyrule",
+		HomeserverURL: "http://hyrule.loz",
+		AccessToken:   "sheikahslate",
+	}); err != nil {
+		t.Fatalf("TestPauseAndResumeService: failed to store client: %s", err)
+	}
+	srv, err := types.CreateService("travis_pause", "travis-ci", "@impa:hyrule", []byte(`{"rooms":{}}`))
+	if err != nil {
+		t.Fatalf("TestPauseAndResumeService: failed to create service: %s", err)
+	}
+	if _, err = db.StoreService(srv); err != nil {
+		t.Fatalf("TestPauseAndResumeService: failed to store service: %s", err)
+	}
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		mockWriter := httptest.NewRecorder()
+		mockReq, _ := http.NewRequest("POST", "http://go.neb"+path, bytes.NewBufferString(body))
+		mux.ServeHTTP(mockWriter, mockReq)
+		return mockWriter
+	}
+	// The webhook has no payload= so Travis-CI rejects it, unless the service is paused.
+	hookPath := "/services/hooks/" + base64.RawURLEncoding.EncodeToString([]byte("travis_pause"))
+	if res := post(hookPath, ``); res.Code != 400 {
+		t.Fatalf("TestPauseAndResumeService: webhook before pausing wanted HTTP status 400, got %d", res.Code)
+	}
+
+	if res := post("/admin/pauseService", `{"ID":"travis_pause","QueueWebhooks":true}`); res.Code != 200 {
+		t.Fatalf("TestPauseAndResumeService: pause wanted HTTP status 200, got %d: %s", res.Code, res.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		if res := post(hookPath, ``); res.Code != 200 {
+			t.Errorf("TestPauseAndResumeService: webhook while paused wanted HTTP status 200, got %d", res.Code)
+		}
+	}
+
+	var getRes struct {
+		Paused *api.ServicePause
+	}
+	res := post("/admin/getService", `{"ID":"travis_pause"}`)
+	if err = json.NewDecoder(res.Body).Decode(&getRes); err != nil {
+		t.Fatalf("TestPauseAndResumeService: failed to decode getService response: %s", err)
+	}
+	if getRes.Paused == nil || !getRes.Paused.QueueWebhooks {
+		t.Errorf("TestPauseAndResumeService: expected getService to report the pause, got %+v", getRes.Paused)
+	}
+
+	var resumeRes struct {
+		QueuedWebhooks int
+	}
+	res = post("/admin/resumeService", `{"ID":"travis_pause"}`)
+	if res.Code != 200 {
+		t.Fatalf("TestPauseAndResumeService: resume wanted HTTP status 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if err = json.NewDecoder(res.Body).Decode(&resumeRes); err != nil {
+		t.Fatalf("TestPauseAndResumeService: failed to decode resume response: %s", err)
+	}
+	if resumeRes.QueuedWebhooks != 2 {
+		t.Errorf("TestPauseAndResumeService: expected 2 queued webhooks to be delivered, got %d", resumeRes.QueuedWebhooks)
+	}
+	if res = post("/admin/resumeService", `{"ID":"travis_pause"}`); res.Code != 400 {
+		t.Errorf("TestPauseAndResumeService: resuming twice wanted HTTP status 400, got %d", res.Code)
+	}
+	if res = post(hookPath, ``); res.Code != 400 {
+		t.Errorf("TestPauseAndResumeService: webhook after resuming wanted HTTP status 400, got %d", res.Code)
+	}
+}
@@ -0,0 +1,153 @@
+// Package leader elects one Go-NEB instance, out of several which share a database, to run the
+// /sync loop of every client and poll every service, so that running more than one instance for
+// availability doesn't duplicate every reply and post. Every instance serves webhooks and the HTTP
+// API whether or not it is the leader.
+//
+// The leader holds a lease in the database which it renews every renewInterval. If it dies, its
+// lease expires after leaseTTL and another instance takes over. An instance which fails to renew
+// its lease steps down before the lease can expire, so two instances are never leader at once.
+// Stepping down stops syncing and polling once any callback which is still running has returned,
+// so callbacks should not block for long.
+package leader
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	leaseName = "leader"
+	// leaseTTL is how long the lease lasts if it isn't renewed. If the leader dies, another instance
+	// takes over within about this long.
+	leaseTTL = 30 * time.Second
+	// renewInterval is how often the leader renews the lease, and how often other instances try to
+	// take it. It must be well under leaseTTL.
+	renewInterval = 10 * time.Second
+)
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "goneb_leader",
+	Help: "1 if this instance is the leader, which syncs clients and polls services, or 0 otherwise",
+})
+
+// An Elector takes part in the election of a leader. Callbacks are called one at a time from a
+// goroutine of their own, so that slow callbacks don't hold up renewing the lease.
+type Elector struct {
+	db         database.Storer
+	instanceID string
+	// Called when this instance becomes the leader.
+	onElected func()
+	// Called when this instance stops being the leader.
+	onDeposed func()
+	// Called every renewInterval while this instance is the leader, e.g. to pick up config
+	// changes made through other instances.
+	whileLeader func()
+	// Called every renewInterval while this instance isn't the leader, e.g. to pick up new
+	// access tokens for the clients it uses to handle webhooks.
+	whileFollower func()
+	// Signalled after every attempt to acquire the lease, to call the callbacks.
+	ticked chan struct{}
+	// Whether onElected has been called more recently than onDeposed. Only used by the goroutine
+	// which calls the callbacks.
+	elected bool
+
+	mu        sync.Mutex
+	leader    bool
+	renewedAt time.Time
+}
+
+// New makes an Elector for the instance with the given ID, which must be unique among the
+// instances which share the database.
+func New(db database.Storer, instanceID string, onElected, onDeposed, whileLeader, whileFollower func()) *Elector {
+	return &Elector{
+		db:            db,
+		instanceID:    instanceID,
+		onElected:     onElected,
+		onDeposed:     onDeposed,
+		whileLeader:   whileLeader,
+		whileFollower: whileFollower,
+		ticked:        make(chan struct{}, 1),
+	}
+}
+
+// IsLeader returns true if this instance is currently the leader.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Run takes part in the election forever. Does not return, so call this as a goroutine!
+func (e *Elector) Run() {
+	go func() {
+		for range e.ticked {
+			e.callCallbacks()
+		}
+	}()
+	for {
+		e.tick(time.Now())
+		time.Sleep(renewInterval)
+	}
+}
+
+// tick tries to acquire or renew the lease, and signals the callback goroutine.
+func (e *Elector) tick(now time.Time) {
+	logger := log.WithField("instance_id", e.instanceID)
+	acquired, err := e.db.AcquireLease(leaseName, e.instanceID, leaseTTL)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to acquire the leader lease")
+	}
+
+	e.mu.Lock()
+	wasLeader := e.leader
+	if acquired {
+		e.renewedAt = now
+		e.leader = true
+	} else if err == nil || now.Sub(e.renewedAt) >= leaseTTL-renewInterval {
+		// Someone else holds the lease, or ours may expire before we next get to renew it.
+		e.leader = false
+	}
+	isLeader := e.leader
+	e.mu.Unlock()
+
+	switch {
+	case isLeader && !wasLeader:
+		logger.Info("Elected leader: syncing clients and polling services")
+		leaderGauge.Set(1)
+	case !isLeader && wasLeader:
+		logger.Warn("No longer the leader: no longer syncing clients or polling services")
+		leaderGauge.Set(0)
+	}
+	// If the callbacks are still running from an earlier tick, they'll run again with the latest
+	// state when they finish.
+	select {
+	case e.ticked <- struct{}{}:
+	default:
+	}
+}
+
+// callCallbacks calls onElected or onDeposed if this instance has become or stopped being the
+// leader since they were last called, or else whileLeader or whileFollower.
+func (e *Elector) callCallbacks() {
+	isLeader := e.IsLeader()
+	switch {
+	case isLeader && !e.elected:
+		e.elected = true
+		e.onElected()
+	case !isLeader && e.elected:
+		e.elected = false
+		e.onDeposed()
+	case isLeader:
+		e.whileLeader()
+	default:
+		e.whileFollower()
+	}
+}
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
@@ -0,0 +1,77 @@
+package leader
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/database"
+)
+
+type leaseStorage struct {
+	database.NopStorage
+	acquired bool
+	err      error
+}
+
+func (s *leaseStorage) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	return s.acquired, s.err
+}
+
+func TestElection(t *testing.T) {
+	db := &leaseStorage{}
+	var events []string
+	e := New(db, "instance-a",
+		func() { events = append(events, "elected") },
+		func() { events = append(events, "deposed") },
+		func() { events = append(events, "leader") },
+		func() { events = append(events, "follower") },
+	)
+	start := time.Now()
+
+	for _, step := range []struct {
+		desc     string
+		after    time.Duration
+		acquired bool
+		err      error
+		leader   bool
+		event    string
+	}{
+		{"someone else holds the lease", 0, false, nil, false, "follower"},
+		{"acquired the lease", renewInterval, true, nil, true, "elected"},
+		{"renewed the lease", 2 * renewInterval, true, nil, true, "leader"},
+		{"failed to renew, but the lease has a while left", 3 * renewInterval, false, errors.New("db down"), true, "leader"},
+		{"failed to renew, and the lease may expire", 4 * renewInterval, false, errors.New("db down"), false, "deposed"},
+		{"acquired the lease again", 5 * renewInterval, true, nil, true, "elected"},
+		{"someone else took over", 6 * renewInterval, false, nil, false, "deposed"},
+		{"someone else still holds the lease", 7 * renewInterval, false, nil, false, "follower"},
+	} {
+		db.acquired, db.err = step.acquired, step.err
+		events = nil
+		e.tick(start.Add(step.after))
+		<-e.ticked
+		e.callCallbacks()
+		if e.IsLeader() != step.leader {
+			t.Errorf("TestElection: %s: want leader=%v, got %v", step.desc, step.leader, e.IsLeader())
+		}
+		if len(events) != 1 || events[0] != step.event {
+			t.Errorf("TestElection: %s: want event %q, got %v", step.desc, step.event, events)
+		}
+	}
+}
+
+// TestSlowCallbacks checks that the lease is renewed while the callbacks are still running.
+func TestSlowCallbacks(t *testing.T) {
+	db := &leaseStorage{acquired: true}
+	e := New(db, "instance-a", func() {}, func() {}, func() {}, func() {})
+	start := time.Now()
+	// Nothing is calling the callbacks, as if they were stuck in onElected.
+	for i := 0; i < 3; i++ {
+		e.tick(start.Add(time.Duration(i) * renewInterval))
+	}
+	db.acquired = false
+	e.tick(start.Add(3 * renewInterval))
+	if e.IsLeader() {
+		t.Errorf("TestSlowCallbacks: want to stop being the leader while the callbacks are busy")
+	}
+}
@@ -0,0 +1,170 @@
+// Package logging configures Go-NEB's logs, and ties log lines to the webhook, command or poll
+// which caused them with a correlation ID.
+//
+// A correlation ID is made for each webhook request, command invocation and poll, and is carried
+// through the call chain in a context.Context. Services can log with it by calling ForRequest
+// with the webhook request they were given, or ForClient with the matrix client they were given.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dugong"
+	"github.com/matrix-org/go-neb/tracing"
+	"github.com/matrix-org/gomatrix"
+)
+
+// CorrelationIDHeader is the header which callers can set to choose the correlation ID of a
+// webhook request, and which the response carries the correlation ID in.
+const CorrelationIDHeader = "X-Request-ID"
+
+// validCorrelationID matches correlation IDs which callers may choose. Anything else is replaced,
+// so that callers can't inject arbitrary text into the logs.
+var validCorrelationID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// Setup configures the format of the logs, which is "text" (the default) or "json", and writes
+// them to info.log, warn.log and error.log in logDir as well as stderr, if logDir is set. Secrets
+// are redacted from every log line.
+func Setup(format, logDir string) error {
+	var formatter log.Formatter
+	switch format {
+	case "", "text":
+		formatter = &log.TextFormatter{
+			TimestampFormat:  "2006-01-02 15:04:05.000000",
+			DisableColors:    true,
+			DisableTimestamp: false,
+			DisableSorting:   false,
+		}
+	case "json":
+		formatter = &log.JSONFormatter{}
+		log.SetFormatter(formatter)
+	default:
+		return fmt.Errorf("unknown log format %q: must be \"text\" or \"json\"", format)
+	}
+
+	// This must be added first so that the other hooks don't see secrets.
+	log.AddHook(redactHook{})
+	if logDir != "" {
+		log.AddHook(dugong.NewFSHook(
+			filepath.Join(logDir, "info.log"),
+			filepath.Join(logDir, "warn.log"),
+			filepath.Join(logDir, "error.log"),
+			formatter, &dugong.DailyRotationSchedule{GZip: false},
+		))
+	}
+	return nil
+}
+
+type correlationIDKey struct{}
+
+// NewCorrelationID returns a new random correlation ID.
+func NewCorrelationID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// WithCorrelationID returns a context which carries the correlation ID.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID in ctx, or "" if there isn't one.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// RequestCorrelationID returns the correlation ID chosen by the caller of an HTTP request, or a
+// new one if the caller didn't choose a valid one.
+func RequestCorrelationID(req *http.Request) string {
+	if id := req.Header.Get(CorrelationIDHeader); validCorrelationID.MatchString(id) {
+		return id
+	}
+	return NewCorrelationID()
+}
+
+// Logger returns a logger which tags every line with the correlation ID in ctx, and the ID of the
+// trace in ctx if it is being traced.
+func Logger(ctx context.Context) *log.Entry {
+	fields := log.Fields{}
+	if id := CorrelationID(ctx); id != "" {
+		fields["correlation_id"] = id
+	}
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		fields["trace_id"] = traceID
+	}
+	return log.WithFields(fields)
+}
+
+// ForRequest returns a logger for a service to use while handling the webhook request.
+func ForRequest(req *http.Request) *log.Entry {
+	return Logger(req.Context())
+}
+
+// ForClient returns a logger for a service to use while handling a command or poll with the matrix
+// client it was given.
+func ForClient(cli *gomatrix.Client) *log.Entry {
+	return Logger(tracing.ClientContext(cli.Client))
+}
+
+// secretPattern matches secrets which end up in log lines by accident, e.g. the access token in
+// the URL of a failed matrix request.
+var secretPattern = regexp.MustCompile(`((?i:access_token|api_key|apikey|secret|password|token)=)[^&\s"']+`)
+
+// secretFields are field names whose values are always redacted.
+var secretFields = map[string]bool{
+	"access_token": true,
+	"api_key":      true,
+	"password":     true,
+	"secret":       true,
+	"secret_token": true,
+	"token":        true,
+}
+
+// redactHook removes secrets from log lines before they are written anywhere.
+type redactHook struct{}
+
+func (redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (redactHook) Fire(entry *log.Entry) error {
+	entry.Message = Redact(entry.Message)
+	// entry.Data may be shared with other goroutines, so replace it rather than changing it.
+	data := make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = redactField(k, v)
+	}
+	entry.Data = data
+	return nil
+}
+
+// Redact removes secrets such as access tokens in URLs from s.
+func Redact(s string) string {
+	return secretPattern.ReplaceAllString(s, "${1}<redacted>")
+}
+
+func redactField(key string, value interface{}) interface{} {
+	if secretFields[key] {
+		return "<redacted>"
+	}
+	switch v := value.(type) {
+	case string:
+		return Redact(v)
+	case error:
+		if redacted := Redact(v.Error()); redacted != v.Error() {
+			return fmt.Errorf("%s", redacted)
+		}
+		return v
+	default:
+		return value
+	}
+}
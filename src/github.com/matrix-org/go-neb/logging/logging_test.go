@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestRedaction(t *testing.T) {
+	entry := log.WithFields(log.Fields{
+		"access_token": "abc123",
+		"url":          "https://hs/_matrix/client/r0/sync?since=s1&access_token=abc123",
+		log.ErrorKey:   errors.New(`Get "/sync?access_token=abc123": EOF`),
+		"count":        3,
+	})
+	entry.Message = "Failed request to /send?access_token=abc123&txn=1"
+	if err := (redactHook{}).Fire(entry); err != nil {
+		t.Fatalf("Fire: %s", err)
+	}
+
+	if want := "Failed request to /send?access_token=<redacted>&txn=1"; entry.Message != want {
+		t.Errorf("message: got %q, want %q", entry.Message, want)
+	}
+	if entry.Data["access_token"] != "<redacted>" {
+		t.Errorf("access_token field: got %v, want <redacted>", entry.Data["access_token"])
+	}
+	if want := "https://hs/_matrix/client/r0/sync?since=s1&access_token=<redacted>"; entry.Data["url"] != want {
+		t.Errorf("url field: got %v, want %q", entry.Data["url"], want)
+	}
+	if err, ok := entry.Data[log.ErrorKey].(error); !ok || err.Error() != `Get "/sync?access_token=<redacted>": EOF` {
+		t.Errorf("error field: got %v", entry.Data[log.ErrorKey])
+	}
+	if entry.Data["count"] != 3 {
+		t.Errorf("count field: got %v, want 3", entry.Data["count"])
+	}
+}
+
+func TestRequestCorrelationID(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		kept   bool
+	}{
+		{"", false},
+		{"req-42", true},
+		{"bad id\nwith newline", false},
+	} {
+		req, _ := http.NewRequest("POST", "/services/hooks/abc", nil)
+		if test.header != "" {
+			req.Header.Set(CorrelationIDHeader, test.header)
+		}
+		id := RequestCorrelationID(req)
+		if id == "" {
+			t.Errorf("header %q: got empty correlation ID", test.header)
+		}
+		if kept := id == test.header; kept != test.kept {
+			t.Errorf("header %q: got %q, kept=%v want %v", test.header, id, kept, test.kept)
+		}
+	}
+}
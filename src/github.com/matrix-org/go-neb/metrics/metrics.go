@@ -1,6 +1,10 @@
 package metrics
 
 import (
+	"net/http"
+	"strconv"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -30,6 +34,34 @@ var (
 		Name: "goneb_auth_session_total",
 		Help: "The total number of successful /requestAuthSession requests",
 	}, []string{"realm_type"})
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "goneb_command_duration_seconds",
+		Help: "How long commands from matrix clients take to run",
+	}, []string{"cmd", "status"})
+	webhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "goneb_webhook_duration_seconds",
+		Help: "How long services take to handle incoming webhook requests",
+	}, []string{"service_type"})
+	pollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "goneb_poll_duration_seconds",
+		Help: "How long services take to poll",
+	}, []string{"service_type"})
+	outboundDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "goneb_outbound_request_duration_seconds",
+		Help: "How long requests to third-party APIs take, by API and HTTP status code",
+	}, []string{"api", "status"})
+	sendFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_matrix_send_failures_total",
+		Help: "The number of messages which failed to be sent into matrix rooms, by matrix errcode",
+	}, []string{"errcode"})
+	webhookRetryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_webhook_retries_total",
+		Help: "The number of times handling a queued webhook failed and was retried later",
+	}, []string{"service_type"})
+	webhookAbandonedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_webhook_abandoned_total",
+		Help: "The number of queued webhooks which were given up on after failing too many times",
+	}, []string{"service_type"})
 )
 
 // IncrementCommand increments the pling command counter
@@ -52,9 +84,72 @@ func IncrementAuthSession(realmType string) {
 	authSessionCounter.With(prometheus.Labels{"realm_type": realmType}).Inc()
 }
 
+// ObserveCommand records how long a pling command took, by its command path, e.g. "github create"
+func ObserveCommand(cmdPath string, st Status, d time.Duration) {
+	commandDuration.With(prometheus.Labels{"cmd": cmdPath, "status": string(st)}).Observe(d.Seconds())
+}
+
+// ObserveWebhook records how long a service took to handle an incoming webhook request
+func ObserveWebhook(serviceType string, d time.Duration) {
+	webhookDuration.With(prometheus.Labels{"service_type": serviceType}).Observe(d.Seconds())
+}
+
+// IncrementWebhookRetry increments the queued webhook retry counter
+func IncrementWebhookRetry(serviceType string) {
+	webhookRetryCounter.With(prometheus.Labels{"service_type": serviceType}).Inc()
+}
+
+// IncrementWebhookAbandoned increments the abandoned queued webhook counter
+func IncrementWebhookAbandoned(serviceType string) {
+	webhookAbandonedCounter.With(prometheus.Labels{"service_type": serviceType}).Inc()
+}
+
+// ObservePoll records how long a service took to poll
+func ObservePoll(serviceType string, d time.Duration) {
+	pollDuration.With(prometheus.Labels{"service_type": serviceType}).Observe(d.Seconds())
+}
+
+// IncrementSendFailure increments the counter of messages which failed to be sent into a room.
+// errcode is the matrix errcode, e.g. "M_FORBIDDEN", or a description of the failure if there isn't one.
+func IncrementSendFailure(errcode string) {
+	sendFailureCounter.With(prometheus.Labels{"errcode": errcode}).Inc()
+}
+
+// Transport returns an http.RoundTripper which records how long every request to the named
+// third-party API takes. Requests are made with base, or http.DefaultTransport if base is nil.
+func Transport(api string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &instrumentedTransport{api, base}
+}
+
+type instrumentedTransport struct {
+	api  string
+	base http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	outboundDuration.With(prometheus.Labels{"api": t.api, "status": code}).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
 func init() {
 	prometheus.MustRegister(cmdCounter)
 	prometheus.MustRegister(configureServicesCounter)
 	prometheus.MustRegister(webhookCounter)
 	prometheus.MustRegister(authSessionCounter)
+	prometheus.MustRegister(commandDuration)
+	prometheus.MustRegister(webhookDuration)
+	prometheus.MustRegister(pollDuration)
+	prometheus.MustRegister(outboundDuration)
+	prometheus.MustRegister(sendFailureCounter)
+	prometheus.MustRegister(webhookRetryCounter)
+	prometheus.MustRegister(webhookAbandonedCounter)
 }
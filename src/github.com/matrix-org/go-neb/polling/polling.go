@@ -1,58 +1,165 @@
 package polling
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
 	"runtime/debug"
-	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// Remember when we first started polling on this service ID. Polling routines will
-// continually check this time. If the service gets updated, this will change, prompting
-// older instances to die away. If this service gets removed, the time will be 0.
+// Every polling service is queued on a single scheduler, which polls each one when it is due
+// using a fixed number of workers. Replacing or stopping a service removes its job from the
+// queue; a poll which is in progress finishes, but the old job is not polled again.
+var sched = newScheduler()
+
+// A DeadPollLoop is a poll loop which stopped unexpectedly, e.g. because the service kept panicking.
+// The service will not be polled again until it is reconfigured or Go-NEB is restarted.
+type DeadPollLoop struct {
+	ServiceID   string
+	ServiceType string
+	// Why the poll loop stopped.
+	Error string
+	// When the poll loop stopped, as a unix timestamp in milliseconds.
+	Timestamp int64
+}
+
+// DeadPollLoops returns every poll loop which has stopped unexpectedly, ordered by service ID.
+func DeadPollLoops() []DeadPollLoop {
+	return sched.deadPollLoops()
+}
+
+// Queue returns every service which is being polled, ordered by when it will next be polled.
+// Services which are being polled right now come first. It also returns how many workers
+// there are and how many of them are busy.
+func Queue() (queue []QueuedPoll, workers, busy int) {
+	return sched.snapshot()
+}
+
 var (
-	pollMutex     sync.Mutex
-	startPollTime = make(map[string]int64) // ServiceID => unix timestamp
+	clientPool *clients.Clients
+	alertRoom  string
 )
-var clientPool *clients.Clients
 
 // SetClients sets a pool of clients for passing into OnPoll
 func SetClients(clis *clients.Clients) {
 	clientPool = clis
 }
 
-// Start polling already existing services
+// SetAlertRoom sets a room to send a notice to when a service is no longer polled because it kept
+// panicking. The notice is sent by the service's client, which must be joined to the room.
+func SetAlertRoom(roomID string) {
+	alertRoom = roomID
+}
+
+// SetWorkers sets how many services can be polled at the same time. It must be called before
+// any service starts polling.
+func SetWorkers(n int) {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	if n > 0 {
+		sched.workers = n
+	}
+}
+
+// Start polling already existing services. Their first polls are spread out over a short period
+// so that they don't all happen at once.
 func Start() error {
-	// Work out which service types require polling
-	for _, serviceType := range types.PollingServiceTypes() {
-		// Query for all services with said service type
-		srvs, err := database.GetServiceDB().LoadServicesByType(serviceType)
-		if err != nil {
+	sched.setStopped(false)
+	srvs, err := loadPollingServices()
+	if err != nil {
+		return err
+	}
+	for _, s := range srvs {
+		if err := startPolling(s, time.Duration(rand.Int63n(int64(startupSpread)))); err != nil {
 			return err
 		}
-		for _, s := range srvs {
-			if err := StartPolling(s); err != nil {
-				return err
-			}
+	}
+	return nil
+}
+
+// Stop stops polling every service, e.g. because another instance has become the leader. Services
+// are not polled again, even if StartPolling is called, until Start is called.
+func Stop() {
+	log.Info("Stopping polling of every service")
+	sched.setStopped(true)
+}
+
+// Reconcile brings the services which are being polled up to date with the database, e.g. because
+// they were configured through another Go-NEB instance which shares the database. Services which
+// aren't being polled are started, unless they are paused or asked not to be polled again, and
+// services which have been deleted are stopped. Does nothing if polling has been stopped.
+func Reconcile() error {
+	if sched.isStopped() {
+		return nil
+	}
+	srvs, err := loadPollingServices()
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]bool)
+	for _, s := range srvs {
+		stored[s.ServiceID()] = true
+		if sched.isKnown(s.ServiceID()) {
+			continue
+		}
+		if _, err := database.GetServiceDB().LoadServicePause(s.ServiceID()); err == nil {
+			continue
+		}
+		if err := StartPolling(s); err != nil {
+			return err
+		}
+	}
+	for _, serviceID := range sched.serviceIDs() {
+		if !stored[serviceID] {
+			sched.remove(serviceID)
 		}
 	}
 	return nil
 }
 
-// StartPolling begins a polling loop for this service.
-// If one already exists for this service, it will be instructed to die. The new poll will not wait for this to happen,
-// so there may be a brief period of overlap. It is safe to immediately call `StopPolling(service)` to immediately terminate
-// this poll.
+// loadPollingServices loads every service of a type which requires polling.
+func loadPollingServices() (services []types.Service, err error) {
+	for _, serviceType := range types.PollingServiceTypes() {
+		srvs, err := database.GetServiceDB().LoadServicesByType(serviceType)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, srvs...)
+	}
+	return services, nil
+}
+
+// StartPolling queues this service to be polled immediately.
+// If it is already queued, the old entry is replaced. A poll of the old entry which is in progress
+// is not interrupted, so there may be a brief period of overlap. It is safe to immediately call
+// `StopPolling(service)` to stop polling. Does nothing if polling has been stopped with Stop.
 func StartPolling(service types.Service) error {
-	// Set the poll time BEFORE spinning off the goroutine in case the caller immediately stops us. If we don't do this here,
-	// we risk them setting the ts to 0 BEFORE we've set the start time, resulting in a poll when one was not intended.
-	ts := time.Now().UnixNano()
-	setPollStartTime(service, ts)
-	go pollLoop(service, ts)
+	return startPolling(service, 0)
+}
+
+func startPolling(service types.Service, delay time.Duration) error {
+	poller, ok := service.(types.Poller)
+	if !ok {
+		log.WithFields(log.Fields{
+			"service_id":   service.ServiceID(),
+			"service_type": service.ServiceType(),
+		}).Error("Service is not a Poller.")
+		return nil
+	}
+	sched.add(service, poller, delay)
 	return nil
 }
 
@@ -62,71 +169,128 @@ func StopPolling(service types.Service) {
 		"service_id":   service.ServiceID(),
 		"service_type": service.ServiceType(),
 	}).Info("StopPolling")
-	setPollStartTime(service, 0)
+	sched.remove(service.ServiceID())
 }
 
-// pollLoop begins the polling loop for this service. Does not return, so call this
-// as a goroutine!
-func pollLoop(service types.Service, ts int64) {
-	logger := log.WithFields(log.Fields{
-		"timestamp":    ts,
+// pollService polls the job's service once. It returns when the service wants to be polled next,
+// why the poll failed if the service is a FalliblePoller, and false if it shouldn't be polled again.
+func pollService(j *pollJob) (next time.Time, pollErr error, again bool) {
+	service, poller := j.service, j.poller
+	ctx := logging.WithCorrelationID(context.Background(), logging.NewCorrelationID())
+	logger := logging.Logger(ctx).WithFields(log.Fields{
 		"service_id":   service.ServiceID(),
 		"service_type": service.ServiceType(),
 	})
 
 	defer func() {
-		// Kill the poll loop entirely as it is likely that whatever made us panic will
-		// make us panic again. We can whine bitterly about it though.
+		// Whatever made us panic may well make us panic again, so restart polling after a delay
+		// which grows with every panic in a row, and stop polling the service entirely if it
+		// keeps panicking. We can whine bitterly about it though.
 		if r := recover(); r != nil {
 			logger.WithField("panic", r).Errorf(
-				"pollLoop panicked!\n%s", debug.Stack(),
+				"OnPoll panicked!\n%s", debug.Stack(),
 			)
+			next, pollErr, again = onPanic(j, service, fmt.Errorf("panic: %v", r))
 		}
 	}()
 
-	poller, ok := service.(types.Poller)
-	if !ok {
-		logger.Error("Service is not a Poller.")
-		return
+	if _, err := database.GetServiceDB().LoadServicePause(service.ServiceID()); err == nil {
+		logger.Info("Not polling - service is paused")
+		return next, nil, false
 	}
-	logger.Info("Starting polling loop")
-	cli, err := clientPool.Client(service.ServiceUserID())
-	if err != nil {
-		logger.WithError(err).WithField("user_id", service.ServiceUserID()).Error("Poll setup failed: failed to load client")
-		return
-	}
-	for {
-		logger.Info("OnPoll")
-		nextTime := poller.OnPoll(cli)
-		if pollTimeChanged(service, ts) {
-			logger.Info("Terminating poll.")
-			break
-		}
-		// work out how long to sleep
-		if nextTime.Unix() == 0 {
-			logger.Info("Terminating poll - OnPoll returned 0")
-			break
+	if j.cli == nil {
+		cli, err := clientPool.Client(service.ServiceUserID())
+		if err != nil {
+			logger.WithError(err).WithField("user_id", service.ServiceUserID()).Error("Poll setup failed: failed to load client")
+			sched.markDead(j, "failed to load client: "+err.Error())
+			return next, nil, false
 		}
-		now := time.Now()
-		time.Sleep(nextTime.Sub(now))
-
-		if pollTimeChanged(service, ts) {
-			logger.Info("Terminating poll.")
-			break
+		j.cli = status.Client(service.ServiceID(), cli)
+	}
+	if stored, err := storedService(service); err != nil {
+		logger.WithError(err).Warn("Failed to check whether the service has changed")
+	} else if stored != service {
+		if storedPoller, ok := stored.(types.Poller); ok {
+			logger.WithField("version", stored.ServiceVersion()).Info("Service has changed: polling the stored version")
+			service, poller = stored, storedPoller
+			sched.setService(j, service, poller)
 		}
 	}
+	logger.Info("OnPoll")
+	ctx, span := tracing.Begin(ctx, "OnPoll", tracing.KindInternal,
+		tracing.Attribute{"service_id", service.ServiceID()},
+		tracing.Attribute{"service_type", service.ServiceType()},
+	)
+	defer span.End()
+	start := time.Now()
+	next = poller.OnPoll(tracing.MatrixClient(ctx, j.cli))
+	metrics.ObservePoll(service.ServiceType(), time.Since(start))
+	sched.clearPanics(j)
+	if fallible, ok := poller.(types.FalliblePoller); ok {
+		pollErr = fallible.PollError()
+	}
+	status.Record(service.ServiceID(), status.KindPoll, "", pollErr)
+	span.SetError(pollErr)
+	if next.Unix() == 0 {
+		logger.Info("Terminating poll - OnPoll returned 0")
+		sched.markFinished(j)
+		return next, pollErr, false
+	}
+	if pollErr != nil {
+		logger.WithError(pollErr).Warn("Poll failed: backing off")
+	}
+	return next, pollErr, true
 }
 
-// setPollStartTime clobbers the current poll time
-func setPollStartTime(service types.Service, startTs int64) {
-	pollMutex.Lock()
-	defer pollMutex.Unlock()
-	startPollTime[service.ServiceID()] = startTs
+// onPanic handles a panic while polling the job. It returns when to restart polling, or false if the
+// service has panicked too many times in a row and shouldn't be polled again.
+func onPanic(j *pollJob, service types.Service, err error) (next time.Time, pollErr error, again bool) {
+	pollPanicsCounter.With(prometheus.Labels{"service_type": service.ServiceType()}).Inc()
+	status.Record(service.ServiceID(), status.KindPoll, "", err)
+	logger := log.WithFields(log.Fields{
+		"service_id":   service.ServiceID(),
+		"service_type": service.ServiceType(),
+	})
+
+	panics := sched.recordPanic(j)
+	if panics < maxConsecutivePanics {
+		delay := restartDelay(panics)
+		logger.WithField("panics", panics).Warnf("Restarting polling in %s", delay)
+		status.RecordPanic(service.ServiceID(), fmt.Sprintf("restarting in %s (%d in a row)", delay, panics), err)
+		return time.Now().Add(delay), nil, true
+	}
+
+	logger.WithField("panics", panics).Error("Polling disabled: too many panics in a row")
+	reason := fmt.Sprintf("%s (%d panics in a row)", err, panics)
+	status.RecordPanic(service.ServiceID(), fmt.Sprintf("polling disabled (%d in a row)", panics), err)
+	sched.markDead(j, reason)
+	pollDisabledCounter.With(prometheus.Labels{"service_type": service.ServiceType()}).Inc()
+	if alertRoom != "" && j.cli != nil {
+		notice := fmt.Sprintf(
+			"Stopped polling %s (%s) after it panicked %d times in a row: %s. Reconfigure the service to start polling it again.",
+			service.ServiceID(), service.ServiceType(), panics, err,
+		)
+		if _, err := j.cli.SendMessageEvent(alertRoom, "m.room.message", gomatrix.TextMessage{"m.notice", notice}); err != nil {
+			logger.WithError(err).WithField("room_id", alertRoom).Error("Failed to send notice that polling is disabled")
+		}
+	}
+	return next, nil, false
 }
 
-// pollTimeChanged returns true if the poll start time for this service ID is different to the one supplied.
-func pollTimeChanged(service types.Service, ts int64) bool {
-	pollMutex.Lock()
-	defer pollMutex.Unlock()
-	return startPollTime[service.ServiceID()] != ts
+// storedService returns the stored version of the service if it has changed since it was last
+// polled, e.g. because OnPoll failed to store it with database.ErrServiceConflict, so that polls
+// don't keep working from, and writing back, a stale config. Otherwise it returns the service it
+// was given.
+func storedService(service types.Service) (types.Service, error) {
+	stored, err := database.GetServiceDB().LoadService(service.ServiceID())
+	if err == sql.ErrNoRows || stored == nil {
+		// It is being deleted, which will stop polling it.
+		return service, nil
+	} else if err != nil {
+		return service, err
+	}
+	if stored.ServiceVersion() == service.ServiceVersion() {
+		return service, nil
+	}
+	return stored, nil
 }
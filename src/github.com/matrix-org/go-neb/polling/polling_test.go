@@ -0,0 +1,154 @@
+package polling
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+)
+
+type panickingPoller struct {
+	types.DefaultService
+}
+
+func (s *panickingPoller) OnPoll(cli *gomatrix.Client) time.Time {
+	panic("the poll is broken")
+}
+
+func TestPanickingPollerIsRestarted(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	SetClients(clients.New(&database.NopStorage{}, &http.Client{}))
+
+	service := &panickingPoller{types.NewDefaultService("panicky", "@bot:hyrule", "panicky-type")}
+	if err := StartPolling(service); err != nil {
+		t.Fatalf("TestPanickingPollerIsRestarted: failed to start polling: %s", err)
+	}
+	defer StopPolling(service)
+
+	var queued *QueuedPoll
+	for i := 0; i < 100 && (queued == nil || queued.ConsecutivePanics == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+		queue, _, _ := Queue()
+		for _, q := range queue {
+			if q.ServiceID == "panicky" {
+				queued = &q
+			}
+		}
+	}
+	if queued == nil || queued.ConsecutivePanics != 1 {
+		t.Fatalf("TestPanickingPollerIsRestarted: expected a queued poll with one panic, got %+v", queued)
+	}
+	earliest := time.Now().Add(minRestartDelay-time.Second).UnixNano() / 1000000
+	if queued.NextPoll < earliest {
+		t.Errorf("TestPanickingPollerIsRestarted: expected restart no earlier than %d, got %d", earliest, queued.NextPoll)
+	}
+	if dead := DeadPollLoops(); len(dead) != 0 {
+		t.Errorf("TestPanickingPollerIsRestarted: expected no dead poll loops, got %+v", dead)
+	}
+	if s := status.Get("panicky"); s.LastPanic == nil || s.LastPanic.Error != "panic: the poll is broken" {
+		t.Errorf("TestPanickingPollerIsRestarted: expected the panic in the service status, got %+v", s.LastPanic)
+	}
+}
+
+func TestPanickingPollerIsDisabled(t *testing.T) {
+	service := &panickingPoller{types.NewDefaultService("very-panicky", "@bot:hyrule", "panicky-type")}
+	// Queue it far in the future so only the panics below are counted.
+	sched.add(service, service, time.Hour)
+	sched.mu.Lock()
+	j := sched.jobs["very-panicky"]
+	sched.mu.Unlock()
+
+	for i := 1; i < maxConsecutivePanics; i++ {
+		if _, _, again := onPanic(j, service, errors.New("panic: the poll is broken")); !again {
+			t.Fatalf("TestPanickingPollerIsDisabled: polling was disabled after %d panics", i)
+		}
+	}
+	if _, _, again := onPanic(j, service, errors.New("panic: the poll is broken")); again {
+		t.Fatalf("TestPanickingPollerIsDisabled: polling was restarted after %d panics", maxConsecutivePanics)
+	}
+
+	dead := DeadPollLoops()
+	if len(dead) != 1 || dead[0].ServiceID != "very-panicky" || dead[0].Error != "panic: the poll is broken (5 panics in a row)" {
+		t.Fatalf("TestPanickingPollerIsDisabled: expected one dead poll loop, got %+v", dead)
+	}
+
+	// Stopping the service on purpose means it is no longer considered dead.
+	StopPolling(service)
+	if dead = DeadPollLoops(); len(dead) != 0 {
+		t.Errorf("TestPanickingPollerIsDisabled: expected no dead poll loops after stopping, got %+v", dead)
+	}
+}
+
+type failingPoller struct {
+	types.DefaultService
+	polls chan struct{}
+}
+
+func (s *failingPoller) OnPoll(cli *gomatrix.Client) time.Time {
+	s.polls <- struct{}{}
+	return time.Now()
+}
+
+func (s *failingPoller) PollError() error {
+	return errors.New("the feed is down")
+}
+
+func TestFailingPollerIsBackedOff(t *testing.T) {
+	database.SetServiceDB(&database.NopStorage{})
+	SetClients(clients.New(&database.NopStorage{}, &http.Client{}))
+
+	service := &failingPoller{types.NewDefaultService("failing", "@bot:hyrule", "failing-type"), make(chan struct{}, 10)}
+	if err := StartPolling(service); err != nil {
+		t.Fatalf("TestFailingPollerIsBackedOff: failed to start polling: %s", err)
+	}
+	defer StopPolling(service)
+
+	select {
+	case <-service.polls:
+	case <-time.After(time.Second):
+		t.Fatalf("TestFailingPollerIsBackedOff: service was not polled")
+	}
+
+	// The service asked to be polled again immediately, but failed, so should be backed off.
+	var queued *QueuedPoll
+	for i := 0; i < 100 && (queued == nil || queued.Polling); i++ {
+		time.Sleep(10 * time.Millisecond)
+		queue, _, _ := Queue()
+		for _, q := range queue {
+			if q.ServiceID == "failing" {
+				queued = &q
+			}
+		}
+	}
+	if queued == nil || queued.Polling || queued.ConsecutiveFailures != 1 {
+		t.Fatalf("TestFailingPollerIsBackedOff: expected a queued poll with one failure, got %+v", queued)
+	}
+	earliest := time.Now().Add(minBackoff-time.Second).UnixNano() / 1000000
+	if queued.NextPoll < earliest {
+		t.Errorf("TestFailingPollerIsBackedOff: expected next poll no earlier than %d, got %d", earliest, queued.NextPoll)
+	}
+	select {
+	case <-service.polls:
+		t.Errorf("TestFailingPollerIsBackedOff: service was polled again before the backoff")
+	default:
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		1:  minBackoff,
+		2:  2 * minBackoff,
+		3:  4 * minBackoff,
+		20: maxBackoff,
+	} {
+		if got := backoff(failures); got != want {
+			t.Errorf("TestBackoff: backoff(%d): want %s, got %s", failures, want, got)
+		}
+	}
+}
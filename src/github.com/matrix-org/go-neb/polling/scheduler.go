@@ -0,0 +1,452 @@
+package polling
+
+import (
+	"container/heap"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/gomatrix"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultWorkers is how many services are polled at the same time, unless SetWorkers is called.
+	defaultWorkers = 10
+	// maxJitter caps the random delay which is added to every poll, to spread out services
+	// which ask to be polled at the same time.
+	maxJitter = 30 * time.Second
+	// startupSpread is the period over which services are first polled when Go-NEB starts.
+	startupSpread = 30 * time.Second
+	// minBackoff and maxBackoff bound how long to wait before polling a service whose last poll
+	// failed. The wait doubles with every consecutive failure.
+	minBackoff = 30 * time.Second
+	maxBackoff = time.Hour
+	// maxConsecutivePanics is how many times in a row a service can panic while being polled before
+	// it is no longer polled. Until then, polling restarts after a delay which doubles with every
+	// panic, from minRestartDelay up to maxRestartDelay.
+	maxConsecutivePanics = 5
+	minRestartDelay      = time.Minute
+	maxRestartDelay      = time.Hour
+)
+
+var (
+	queueLengthGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "goneb_poll_queue_length",
+		Help: "The number of services waiting to be polled",
+	})
+	busyWorkersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "goneb_poll_workers_busy",
+		Help: "The number of poll workers which are polling a service",
+	})
+	pollLatenessHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "goneb_poll_lateness_seconds",
+		Help:    "How long after their scheduled time services are polled, e.g. because every worker was busy",
+		Buckets: []float64{0.01, 0.1, 1, 10, 60, 300},
+	})
+	activePollsGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "goneb_poll_loops_active",
+		Help: "The number of services which are being polled by this instance",
+	}, func() float64 {
+		sched.mu.Lock()
+		defer sched.mu.Unlock()
+		return float64(len(sched.jobs))
+	})
+	pollPanicsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_poll_panics_total",
+		Help: "The number of times a service has panicked while being polled",
+	}, []string{"service_type"})
+	pollDisabledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goneb_poll_disabled_total",
+		Help: "The number of services which are no longer polled because they kept panicking",
+	}, []string{"service_type"})
+)
+
+// A QueuedPoll is a service in the poll queue.
+type QueuedPoll struct {
+	ServiceID   string
+	ServiceType string
+	// When the service will next be polled, as a unix timestamp in milliseconds, or 0 if it is
+	// being polled right now.
+	NextPoll int64
+	// True if the service is being polled right now.
+	Polling bool
+	// How many times in a row polling the service has failed.
+	ConsecutiveFailures int
+	// How many times in a row polling the service has panicked. It is restarted after a delay.
+	ConsecutivePanics int `json:",omitempty"`
+}
+
+// A pollJob is a service which is being polled.
+type pollJob struct {
+	service  types.Service
+	poller   types.Poller
+	cli      *gomatrix.Client // loaded when the service is first polled
+	next     time.Time
+	failures int
+	panics   int
+	running  bool
+	index    int // the index in the queue, or -1 if it isn't queued
+}
+
+// pollQueue is a heap of jobs ordered by when they should next be polled.
+type pollQueue []*pollJob
+
+func (q pollQueue) Len() int           { return len(q) }
+func (q pollQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q pollQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *pollQueue) Push(x interface{}) {
+	j := x.(*pollJob)
+	j.index = len(*q)
+	*q = append(*q, j)
+}
+
+func (q *pollQueue) Pop() interface{} {
+	old := *q
+	j := old[len(old)-1]
+	j.index = -1
+	*q = old[:len(old)-1]
+	return j
+}
+
+// scheduler polls every service from a single queue with a fixed number of workers, so that the
+// number of services doesn't affect how many are polled at once.
+type scheduler struct {
+	mu       sync.Mutex
+	queue    pollQueue
+	jobs     map[string]*pollJob     // ServiceID => job
+	dead     map[string]DeadPollLoop // ServiceID => DeadPollLoop
+	finished map[string]bool         // ServiceIDs which asked not to be polled again
+	stopped  bool
+	workers  int
+	busy     int
+	started  bool
+	wake     chan struct{}
+	work     chan *pollJob
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		jobs:     make(map[string]*pollJob),
+		dead:     make(map[string]DeadPollLoop),
+		finished: make(map[string]bool),
+		workers:  defaultWorkers,
+		wake:     make(chan struct{}, 1),
+		work:     make(chan *pollJob),
+	}
+}
+
+// add schedules the service to be polled after the delay, replacing any existing job for it.
+// A job which is being polled when it is replaced finishes its poll but isn't polled again.
+func (s *scheduler) add(service types.Service, poller types.Poller, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	if !s.started {
+		s.started = true
+		go s.dispatch()
+		for i := 0; i < s.workers; i++ {
+			go s.worker()
+		}
+	}
+	s.removeLocked(service.ServiceID())
+	j := &pollJob{
+		service: service,
+		poller:  poller,
+		next:    time.Now().Add(delay),
+		index:   -1,
+	}
+	s.jobs[service.ServiceID()] = j
+	s.pushLocked(j)
+}
+
+// remove stops polling the service. It is no longer considered dead.
+func (s *scheduler) remove(serviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(serviceID)
+}
+
+func (s *scheduler) removeLocked(serviceID string) {
+	if j := s.jobs[serviceID]; j != nil && j.index >= 0 {
+		heap.Remove(&s.queue, j.index)
+		queueLengthGauge.Set(float64(len(s.queue)))
+	}
+	delete(s.jobs, serviceID)
+	delete(s.dead, serviceID)
+	delete(s.finished, serviceID)
+}
+
+// setStopped sets whether services can be polled. Stopping forgets every job.
+func (s *scheduler) setStopped(stopped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = stopped
+	if stopped {
+		for serviceID := range s.jobs {
+			s.removeLocked(serviceID)
+		}
+		s.dead = make(map[string]DeadPollLoop)
+		s.finished = make(map[string]bool)
+	}
+}
+
+func (s *scheduler) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// isKnown returns true if the service is being polled, has died or has asked not to be polled again.
+func (s *scheduler) isKnown(serviceID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, dead := s.dead[serviceID]
+	return s.jobs[serviceID] != nil || dead || s.finished[serviceID]
+}
+
+// serviceIDs returns the IDs of every service which is being polled.
+func (s *scheduler) serviceIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.jobs))
+	for serviceID := range s.jobs {
+		ids = append(ids, serviceID)
+	}
+	return ids
+}
+
+func (s *scheduler) pushLocked(j *pollJob) {
+	heap.Push(&s.queue, j)
+	queueLengthGauge.Set(float64(len(s.queue)))
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands each job to a worker when it is due. It blocks while every worker is busy.
+func (s *scheduler) dispatch() {
+	for {
+		s.mu.Lock()
+		var due *pollJob
+		wait := time.Duration(-1)
+		if len(s.queue) > 0 {
+			if wait = time.Until(s.queue[0].next); wait <= 0 {
+				due = heap.Pop(&s.queue).(*pollJob)
+				due.running = true
+				queueLengthGauge.Set(float64(len(s.queue)))
+			}
+		}
+		s.mu.Unlock()
+
+		if due != nil {
+			pollLatenessHistogram.Observe(time.Since(due.next).Seconds())
+			s.work <- due
+			continue
+		}
+		if wait < 0 {
+			<-s.wake
+			continue
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *scheduler) worker() {
+	for j := range s.work {
+		if !s.isCurrent(j) {
+			// Replaced or stopped while it was waiting for a worker.
+			continue
+		}
+		s.setBusy(1)
+		next, err, again := pollService(j)
+		s.setBusy(-1)
+		s.reschedule(j, next, err, again)
+	}
+}
+
+func (s *scheduler) setBusy(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy += delta
+	busyWorkersGauge.Set(float64(s.busy))
+}
+
+func (s *scheduler) isCurrent(j *pollJob) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[j.service.ServiceID()] == j
+}
+
+// setService replaces the service which the job polls, e.g. because the stored service has changed.
+func (s *scheduler) setService(j *pollJob, service types.Service, poller types.Poller) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.service = service
+	j.poller = poller
+}
+
+// reschedule queues the job again after it has been polled, unless it has been replaced or
+// stopped, or shouldn't be polled again. Failed polls are backed off.
+func (s *scheduler) reschedule(j *pollJob, next time.Time, pollErr error, again bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.running = false
+	serviceID := j.service.ServiceID()
+	if s.jobs[serviceID] != j {
+		return
+	}
+	if !again {
+		delete(s.jobs, serviceID)
+		return
+	}
+	now := time.Now()
+	if pollErr != nil {
+		j.failures++
+		if retry := now.Add(backoff(j.failures)); next.Before(retry) {
+			next = retry
+		}
+	} else {
+		j.failures = 0
+	}
+	j.next = next.Add(jitter(next.Sub(now)))
+	s.pushLocked(j)
+}
+
+// recordPanic counts a panic while polling the job, and returns how many times in a row it has panicked.
+func (s *scheduler) recordPanic(j *pollJob) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.panics++
+	return j.panics
+}
+
+// clearPanics records that polling the job didn't panic.
+func (s *scheduler) clearPanics(j *pollJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.panics = 0
+}
+
+// markFinished records that the job asked not to be polled again, unless it has already been replaced.
+func (s *scheduler) markFinished(j *pollJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jobs[j.service.ServiceID()] == j {
+		s.finished[j.service.ServiceID()] = true
+	}
+}
+
+// markDead records that the job stopped unexpectedly, unless it has already been replaced.
+func (s *scheduler) markDead(j *pollJob, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	serviceID := j.service.ServiceID()
+	if s.jobs[serviceID] != j {
+		return
+	}
+	delete(s.jobs, serviceID)
+	s.dead[serviceID] = DeadPollLoop{
+		ServiceID:   serviceID,
+		ServiceType: j.service.ServiceType(),
+		Error:       reason,
+		Timestamp:   time.Now().UnixNano() / 1000000,
+	}
+}
+
+func (s *scheduler) deadPollLoops() []DeadPollLoop {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dead := make([]DeadPollLoop, 0, len(s.dead))
+	for _, d := range s.dead {
+		dead = append(dead, d)
+	}
+	sort.Slice(dead, func(i, j int) bool {
+		return dead[i].ServiceID < dead[j].ServiceID
+	})
+	return dead
+}
+
+func (s *scheduler) snapshot() (queue []QueuedPoll, workers, busy int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue = make([]QueuedPoll, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		q := QueuedPoll{
+			ServiceID:           j.service.ServiceID(),
+			ServiceType:         j.service.ServiceType(),
+			Polling:             j.running,
+			ConsecutiveFailures: j.failures,
+			ConsecutivePanics:   j.panics,
+		}
+		if !j.running {
+			q.NextPoll = j.next.UnixNano() / 1000000
+		}
+		queue = append(queue, q)
+	}
+	sort.Slice(queue, func(a, b int) bool {
+		if queue[a].NextPoll != queue[b].NextPoll {
+			return queue[a].NextPoll < queue[b].NextPoll
+		}
+		return queue[a].ServiceID < queue[b].ServiceID
+	})
+	return queue, s.workers, s.busy
+}
+
+// backoff returns how long to wait before polling again after the given number of consecutive
+// failures.
+func backoff(failures int) time.Duration {
+	return doubling(minBackoff, maxBackoff, failures)
+}
+
+// restartDelay returns how long to wait before polling again after the given number of
+// consecutive panics.
+func restartDelay(panics int) time.Duration {
+	return doubling(minRestartDelay, maxRestartDelay, panics)
+}
+
+// doubling returns min doubled n-1 times, capped at max.
+func doubling(min, max time.Duration, n int) time.Duration {
+	d := min
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// jitter returns a random delay of up to a tenth of the interval, capped at maxJitter.
+func jitter(interval time.Duration) time.Duration {
+	max := interval / 10
+	if max > maxJitter {
+		max = maxJitter
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func init() {
+	prometheus.MustRegister(queueLengthGauge)
+	prometheus.MustRegister(busyWorkersGauge)
+	prometheus.MustRegister(pollLatenessHistogram)
+	prometheus.MustRegister(activePollsGauge)
+	prometheus.MustRegister(pollPanicsCounter)
+	prometheus.MustRegister(pollDisabledCounter)
+}
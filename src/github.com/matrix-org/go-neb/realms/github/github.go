@@ -2,6 +2,7 @@
 package github
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -75,7 +76,7 @@ func (s *Session) Info() interface{} {
 		"user_id":  s.userID,
 		"realm_id": s.realmID,
 	})
-	cli := client.New(s.AccessToken)
+	cli := client.New(context.Background(), s.AccessToken)
 	var repos []client.TrimmedRepository
 
 	opts := &github.RepositoryListOptions{
@@ -16,7 +16,9 @@ import (
 	jira "github.com/andygrunwald/go-jira"
 	"github.com/dghubble/oauth1"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/realms/jira/urls"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"golang.org/x/net/context"
 )
@@ -24,6 +26,9 @@ import (
 // RealmType of the JIRA realm
 const RealmType = "jira"
 
+// httpClient records how long requests to JIRA take.
+var httpClient = &http.Client{Transport: metrics.Transport(RealmType, tracing.Transport(nil))}
+
 // Realm is an AuthRealm which can process JIRA installations.
 //
 // Example request:
@@ -68,15 +73,15 @@ type Realm struct {
 
 	// The server name of the JIRA installation from /serverInfo.
 	// This is an informational field populated by Go-NEB post-creation.
-	Server string
+	Server string `readonly:"true"`
 	// The JIRA version string from /serverInfo.
 	// This is an informational field populated by Go-NEB post-creation.
-	Version string
+	Version string `readonly:"true"`
 	// The public key for the given private key. This is populated by Go-NEB.
-	PublicKeyPEM string
+	PublicKeyPEM string `readonly:"true"`
 
 	// Internal field. True if this realm has already registered a webhook with the JIRA installation.
-	HasWebhook bool
+	HasWebhook bool `readonly:"true"`
 }
 
 // Session represents a single authentication session between a user and a JIRA endpoint.
@@ -173,7 +178,7 @@ func (r *Realm) Register() error {
 	r.HasWebhook = false // never let the user set this; only NEB can.
 
 	// Check to see if JIRA endpoint is valid by pinging an endpoint
-	cli, err := r.JIRAClient("", true)
+	cli, err := r.JIRAClient(context.Background(), "", true)
 	if err != nil {
 		return err
 	}
@@ -309,9 +314,9 @@ func (r *Realm) AuthSession(id, userID, realmID string) types.AuthSession {
 // ProjectKeyExists returns true if the given project key exists on this JIRA realm.
 // An authenticated client for userID will be used if one exists, else an
 // unauthenticated client will be used, which may not be able to see the complete list
-// of projects.
-func (r *Realm) ProjectKeyExists(userID, projectKey string) (bool, error) {
-	cli, err := r.JIRAClient(userID, true)
+// of projects. Requests are traced as children of the span in ctx.
+func (r *Realm) ProjectKeyExists(ctx context.Context, userID, projectKey string) (bool, error) {
+	cli, err := r.JIRAClient(ctx, userID, true)
 	if err != nil {
 		return false, err
 	}
@@ -344,14 +349,16 @@ func (r *Realm) ProjectKeyExists(userID, projectKey string) (bool, error) {
 
 // JIRAClient returns an authenticated jira.Client for the given userID. Returns an unauthenticated
 // client if allowUnauth is true and no authenticated session is found, else returns an error.
-func (r *Realm) JIRAClient(userID string, allowUnauth bool) (*jira.Client, error) {
+// Requests made by the client are traced as children of the span in ctx.
+func (r *Realm) JIRAClient(ctx context.Context, userID string, allowUnauth bool) (*jira.Client, error) {
+	tracedClient := tracing.WithContext(ctx, httpClient)
 	// Check if user has an auth session.
 	session, err := database.GetServiceDB().LoadAuthSessionByUser(r.id, userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			if allowUnauth {
 				// make an unauthenticated client
-				return jira.NewClient(nil, r.JIRAEndpoint)
+				return jira.NewClient(tracedClient, r.JIRAEndpoint)
 			}
 		}
 		return nil, err
@@ -365,17 +372,17 @@ func (r *Realm) JIRAClient(userID string, allowUnauth bool) (*jira.Client, error
 	if jsession.AccessSecret == "" || jsession.AccessToken == "" {
 		if allowUnauth {
 			// make an unauthenticated client
-			return jira.NewClient(nil, r.JIRAEndpoint)
+			return jira.NewClient(tracedClient, r.JIRAEndpoint)
 		}
 		return nil, errors.New("No authenticated session found for " + userID)
 	}
 	// make an authenticated client
 	auth := r.oauth1Config(r.JIRAEndpoint)
-	httpClient := auth.Client(
-		context.TODO(),
+	authClient := auth.Client(
+		context.WithValue(context.TODO(), oauth1.HTTPClient, tracedClient),
 		oauth1.NewToken(jsession.AccessToken, jsession.AccessSecret),
 	)
-	return jira.NewClient(httpClient, r.JIRAEndpoint)
+	return jira.NewClient(authClient, r.JIRAEndpoint)
 }
 
 func (r *Realm) parsePrivateKey() error {
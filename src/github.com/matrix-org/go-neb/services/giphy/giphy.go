@@ -2,6 +2,7 @@
 package giphy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,6 +11,8 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -17,6 +20,8 @@ import (
 // ServiceType of the Giphy service.
 const ServiceType = "giphy"
 
+var httpClient = &http.Client{Transport: metrics.Transport(ServiceType, tracing.Transport(nil))}
+
 type image struct {
 	URL string `json:"url"`
 	// Giphy returns ints as strings..
@@ -72,7 +77,7 @@ func (s *Service) Commands(client *gomatrix.Client) []types.Command {
 func (s *Service) cmdGiphy(client *gomatrix.Client, roomID, userID string, args []string) (interface{}, error) {
 	// only 1 arg which is the text to search for.
 	query := strings.Join(args, " ")
-	gifResult, err := s.searchGiphy(query)
+	gifResult, err := s.searchGiphy(tracing.ClientContext(client.Client), query)
 	if err != nil {
 		return nil, err
 	}
@@ -104,7 +109,7 @@ func (s *Service) cmdGiphy(client *gomatrix.Client, roomID, userID string, args
 }
 
 // searchGiphy returns info about a gif
-func (s *Service) searchGiphy(query string) (*result, error) {
+func (s *Service) searchGiphy(ctx context.Context, query string) (*result, error) {
 	log.Info("Searching giphy for ", query)
 	u, err := url.Parse("http://api.giphy.com/v1/gifs/translate")
 	if err != nil {
@@ -114,7 +119,7 @@ func (s *Service) searchGiphy(query string) (*result, error) {
 	q.Set("s", query)
 	q.Set("api_key", s.APIKey)
 	u.RawQuery = q.Encode()
-	res, err := http.Get(u.String())
+	res, err := tracing.WithContext(ctx, httpClient).Get(u.String())
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -1,7 +1,12 @@
 package client
 
 import (
+	"net/http"
+
 	"github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/tracing"
+	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
 
@@ -36,16 +41,20 @@ func TrimRepository(repo *github.Repository) TrimmedRepository {
 	}
 }
 
-// New returns a github Client which can perform Github API operations.
-// If `token` is empty, a non-authenticated client will be created. This should be
+// New returns a github Client which can perform Github API operations, traced as children of
+// the span in ctx. If `token` is empty, a non-authenticated client will be created. This should be
 // used sparingly where possible as you only get 60 requests/hour like that (IP locked).
-func New(token string) *github.Client {
+func New(ctx context.Context, token string) *github.Client {
 	var tokenSource oauth2.TokenSource
 	if token != "" {
 		tokenSource = oauth2.StaticTokenSource(
 			&oauth2.Token{AccessToken: token},
 		)
 	}
-	httpCli := oauth2.NewClient(oauth2.NoContext, tokenSource)
+	// Record and trace requests to the GitHub API.
+	httpCli := tracing.WithContext(ctx, &http.Client{
+		Transport: metrics.Transport("github", tracing.Transport(nil)),
+	})
+	httpCli = oauth2.NewClient(context.WithValue(oauth2.NoContext, oauth2.HTTPClient, httpCli), tokenSource)
 	return github.NewClient(httpCli)
 }
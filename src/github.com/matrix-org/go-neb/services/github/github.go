@@ -5,6 +5,7 @@
 package github
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"regexp"
@@ -18,6 +19,7 @@ import (
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/realms/github"
 	"github.com/matrix-org/go-neb/services/github/client"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 	"html"
@@ -60,8 +62,8 @@ type Service struct {
 	RealmID string
 }
 
-func (s *Service) requireGithubClientFor(userID string) (cli *gogithub.Client, resp interface{}, err error) {
-	cli = s.githubClientFor(userID, false)
+func (s *Service) requireGithubClientFor(ctx context.Context, userID string) (cli *gogithub.Client, resp interface{}, err error) {
+	cli = s.githubClientFor(ctx, userID, false)
 	if cli == nil {
 		var r types.AuthRealm
 		if r, err = database.GetServiceDB().LoadAuthRealm(s.RealmID); err != nil {
@@ -82,8 +84,8 @@ func (s *Service) requireGithubClientFor(userID string) (cli *gogithub.Client, r
 const numberGithubSearchSummaries = 3
 const cmdGithubSearchUsage = `!github create owner/repo "search query"`
 
-func (s *Service) cmdGithubSearch(roomID, userID string, args []string) (interface{}, error) {
-	cli := s.githubClientFor(userID, true)
+func (s *Service) cmdGithubSearch(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+	cli := s.githubClientFor(ctx, userID, true)
 	if len(args) < 2 {
 		return &gomatrix.TextMessage{"m.notice", "Usage: " + cmdGithubSearchUsage}, nil
 	}
@@ -131,8 +133,8 @@ func (s *Service) cmdGithubSearch(roomID, userID string, args []string) (interfa
 
 const cmdGithubCreateUsage = `!github create [owner/repo] "issue title" "description"`
 
-func (s *Service) cmdGithubCreate(roomID, userID string, args []string) (interface{}, error) {
-	cli, resp, err := s.requireGithubClientFor(userID)
+func (s *Service) cmdGithubCreate(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(ctx, userID)
 	if cli == nil {
 		return resp, err
 	}
@@ -226,8 +228,8 @@ var cmdGithubReactAliases = map[string]string{
 
 const cmdGithubReactUsage = `!github react [owner/repo]#issue (+1|👍|-1|:-1:|laugh|:smile:|confused|uncertain|heart|❤|hooray|:tada:)`
 
-func (s *Service) cmdGithubReact(roomID, userID string, args []string) (interface{}, error) {
-	cli, resp, err := s.requireGithubClientFor(userID)
+func (s *Service) cmdGithubReact(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(ctx, userID)
 	if cli == nil {
 		return resp, err
 	}
@@ -261,8 +263,8 @@ func (s *Service) cmdGithubReact(roomID, userID string, args []string) (interfac
 
 const cmdGithubCommentUsage = `!github comment [owner/repo]#issue "comment text"`
 
-func (s *Service) cmdGithubComment(roomID, userID string, args []string) (interface{}, error) {
-	cli, resp, err := s.requireGithubClientFor(userID)
+func (s *Service) cmdGithubComment(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(ctx, userID)
 	if cli == nil {
 		return resp, err
 	}
@@ -302,8 +304,8 @@ func (s *Service) cmdGithubComment(roomID, userID string, args []string) (interf
 
 const cmdGithubAssignUsage = `!github assign [owner/repo]#issue username [username] [...]`
 
-func (s *Service) cmdGithubAssign(roomID, userID string, args []string) (interface{}, error) {
-	cli, resp, err := s.requireGithubClientFor(userID)
+func (s *Service) cmdGithubAssign(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(ctx, userID)
 	if cli == nil {
 		return resp, err
 	}
@@ -334,8 +336,8 @@ func (s *Service) cmdGithubAssign(roomID, userID string, args []string) (interfa
 
 const cmdGithubCloseUsage = `!github close [owner/repo]#issue`
 
-func (s *Service) cmdGithubClose(roomID, userID string, args []string) (interface{}, error) {
-	cli, resp, err := s.requireGithubClientFor(userID)
+func (s *Service) cmdGithubClose(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+	cli, resp, err := s.requireGithubClientFor(ctx, userID)
 	if cli == nil {
 		return resp, err
 	}
@@ -406,8 +408,8 @@ func (s *Service) getIssueDetailsFor(input, roomID, usage string) (owner, repo s
 	return
 }
 
-func (s *Service) expandIssue(roomID, userID, owner, repo string, issueNum int) interface{} {
-	cli := s.githubClientFor(userID, true)
+func (s *Service) expandIssue(ctx context.Context, roomID, userID, owner, repo string, issueNum int) interface{} {
+	cli := s.githubClientFor(ctx, userID, true)
 
 	i, _, err := cli.Issues.Get(owner, repo, issueNum)
 	if err != nil {
@@ -435,41 +437,42 @@ func (s *Service) expandIssue(roomID, userID, owner, repo string, issueNum int)
 // a Github account to be linked to the Matrix user ID issuing the command. If there
 // is no link, it will return a Starter Link instead.
 func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	ctx := tracing.ClientContext(cli.Client)
 	return []types.Command{
 		types.Command{
 			Path: []string{"github", "search"},
 			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdGithubSearch(roomID, userID, args)
+				return s.cmdGithubSearch(ctx, roomID, userID, args)
 			},
 		},
 		types.Command{
 			Path: []string{"github", "create"},
 			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdGithubCreate(roomID, userID, args)
+				return s.cmdGithubCreate(ctx, roomID, userID, args)
 			},
 		},
 		types.Command{
 			Path: []string{"github", "react"},
 			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdGithubReact(roomID, userID, args)
+				return s.cmdGithubReact(ctx, roomID, userID, args)
 			},
 		},
 		types.Command{
 			Path: []string{"github", "comment"},
 			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdGithubComment(roomID, userID, args)
+				return s.cmdGithubComment(ctx, roomID, userID, args)
 			},
 		},
 		types.Command{
 			Path: []string{"github", "assign"},
 			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdGithubAssign(roomID, userID, args)
+				return s.cmdGithubAssign(ctx, roomID, userID, args)
 			},
 		},
 		types.Command{
 			Path: []string{"github", "close"},
 			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdGithubClose(roomID, userID, args)
+				return s.cmdGithubClose(ctx, roomID, userID, args)
 			},
 		},
 		types.Command{
@@ -497,6 +500,7 @@ func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 //   #12
 // using the default repository.
 func (s *Service) Expansions(cli *gomatrix.Client) []types.Expansion {
+	ctx := tracing.ClientContext(cli.Client)
 	return []types.Expansion{
 		types.Expansion{
 			Regexp: ownerRepoIssueRegex,
@@ -538,12 +542,17 @@ func (s *Service) Expansions(cli *gomatrix.Client) []types.Expansion {
 					log.WithField("issue_number", matchingGroups[4]).Print("Bad issue number")
 					return nil
 				}
-				return s.expandIssue(roomID, userID, matchingGroups[2], matchingGroups[3], num)
+				return s.expandIssue(ctx, roomID, userID, matchingGroups[2], matchingGroups[3], num)
 			},
 		},
 	}
 }
 
+// RealmIDs returns the Github realm used by this service.
+func (s *Service) RealmIDs() []string {
+	return []string{s.RealmID}
+}
+
 // Register makes sure that the given realm ID maps to a github realm.
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
 	if s.RealmID == "" {
@@ -558,8 +567,6 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 	if realm.Type() != "github" {
 		return fmt.Errorf("Realm is of type '%s', not 'github'", realm.Type())
 	}
-
-	log.Infof("%+v", s)
 	return nil
 }
 
@@ -593,7 +600,7 @@ func (s *Service) defaultRepo(roomID string) string {
 	return defaultRepo
 }
 
-func (s *Service) githubClientFor(userID string, allowUnauth bool) *gogithub.Client {
+func (s *Service) githubClientFor(ctx context.Context, userID string, allowUnauth bool) *gogithub.Client {
 	token, err := getTokenForUser(s.RealmID, userID)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -603,9 +610,9 @@ func (s *Service) githubClientFor(userID string, allowUnauth bool) *gogithub.Cli
 		}).Print("Failed to get token for user")
 	}
 	if token != "" {
-		return client.New(token)
+		return client.New(ctx, token)
 	} else if allowUnauth {
-		return client.New("")
+		return client.New(ctx, "")
 	} else {
 		return nil
 	}
@@ -1,6 +1,8 @@
 package github
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -9,10 +11,12 @@ import (
 	log "github.com/Sirupsen/logrus"
 	gogithub "github.com/google/go-github/github"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
 	"github.com/matrix-org/go-neb/services/github/client"
 	"github.com/matrix-org/go-neb/services/github/webhook"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
 )
 
 // WebhookServiceType of the Github Webhook service.
@@ -44,6 +48,8 @@ const WebhookServiceType = "github-webhook"
 type WebhookService struct {
 	types.DefaultService
 	webhookEndpointURL string
+	// The URL which Github sends webhooks to - Populated by Go-NEB after Service registration.
+	WebhookURL string `readonly:"true"`
 	// The user ID to create/delete webhooks as.
 	ClientUserID string
 	// The ID of an existing "github" realm. This realm will be used to obtain
@@ -79,13 +85,57 @@ type WebhookService struct {
 //
 // If the "owner/repo" string doesn't exist in this Service config, then the webhook will be deleted from
 // Github.
+//
+// Webhooks from Github are checked by VerifyWebhook and handled in the background by HandleWebhook
+// instead, so this is only used for webhooks which are replayed from the webhook journal.
 func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
 	evType, repo, msg, err := webhook.OnReceiveRequest(req, s.SecretToken)
 	if err != nil {
 		w.WriteHeader(err.Code)
 		return
 	}
-	logger := log.WithFields(log.Fields{
+	send := func(roomID string, msg interface{}) error {
+		_, err := cli.SendMessageEvent(roomID, "m.room.message", msg)
+		return err
+	}
+	if err := s.notify(req, evType, repo, msg, send); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// VerifyWebhook checks the signature of a Github webhook request, so that it can be handled in the
+// background by HandleWebhook.
+func (s *WebhookService) VerifyWebhook(req *http.Request, body []byte) *util.JSONResponse {
+	return webhook.VerifyRequest(req, body, s.SecretToken)
+}
+
+// HandleWebhook sends notifications for a Github webhook which VerifyWebhook accepted. Returns an
+// error if a notification couldn't be sent but may be if tried again, so that the webhook is
+// handled again later for the rooms which didn't get it.
+func (s *WebhookService) HandleWebhook(req *http.Request, body []byte, cli *gomatrix.Client, progress *types.WebhookProgress) error {
+	evType, repo, msg, resErr := webhook.ParseRequest(req, body)
+	if resErr != nil {
+		// Trying again won't help.
+		return nil
+	}
+	send := func(roomID string, msg interface{}) error {
+		return progress.SendMessageEvent(cli, roomID, "m.room.message", msg)
+	}
+	// A malformed repo won't be fixed by trying again either.
+	s.notify(req, evType, repo, msg, send)
+	return progress.Err()
+}
+
+// errMalformedRepo is returned by notify for events whose repo isn't of the form owner/repo.
+var errMalformedRepo = errors.New("received event with malformed owner/repo")
+
+// notify sends the message for a Github event into the rooms which want to be notified about it
+// with send. Failures to send are logged. The webhook for the repo is deleted if no rooms are
+// interested in the repo any more. Returns errMalformedRepo if the repo isn't of the form owner/repo.
+func (s *WebhookService) notify(req *http.Request, evType string, repo *gogithub.Repository, msg *gomatrix.HTMLMessage, send func(roomID string, msg interface{}) error) error {
+	logger := logging.ForRequest(req).WithFields(log.Fields{
 		"event": evType,
 		"repo":  *repo.FullName,
 	})
@@ -108,7 +158,7 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 					"message": msg,
 					"room_id": roomID,
 				}).Print("Sending notification to room")
-				if _, e := cli.SendMessageEvent(roomID, "m.room.message", msg); e != nil {
+				if e := send(roomID, msg); e != nil {
 					logger.WithError(e).WithField("room_id", roomID).Print(
 						"Failed to send notification to room.")
 				}
@@ -120,8 +170,7 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 		segs := strings.Split(*repo.FullName, "/")
 		if len(segs) != 2 {
 			logger.Error("Received event with malformed owner/repo.")
-			w.WriteHeader(400)
-			return
+			return errMalformedRepo
 		}
 		if err := s.deleteHook(segs[0], segs[1]); err != nil {
 			logger.WithError(err).Print("Failed to delete webhook")
@@ -129,8 +178,7 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 			logger.Info("Deleted webhook")
 		}
 	}
-
-	w.WriteHeader(200)
+	return nil
 }
 
 // Register will create webhooks for the repos specified in Rooms
@@ -144,19 +192,59 @@ func (s *WebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reque
 // Hooks can get out of sync if a user manually deletes a hook in the Github UI. In this case, toggling the repo configuration will
 // force NEB to recreate the hook.
 func (s *WebhookService) Register(oldService types.Service, client *gomatrix.Client) error {
+	s.WebhookURL = s.webhookEndpointURL
+	cli, newRepos, _, err := s.checkRegister(oldService)
+	if err != nil {
+		return err
+	}
+	for _, r := range newRepos {
+		logger := log.WithField("repo", r)
+		err := s.createHook(cli, r)
+		if err != nil {
+			logger.WithError(err).Error("Failed to create webhook")
+			return err
+		}
+		logger.Info("Created webhook")
+	}
+
+	if err := s.joinWebhookRooms(client); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DryRun performs the same checks as Register and works out which webhooks would be created by
+// Register and removed by PostRegister. The WebhookURL is set as Register sets it, so that it isn't
+// shown as a change.
+func (s *WebhookService) DryRun(oldService types.Service, client *gomatrix.Client) (plan types.RegisterPlan, err error) {
+	s.WebhookURL = s.webhookEndpointURL
+	_, plan.AddWebhooks, plan.RemoveWebhooks, err = s.checkRegister(oldService)
+	if err != nil {
+		return
+	}
+	plan.JoinRooms = s.ServiceRooms()
+	return
+}
+
+// checkRegister makes sure that this service can be registered, returning a Github client for the
+// ClientUserID and the repos which have been added and removed since the old service.
+func (s *WebhookService) checkRegister(oldService types.Service) (cli *gogithub.Client, newRepos, removedRepos []string, err error) {
 	if s.RealmID == "" || s.ClientUserID == "" {
-		return fmt.Errorf("RealmID and ClientUserID is required")
+		err = fmt.Errorf("RealmID and ClientUserID is required")
+		return
 	}
 	realm, err := s.loadRealm()
 	if err != nil {
-		return err
+		return
 	}
 
 	// In order to register the GH service as a client, you must have authed with GH.
-	cli := s.githubClientFor(s.ClientUserID, false)
+	cli = s.githubClientFor(s.ClientUserID, false)
 	if cli == nil {
-		return fmt.Errorf(
+		err = fmt.Errorf(
 			"User %s does not have a Github auth session with realm %s.", s.ClientUserID, realm.ID())
+		return
 	}
 
 	// Fetch the old service list and work out the difference between the two services.
@@ -177,30 +265,14 @@ func (s *WebhookService) Register(oldService types.Service, client *gomatrix.Cli
 	reposForWebhooks := s.repoList()
 
 	// Add hooks for the newly added repos but don't remove hooks for the removed repos: we'll clean those out later
-	newRepos, removedRepos := difference(reposForWebhooks, oldRepos)
+	newRepos, removedRepos = difference(reposForWebhooks, oldRepos)
 	if len(reposForWebhooks) == 0 && len(removedRepos) == 0 {
 		// The user didn't specify any webhooks. This may be a bug or it may be
 		// a conscious decision to remove all webhooks for this service. Figure out
 		// which it is by checking if we'd be removing any webhooks.
-		return fmt.Errorf("No webhooks specified.")
-	}
-	for _, r := range newRepos {
-		logger := log.WithField("repo", r)
-		err := s.createHook(cli, r)
-		if err != nil {
-			logger.WithError(err).Error("Failed to create webhook")
-			return err
-		}
-		logger.Info("Created webhook")
-	}
-
-	if err := s.joinWebhookRooms(client); err != nil {
-		return err
+		err = fmt.Errorf("No webhooks specified.")
 	}
-
-	log.Infof("%+v", s)
-
-	return nil
+	return
 }
 
 // PostRegister cleans up removed repositories from the old service by
@@ -249,6 +321,40 @@ func (s *WebhookService) PostRegister(oldService types.Service) {
 	}
 }
 
+// RealmIDs returns the Github realm used to create and delete webhooks.
+func (s *WebhookService) RealmIDs() []string {
+	return []string{s.RealmID}
+}
+
+// ServiceRooms returns every room which webhooks are sent into.
+func (s *WebhookService) ServiceRooms() []string {
+	var rooms []string
+	for roomID := range s.Rooms {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// ServiceOwner returns the user whose Github session is used to create webhooks.
+func (s *WebhookService) ServiceOwner() string {
+	return s.ClientUserID
+}
+
+// Unregister removes the webhooks for every repository in this service's config from Github.
+// Failures are logged but do not prevent the service from being deleted.
+func (s *WebhookService) Unregister(client *gomatrix.Client) {
+	for _, r := range s.repoList() {
+		segs := strings.Split(r, "/")
+		if err := s.deleteHook(segs[0], segs[1]); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"repo":       r,
+			}).Warn("Failed to remove webhook")
+		}
+	}
+}
+
 func (s *WebhookService) joinWebhookRooms(client *gomatrix.Client) error {
 	for roomID := range s.Rooms {
 		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
@@ -437,9 +543,9 @@ func (s *WebhookService) githubClientFor(userID string, allowUnauth bool) *gogit
 		}).Print("Failed to get token for user")
 	}
 	if token != "" {
-		return client.New(token)
+		return client.New(context.Background(), token)
 	} else if allowUnauth {
-		return client.New("")
+		return client.New(context.Background(), "")
 	} else {
 		return nil
 	}
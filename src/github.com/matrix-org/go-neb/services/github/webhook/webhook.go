@@ -22,25 +22,34 @@ import (
 // The secretToken, if supplied, will be used to verify the request is from
 // Github. If it isn't, an error is returned.
 func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repository, *gomatrix.HTMLMessage, *util.JSONResponse) {
-	// Verify the HMAC signature if NEB was configured with a secret token
-	eventType := r.Header.Get("X-GitHub-Event")
-	signatureSHA1 := r.Header.Get("X-Hub-Signature")
 	content, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.WithError(err).Print("Failed to read Github webhook body")
 		resErr := util.MessageResponse(400, "Failed to parse body")
 		return "", nil, nil, &resErr
 	}
+	if res := VerifyRequest(r, content, secretToken); res != nil {
+		return "", nil, nil, res
+	}
+	return ParseRequest(r, content)
+}
+
+// VerifyRequest checks a github webhook request with the given body. The secretToken, if
+// supplied, will be used to verify the request is from Github. Returns the response to send
+// if the request should not be handled any further, or nil if it should.
+func VerifyRequest(r *http.Request, content []byte, secretToken string) *util.JSONResponse {
+	// Verify the HMAC signature if NEB was configured with a secret token
+	eventType := r.Header.Get("X-GitHub-Event")
+	signatureSHA1 := r.Header.Get("X-Hub-Signature")
 	// Verify request if a secret token has been supplied.
 	if secretToken != "" {
 		sigHex := strings.Split(signatureSHA1, "=")[1]
-		var sigBytes []byte
-		sigBytes, err = hex.DecodeString(sigHex)
+		sigBytes, err := hex.DecodeString(sigHex)
 		if err != nil {
 			log.WithError(err).WithField("X-Hub-Signature", sigHex).Print(
 				"Failed to decode signature as hex.")
 			resErr := util.MessageResponse(400, "Failed to decode signature")
-			return "", nil, nil, &resErr
+			return &resErr
 		}
 
 		if !checkMAC([]byte(content), sigBytes, []byte(secretToken)) {
@@ -48,7 +57,7 @@ func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repo
 				"X-Hub-Signature": signatureSHA1,
 			}).Print("Received Github event which failed MAC check.")
 			resErr := util.MessageResponse(403, "Bad signature")
-			return "", nil, nil, &resErr
+			return &resErr
 		}
 	}
 
@@ -62,10 +71,15 @@ func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repo
 		// to return a 200 in order for the webhook to be marked as "up" (this doesn't
 		// affect delivery, just the tick/cross status flag).
 		res := util.MessageResponse(200, "pong")
-		return "", nil, nil, &res
+		return &res
 	}
+	return nil
+}
 
-	htmlStr, repo, refinedType, err := parseGithubEvent(eventType, content)
+// ParseRequest returns a matrix message to send for a github webhook request with the given body,
+// which VerifyRequest has accepted, along with parsed repo information.
+func ParseRequest(r *http.Request, content []byte) (string, *github.Repository, *gomatrix.HTMLMessage, *util.JSONResponse) {
+	htmlStr, repo, refinedType, err := parseGithubEvent(r.Header.Get("X-GitHub-Event"), content)
 	if err != nil {
 		log.WithError(err).Print("Failed to parse github event")
 		resErr := util.MessageResponse(500, "Failed to parse github event")
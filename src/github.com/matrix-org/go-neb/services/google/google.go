@@ -3,6 +3,7 @@
 package google
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -12,6 +13,8 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -19,7 +22,7 @@ import (
 // ServiceType of the Google service
 const ServiceType = "google"
 
-var httpClient = &http.Client{}
+var httpClient = &http.Client{Transport: metrics.Transport(ServiceType, tracing.Transport(nil))}
 
 type googleSearchResults struct {
 	SearchInformation struct {
@@ -106,7 +109,7 @@ func (s *Service) cmdGoogleImgSearch(client *gomatrix.Client, roomID, userID str
 	// Get the query text to search for.
 	querySentence := strings.Join(args, " ")
 
-	searchResult, err := s.text2imgGoogle(querySentence)
+	searchResult, err := s.text2imgGoogle(tracing.ClientContext(client.Client), querySentence)
 
 	if err != nil {
 		return nil, err
@@ -139,7 +142,7 @@ func (s *Service) cmdGoogleImgSearch(client *gomatrix.Client, roomID, userID str
 }
 
 // text2imgGoogle returns info about an image
-func (s *Service) text2imgGoogle(query string) (*googleSearchResult, error) {
+func (s *Service) text2imgGoogle(ctx context.Context, query string) (*googleSearchResult, error) {
 	log.Info("Searching Google for an image of a ", query)
 
 	u, err := url.Parse("https://www.googleapis.com/customsearch/v1")
@@ -160,7 +163,7 @@ func (s *Service) text2imgGoogle(query string) (*googleSearchResult, error) {
 	u.RawQuery = q.Encode()
 	// log.Info("Request URL: ", u)
 
-	res, err := httpClient.Get(u.String())
+	res, err := tracing.WithContext(ctx, httpClient).Get(u.String())
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -3,6 +3,7 @@ package guggy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,8 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -18,7 +21,7 @@ import (
 // ServiceType of the Guggy service
 const ServiceType = "guggy"
 
-var httpClient = &http.Client{}
+var httpClient = &http.Client{Transport: metrics.Transport(ServiceType, tracing.Transport(nil))}
 
 type guggyQuery struct {
 	// "mp4" or "gif"
@@ -62,7 +65,7 @@ func (s *Service) Commands(client *gomatrix.Client) []types.Command {
 func (s *Service) cmdGuggy(client *gomatrix.Client, roomID, userID string, args []string) (interface{}, error) {
 	// only 1 arg which is the text to search for.
 	querySentence := strings.Join(args, " ")
-	gifResult, err := s.text2gifGuggy(querySentence)
+	gifResult, err := s.text2gifGuggy(tracing.ClientContext(client.Client), querySentence)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to query Guggy: %s", err.Error())
 	}
@@ -92,7 +95,7 @@ func (s *Service) cmdGuggy(client *gomatrix.Client, roomID, userID string, args
 }
 
 // text2gifGuggy returns info about a gif
-func (s *Service) text2gifGuggy(querySentence string) (*guggyGifResult, error) {
+func (s *Service) text2gifGuggy(ctx context.Context, querySentence string) (*guggyGifResult, error) {
 	log.Info("Transforming to GIF query ", querySentence)
 
 	var query guggyQuery
@@ -114,7 +117,7 @@ func (s *Service) text2gifGuggy(querySentence string) (*guggyGifResult, error) {
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("apiKey", s.APIKey)
 
-	res, err := httpClient.Do(req)
+	res, err := tracing.WithContext(ctx, httpClient).Do(req)
 	if res != nil {
 		defer res.Body.Close()
 	}
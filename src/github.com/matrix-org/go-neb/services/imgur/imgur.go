@@ -2,6 +2,7 @@
 package imgur
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,8 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -18,7 +21,7 @@ import (
 // ServiceType of the Imgur service
 const ServiceType = "imgur"
 
-var httpClient = &http.Client{}
+var httpClient = &http.Client{Transport: metrics.Transport(ServiceType, tracing.Transport(nil))}
 
 // Represents an Imgur Gallery Image
 type imgurGalleryImage struct {
@@ -146,7 +149,7 @@ func (s *Service) cmdImgSearch(client *gomatrix.Client, roomID, userID string, a
 
 	// Perform search
 	querySentence := strings.Join(args, " ")
-	searchResultImage, searchResultAlbum, err := s.text2img(querySentence)
+	searchResultImage, searchResultAlbum, err := s.text2img(tracing.ClientContext(client.Client), querySentence)
 	if err != nil {
 		return nil, err
 	}
@@ -192,9 +195,9 @@ func (s *Service) cmdImgSearch(client *gomatrix.Client, roomID, userID string, a
 }
 
 // text2img returns info about an image or an album
-func (s *Service) text2img(query string) (*imgurGalleryImage, *imgurGalleryAlbum, error) {
+func (s *Service) text2img(ctx context.Context, query string) (*imgurGalleryImage, *imgurGalleryAlbum, error) {
 	log.Info("Searching Imgur for an image of a ", query)
-	bytes, err := queryImgur(query, s.ClientID)
+	bytes, err := queryImgur(ctx, query, s.ClientID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -228,7 +231,7 @@ func (s *Service) text2img(query string) (*imgurGalleryImage, *imgurGalleryAlbum
 }
 
 // Query imgur and return HTTP response or error
-func queryImgur(query, clientID string) ([]byte, error) {
+func queryImgur(ctx context.Context, query, clientID string) ([]byte, error) {
 	query = url.QueryEscape(query)
 
 	// Build the query URL
@@ -249,7 +252,7 @@ func queryImgur(query, clientID string) ([]byte, error) {
 
 	// Add authorisation header
 	req.Header.Add("Authorization", "Client-ID "+clientID)
-	res, err := httpClient.Do(req)
+	res, err := tracing.WithContext(ctx, httpClient).Do(req)
 	if res != nil {
 		defer res.Body.Close()
 	}
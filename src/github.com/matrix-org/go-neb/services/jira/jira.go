@@ -4,12 +4,14 @@
 package jira
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"html"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -19,8 +21,10 @@ import (
 	"github.com/matrix-org/go-neb/realms/jira"
 	"github.com/matrix-org/go-neb/realms/jira/urls"
 	"github.com/matrix-org/go-neb/services/jira/webhook"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
 )
 
 // ServiceType of the JIRA Service
@@ -52,6 +56,8 @@ var projectKeyRegex = regexp.MustCompile("^[A-z]+$")
 type Service struct {
 	types.DefaultService
 	webhookEndpointURL string
+	// The URL which JIRA sends webhooks to - Populated by Go-NEB after Service registration.
+	WebhookURL string `readonly:"true"`
 	// The user ID to create issues as, or to create/delete webhooks as. This user
 	// is also used to look up issues for expansions.
 	ClientUserID string
@@ -74,18 +80,15 @@ type Service struct {
 // Register ensures that the given realm IDs are valid JIRA realms and registers webhooks
 // with those JIRA endpoints.
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	s.WebhookURL = s.webhookEndpointURL
 	// We only ever make 1 JIRA webhook which listens for all projects and then filter
 	// on receive. So we simply need to know if we need to make a webhook or not. We
 	// need to do this for each unique realm.
 	for realmID, pkeys := range projectsAndRealmsToTrack(s) {
-		realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+		jrealm, err := loadJIRARealm(realmID)
 		if err != nil {
 			return err
 		}
-		jrealm, ok := realm.(*jira.Realm)
-		if !ok {
-			return errors.New("Realm ID doesn't map to a JIRA realm")
-		}
 
 		if err = webhook.RegisterHook(jrealm, pkeys, s.ClientUserID, s.webhookEndpointURL); err != nil {
 			return err
@@ -94,7 +97,72 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 	return nil
 }
 
-func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface{}, error) {
+// DryRun ensures that the given realm IDs are valid JIRA realms which the ClientUserID has
+// authenticated with, and lists the JIRA endpoints which would have a webhook registered.
+// It cannot check whether the ClientUserID has permission to create webhooks. The WebhookURL is
+// set as Register sets it, so that it isn't shown as a change.
+func (s *Service) DryRun(oldService types.Service, client *gomatrix.Client) (plan types.RegisterPlan, err error) {
+	s.WebhookURL = s.webhookEndpointURL
+	for realmID, pkeys := range projectsAndRealmsToTrack(s) {
+		var jrealm *jira.Realm
+		if jrealm, err = loadJIRARealm(realmID); err != nil {
+			return
+		}
+		if _, err = jrealm.JIRAClient(context.Background(), s.ClientUserID, false); err != nil {
+			return
+		}
+		sort.Strings(pkeys)
+		plan.AddWebhooks = append(plan.AddWebhooks, fmt.Sprintf(
+			"%s (projects %s)", jrealm.JIRAEndpoint, strings.Join(pkeys, ", "),
+		))
+	}
+	sort.Strings(plan.AddWebhooks)
+	return
+}
+
+func loadJIRARealm(realmID string) (*jira.Realm, error) {
+	realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+	if err != nil {
+		return nil, err
+	}
+	jrealm, ok := realm.(*jira.Realm)
+	if !ok {
+		return nil, errors.New("Realm ID doesn't map to a JIRA realm")
+	}
+	return jrealm, nil
+}
+
+// RealmIDs returns every JIRA realm referred to in the Rooms config.
+func (s *Service) RealmIDs() []string {
+	seen := make(map[string]bool)
+	var realmIDs []string
+	for _, roomConfig := range s.Rooms {
+		for realmID := range roomConfig.Realms {
+			if !seen[realmID] {
+				seen[realmID] = true
+				realmIDs = append(realmIDs, realmID)
+			}
+		}
+	}
+	return realmIDs
+}
+
+// ServiceRooms returns every room in the Rooms config.
+func (s *Service) ServiceRooms() []string {
+	var rooms []string
+	for roomID := range s.Rooms {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// ServiceOwner returns the user whose JIRA session is used to create issues and webhooks.
+func (s *Service) ServiceOwner() string {
+	return s.ClientUserID
+}
+
+func (s *Service) cmdJiraCreate(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
 	// E.g jira create PROJ "Issue title" "Issue desc"
 	if len(args) <= 1 {
 		return nil, errors.New("Missing project key (e.g 'ABC') and/or title")
@@ -115,7 +183,7 @@ func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface
 		title = joinedTitle
 	}
 
-	r, err := s.projectToRealm(userID, pkey)
+	r, err := s.projectToRealm(ctx, userID, pkey)
 	if err != nil {
 		log.WithError(err).Print("Failed to map project key to realm")
 		return nil, errors.New("Failed to map project key to a JIRA endpoint.")
@@ -137,7 +205,7 @@ func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface
 			},
 		},
 	}
-	cli, err := r.JIRAClient(userID, false)
+	cli, err := r.JIRAClient(ctx, userID, false)
 	if err != nil {
 		if err == sql.ErrNoRows { // no client found
 			return matrix.StarterLinkMessage{
@@ -170,7 +238,7 @@ func (s *Service) cmdJiraCreate(roomID, userID string, args []string) (interface
 	}, nil
 }
 
-func (s *Service) expandIssue(roomID, userID string, issueKeyGroups []string) interface{} {
+func (s *Service) expandIssue(ctx context.Context, roomID, userID string, issueKeyGroups []string) interface{} {
 	// issueKeyGroups => ["SYN-123", "SYN", "123"]
 	if len(issueKeyGroups) != 3 {
 		log.WithField("groups", issueKeyGroups).Error("Bad number of groups")
@@ -207,7 +275,7 @@ func (s *Service) expandIssue(roomID, userID string, issueKeyGroups []string) in
 	// Use the person who *provisioned* the service to check for project keys
 	// rather than the person who mentioned the issue key, as it is unlikely
 	// some random who mentioned the issue will have the intended auth.
-	cli, err := jrealm.JIRAClient(s.ClientUserID, false)
+	cli, err := jrealm.JIRAClient(ctx, s.ClientUserID, false)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			log.ErrorKey: err,
@@ -240,11 +308,12 @@ func (s *Service) expandIssue(roomID, userID string, issueKeyGroups []string) in
 // is no JIRA account linked to the Matrix user ID, it will return a Starter Link
 // if there is a known public project with that project key.
 func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
+	ctx := tracing.ClientContext(cli.Client)
 	return []types.Command{
 		types.Command{
 			Path: []string{"jira", "create"},
 			Command: func(roomID, userID string, args []string) (interface{}, error) {
-				return s.cmdJiraCreate(roomID, userID, args)
+				return s.cmdJiraCreate(ctx, roomID, userID, args)
 			},
 		},
 	}
@@ -257,17 +326,21 @@ func (s *Service) Commands(cli *gomatrix.Client) []types.Command {
 // If there are multiple projects with the same project key in the Service Config, one will
 // be chosen arbitrarily.
 func (s *Service) Expansions(cli *gomatrix.Client) []types.Expansion {
+	ctx := tracing.ClientContext(cli.Client)
 	return []types.Expansion{
 		types.Expansion{
 			Regexp: issueKeyRegex,
 			Expand: func(roomID, userID string, issueKeyGroups []string) interface{} {
-				return s.expandIssue(roomID, userID, issueKeyGroups)
+				return s.expandIssue(ctx, roomID, userID, issueKeyGroups)
 			},
 		},
 	}
 }
 
 // OnReceiveWebhook receives requests from JIRA and possibly sends requests to Matrix as a result.
+//
+// Webhooks from JIRA are checked by VerifyWebhook and handled in the background by HandleWebhook
+// instead, so this is only used for webhooks which are replayed from the webhook journal.
 func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
 	eventProjectKey, event, httpErr := webhook.OnReceiveRequest(req)
 	if httpErr != nil {
@@ -275,30 +348,76 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		w.WriteHeader(httpErr.Code)
 		return
 	}
-	// grab base jira url
-	jurl, err := urls.ParseJIRAURL(event.Issue.Self)
+	htmlText, err := htmlForWebhook(event)
 	if err != nil {
 		log.WithError(err).Print("Failed to parse base JIRA URL")
 		w.WriteHeader(500)
 		return
 	}
-	// work out the HTML to send
-	htmlText := htmlForEvent(event, jurl.Base)
 	if htmlText == "" {
 		log.WithField("project", eventProjectKey).Print("Unable to process event for project")
 		w.WriteHeader(200)
 		return
 	}
-	// send message into each configured room
+	s.sendNotices(eventProjectKey, htmlText, func(roomID string, msg interface{}) error {
+		_, err := cli.SendMessageEvent(roomID, "m.room.message", msg)
+		return err
+	})
+	w.WriteHeader(200)
+}
+
+// VerifyWebhook checks that a JIRA webhook request is a JIRA event, so that it can be handled in
+// the background by HandleWebhook.
+func (s *Service) VerifyWebhook(req *http.Request, body []byte) *util.JSONResponse {
+	_, _, httpErr := webhook.ParseRequest(body)
+	return httpErr
+}
+
+// HandleWebhook sends notices for a JIRA webhook which VerifyWebhook accepted. Returns an error if
+// a notice couldn't be sent but may be if tried again, so that the webhook is handled again later
+// for the rooms which didn't get it.
+func (s *Service) HandleWebhook(req *http.Request, body []byte, cli *gomatrix.Client, progress *types.WebhookProgress) error {
+	eventProjectKey, event, httpErr := webhook.ParseRequest(body)
+	if httpErr != nil {
+		// VerifyWebhook has already checked this.
+		return nil
+	}
+	htmlText, err := htmlForWebhook(event)
+	if err != nil {
+		// Trying again won't help.
+		log.WithError(err).Print("Failed to parse base JIRA URL")
+		return nil
+	}
+	if htmlText == "" {
+		log.WithField("project", eventProjectKey).Print("Unable to process event for project")
+		return nil
+	}
+	s.sendNotices(eventProjectKey, htmlText, func(roomID string, msg interface{}) error {
+		return progress.SendMessageEvent(cli, roomID, "m.room.message", msg)
+	})
+	return progress.Err()
+}
+
+// htmlForWebhook works out the HTML to send for a JIRA webhook event, or "" if there isn't any.
+func htmlForWebhook(event *webhook.Event) (string, error) {
+	// grab base jira url
+	jurl, err := urls.ParseJIRAURL(event.Issue.Self)
+	if err != nil {
+		return "", err
+	}
+	return htmlForEvent(event, jurl.Base), nil
+}
+
+// sendNotices sends the HTML as a notice into each room which tracks the project with send.
+// Failures to send are logged.
+func (s *Service) sendNotices(projectKey, htmlText string, send func(roomID string, msg interface{}) error) {
 	for roomID, roomConfig := range s.Rooms {
 		for _, realmConfig := range roomConfig.Realms {
 			for pkey, projectConfig := range realmConfig.Projects {
-				if pkey != eventProjectKey || !projectConfig.Track {
+				if pkey != projectKey || !projectConfig.Track {
 					continue
 				}
-				_, msgErr := cli.SendMessageEvent(
-					roomID, "m.room.message", gomatrix.GetHTMLMessage("m.notice", htmlText),
-				)
+				msgErr := send(roomID, gomatrix.GetHTMLMessage("m.notice", htmlText))
 				if msgErr != nil {
 					log.WithFields(log.Fields{
 						log.ErrorKey: msgErr,
@@ -309,7 +428,6 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 			}
 		}
 	}
-	w.WriteHeader(200)
 }
 
 func (s *Service) realmIDForProject(roomID, projectKey string) string {
@@ -324,7 +442,7 @@ func (s *Service) realmIDForProject(roomID, projectKey string) string {
 	return ""
 }
 
-func (s *Service) projectToRealm(userID, pkey string) (*jira.Realm, error) {
+func (s *Service) projectToRealm(ctx context.Context, userID, pkey string) (*jira.Realm, error) {
 	// We don't know which JIRA installation this project maps to, so:
 	//  - Get all known JIRA realms and f.e query their endpoints with the
 	//    given user ID's credentials (so if it is a private project they
@@ -371,7 +489,7 @@ func (s *Service) projectToRealm(userID, pkey string) (*jira.Realm, error) {
 	queue = append(queue, unauthRealms...)
 
 	for _, jr := range queue {
-		exists, err := jr.ProjectKeyExists(userID, pkey)
+		exists, err := jr.ProjectKeyExists(ctx, userID, pkey)
 		if err != nil {
 			logger.WithError(err).WithField("realm_id", jr.ID()).Print(
 				"Failed to check if project key exists on this realm.",
@@ -1,8 +1,10 @@
 package webhook
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
@@ -60,7 +62,7 @@ func RegisterHook(jrealm *jira.Realm, projects []string, userID, webhookEndpoint
 		"jira_url": jrealm.JIRAEndpoint,
 		"user_id":  userID,
 	})
-	cli, err := jrealm.JIRAClient(userID, false)
+	cli, err := jrealm.JIRAClient(context.Background(), userID, false)
 	if err != nil {
 		logger.WithError(err).Print("No JIRA client exists")
 		return err // no OAuth token on this JIRA endpoint
@@ -104,15 +106,20 @@ func RegisterHook(jrealm *jira.Realm, projects []string, userID, webhookEndpoint
 func OnReceiveRequest(req *http.Request) (string, *Event, *util.JSONResponse) {
 	// extract the JIRA webhook event JSON
 	defer req.Body.Close()
-	var whe Event
-	err := json.NewDecoder(req.Body).Decode(&whe)
+	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		resErr := util.MessageResponse(400, "Failed to parse request JSON")
+		resErr := util.MessageResponse(400, "Failed to read request body")
 		return "", nil, &resErr
 	}
+	return ParseRequest(body)
+}
 
-	if err != nil {
-		resErr := util.MessageResponse(400, "Failed to parse JIRA URL")
+// ParseRequest parses the body of a request from JIRA.
+// Returns the project key and webhook event, or an error.
+func ParseRequest(body []byte) (string, *Event, *util.JSONResponse) {
+	var whe Event
+	if err := json.Unmarshal(body, &whe); err != nil {
+		resErr := util.MessageResponse(400, "Failed to parse request JSON")
 		return "", nil, &resErr
 	}
 	projKey := strings.Split(whe.Issue.Key, "-")[0]
@@ -121,7 +128,7 @@ func OnReceiveRequest(req *http.Request) (string, *Event, *util.JSONResponse) {
 }
 
 func createWebhook(jrealm *jira.Realm, webhookEndpointURL, userID string) error {
-	cli, err := jrealm.JIRAClient(userID, false)
+	cli, err := jrealm.JIRAClient(context.Background(), userID, false)
 	if err != nil {
 		return err
 	}
@@ -183,7 +190,7 @@ func getWebhook(cli *gojira.Client, webhookEndpointURL string) (*jiraWebhook, bo
 }
 
 func checkProjectsArePublic(jrealm *jira.Realm, projects []string, userID string) error {
-	publicCli, err := jrealm.JIRAClient("", true)
+	publicCli, err := jrealm.JIRAClient(context.Background(), "", true)
 	if err != nil {
 		return fmt.Errorf("Cannot create public JIRA client")
 	}
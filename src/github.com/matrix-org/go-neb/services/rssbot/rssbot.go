@@ -2,19 +2,26 @@
 package rssbot
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/die-net/lrucache"
 	"github.com/gregjones/httpcache"
+	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/logging"
+	"github.com/matrix-org/go-neb/metrics"
 	"github.com/matrix-org/go-neb/polling"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 	"github.com/mmcdole/gofeed"
@@ -57,21 +64,97 @@ type Service struct {
 		PollIntervalMins int `json:"poll_interval_mins"`
 		// The list of rooms to send feed updates into. This cannot be empty.
 		Rooms []string `json:"rooms"`
-		// True if rss bot is unable to poll this feed. This is populated by Go-NEB. Use /getService to
-		// retrieve this value.
-		IsFailing bool `json:"is_failing"`
-		// The time of the last successful poll. This is populated by Go-NEB. Use /getService to retrieve
-		// this value.
-		FeedUpdatedTimestampSecs int64 `json:"last_updated_ts_secs"`
-		// Internal field. When we should poll again.
-		NextPollTimestampSecs int64
-		// Internal field. The most recently seen GUIDs. Sized to the number of items in the feed.
-		RecentGUIDs []string
 	} `json:"feeds"`
+
+	// Why the last poll failed, if it did.
+	pollErr error
+	// The state of each feed which was kept in the config by older versions of Go-NEB, which is
+	// moved into the service state store when the feed is next polled.
+	legacyStates map[string]*feedState
+}
+
+// legacyFeedConfig is the config of a feed as stored by older versions of Go-NEB, which kept the
+// state of the feed in its config.
+type legacyFeedConfig struct {
+	IsFailing                bool  `json:"is_failing"`
+	FeedUpdatedTimestampSecs int64 `json:"last_updated_ts_secs"`
+	NextPollTimestampSecs    int64
+	RecentGUIDs              []string
+}
+
+// UnmarshalJSON unmarshals the config of the service, remembering the state of any feeds which
+// was kept in the config by older versions of Go-NEB.
+func (s *Service) UnmarshalJSON(data []byte) error {
+	type config Service // without this method
+	if err := json.Unmarshal(data, (*config)(s)); err != nil {
+		return err
+	}
+	var legacy struct {
+		Feeds map[string]legacyFeedConfig `json:"feeds"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	s.legacyStates = nil
+	for feedURL, f := range legacy.Feeds {
+		if f.NextPollTimestampSecs == 0 && len(f.RecentGUIDs) == 0 {
+			continue
+		}
+		if s.legacyStates == nil {
+			s.legacyStates = make(map[string]*feedState)
+		}
+		s.legacyStates[feedURL] = &feedState{
+			IsFailing:                f.IsFailing,
+			FeedUpdatedTimestampSecs: f.FeedUpdatedTimestampSecs,
+			NextPollTimestampSecs:    f.NextPollTimestampSecs,
+			RecentGUIDs:              f.RecentGUIDs,
+		}
+	}
+	return nil
+}
+
+// feedStateNamespace is the namespace of the service state store which holds the state of each
+// feed, keyed by feed URL.
+const feedStateNamespace = "feeds"
+
+// feedState is what the service remembers about a feed between polls. It is kept in the service
+// state store rather than the config, so that polling doesn't need to rewrite the config.
+type feedState struct {
+	// True if rss bot is unable to poll this feed.
+	IsFailing bool
+	// The time of the last successful poll.
+	FeedUpdatedTimestampSecs int64
+	// When we should poll again.
+	NextPollTimestampSecs int64
+	// The most recently seen GUIDs. Sized to the number of items in the feed.
+	RecentGUIDs []string
 }
 
 // Register will check the liveness of each RSS feed given. If all feeds check out okay, no error is returned.
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
+	if err := s.checkFeeds(oldService); err != nil {
+		return err
+	}
+	if len(s.Feeds) > 0 {
+		s.joinRooms(client)
+	}
+	return nil
+}
+
+// DryRun checks the liveness of each RSS feed given and lists the rooms which would be joined.
+func (s *Service) DryRun(oldService types.Service, client *gomatrix.Client) (plan types.RegisterPlan, err error) {
+	if err = s.checkFeeds(oldService); err != nil {
+		return
+	}
+	for feedURL := range s.Feeds {
+		plan.ValidatedFeeds = append(plan.ValidatedFeeds, feedURL)
+	}
+	sort.Strings(plan.ValidatedFeeds)
+	plan.JoinRooms = s.roomList()
+	return
+}
+
+func (s *Service) checkFeeds(oldService types.Service) error {
 	if len(s.Feeds) == 0 {
 		// this is an error UNLESS the old service had some feeds in which case they are deleting us :(
 		var numOldFeeds int
@@ -88,27 +171,39 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 	}
 	// Make sure we can parse the feed
 	for feedURL, feedInfo := range s.Feeds {
-		if _, err := readFeed(feedURL); err != nil {
+		if _, err := readFeed(context.Background(), feedURL); err != nil {
 			return fmt.Errorf("Failed to read URL %s: %s", feedURL, err.Error())
 		}
 		if len(feedInfo.Rooms) == 0 {
 			return fmt.Errorf("Feed %s has no rooms to send updates to", feedURL)
 		}
 	}
-
-	s.joinRooms(client)
 	return nil
 }
 
-func (s *Service) joinRooms(client *gomatrix.Client) {
+// roomList returns the sorted IDs of every room which any feed sends updates to.
+func (s *Service) roomList() []string {
 	roomSet := make(map[string]bool)
 	for _, feedInfo := range s.Feeds {
 		for _, roomID := range feedInfo.Rooms {
 			roomSet[roomID] = true
 		}
 	}
-
+	var rooms []string
 	for roomID := range roomSet {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// ServiceRooms returns every room which any feed sends updates to.
+func (s *Service) ServiceRooms() []string {
+	return s.roomList()
+}
+
+func (s *Service) joinRooms(client *gomatrix.Client) {
+	for _, roomID := range s.roomList() {
 		if _, err := client.JoinRoom(roomID, "", nil); err != nil {
 			log.WithFields(log.Fields{
 				log.ErrorKey: err,
@@ -119,18 +214,32 @@ func (s *Service) joinRooms(client *gomatrix.Client) {
 	}
 }
 
-// PostRegister deletes this service if there are no feeds remaining.
+// PostRegister deletes this service if there are no feeds remaining, and otherwise forgets the
+// state of any feeds which have been removed.
 func (s *Service) PostRegister(oldService types.Service) {
+	logger := log.WithFields(log.Fields{
+		"service_id":   s.ServiceID(),
+		"service_type": s.ServiceType(),
+	})
 	if len(s.Feeds) == 0 { // bye-bye :(
-		logger := log.WithFields(log.Fields{
-			"service_id":   s.ServiceID(),
-			"service_type": s.ServiceType(),
-		})
 		logger.Info("Deleting service: No feeds remaining.")
 		polling.StopPolling(s)
 		if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
 			logger.WithError(err).Error("Failed to delete service")
 		}
+		return
+	}
+	oldFeedService, ok := oldService.(*Service)
+	if !ok {
+		return
+	}
+	for feedURL := range oldFeedService.Feeds {
+		if _, exists := s.Feeds[feedURL]; exists {
+			continue
+		}
+		if err := database.GetServiceDB().DeleteServiceState(s.ServiceID(), feedStateNamespace, feedURL); err != nil {
+			logger.WithError(err).WithField("feed_url", feedURL).Error("Failed to delete feed state")
+		}
 	}
 }
 
@@ -145,31 +254,43 @@ func (s *Service) PostRegister(oldService types.Service) {
 //
 // Returns a timestamp representing when this Service should have OnPoll called again.
 func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
-	logger := log.WithFields(log.Fields{
+	logger := logging.ForClient(cli).WithFields(log.Fields{
 		"service_id":   s.ServiceID(),
 		"service_type": s.ServiceType(),
 	})
 	now := time.Now().Unix() // Second resolution
+	states := s.loadFeedStates(logger)
 
 	// Work out which feeds should be polled
 	var pollFeeds []string
-	for u, feedInfo := range s.Feeds {
-		if feedInfo.NextPollTimestampSecs == 0 || now >= feedInfo.NextPollTimestampSecs {
+	for u := range s.Feeds {
+		state := states[u]
+		if state.NextPollTimestampSecs == 0 || now >= state.NextPollTimestampSecs {
 			// re-query this feed
 			pollFeeds = append(pollFeeds, u)
 		}
 	}
 
+	s.pollErr = nil
 	if len(pollFeeds) == 0 {
-		return s.nextTimestamp()
+		return s.nextTimestamp(states)
 	}
 
 	// Query each feed and send new items to subscribed rooms
+	failed := 0
 	for _, u := range pollFeeds {
-		feed, items, err := s.queryFeed(u)
+		feed, items, err := s.queryFeed(tracing.ClientContext(cli.Client), u, states[u])
+		// Persist the state of the feed to save the next poll time and the GUIDs we've seen
+		if storeErr := s.storeFeedState(u, states[u]); storeErr != nil {
+			logger.WithField("feed_url", u).WithError(storeErr).Error("Failed to persist feed state")
+		}
 		if err != nil {
 			logger.WithField("feed_url", u).WithError(err).Error("Failed to query feed")
 			incrementMetrics(u, err)
+			failed++
+			if failed == len(pollFeeds) {
+				s.pollErr = fmt.Errorf("failed to query all %d feeds: %s", failed, err)
+			}
 			continue
 		}
 		incrementMetrics(u, nil)
@@ -191,12 +312,63 @@ func (s *Service) OnPoll(cli *gomatrix.Client) time.Time {
 		}
 	}
 
-	// Persist the service to save the next poll times
-	if _, err := database.GetServiceDB().StoreService(s); err != nil {
-		logger.WithError(err).Error("Failed to persist next poll times for service")
+	return s.nextTimestamp(states)
+}
+
+// PollError returns an error if every feed failed to be queried by the last poll, so that polling
+// backs off rather than hammering feeds which are all unreachable, e.g. because the network is down.
+func (s *Service) PollError() error {
+	return s.pollErr
+}
+
+// loadFeedStates loads the state of every feed from the service state store. Feeds with no state,
+// e.g. because they have never been polled, get an empty state, unless an older version of Go-NEB
+// kept their state in the config, in which case that state is moved into the store.
+func (s *Service) loadFeedStates(logger *log.Entry) map[string]*feedState {
+	states := make(map[string]*feedState)
+	stored, err := database.GetServiceDB().ScanServiceState(s.ServiceID(), feedStateNamespace, "")
+	if err != nil {
+		logger.WithError(err).Error("Failed to load feed state")
 	}
+	for _, st := range stored {
+		if _, ok := s.Feeds[st.Key]; !ok {
+			continue
+		}
+		var state feedState
+		if err := json.Unmarshal(st.Value, &state); err != nil {
+			logger.WithField("feed_url", st.Key).WithError(err).Error("Failed to parse feed state")
+			continue
+		}
+		states[st.Key] = &state
+	}
+	for u := range s.Feeds {
+		if states[u] != nil {
+			continue
+		}
+		if legacy := s.legacyStates[u]; legacy != nil && err == nil {
+			logger.WithField("feed_url", u).Info("Moving feed state out of the service config")
+			if storeErr := s.storeFeedState(u, legacy); storeErr != nil {
+				logger.WithField("feed_url", u).WithError(storeErr).Error("Failed to move feed state")
+			}
+			states[u] = legacy
+			continue
+		}
+		states[u] = &feedState{}
+	}
+	return states
+}
 
-	return s.nextTimestamp()
+func (s *Service) storeFeedState(feedURL string, state *feedState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return database.GetServiceDB().StoreServiceState(api.ServiceState{
+		ServiceID: s.ServiceID(),
+		Namespace: feedStateNamespace,
+		Key:       feedURL,
+		Value:     value,
+	})
 }
 
 func incrementMetrics(urlStr string, err error) {
@@ -218,12 +390,12 @@ func incrementMetrics(urlStr string, err error) {
 	}
 }
 
-func (s *Service) nextTimestamp() time.Time {
+func (s *Service) nextTimestamp(states map[string]*feedState) time.Time {
 	// return the earliest next poll ts
 	var earliestNextTs int64
-	for _, feedInfo := range s.Feeds {
-		if earliestNextTs == 0 || feedInfo.NextPollTimestampSecs < earliestNextTs {
-			earliestNextTs = feedInfo.NextPollTimestampSecs
+	for u := range s.Feeds {
+		if earliestNextTs == 0 || states[u].NextPollTimestampSecs < earliestNextTs {
+			earliestNextTs = states[u].NextPollTimestampSecs
 		}
 	}
 
@@ -237,11 +409,11 @@ func (s *Service) nextTimestamp() time.Time {
 	return time.Unix(earliestNextTs, 0)
 }
 
-// Query the given feed, update relevant timestamps and return NEW items
-func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error) {
+// Query the given feed, update relevant timestamps in its state and return NEW items
+func (s *Service) queryFeed(ctx context.Context, feedURL string, state *feedState) (*gofeed.Feed, []gofeed.Item, error) {
 	log.WithField("feed_url", feedURL).Info("Querying feed")
 	var items []gofeed.Item
-	feed, err := readFeed(feedURL)
+	feed, err := readFeed(ctx, feedURL)
 	// check for no items in addition to any returned errors as it appears some RSS feeds
 	// do not consistently return items.
 	if err == nil && len(feed.Items) == 0 {
@@ -249,9 +421,7 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 	}
 
 	if err != nil {
-		f := s.Feeds[feedURL]
-		f.IsFailing = true
-		s.Feeds[feedURL] = f
+		state.IsFailing = true
 		return nil, items, err
 	}
 
@@ -261,8 +431,8 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 	// Work out which items are new, if any (based on the last updated TS we have)
 	// If the TS is 0 then this is the first ever poll, so let's not send 10s of events
 	// into the room and just do new ones from this point onwards.
-	if s.Feeds[feedURL].NextPollTimestampSecs != 0 {
-		items = s.newItems(feedURL, feed.Items)
+	if state.NextPollTimestampSecs != 0 {
+		items = newItems(state.RecentGUIDs, feed.Items)
 	}
 
 	now := time.Now().Unix() // Second resolution
@@ -277,20 +447,19 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 
 	// Work out which GUIDs to remember. We don't want to remember every GUID ever as that leads to completely
 	// unbounded growth of data.
-	f := s.Feeds[feedURL]
 	// Some RSS feeds can return a very small number of items then bounce
 	// back to their "normal" size, so we cannot just clobber the recent GUID list per request or else we'll
 	// forget what we sent and resend it. Instead, we'll keep 2x the max number of items that we've ever
 	// seen from this feed, up to a max of 10,000.
 	maxGuids := 2 * len(feed.Items)
-	if len(f.RecentGUIDs) > maxGuids {
-		maxGuids = len(f.RecentGUIDs) // already 2x'd.
+	if len(state.RecentGUIDs) > maxGuids {
+		maxGuids = len(state.RecentGUIDs) // already 2x'd.
 	}
 	if maxGuids > 10000 {
 		maxGuids = 10000
 	}
 
-	lastSet := uniqueStrings(f.RecentGUIDs) // e.g. [4,5,6]
+	lastSet := uniqueStrings(state.RecentGUIDs) // e.g. [4,5,6]
 	thisSet := uniqueGuids(feed.Items)      // e.g. [1,2,3]
 	guids := append(thisSet, lastSet...)    // e.g. [1,2,3,4,5,6]
 	guids = uniqueStrings(guids)
@@ -299,24 +468,23 @@ func (s *Service) queryFeed(feedURL string) (*gofeed.Feed, []gofeed.Item, error)
 		guids = guids[0:maxGuids]
 	}
 
-	// Update the service config to persist the new times
-	f.NextPollTimestampSecs = nextPollTsSec
-	f.FeedUpdatedTimestampSecs = now
-	f.RecentGUIDs = guids
-	f.IsFailing = false
-	s.Feeds[feedURL] = f
+	// Update the feed state to persist the new times
+	state.NextPollTimestampSecs = nextPollTsSec
+	state.FeedUpdatedTimestampSecs = now
+	state.RecentGUIDs = guids
+	state.IsFailing = false
 
 	return feed, items, nil
 }
 
-func (s *Service) newItems(feedURL string, allItems []*gofeed.Item) (items []gofeed.Item) {
+func newItems(recentGUIDs []string, allItems []*gofeed.Item) (items []gofeed.Item) {
 	for _, i := range allItems {
 		if i == nil {
 			continue
 		}
 		// if we've seen this guid before, we've sent it before
 		seenBefore := false
-		for _, guid := range s.Feeds[feedURL].RecentGUIDs {
+		for _, guid := range recentGUIDs {
 			if guid == i.GUID {
 				seenBefore = true
 				break
@@ -416,10 +584,10 @@ func (rt userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, er
 	return rt.Transport.RoundTrip(req)
 }
 
-func readFeed(feedURL string) (*gofeed.Feed, error) {
+func readFeed(ctx context.Context, feedURL string) (*gofeed.Feed, error) {
 	// Don't use fp.ParseURL because it leaks on non-2xx responses as of 2016/11/29 (cac19c6c27)
 	fp := gofeed.NewParser()
-	resp, err := cachingClient.Get(feedURL)
+	resp, err := tracing.WithContext(ctx, cachingClient).Get(feedURL)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -438,8 +606,10 @@ func readFeed(feedURL string) (*gofeed.Feed, error) {
 
 func init() {
 	lruCache := lrucache.New(1024*1024*20, 0) // 20 MB cache, no max-age
+	cache := httpcache.NewTransport(lruCache)
+	cache.Transport = tracing.Transport(nil) // only trace requests which miss the cache
 	cachingClient = &http.Client{
-		Transport: userAgentRoundTripper{httpcache.NewTransport(lruCache)},
+		Transport: userAgentRoundTripper{metrics.Transport(ServiceType, cache)},
 	}
 	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
 		r := &Service{
@@ -6,11 +6,14 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/api"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/testutils"
 	"github.com/matrix-org/go-neb/types"
@@ -36,9 +39,33 @@ const rssFeedXML = `
 </channel>
 </rss>`
 
+// feedStateStorage keeps the service state store in memory.
+type feedStateStorage struct {
+	database.NopStorage
+	states map[string]api.ServiceState
+}
+
+func (s *feedStateStorage) StoreServiceState(state api.ServiceState) error {
+	s.states[state.Key] = state
+	return nil
+}
+
+func (s *feedStateStorage) ScanServiceState(serviceID, namespace, prefix string) (states []api.ServiceState, err error) {
+	for _, state := range s.states {
+		states = append(states, state)
+	}
+	return
+}
+
 func TestHTMLEntities(t *testing.T) {
-	database.SetServiceDB(&database.NopStorage{})
 	feedURL := "https://thehappymaskshop.hyrule"
+	// Pretend the feed has been polled before, so that OnPoll sends new items rather than
+	// just remembering them.
+	stateJSON, _ := json.Marshal(feedState{NextPollTimestampSecs: time.Now().Unix()})
+	storage := &feedStateStorage{states: map[string]api.ServiceState{
+		feedURL: {ServiceID: "id", Namespace: feedStateNamespace, Key: feedURL, Value: stateJSON},
+	}}
+	database.SetServiceDB(storage)
 	// Replace the cachingClient with a mock so we can intercept RSS requests
 	rssTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
 		if req.URL.String() != feedURL {
@@ -64,7 +91,6 @@ func TestHTMLEntities(t *testing.T) {
 	// to the right room.
 	f := rssbot.Feeds[feedURL]
 	f.Rooms = []string{"!linksroom:hyrule"}
-	f.NextPollTimestampSecs = time.Now().Unix()
 	rssbot.Feeds[feedURL] = f
 
 	// Create the Matrix client which will send the notification
@@ -102,4 +128,49 @@ func TestHTMLEntities(t *testing.T) {
 
 	// Check that the Matrix client sent a message
 	wg.Wait()
+
+	// Check that the item was remembered so it won't be sent again
+	var state feedState
+	if err := json.Unmarshal(storage.states[feedURL].Value, &state); err != nil {
+		t.Fatal("Failed to decode feed state: ", err)
+	}
+	if len(state.RecentGUIDs) != 1 || state.RecentGUIDs[0] != "http://go.neb/rss/majoras-mask" {
+		t.Errorf("TestHTMLEntities: want the item GUID in RecentGUIDs, got %v", state.RecentGUIDs)
+	}
+}
+
+func TestLegacyFeedState(t *testing.T) {
+	storage := &feedStateStorage{states: map[string]api.ServiceState{}}
+	database.SetServiceDB(storage)
+	feedURL := "https://thehappymaskshop.hyrule"
+	// Older versions of Go-NEB kept the state of each feed in the config.
+	srv, err := types.CreateService("id", "rssbot", "@happy_mask_salesman:hyrule", []byte(`{"feeds": {"`+feedURL+`": {
+		"rooms": ["!linksroom:hyrule"],
+		"is_failing": true,
+		"last_updated_ts_secs": 1000,
+		"NextPollTimestampSecs": 2000,
+		"RecentGUIDs": ["http://go.neb/rss/majoras-mask"]
+	}}}`))
+	if err != nil {
+		t.Fatal("Failed to create RSS bot: ", err)
+	}
+	rssbot := srv.(*Service)
+
+	states := rssbot.loadFeedStates(log.WithField("test", "TestLegacyFeedState"))
+	want := feedState{true, 1000, 2000, []string{"http://go.neb/rss/majoras-mask"}}
+	if !reflect.DeepEqual(*states[feedURL], want) {
+		t.Errorf("TestLegacyFeedState: want the state from the config, got %+v", states[feedURL])
+	}
+	var stored feedState
+	if err := json.Unmarshal(storage.states[feedURL].Value, &stored); err != nil || !reflect.DeepEqual(stored, want) {
+		t.Errorf("TestLegacyFeedState: want the state to be moved into the store, got %+v (err %v)", stored, err)
+	}
+	// The state is no longer kept in the config.
+	configJSON, _ := json.Marshal(rssbot)
+	if strings.Contains(string(configJSON), "RecentGUIDs") {
+		t.Errorf("TestLegacyFeedState: want the state to be left out of the config, got %s", configJSON)
+	}
+	if rssbot.Feeds[feedURL].Rooms[0] != "!linksroom:hyrule" {
+		t.Errorf("TestLegacyFeedState: want the rest of the config to be kept, got %s", configJSON)
+	}
 }
@@ -2,6 +2,7 @@ package slackapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -13,6 +14,8 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/gomatrix"
 	"github.com/russross/blackfriday"
 )
@@ -82,7 +85,8 @@ var htmlTemplate, _ = template.New("htmlTemplate").Parse(`
 `)
 
 var netClient = &http.Client{
-	Timeout: time.Second * 10,
+	Timeout:   time.Second * 10,
+	Transport: metrics.Transport(ServiceType, tracing.Transport(nil)),
 }
 
 // TODO: What does this do?
@@ -133,13 +137,13 @@ func getColor(color *string) string {
 
 // fetches an image and encodes it as a data URL
 // returns an empty string if fetch fails
-func fetchAndEncodeImage(url *string) (data template.URL) {
+func fetchAndEncodeImage(ctx context.Context, url *string) (data template.URL) {
 	if url == nil {
 		return
 	}
 
 	var resp *http.Response
-	resp, err := netClient.Get(*url)
+	resp, err := tracing.WithContext(ctx, netClient).Get(*url)
 	if err != nil {
 		log.WithError(err).WithField("url", url).Error("Failed to GET URL")
 		return
@@ -162,13 +166,13 @@ func fetchAndEncodeImage(url *string) (data template.URL) {
 	return
 }
 
-func renderSlackAttachment(attachment *slackAttachment) {
+func renderSlackAttachment(ctx context.Context, attachment *slackAttachment) {
 	if attachment == nil {
 		return
 	}
 
 	attachment.ColorRendered = template.HTMLAttr(getColor(attachment.Color))
-	attachment.AuthorIconURL = fetchAndEncodeImage(attachment.AuthorIcon)
+	attachment.AuthorIconURL = fetchAndEncodeImage(ctx, attachment.AuthorIcon)
 
 	for _, fieldName := range attachment.MrkdwnIn {
 		var (
@@ -195,14 +199,14 @@ func renderSlackAttachment(attachment *slackAttachment) {
 	}
 }
 
-func slackMessageToHTMLMessage(message slackMessage) (html gomatrix.HTMLMessage, err error) {
+func slackMessageToHTMLMessage(ctx context.Context, message slackMessage) (html gomatrix.HTMLMessage, err error) {
 	text := linkifyString(message.Text)
 	if message.Mrkdwn == nil || *message.Mrkdwn == true {
 		message.TextRendered = template.HTML(blackfriday.MarkdownBasic([]byte(text)))
 	}
 
 	for attachmentID := range message.Attachments {
-		renderSlackAttachment(&message.Attachments[attachmentID])
+		renderSlackAttachment(ctx, &message.Attachments[attachmentID])
 	}
 
 	var buffer bytes.Buffer
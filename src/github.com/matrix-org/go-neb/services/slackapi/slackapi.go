@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -26,7 +27,7 @@ type Service struct {
 	types.DefaultService
 	webhookEndpointURL string
 	// The URL which should be given to an outgoing slack webhook - Populated by Go-NEB after Service registration.
-	WebhookURL  string `json:"webhook_url"`
+	WebhookURL  string `json:"webhook_url" readonly:"true"`
 	RoomID      string `json:"room_id"`
 	MessageType string `json:"message_type"`
 }
@@ -56,7 +57,7 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		return
 	}
 
-	htmlMessage, err := slackMessageToHTMLMessage(slackMessage)
+	htmlMessage, err := slackMessageToHTMLMessage(tracing.ClientContext(cli.Client), slackMessage)
 	if err != nil {
 		log.WithError(err).Error("Converting slack message to HTML")
 		w.WriteHeader(500)
@@ -69,6 +70,11 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 	w.WriteHeader(200)
 }
 
+// ServiceRooms returns the room which Slack messages are sent into.
+func (s *Service) ServiceRooms() []string {
+	return []string{s.RoomID}
+}
+
 // Register joins the configured room and sets the public WebhookURL
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
 	s.WebhookURL = s.webhookEndpointURL
@@ -82,6 +88,13 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 	return nil
 }
 
+// DryRun sets the public WebhookURL and lists the room which would be joined.
+func (s *Service) DryRun(oldService types.Service, client *gomatrix.Client) (plan types.RegisterPlan, err error) {
+	s.WebhookURL = s.webhookEndpointURL
+	plan.JoinRooms = s.ServiceRooms()
+	return
+}
+
 func init() {
 	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
 		return &Service{
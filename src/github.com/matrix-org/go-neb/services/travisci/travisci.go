@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -28,7 +31,7 @@ const DefaultTemplate = (`%{repository}#%{build_number} (%{branch} - %{commit} :
 // Matches 'owner/repo'
 var ownerRepoRegex = regexp.MustCompile(`^([A-z0-9-_.]+)/([A-z0-9-_.]+)$`)
 
-var httpClient = &http.Client{}
+var httpClient = &http.Client{Transport: metrics.Transport(ServiceType, tracing.Transport(nil))}
 
 // Service contains the Config fields for the Travis-CI service.
 //
@@ -52,7 +55,7 @@ type Service struct {
 	types.DefaultService
 	webhookEndpointURL string
 	// The URL which should be added to .travis.yml - Populated by Go-NEB after Service registration.
-	WebhookURL string `json:"webhook_url"`
+	WebhookURL string `json:"webhook_url" readonly:"true"`
 	// A map from Matrix room ID to Github-style owner/repo repositories.
 	Rooms map[string]struct {
 		// A map of "owner/repo" to configuration information
@@ -190,7 +193,7 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 		w.WriteHeader(400)
 		return
 	}
-	if err := verifyOrigin([]byte(payload), req.Header.Get("Signature")); err != nil {
+	if err := verifyOrigin(tracing.ClientContext(cli.Client), []byte(payload), req.Header.Get("Signature")); err != nil {
 		log.WithFields(log.Fields{
 			"Signature":  req.Header.Get("Signature"),
 			log.ErrorKey: err,
@@ -243,6 +246,35 @@ func (s *Service) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli
 // Register makes sure the Config information supplied is valid.
 func (s *Service) Register(oldService types.Service, client *gomatrix.Client) error {
 	s.WebhookURL = s.webhookEndpointURL
+	if err := s.checkRepos(); err != nil {
+		return err
+	}
+	s.joinRooms(client)
+	return nil
+}
+
+// DryRun checks that every repository name is valid and lists the rooms which would be joined.
+// The WebhookURL is set as Register sets it, so that it isn't shown as a change.
+func (s *Service) DryRun(oldService types.Service, client *gomatrix.Client) (plan types.RegisterPlan, err error) {
+	s.WebhookURL = s.webhookEndpointURL
+	if err = s.checkRepos(); err != nil {
+		return
+	}
+	plan.JoinRooms = s.ServiceRooms()
+	return
+}
+
+// ServiceRooms returns every room which build notifications are sent into.
+func (s *Service) ServiceRooms() []string {
+	var rooms []string
+	for roomID := range s.Rooms {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (s *Service) checkRepos() error {
 	for _, roomData := range s.Rooms {
 		for repo := range roomData.Repos {
 			match := ownerRepoRegex.FindStringSubmatch(repo)
@@ -251,7 +283,6 @@ func (s *Service) Register(oldService types.Service, client *gomatrix.Client) er
 			}
 		}
 	}
-	s.joinRooms(client)
 	return nil
 }
 
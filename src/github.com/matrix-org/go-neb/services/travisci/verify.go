@@ -1,6 +1,7 @@
 package travisci
 
 import (
+	"context"
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -11,6 +12,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/matrix-org/go-neb/tracing"
 )
 
 // Host => Public Key.
@@ -21,7 +24,7 @@ var travisPublicKeyMap = map[string]*rsa.PublicKey{
 	"api.travis-ci.com": nil,
 }
 
-func verifyOrigin(payload []byte, sigHeader string) error {
+func verifyOrigin(ctx context.Context, payload []byte, sigHeader string) error {
 	/*
 		From: https://docs.travis-ci.com/user/notifications#Verifying-Webhook-requests
 			 1. Pick up the payload data from the HTTP request’s body.
@@ -36,7 +39,7 @@ func verifyOrigin(payload []byte, sigHeader string) error {
 		return fmt.Errorf("verifyOrigin: Failed to decode signature as base64: %s", err)
 	}
 
-	if err := loadPublicKeys(); err != nil {
+	if err := loadPublicKeys(ctx); err != nil {
 		return fmt.Errorf("verifyOrigin: Failed to cache Travis public keys: %s", err)
 	}
 
@@ -56,11 +59,11 @@ func verifyOrigin(payload []byte, sigHeader string) error {
 	return fmt.Errorf("verifyOrigin: Signature verification failed: %s", verifyErr)
 }
 
-func loadPublicKeys() error {
+func loadPublicKeys(ctx context.Context) error {
 	for _, host := range []string{"api.travis-ci.com", "api.travis-ci.org"} {
 		pubKey := travisPublicKeyMap[host]
 		if pubKey == nil {
-			pemPubKey, err := fetchPEMPublicKey("https://" + host + "/config")
+			pemPubKey, err := fetchPEMPublicKey(ctx, "https://"+host+"/config")
 			if err != nil {
 				return err
 			}
@@ -80,9 +83,9 @@ func loadPublicKeys() error {
 	return nil
 }
 
-func fetchPEMPublicKey(travisURL string) (key string, err error) {
+func fetchPEMPublicKey(ctx context.Context, travisURL string) (key string, err error) {
 	var res *http.Response
-	res, err = httpClient.Get(travisURL)
+	res, err = tracing.WithContext(ctx, httpClient).Get(travisURL)
 	if res != nil {
 		defer res.Body.Close()
 	}
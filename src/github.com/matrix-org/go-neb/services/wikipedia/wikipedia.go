@@ -2,6 +2,7 @@
 package wikipedia
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,8 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jaytaylor/html2text"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
@@ -19,7 +22,7 @@ import (
 const ServiceType = "wikipedia"
 const maxExtractLength = 1024 // Max length of extract string in bytes
 
-var httpClient = &http.Client{}
+var httpClient = &http.Client{Transport: metrics.Transport(ServiceType, tracing.Transport(nil))}
 
 // Search results (returned by search query)
 type wikipediaSearchResults struct {
@@ -74,7 +77,7 @@ func (s *Service) cmdWikipediaSearch(client *gomatrix.Client, roomID, userID str
 
 	// Get the query text and per,form search
 	querySentence := strings.Join(args, " ")
-	searchResultPage, err := s.text2Wikipedia(querySentence)
+	searchResultPage, err := s.text2Wikipedia(tracing.ClientContext(client.Client), querySentence)
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +115,7 @@ func (s *Service) cmdWikipediaSearch(client *gomatrix.Client, roomID, userID str
 }
 
 // text2Wikipedia returns a Wikipedia article summary
-func (s *Service) text2Wikipedia(query string) (*wikipediaPage, error) {
+func (s *Service) text2Wikipedia(ctx context.Context, query string) (*wikipediaPage, error) {
 	log.Info("Searching Wikipedia for: ", query)
 
 	u, err := url.Parse("https://en.wikipedia.org/w/api.php")
@@ -133,7 +136,7 @@ func (s *Service) text2Wikipedia(query string) (*wikipediaPage, error) {
 	// log.Info("Request URL: ", u)
 
 	// Perform wikipedia search request
-	res, err := httpClient.Get(u.String())
+	res, err := tracing.WithContext(ctx, httpClient).Get(u.String())
 	if res != nil {
 		defer res.Body.Close()
 	}
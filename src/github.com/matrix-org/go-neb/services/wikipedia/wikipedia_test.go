@@ -2,6 +2,7 @@ package wikipedia
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,10 +12,13 @@ import (
 
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/testutils"
+	"github.com/matrix-org/go-neb/tracing"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/gomatrix"
 )
 
+type commandContextKey struct{}
+
 // TODO: It would be nice to tabularise this test so we can try failing different combinations of responses to make
 //       sure all cases are handled, rather than just the general case as is here.
 func TestCommand(t *testing.T) {
@@ -26,6 +30,11 @@ func TestCommand(t *testing.T) {
 	wikipediaTrans := testutils.NewRoundTripper(func(req *http.Request) (*http.Response, error) {
 		query := req.URL.Query()
 
+		// Check the request is made as part of the command, so that it is traced with it
+		if req.Context().Value(commandContextKey{}) == nil {
+			t.Fatalf("Request was not made with the context of the command")
+		}
+
 		// Check the base API URL
 		if !strings.HasPrefix(req.URL.String(), wikipediaAPIURL) {
 			t.Fatalf("Bad URL: got %s want prefix %s", req.URL.String(), wikipediaAPIURL)
@@ -85,6 +94,7 @@ func TestCommand(t *testing.T) {
 	}
 	matrixCli, _ := gomatrix.NewClient("https://hyrule", "@wikipediabot:hyrule", "its_a_secret")
 	matrixCli.Client = &http.Client{Transport: matrixTrans}
+	matrixCli = tracing.MatrixClient(context.WithValue(context.Background(), commandContextKey{}, true), matrixCli)
 
 	// Execute the matrix !command
 	cmds := wikipedia.Commands(matrixCli)
@@ -0,0 +1,172 @@
+// Package status tracks what every service has done recently: the outcome of its last command,
+// webhook, poll and message send. Services do not need to do anything to be tracked.
+//
+// Statuses are kept in memory, so they start empty whenever Go-NEB is restarted.
+package status
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// The kinds of thing a service does which have their outcome tracked.
+const (
+	KindCommand = "command"
+	KindWebhook = "webhook"
+	KindPoll    = "poll"
+	KindSend    = "send"
+)
+
+// An Outcome is the result of a single command, webhook, poll or send.
+type Outcome struct {
+	// When it happened, as a unix timestamp in milliseconds.
+	Timestamp int64
+	// What it was, e.g. the command which was run or the room a message was sent to.
+	Detail string `json:",omitempty"`
+	// Why it failed. Empty if it succeeded.
+	Error string `json:",omitempty"`
+}
+
+// A ServiceStatus is the latest outcome of each kind of thing a service does. Outcomes are nil if
+// the service has not done that since Go-NEB started.
+type ServiceStatus struct {
+	LastCommand *Outcome `json:",omitempty"`
+	LastWebhook *Outcome `json:",omitempty"`
+	LastPoll    *Outcome `json:",omitempty"`
+	LastSend    *Outcome `json:",omitempty"`
+	// The most recent failure of any kind, which may be older than the outcomes above.
+	LastError *Outcome `json:",omitempty"`
+	// The kind of thing which failed most recently, e.g. "webhook".
+	LastErrorKind string `json:",omitempty"`
+	// The most recent time the service panicked while being polled, and what was done about it.
+	LastPanic *Outcome `json:",omitempty"`
+}
+
+var (
+	statusMutex sync.Mutex
+	statuses    = make(map[string]ServiceStatus) // ServiceID => ServiceStatus
+)
+
+// Record records the outcome of something a service did. err is nil if it succeeded.
+func Record(serviceID, kind, detail string, err error) {
+	outcome := &Outcome{
+		Timestamp: time.Now().UnixNano() / 1000000,
+		Detail:    detail,
+	}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	s := statuses[serviceID]
+	switch kind {
+	case KindCommand:
+		s.LastCommand = outcome
+	case KindWebhook:
+		s.LastWebhook = outcome
+	case KindPoll:
+		s.LastPoll = outcome
+	case KindSend:
+		s.LastSend = outcome
+	}
+	if err != nil {
+		s.LastError = outcome
+		s.LastErrorKind = kind
+	}
+	statuses[serviceID] = s
+}
+
+// RecordPanic records that polling the service panicked. detail describes what was done about it,
+// e.g. that polling will be restarted.
+func RecordPanic(serviceID, detail string, err error) {
+	outcome := &Outcome{
+		Timestamp: time.Now().UnixNano() / 1000000,
+		Detail:    detail,
+		Error:     err.Error(),
+	}
+
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	s := statuses[serviceID]
+	s.LastPanic = outcome
+	statuses[serviceID] = s
+}
+
+// Get returns the status of a service.
+func Get(serviceID string) ServiceStatus {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	return statuses[serviceID]
+}
+
+// Forget removes the status of a service, e.g. because it has been deleted.
+func Forget(serviceID string) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	delete(statuses, serviceID)
+}
+
+// Client returns a copy of the given client which records the outcome of every message it sends
+// as a "send" by the given service. Pass this to services instead of the shared client.
+func Client(serviceID string, cli *gomatrix.Client) *gomatrix.Client {
+	httpClient := http.Client{}
+	if cli.Client != nil {
+		httpClient = *cli.Client
+	}
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	httpClient.Transport = &sendRecorder{serviceID, base}
+	return &gomatrix.Client{
+		HomeserverURL: cli.HomeserverURL,
+		Prefix:        cli.Prefix,
+		UserID:        cli.UserID,
+		AccessToken:   cli.AccessToken,
+		Client:        &httpClient,
+		Syncer:        cli.Syncer,
+		Store:         cli.Store,
+	}
+}
+
+// sendRecorder is an http.RoundTripper which records the outcome of requests which send events
+// into rooms.
+type sendRecorder struct {
+	serviceID string
+	base      http.RoundTripper
+}
+
+func (t *sendRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	roomID, ok := SentToRoom(req)
+	if !ok {
+		return res, err
+	}
+	if err == nil && (res.StatusCode < 200 || res.StatusCode >= 300) {
+		Record(t.serviceID, KindSend, roomID, fmt.Errorf("HTTP %d", res.StatusCode))
+	} else {
+		Record(t.serviceID, KindSend, roomID, err)
+	}
+	return res, err
+}
+
+// SentToRoom returns the room ID if the request sends an event into a room,
+// i.e. is a PUT to .../rooms/{roomId}/send/{eventType}/{txnId}
+func SentToRoom(req *http.Request) (string, bool) {
+	if req.Method != "PUT" {
+		return "", false
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	for i := 0; i+2 < len(segments); i++ {
+		if segments[i] == "rooms" && segments[i+2] == "send" {
+			return segments[i+1], true
+		}
+	}
+	return "", false
+}
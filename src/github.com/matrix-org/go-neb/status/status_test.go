@@ -0,0 +1,64 @@
+package status
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+type mockTransport struct {
+	code int
+}
+
+func (t mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: t.code,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$foo:hyrule"}`)),
+	}, nil
+}
+
+func TestRecord(t *testing.T) {
+	defer Forget("record_service")
+	Record("record_service", KindPoll, "", nil)
+	Record("record_service", KindWebhook, "POST /hook", errors.New("responded with HTTP 500"))
+	Record("record_service", KindWebhook, "POST /hook", nil)
+
+	s := Get("record_service")
+	if s.LastPoll == nil || s.LastPoll.Error != "" {
+		t.Errorf("TestRecord: expected successful poll, got %+v", s.LastPoll)
+	}
+	if s.LastWebhook == nil || s.LastWebhook.Error != "" {
+		t.Errorf("TestRecord: expected last webhook to have succeeded, got %+v", s.LastWebhook)
+	}
+	if s.LastError == nil || s.LastErrorKind != KindWebhook || s.LastError.Error != "responded with HTTP 500" {
+		t.Errorf("TestRecord: expected failed webhook to be the last error, got %s %+v", s.LastErrorKind, s.LastError)
+	}
+	if s.LastCommand != nil || s.LastSend != nil {
+		t.Errorf("TestRecord: expected no commands or sends, got %+v", s)
+	}
+}
+
+func TestClientRecordsSends(t *testing.T) {
+	defer Forget("send_service")
+	cli, _ := gomatrix.NewClient("https://hyrule.loz", "@bot:hyrule", "its_a_secret")
+	cli.Client = &http.Client{Transport: mockTransport{403}}
+
+	if _, err := Client("send_service", cli).SendText("!castle:hyrule", "hello"); err == nil {
+		t.Fatalf("TestClientRecordsSends: expected send to fail")
+	}
+	s := Get("send_service")
+	if s.LastSend == nil || s.LastSend.Detail != "!castle:hyrule" || s.LastSend.Error != "HTTP 403" {
+		t.Errorf("TestClientRecordsSends: expected failed send to be recorded, got %+v", s.LastSend)
+	}
+
+	// Requests which don't send events aren't sends.
+	cli.Client = &http.Client{Transport: mockTransport{200}}
+	Client("send_service", cli).JoinRoom("!castle:hyrule", "", nil)
+	if s = Get("send_service"); s.LastSend.Error != "HTTP 403" {
+		t.Errorf("TestClientRecordsSends: expected join not to be recorded as a send, got %+v", s.LastSend)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 )
 
 // newResponse creates a new HTTP response with the given data.
@@ -15,8 +16,10 @@ func newResponse(statusCode int, body string) *http.Response {
 	}
 }
 
-// matrixTripper mocks out RoundTrip and calls a registered handler instead.
+// matrixTripper mocks out RoundTrip and calls a registered handler instead. Handlers may be
+// registered while the /sync loops of earlier tests are still making requests.
 type matrixTripper struct {
+	mu       sync.Mutex
 	handlers map[string]func(req *http.Request) (*http.Response, error)
 }
 
@@ -28,11 +31,13 @@ func newMatrixTripper() *matrixTripper {
 
 func (rt *matrixTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	key := req.Method + " " + req.URL.Path
-	h := rt.handlers[key]
+	rt.mu.Lock()
+	h, n := rt.handlers[key], len(rt.handlers)
+	rt.mu.Unlock()
 	if h == nil {
 		panic(fmt.Sprintf(
 			"RoundTrip: Unhandled request: %s\nHandlers: %d",
-			key, len(rt.handlers),
+			key, n,
 		))
 	}
 	return h(req)
@@ -40,6 +45,8 @@ func (rt *matrixTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 
 func (rt *matrixTripper) Handle(method, path string, handler func(req *http.Request) (*http.Response, error)) {
 	key := method + " " + path
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
 	if _, exists := rt.handlers[key]; exists {
 		panic(fmt.Sprintf("Test handler with key %s already exists", key))
 	}
@@ -57,6 +64,8 @@ func (rt *matrixTripper) HandlePOSTFilter(userID string) {
 }
 
 func (rt *matrixTripper) ClearHandlers() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
 	for k := range rt.handlers {
 		delete(rt.handlers, k)
 	}
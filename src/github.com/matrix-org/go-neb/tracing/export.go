@@ -0,0 +1,222 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// queueSize is how many finished spans can wait to be exported. Spans are dropped if the
+	// exporter can't keep up.
+	queueSize = 4096
+	// batchSize is the most spans which are exported at once.
+	batchSize = 512
+	// flushInterval is the longest a finished span waits before it is exported.
+	flushInterval = 5 * time.Second
+)
+
+// An Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+var (
+	exporterMutex sync.Mutex
+	exporter      Exporter
+	queue         chan SpanData
+)
+
+func currentExporter() Exporter {
+	exporterMutex.Lock()
+	defer exporterMutex.Unlock()
+	return exporter
+}
+
+// Start turns on tracing, exporting spans with the given exporter from now on. It must only be
+// called once.
+func Start(e Exporter) {
+	exporterMutex.Lock()
+	defer exporterMutex.Unlock()
+	exporter = e
+	queue = make(chan SpanData, queueSize)
+	go exportLoop(e, queue)
+}
+
+func enqueue(span SpanData) {
+	select {
+	case queue <- span:
+	default:
+		log.WithField("span", span.Name).Warn("Dropping span: the trace exporter is falling behind")
+	}
+}
+
+func exportLoop(e Exporter, queue chan SpanData) {
+	ticker := time.NewTicker(flushInterval)
+	var batch []SpanData
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.Export(batch); err != nil {
+			log.WithError(err).WithField("spans", len(batch)).Warn("Failed to export spans")
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case span := <-queue:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// NewOTLPExporter returns an Exporter which sends spans to an OpenTelemetry collector over
+// OTLP/HTTP with JSON encoding. endpoint is the base URL of the collector, e.g.
+// "http://localhost:4318", and serviceName is reported as the "service.name" of every span.
+func NewOTLPExporter(endpoint, serviceName string) Exporter {
+	return &otlpExporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+}
+
+func (e *otlpExporter) Export(spans []SpanData) error {
+	body, err := json.Marshal(otlpRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("OTLP collector responded with HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+// NewStdoutExporter returns an Exporter which writes each span to w as a line of JSON, for local runs.
+func NewStdoutExporter(w io.Writer) Exporter {
+	return &stdoutExporter{w: w}
+}
+
+type stdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (e *stdoutExporter) Export(spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, span := range spans {
+		if err := enc.Encode(otlpSpan(span)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of spans. Only the fields which Go-NEB sets are included.
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpanJSON struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func keyValue(key, value string) otlpKeyValue {
+	var kv otlpKeyValue
+	kv.Key = key
+	kv.Value.StringValue = value
+	return kv
+}
+
+func otlpSpan(span SpanData) otlpSpanJSON {
+	s := otlpSpanJSON{
+		TraceID:           hex.EncodeToString(span.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.SpanID[:]),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1}, // OK
+	}
+	if span.ParentID != ([8]byte{}) {
+		s.ParentSpanID = hex.EncodeToString(span.ParentID[:])
+	}
+	for _, attr := range span.Attributes {
+		s.Attributes = append(s.Attributes, keyValue(attr.Key, attr.Value))
+	}
+	if span.Error != "" {
+		s.Status = otlpStatus{Code: 2, Message: span.Error} // ERROR
+	}
+	return s
+}
+
+func otlpRequest(serviceName string, spans []SpanData) interface{} {
+	encoded := make([]otlpSpanJSON, len(spans))
+	for i, span := range spans {
+		encoded[i] = otlpSpan(span)
+	}
+	type scope struct {
+		Name string `json:"name"`
+	}
+	type scopeSpans struct {
+		Scope scope          `json:"scope"`
+		Spans []otlpSpanJSON `json:"spans"`
+	}
+	type resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	type resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	return struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{{
+		Resource:   resource{[]otlpKeyValue{keyValue("service.name", serviceName)}},
+		ScopeSpans: []scopeSpans{{Scope: scope{"github.com/matrix-org/go-neb"}, Spans: encoded}},
+	}}}
+}
@@ -0,0 +1,167 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+const traceparentHeader = "traceparent"
+
+// Handler returns an http.Handler which traces every request handled by mux, continuing the trace
+// of the caller if the request has a traceparent header. Spans are named after the pattern which
+// matched the request, e.g. "POST /services/hooks/", rather than the full path.
+func Handler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if currentExporter() == nil {
+			mux.ServeHTTP(w, req)
+			return
+		}
+		_, pattern := mux.Handler(req)
+		ctx := withTraceparent(req.Context(), req.Header.Get(traceparentHeader))
+		ctx, span := Begin(ctx, req.Method+" "+pattern, KindServer,
+			Attribute{"http.method", req.Method},
+			Attribute{"http.target", req.URL.Path},
+		)
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w, code: 200}
+		mux.ServeHTTP(rec, req.WithContext(ctx))
+		span.SetAttribute("http.status_code", strconv.Itoa(rec.code))
+		if rec.code >= 500 {
+			span.SetError(fmt.Errorf("responded with HTTP %d", rec.code))
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Transport returns an http.RoundTripper which traces every request as a child of the span in the
+// request's context. Requests are made with base, or http.DefaultTransport if base is nil. The
+// trace isn't passed on: third parties have no use for it, and its IDs would let them correlate
+// requests.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tracingTransport{base: base}
+}
+
+// MatrixTransport returns an http.RoundTripper like Transport for a matrix client of the
+// homeserver at homeserverURL, which passes the trace on to the homeserver in a traceparent header.
+// Requests to other hosts, e.g. to download images to upload, don't have the header. /sync
+// requests aren't traced, as they are long-polled all the time rather than caused by anything.
+func MatrixTransport(base http.RoundTripper, homeserverURL string) http.RoundTripper {
+	t := &tracingTransport{base: base, skipSync: true}
+	if t.base == nil {
+		t.base = http.DefaultTransport
+	}
+	if u, err := url.Parse(homeserverURL); err == nil {
+		t.propagateHost = u.Host
+	}
+	return t
+}
+
+type tracingTransport struct {
+	base http.RoundTripper
+	// The host which is sent traceparent headers, if any.
+	propagateHost string
+	// True to not trace matrix /sync requests.
+	skipSync bool
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if currentExporter() == nil || (t.skipSync && strings.HasSuffix(req.URL.Path, "/sync")) {
+		return t.base.RoundTrip(req)
+	}
+	ctx, span := Begin(req.Context(), req.Method+" "+req.URL.Host, KindClient,
+		Attribute{"http.method", req.Method},
+		Attribute{"http.url", req.URL.Scheme + "://" + req.URL.Host + req.URL.Path},
+	)
+	defer span.End()
+	req = req.WithContext(ctx)
+	if t.propagateHost != "" && req.URL.Host == t.propagateHost {
+		req.Header = cloneHeader(req.Header)
+		req.Header.Set(traceparentHeader, span.traceparent())
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.SetError(err)
+		return res, err
+	}
+	span.SetAttribute("http.status_code", strconv.Itoa(res.StatusCode))
+	if res.StatusCode >= 400 {
+		span.SetError(fmt.Errorf("HTTP %d", res.StatusCode))
+	}
+	return res, err
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h)+1)
+	for k, v := range h {
+		clone[k] = v
+	}
+	return clone
+}
+
+// WithContext returns a copy of the HTTP client which makes every request with ctx, so that
+// requests made by code which doesn't take a context, such as gomatrix, are traced as children
+// of the span in ctx.
+func WithContext(ctx context.Context, cli *http.Client) *http.Client {
+	httpClient := http.Client{}
+	if cli != nil {
+		httpClient = *cli
+	}
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	httpClient.Transport = &contextTransport{ctx, base}
+	return &httpClient
+}
+
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// ClientContext returns the context which the HTTP client was given by WithContext, or
+// context.Background() if it wasn't.
+func ClientContext(cli *http.Client) context.Context {
+	if cli != nil {
+		if t, ok := cli.Transport.(*contextTransport); ok {
+			return t.ctx
+		}
+	}
+	return context.Background()
+}
+
+// MatrixClient returns a copy of the matrix client which makes every request with ctx, so that
+// they are traced as children of the span in ctx, e.g. messages sent in response to a webhook.
+func MatrixClient(ctx context.Context, cli *gomatrix.Client) *gomatrix.Client {
+	return &gomatrix.Client{
+		HomeserverURL: cli.HomeserverURL,
+		Prefix:        cli.Prefix,
+		UserID:        cli.UserID,
+		AccessToken:   cli.AccessToken,
+		Client:        WithContext(ctx, cli.Client),
+		Syncer:        cli.Syncer,
+		Store:         cli.Store,
+	}
+}
@@ -0,0 +1,167 @@
+// Package tracing records traces of what Go-NEB does with each request, e.g. an incoming webhook,
+// the database loads it caused, the third-party APIs which were called and the messages sent into
+// matrix, so that it is possible to see where something went wrong.
+//
+// Spans are exported in batches over OTLP/HTTP (JSON), so they can be sent to any OpenTelemetry
+// collector, or written to stdout for local runs. Trace context is propagated to and from other
+// systems with the W3C "traceparent" header. Tracing is off until Start is called, and every
+// function in this package is cheap when it is off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of span, as numbered by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// A Span is a single operation within a trace. A nil *Span is valid and does nothing, which is
+// what Begin returns when tracing is off.
+type Span struct {
+	mu   sync.Mutex
+	data SpanData
+	done bool
+}
+
+// SpanData is a finished span, as passed to an Exporter.
+type SpanData struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // all zeroes for the root span of a trace
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	// Why the operation failed. Empty if it succeeded.
+	Error string
+}
+
+// An Attribute describes a span, e.g. the ID of the service which handled a webhook.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+type spanContextKey struct{}
+
+// Begin starts a span named name as a child of the span in ctx, if any, or else as the root of
+// a new trace. It returns a context holding the new span, which must be ended with End.
+func Begin(ctx context.Context, name string, kind int, attrs ...Attribute) (context.Context, *Span) {
+	if currentExporter() == nil {
+		return ctx, nil
+	}
+	span := &Span{data: SpanData{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: attrs,
+	}}
+	if parent := FromContext(ctx); parent != nil {
+		span.data.TraceID = parent.data.TraceID
+		span.data.ParentID = parent.data.SpanID
+	} else if remote, ok := ctx.Value(remoteContextKey{}).(remoteParent); ok {
+		span.data.TraceID = remote.traceID
+		span.data.ParentID = remote.spanID
+	} else {
+		rand.Read(span.data.TraceID[:])
+	}
+	rand.Read(span.data.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// FromContext returns the span in ctx, or nil if there isn't one.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// TraceID returns the ID of the trace which the span in ctx belongs to, or "" if there isn't one.
+func TraceID(ctx context.Context) string {
+	span := FromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	return hex.EncodeToString(span.data.TraceID[:])
+}
+
+// SetAttribute adds an attribute to the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, Attribute{key, value})
+}
+
+// SetError marks the span as failed, unless err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and queues it to be exported. Calling End more than once does nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	enqueue(data)
+}
+
+// traceparent returns the W3C traceparent header value which makes the span the parent of a span
+// in another system.
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.data.TraceID[:]), hex.EncodeToString(s.data.SpanID[:]))
+}
+
+type remoteContextKey struct{}
+
+// remoteParent is a span in another system, read from a traceparent header.
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// withTraceparent returns a context whose next span is a child of the span described by the
+// W3C traceparent header value, or ctx unchanged if the value isn't valid.
+func withTraceparent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	var parent remoteParent
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	if parent.traceID == ([16]byte{}) || parent.spanID == ([8]byte{}) {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteContextKey{}, parent)
+}
@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopExporter struct{}
+
+func (nopExporter) Export(spans []SpanData) error { return nil }
+
+// startTest turns on tracing, returning the queue of finished spans rather than exporting them.
+func startTest() chan SpanData {
+	exporterMutex.Lock()
+	defer exporterMutex.Unlock()
+	exporter = nopExporter{}
+	queue = make(chan SpanData, queueSize)
+	return queue
+}
+
+func nextSpan(t *testing.T, spans chan SpanData) SpanData {
+	select {
+	case span := <-spans:
+		return span
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a span")
+	}
+	return SpanData{}
+}
+
+func TestTraceIsPropagated(t *testing.T) {
+	spans := startTest()
+
+	// Servers which record the traceparent they were sent for each path.
+	traceparents := make(map[string]string)
+	record := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparents[req.Host+req.URL.Path] = req.Header.Get("traceparent")
+	})
+	api := httptest.NewServer(record)
+	defer api.Close()
+	hs := httptest.NewServer(record)
+	defer hs.Close()
+	apiClient := &http.Client{Transport: Transport(nil)}
+	hsClient := &http.Client{Transport: MatrixTransport(nil, hs.URL)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/hooks/", func(w http.ResponseWriter, req *http.Request) {
+		for _, call := range []struct {
+			cli *http.Client
+			url string
+		}{
+			{apiClient, api.URL + "/search"},
+			{hsClient, api.URL + "/image"},
+			{hsClient, hs.URL + "/_matrix/client/r0/sync"},
+			{hsClient, hs.URL + "/_matrix/client/r0/send"},
+		} {
+			res, err := WithContext(req.Context(), call.cli).Get(call.url)
+			if err != nil {
+				t.Fatalf("TestTraceIsPropagated: failed to call %s: %s", call.url, err)
+			}
+			res.Body.Close()
+		}
+		w.WriteHeader(202)
+	})
+	req := httptest.NewRequest("POST", "/services/hooks/c2VydmljZQ", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	Handler(mux).ServeHTTP(httptest.NewRecorder(), req)
+
+	// The /sync request isn't traced.
+	var clients []SpanData
+	for i := 0; i < 3; i++ {
+		clients = append(clients, nextSpan(t, spans))
+	}
+	server := nextSpan(t, spans)
+	if server.Name != "POST /services/hooks/" || server.Kind != KindServer {
+		t.Errorf("TestTraceIsPropagated: unexpected server span %+v", server)
+	}
+	if hex.EncodeToString(server.TraceID[:]) != "0af7651916cd43dd8448eb211c80319c" ||
+		hex.EncodeToString(server.ParentID[:]) != "b7ad6b7169203331" {
+		t.Errorf("TestTraceIsPropagated: server span did not continue the caller's trace: %+v", server)
+	}
+	for _, client := range clients {
+		if client.Kind != KindClient || client.TraceID != server.TraceID || client.ParentID != server.SpanID {
+			t.Errorf("TestTraceIsPropagated: client span is not a child of the server span: %+v", client)
+		}
+	}
+
+	apiHost, hsHost := strings.TrimPrefix(api.URL, "http://"), strings.TrimPrefix(hs.URL, "http://")
+	if got := traceparents[apiHost+"/search"] + traceparents[apiHost+"/image"]; got != "" {
+		t.Errorf("TestTraceIsPropagated: third-party API was sent traceparent %q", got)
+	}
+	if got := traceparents[hsHost+"/_matrix/client/r0/sync"]; got != "" {
+		t.Errorf("TestTraceIsPropagated: untraced /sync was sent traceparent %q", got)
+	}
+	want := "00-0af7651916cd43dd8448eb211c80319c-" + hex.EncodeToString(clients[2].SpanID[:]) + "-01"
+	if got := traceparents[hsHost+"/_matrix/client/r0/send"]; got != want {
+		t.Errorf("TestTraceIsPropagated: homeserver was sent traceparent %q, want %q", got, want)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		b, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(b, &body)
+	}))
+	defer collector.Close()
+
+	span := SpanData{Name: "OnPoll", Kind: KindInternal, Start: time.Now(), End: time.Now(), Error: "feed is down"}
+	span.TraceID[0], span.SpanID[0] = 1, 2
+	if err := NewOTLPExporter(collector.URL+"/", "neb-test").Export([]SpanData{span}); err != nil {
+		t.Fatalf("TestOTLPExporter: failed to export: %s", err)
+	}
+	if path != "/v1/traces" {
+		t.Errorf("TestOTLPExporter: exported to %q, want /v1/traces", path)
+	}
+	encoded, _ := json.Marshal(body)
+	for _, want := range []string{
+		`"stringValue":"neb-test"`,
+		`"name":"OnPoll"`,
+		`"traceId":"01000000000000000000000000000000"`,
+		`"status":{"code":2,"message":"feed is down"}`,
+	} {
+		if !strings.Contains(string(encoded), want) {
+			t.Errorf("TestOTLPExporter: expected %s in %s", want, encoded)
+		}
+	}
+}
@@ -20,10 +20,19 @@ type AuthRealm interface {
 }
 
 var realmsByType = map[string]func(string, string) AuthRealm{}
+var realmSchemasByType = map[string]*JSONSchema{}
 
-// RegisterAuthRealm registers a factory for creating AuthRealm instances.
+// RegisterAuthRealm registers a factory for creating AuthRealm instances. A JSON Schema for the
+// realm config is generated from the type of AuthRealm which the factory returns.
 func RegisterAuthRealm(factory func(string, string) AuthRealm) {
-	realmsByType[factory("", "").Type()] = factory
+	r := factory("", "")
+	realmsByType[r.Type()] = factory
+	realmSchemasByType[r.Type()] = GenerateJSONSchema(r)
+}
+
+// AuthRealmSchemas returns the JSON Schema for the config of every registered realm type.
+func AuthRealmSchemas() map[string]*JSONSchema {
+	return realmSchemasByType
 }
 
 // CreateAuthRealm creates an AuthRealm of the given type and realm ID.
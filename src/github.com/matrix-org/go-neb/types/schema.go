@@ -0,0 +1,227 @@
+package types
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JSONSchemaDraft is the version of JSON Schema which generated schemas conform to.
+const JSONSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// A JSONSchema describes the JSON accepted by a service or auth realm config. Schemas are
+// generated from the Go struct of the service or realm when it is registered.
+//
+// Fields which are populated by Go-NEB rather than the user are marked with a "readonly" struct
+// tag, e.g. `readonly:"true"`, and appear in the schema with "readOnly": true. They are still
+// accepted in configs, so that a config returned by /admin/getService can be sent back as-is.
+//
+// Objects may have keys which aren't fields of the struct, as encoding/json ignores them and
+// configs written by older versions of Go-NEB may still have keys which have since been removed,
+// e.g. the feed state which rssbot used to keep in its config.
+type JSONSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	ReadOnly             bool                   `json:"readOnly,omitempty"`
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// GenerateJSONSchema generates a JSON Schema for the JSON which encoding/json will unmarshal into v.
+func GenerateJSONSchema(v interface{}) *JSONSchema {
+	s := schemaForType(reflect.TypeOf(v), map[reflect.Type]bool{})
+	s.Schema = JSONSchemaDraft
+	return s
+}
+
+func schemaForType(t reflect.Type, visiting map[reflect.Type]bool) *JSONSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	}
+	// Types which unmarshal themselves can accept anything.
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return &JSONSchema{}
+	}
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return &JSONSchema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &JSONSchema{Type: "string"} // base64
+		}
+		return &JSONSchema{Type: "array", Items: schemaForType(t.Elem(), visiting)}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: schemaForType(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			// Recursive type: don't try to describe it any further.
+			return &JSONSchema{Type: "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		s := &JSONSchema{Type: "object", Properties: map[string]*JSONSchema{}}
+		addStructProperties(s, t, visiting)
+		return s
+	}
+	// Interfaces and anything else can be any JSON value.
+	return &JSONSchema{}
+}
+
+func addStructProperties(s *JSONSchema, t reflect.Type, visiting map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructProperties(s, ft, visiting)
+				continue
+			}
+		}
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		var prop *JSONSchema
+		if strings.Contains(tag, ",string") {
+			prop = &JSONSchema{Type: "string"}
+		} else {
+			prop = schemaForType(f.Type, visiting)
+		}
+		prop.ReadOnly = f.Tag.Get("readonly") == "true"
+		s.Properties[name] = prop
+	}
+}
+
+// Validate checks that the given JSON matches this schema. Object keys are matched against
+// properties case-insensitively, as encoding/json does. JSON null is accepted anywhere.
+func (s *JSONSchema) Validate(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return s.validate("", v)
+}
+
+func (s *JSONSchema) validate(path string, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	at := path
+	if at == "" {
+		at = "/"
+	}
+	switch s.Type {
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean", at)
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != float64(int64(f)) {
+			return fmt.Errorf("%s: expected an integer", at)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: expected a number", at)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: expected a string", at)
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array", at)
+		}
+		for i, item := range arr {
+			if err := s.Items.validate(fmt.Sprintf("%s/%d", path, i), item); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object", at)
+		}
+		return s.validateObject(path, obj)
+	}
+	return nil
+}
+
+func (s *JSONSchema) validateObject(path string, obj map[string]interface{}) error {
+	// Check keys in a stable order so that errors are deterministic.
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		prop := s.property(k)
+		if prop == nil {
+			switch additional := s.AdditionalProperties.(type) {
+			case *JSONSchema:
+				prop = additional
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s/%s: unknown field", path, k)
+				}
+			}
+		}
+		if prop == nil {
+			continue
+		}
+		if err := prop.validate(path+"/"+k, obj[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// property returns the schema for the given object key, matching names case-insensitively
+// but preferring an exact match.
+func (s *JSONSchema) property(key string) *JSONSchema {
+	if prop, ok := s.Properties[key]; ok {
+		return prop
+	}
+	for name, prop := range s.Properties {
+		if strings.EqualFold(name, key) {
+			return prop
+		}
+	}
+	return nil
+}
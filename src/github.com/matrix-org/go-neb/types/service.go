@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
 )
 
 // BotOptions for a given bot user in a given room
@@ -26,6 +27,76 @@ type Poller interface {
 	OnPoll(client *gomatrix.Client) time.Time
 }
 
+// A FalliblePoller is a Poller which reports when polling fails. Pollers which keep failing are
+// polled less and less often, rather than at the time they ask for, until they succeed again.
+type FalliblePoller interface {
+	Poller
+	// PollError returns why the last call to OnPoll failed, or nil if it succeeded.
+	PollError() error
+}
+
+// An AsyncWebhookHandler is a Service which checks webhook requests separately from handling them.
+// Webhooks for it are checked with VerifyWebhook while the sender waits, answered with HTTP 202,
+// and then handled with HandleWebhook in the background instead of being passed to
+// OnReceiveWebhook. This stops senders such as Github and JIRA timing out, and marking deliveries
+// as failed, when the homeserver is slow.
+type AsyncWebhookHandler interface {
+	Service
+	// VerifyWebhook checks that a webhook request is genuine, e.g. by checking its signature, and
+	// that it should be handled. body is the body of the request, which has already been read.
+	// Returns nil if the webhook should be handled, or else the response to send instead.
+	VerifyWebhook(req *http.Request, body []byte) *util.JSONResponse
+	// HandleWebhook handles a webhook which VerifyWebhook accepted. Messages for rooms should be
+	// sent with progress, so that if handling fails and is tried again, rooms which the webhook has
+	// already been sent into don't get it again. Returns an error if handling failed in a way which
+	// is worth trying again, e.g. progress.Err(). A webhook may be handled more than once, if
+	// handling it failed or Go-NEB restarted part way through.
+	HandleWebhook(req *http.Request, body []byte, client *gomatrix.Client, progress *WebhookProgress) error
+}
+
+// RealmDependent represents a service which makes use of one or more auth realms. Services which refer to
+// realm IDs in their config should implement this so that those realms cannot be deleted from under them.
+type RealmDependent interface {
+	// RealmIDs returns the IDs of every auth realm this service uses.
+	RealmIDs() []string
+}
+
+// RoomService represents a service which is configured to send into particular Matrix rooms.
+// Room admins can only control such a service with "!neb" commands from one of those rooms.
+type RoomService interface {
+	// ServiceRooms returns the IDs of every room in this service's config.
+	ServiceRooms() []string
+}
+
+// OwnedService represents a service which acts on behalf of a Matrix user, e.g. with their Github
+// session. That user can control the service with "!neb" commands from any room.
+type OwnedService interface {
+	// ServiceOwner returns the user ID of the Matrix user this service acts on behalf of.
+	ServiceOwner() string
+}
+
+// A RegisterPlan describes the side-effects which registering a service would have.
+type RegisterPlan struct {
+	// The Matrix rooms which the service user would join.
+	JoinRooms []string `json:",omitempty"`
+	// The webhooks which would be created or checked on third-party sites, e.g. Github "owner/repo"s.
+	AddWebhooks []string `json:",omitempty"`
+	// The webhooks which would be removed from third-party sites.
+	RemoveWebhooks []string `json:",omitempty"`
+	// The feed URLs which were fetched and parsed successfully.
+	ValidatedFeeds []string `json:",omitempty"`
+}
+
+// DryRunner represents a service which can check its config and describe what Register and PostRegister would do,
+// without doing it. Services with side-effects in Register should implement this to support dry runs of
+// /admin/configureService.
+type DryRunner interface {
+	// DryRun performs the same checks as Register, returning an error if Register would fail, and describes the
+	// side-effects which Register and PostRegister would have. This MUST NOT modify anything, either locally or
+	// on third-party sites. It MAY make requests which only read data.
+	DryRun(oldService Service, client *gomatrix.Client) (RegisterPlan, error)
+}
+
 // A Service is the configuration for a bot service.
 type Service interface {
 	// Return the user ID of this service.
@@ -34,6 +105,11 @@ type Service interface {
 	ServiceID() string
 	// Return the type of service. This string MUST NOT change.
 	ServiceType() string
+	// Return the version of the stored config which this service was loaded from, or 0 if it
+	// hasn't been stored. The database uses this to detect concurrent changes to the service.
+	ServiceVersion() int64
+	// Set the version of the stored config. This is called by the database.
+	SetServiceVersion(version int64)
 	Commands(cli *gomatrix.Client) []Command
 	Expansions(cli *gomatrix.Client) []Expansion
 	OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client)
@@ -47,6 +123,11 @@ type Service interface {
 	// concurrent modifications to this service whilst this function executes. This lifecycle hook should be used to clean
 	// up resources which are no longer needed (e.g. removing old webhooks).
 	PostRegister(oldService Service)
+	// A lifecycle function which is invoked when the service is being deleted, after polling has been stopped but
+	// before the service is removed from the database. This function is invoked within the critical section for
+	// configuring services. This lifecycle hook should be used to clean up any external resources which were created
+	// in Register (e.g. removing webhooks). The client may be nil if the Client for ServiceUserID() cannot be loaded.
+	Unregister(client *gomatrix.Client)
 }
 
 // DefaultService NO-OPs the implementation of optional Service interface methods. Feel free to override them.
@@ -54,11 +135,12 @@ type DefaultService struct {
 	id            string
 	serviceUserID string
 	serviceType   string
+	version       int64
 }
 
 // NewDefaultService creates a new service with implementations for ServiceID(), ServiceType() and ServiceUserID()
 func NewDefaultService(serviceID, serviceUserID, serviceType string) DefaultService {
-	return DefaultService{serviceID, serviceUserID, serviceType}
+	return DefaultService{id: serviceID, serviceUserID: serviceUserID, serviceType: serviceType}
 }
 
 // ServiceID returns the service's ID. In order for this to return the ID, DefaultService MUST have been
@@ -81,6 +163,16 @@ func (s *DefaultService) ServiceType() string {
 	return s.serviceType
 }
 
+// ServiceVersion returns the version of the stored config which this service was loaded from.
+func (s *DefaultService) ServiceVersion() int64 {
+	return s.version
+}
+
+// SetServiceVersion sets the version of the stored config.
+func (s *DefaultService) SetServiceVersion(version int64) {
+	s.version = version
+}
+
 // Commands returns no commands.
 func (s *DefaultService) Commands(cli *gomatrix.Client) []Command {
 	return []Command{}
@@ -97,6 +189,9 @@ func (s *DefaultService) Register(oldService Service, client *gomatrix.Client) e
 // PostRegister does nothing.
 func (s *DefaultService) PostRegister(oldService Service) {}
 
+// Unregister does nothing.
+func (s *DefaultService) Unregister(client *gomatrix.Client) {}
+
 // OnReceiveWebhook does nothing but 200 OK the request.
 func (s *DefaultService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *gomatrix.Client) {
 	w.WriteHeader(200) // Do nothing
@@ -122,11 +217,14 @@ func BaseURL(u string) error {
 
 var servicesByType = map[string]func(string, string, string) Service{}
 var serviceTypesWhichPoll = map[string]bool{}
+var serviceSchemasByType = map[string]*JSONSchema{}
 
-// RegisterService registers a factory for creating Service instances.
+// RegisterService registers a factory for creating Service instances. A JSON Schema for the
+// service config is generated from the type of Service which the factory returns.
 func RegisterService(factory func(string, string, string) Service) {
 	s := factory("", "", "")
 	servicesByType[s.ServiceType()] = factory
+	serviceSchemasByType[s.ServiceType()] = GenerateJSONSchema(s)
 
 	if _, ok := s.(Poller); ok {
 		serviceTypesWhichPoll[s.ServiceType()] = true
@@ -141,6 +239,21 @@ func PollingServiceTypes() (types []string) {
 	return
 }
 
+// ServiceSchemas returns the JSON Schema for the config of every registered service type.
+func ServiceSchemas() map[string]*JSONSchema {
+	return serviceSchemasByType
+}
+
+// ValidateServiceConfig checks that the given service config JSON matches the JSON Schema for
+// the service type. Returns an error if the service type is unknown or the config is invalid.
+func ValidateServiceConfig(serviceType string, serviceJSON []byte) error {
+	schema := serviceSchemasByType[serviceType]
+	if schema == nil {
+		return errors.New("Unknown service type: " + serviceType)
+	}
+	return schema.Validate(serviceJSON)
+}
+
 // CreateService creates a Service of the given type and serviceID.
 // Returns an error if the Service couldn't be created.
 func CreateService(serviceID, serviceType, serviceUserID string, serviceJSON []byte) (Service, error) {
@@ -0,0 +1,67 @@
+package types
+
+import (
+	"sort"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+// A WebhookProgress records which rooms a webhook handled in the background has been sent into, so
+// that when sending into some rooms fails, trying again only sends into the rooms which failed.
+type WebhookProgress struct {
+	sent    map[string]bool
+	lastErr error
+}
+
+// NewWebhookProgress returns the progress of a webhook which has already been sent into the
+// given rooms.
+func NewWebhookProgress(sentRooms []string) *WebhookProgress {
+	p := &WebhookProgress{sent: make(map[string]bool)}
+	for _, roomID := range sentRooms {
+		p.sent[roomID] = true
+	}
+	return p
+}
+
+// SendMessageEvent sends a message into a room with the client, unless it has already been sent
+// there by an earlier attempt at handling the webhook. Services should send each room at most one
+// message per webhook through this.
+func (p *WebhookProgress) SendMessageEvent(cli *gomatrix.Client, roomID, eventType string, content interface{}) error {
+	if p.sent[roomID] {
+		return nil
+	}
+	if _, err := cli.SendMessageEvent(roomID, eventType, content); err != nil {
+		if isRetryable(err) {
+			p.lastErr = err
+		}
+		return err
+	}
+	p.sent[roomID] = true
+	return nil
+}
+
+// SentRooms returns the rooms which the webhook has been sent into, sorted.
+func (p *WebhookProgress) SentRooms() []string {
+	rooms := make([]string, 0, len(p.sent))
+	for roomID := range p.sent {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Err returns the last error from sending into a room which is worth trying again, or nil if
+// there wasn't one. Failures which won't go away by themselves, such as the homeserver refusing
+// to let the bot send into a room which it isn't in, are not worth trying again.
+func (p *WebhookProgress) Err() error {
+	return p.lastErr
+}
+
+// isRetryable reports whether a failed request to the homeserver may succeed if it is tried
+// again: anything but a 4xx response other than 429 Too Many Requests.
+func isRetryable(err error) bool {
+	if httpErr, ok := err.(gomatrix.HTTPError); ok {
+		return httpErr.Code < 400 || httpErr.Code >= 500 || httpErr.Code == 429
+	}
+	return true
+}